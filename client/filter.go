@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ValueFilter keeps the values of an attribute that start with one of the prefixes or match the pattern, dropping
+// the others. Values are kept when neither is set.
+type ValueFilter struct {
+	Prefixes []string `mapstructure:"prefixes"`
+	// Regular expression, which matches anywhere in the value unless anchored with ^ and $
+	Pattern string `mapstructure:"pattern"`
+}
+
+// validate rejects patterns that don't compile
+func (f ValueFilter) validate(attribute string) error {
+	if _, err := regexp.Compile(f.Pattern); err != nil {
+		return fmt.Errorf("invalid value filter pattern for %s: %w", attribute, err)
+	}
+	return nil
+}
+
+// keep returns the values the filter allows
+func (f ValueFilter) keep(values []string) []string {
+	if len(f.Prefixes) == 0 && f.Pattern == "" {
+		return values
+	}
+	var pattern *regexp.Regexp
+	if f.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(f.Pattern); err != nil {
+			// Release nothing rather than everything
+			log.Errorf("invalid value filter pattern %s: %s", f.Pattern, err)
+			return nil
+		}
+	}
+	kept := make([]string, 0, len(values))
+	for _, value := range values {
+		if hasPrefix(value, f.Prefixes) || (pattern != nil && pattern.MatchString(value)) {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+func hasPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterValues applies the value filter configured for the attribute. Attribute names are compared ignoring case
+// since the configuration keys are lowercased.
+func (client *LdapClient) filterValues(attribute string, values []string) []string {
+	for name, filter := range client.ValueFilters {
+		if strings.EqualFold(name, attribute) {
+			return filter.keep(values)
+		}
+	}
+	return values
+}
@@ -1,67 +1,203 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/chriskery/sso-idp/settings"
 	"github.com/go-ldap/ldap/v3"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
-	"sync"
+	"net"
+	"strings"
+	"time"
 )
 
 var (
-	once sync.Once
-	lc   *LdapClient
+	// ErrInvalidCredentials is returned when the user doesn't exist or the password is incorrect
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUnavailable is returned when the LDAP server can't be reached or fails to answer a search
+	ErrUnavailable = errors.New("ldap server unavailable")
+	// ErrPasswordExpired is returned when the password is correct but has expired or was reset by an administrator,
+	// so it must be changed before the user can log in
+	ErrPasswordExpired = errors.New("password expired")
 )
 
-func NewLdapClient() *LdapClient {
-	once.Do(func() {
-		lc = &LdapClient{ldapConfig{}}
-		if err := viper.UnmarshalKey("ldap", &lc.ldapConfig); err != nil {
-			log.Fatalln(err)
+// New returns a client for the directory described by config
+func New(config Config) *LdapClient {
+	return &LdapClient{config}
+}
+
+// LoadConfig reads the client configuration from the ldap key
+func LoadConfig() (Config, error) {
+	config := Config{}
+	if err := settings.UnmarshalKey("ldap", &config); err != nil {
+		return config, fmt.Errorf("invalid ldap configuration: %w", err)
+	}
+	for attribute, filter := range config.ValueFilters {
+		if err := filter.validate(attribute); err != nil {
+			return config, fmt.Errorf("invalid ldap configuration: %w", err)
 		}
-	})
-	return lc
+	}
+	// Credentials are sent wherever referrals lead, so they're only followed to listed hosts
+	if config.FollowReferrals && len(config.ReferralHosts) == 0 {
+		return config, errors.New("invalid ldap configuration: follow_referrals requires referral_hosts")
+	}
+	return config, nil
+}
+
+// NewLdapClient returns a client configured by the ldap key
+func NewLdapClient() (*LdapClient, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return New(config), nil
 }
 
-type ldapConfig struct {
+// Config describes how to connect to and search a directory
+type Config struct {
 	Addr             string `mapstructure:"addr"`
 	BindDN           string `mapstructure:"bindDN"`
 	BindDNCredential string `mapstructure:"bindDN_credential"`
-	SearchBase       string `mapstructure:"search_base" v`
+	SearchBase       string `mapstructure:"search_base"`
+	// posix (default) reads groups from memberUid, ad reads them from memberOf
+	Flavor string `mapstructure:"flavor"`
+	// Expand Active Directory nested groups using LDAP_MATCHING_RULE_IN_CHAIN
+	NestedGroups bool `mapstructure:"nested_groups"`
+	// Base for nested group searches, defaults to search_base
+	GroupSearchBase string `mapstructure:"group_search_base"`
+	// Attribute the groups are returned as, defaults to memberUid or memberOf depending on the flavor
+	GroupAttribute string `mapstructure:"group_attribute"`
+	// Attributes users may log in with, such as mail or sAMAccountName, defaults to DefaultLoginAttributes. The
+	// first one names the user whichever attribute they logged in with.
+	LoginAttributes []string `mapstructure:"login_attributes"`
+	// Attributes read from the user's entry, defaults to DefaultAttributes. * reads every attribute.
+	Attributes []string `mapstructure:"attributes"`
+	// Entries requested per page of search results, defaults to DefaultPageSize
+	PageSize uint32 `mapstructure:"page_size"`
+	// Chase referrals to other directories, such as the domains of an AD forest. Off by default since the
+	// service account credentials and users' passwords are sent to the directories that are referred to.
+	FollowReferrals bool `mapstructure:"follow_referrals"`
+	// Longest chain of referrals followed, defaults to DefaultReferralHopLimit
+	ReferralHopLimit int `mapstructure:"referral_hop_limit"`
+	// Hosts referrals may be followed to, required with follow_referrals
+	ReferralHosts []string `mapstructure:"referral_hosts"`
+	// Credentials for searching the directories referred to, defaults to bindDN and bindDN_credential
+	ReferralBindDN           string `mapstructure:"referral_bindDN"`
+	ReferralBindDNCredential string `mapstructure:"referral_bindDN_credential"`
+	// Filters limiting the values read for an attribute, such as the groups relevant to the applications
+	ValueFilters map[string]ValueFilter `mapstructure:"value_filters"`
 }
 
+// DefaultPageSize is the number of entries requested per page unless page_size is configured. It's below the
+// 1000 entry limit of Active Directory and OpenLDAP.
+const DefaultPageSize = 500
+
+const (
+	// FlavorPosix is a directory using posixGroup memberUid membership
+	FlavorPosix = "posix"
+	// FlavorActiveDirectory is a Microsoft Active Directory using memberOf membership
+	FlavorActiveDirectory = "ad"
+	// matchingRuleInChain walks the ancestry of AD groups
+	matchingRuleInChain = "1.2.840.113556.1.4.1941"
+)
+
 type LdapClient struct {
-	ldapConfig
+	Config
+}
+
+// conn closes the underlying connection when the context is done so blocked operations return
+type conn struct {
+	*ldap.Conn
+	done chan struct{}
+	// the bind succeeded but the password policy only allows changing the password
+	mustChangePassword bool
+}
+
+func (c *conn) Close() {
+	close(c.done)
+	c.Conn.Close()
 }
 
-func (client *LdapClient) getConn(username, password string) (*ldap.Conn, error) {
-	conn, err := ldap.DialURL(client.Addr)
+func (client *LdapClient) getConn(ctx context.Context, addr, username, password string) (*conn, error) {
+	dialer := &net.Dialer{}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		dialer.Deadline = deadline
+	}
+	ldapConn, err := ldap.DialURL(addr, ldap.DialWithDialer(dialer))
 	if err != nil {
-		return nil, err
+		return nil, contextError(ctx, err)
 	}
+	if hasDeadline {
+		ldapConn.SetTimeout(time.Until(deadline))
+	}
+	c := &conn{Conn: ldapConn, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			ldapConn.Close()
+		case <-c.done:
+		}
+	}()
 
-	if _, err = conn.SimpleBind(&ldap.SimpleBindRequest{
+	result, err := c.SimpleBind(&ldap.SimpleBindRequest{
 		Username: username,
 		Password: password,
-	}); err != nil {
-		return nil, err
+		// Asks OpenLDAP to report expired and reset passwords
+		Controls: []ldap.Control{ldap.NewControlBeheraPasswordPolicy()},
+	})
+	if err != nil {
+		c.Close()
+		if mustChangePassword(result, err) {
+			return nil, fmt.Errorf("%w: %s", ErrPasswordExpired, err)
+		}
+		return nil, contextError(ctx, err)
+	}
+	c.mustChangePassword = mustChangePassword(result, nil)
+	return c, nil
+}
+
+// contextError reports the context's error in place of the one caused by closing the connection
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// unavailable wraps errors from connecting to or searching the server in ErrUnavailable
+func unavailable(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
 	}
-	return conn, nil
+	return fmt.Errorf("%w: %s", ErrUnavailable, err)
 }
 
-func (client *LdapClient) getConnWithAdmin() (*ldap.Conn, error) {
-	return client.getConn(client.BindDN, client.BindDNCredential)
+func (client *LdapClient) sendRequest(ctx context.Context,
+	request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result, _, err := client.search(ctx, request)
+	return result, err
 }
 
-func (client *LdapClient) sendRequest(
+// searchServer searches using the simple paged results control, collecting the entries of every page so results
+// aren't truncated by the server's size limit
+func (client *LdapClient) searchServer(ctx context.Context, addr, bindDN, credential string,
 	request *ldap.SearchRequest) (*ldap.SearchResult, error) {
-	conn, err := client.getConnWithAdmin()
+	conn, err := client.getConn(ctx, addr, bindDN, credential)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
-	return conn.Search(request)
+	pageSize := client.PageSize
+	if pageSize == 0 {
+		pageSize = DefaultPageSize
+	}
+	result, err := conn.SearchWithPaging(request, pageSize)
+	if err != nil {
+		return result, contextError(ctx, err)
+	}
+	return result, nil
 }
 
 const (
@@ -72,42 +208,193 @@ const (
 	ldapAttributeUidNumber      = "uidNumber"
 	ldapAttributePrimaryGroupID = "primaryGroupID"
 	ldapAttributeEmail          = "mail"
+	ldapAttributeMemberOf       = "memberOf"
+	// allUserAttributes requests every user attribute of the entry
+	allUserAttributes = "*"
 )
 
-func (client *LdapClient) Authenticate(username, password string) (map[string][]string, error) {
-	attributes := []string{
-		ldapAttributeCN,
-		ldapAttributeGidNumber,
-		ldapAttributeMemberUid,
-		ldapAttributeUid,
-		ldapAttributeUidNumber,
-		ldapAttributeEmail,
-	}
-	request := buildSearchRequest(client.SearchBase, fmt.Sprintf("(cn=%s)", username), attributes)
-	result, err := client.sendRequest(request)
+// DefaultLoginAttributes are the attributes users log in with unless login_attributes is configured
+var DefaultLoginAttributes = []string{ldapAttributeCN}
+
+// DefaultAttributes are read from the user's entry unless attributes is configured
+var DefaultAttributes = []string{
+	ldapAttributeCN,
+	ldapAttributeGidNumber,
+	ldapAttributeMemberUid,
+	ldapAttributeUid,
+	ldapAttributeUidNumber,
+	ldapAttributeEmail,
+}
+
+// attributes returns the attributes to read from the user's entry. Active Directory groups are always read
+// since they're kept in memberOf.
+func (client *LdapClient) attributes() []string {
+	attributes := DefaultAttributes
+	if len(client.Attributes) > 0 {
+		attributes = client.Attributes
+	}
+	attributes = append([]string(nil), attributes...)
+	// The attribute naming the user is needed for LoginName when users log in with other identifiers
+	if len(client.LoginAttributes) > 0 && !containsFold(attributes, client.LoginAttributes[0]) &&
+		!containsFold(attributes, allUserAttributes) {
+		attributes = append(attributes, client.LoginAttributes[0])
+	}
+	if client.Flavor == FlavorActiveDirectory && !containsFold(attributes, ldapAttributeMemberOf) &&
+		!containsFold(attributes, allUserAttributes) {
+		attributes = append(attributes, ldapAttributeMemberOf)
+	}
+	return attributes
+}
+
+// containsFold reports whether the value is listed, ignoring case like attribute and host names
+func containsFold(attributes []string, attribute string) bool {
+	for _, a := range attributes {
+		if strings.EqualFold(a, attribute) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate binds as the user and returns their attributes. Outstanding LDAP operations are abandoned
+// when the context is cancelled or its deadline passes.
+func (client *LdapClient) Authenticate(ctx context.Context, username, password string) (map[string][]string, error) {
+	attributes := client.attributes()
+	request := buildSearchRequest(client.SearchBase, client.loginFilter(username), attributes)
+	result, servers, err := client.search(ctx, request)
 	if err != nil {
-		return nil, errors.New("can not find user's DN")
+		return nil, unavailable(err)
+	}
+	if err = uniqueEntry(username, result); err != nil {
+		return nil, err
 	}
 	for _, entry := range result.Entries {
-		if conn, err := client.getConn(entry.DN, password); err != nil {
+		// Bind to the directory holding the entry, which may have been found by following a referral
+		if conn, err := client.getConn(ctx, servers[entry], entry.DN, password); err != nil {
+			if errors.Is(err, ErrPasswordExpired) {
+				log.Error(err)
+				return nil, ErrPasswordExpired
+			}
+			if !ldap.IsErrorAnyOf(err, ldap.LDAPResultInvalidCredentials, ldap.ErrorEmptyPassword) {
+				return nil, unavailable(err)
+			}
 			log.Error(err)
 			continue
 		} else {
 			conn.Close()
+			if conn.mustChangePassword {
+				return nil, ErrPasswordExpired
+			}
+		}
+		attrs := client.getAttributes(entry, attributes)
+		if err := client.setGroups(ctx, entry.DN, attrs); err != nil {
+			return nil, unavailable(err)
 		}
-		return client.getAttributes(entry, attributes), nil
+		return attrs, nil
 	}
-	return nil, errors.New(ldap.LDAPResultCodeMap[ldap.LDAPResultNoSuchObject])
+	return nil, ErrInvalidCredentials
 }
 
+// uniqueEntry rejects usernames matching more than one entry, such as a uid equal to another user's mail, rather
+// than letting whichever password binds decide who logs in
+func uniqueEntry(username string, result *ldap.SearchResult) error {
+	if len(result.Entries) > 1 {
+		log.Errorf("%s matches %d directory entries", username, len(result.Entries))
+		return fmt.Errorf("%w: %s matches more than one directory entry", ErrInvalidCredentials, username)
+	}
+	return nil
+}
+
+func (client *LdapClient) loginAttributes() []string {
+	if len(client.LoginAttributes) > 0 {
+		return client.LoginAttributes
+	}
+	return DefaultLoginAttributes
+}
+
+// loginFilter matches the entries with any of the login attributes equal to the username
+func (client *LdapClient) loginFilter(username string) string {
+	value := ldap.EscapeFilter(username)
+	attributes := client.loginAttributes()
+	if len(attributes) == 1 {
+		return fmt.Sprintf("(%s=%s)", attributes[0], value)
+	}
+	filter := &strings.Builder{}
+	filter.WriteString("(|")
+	for _, attribute := range attributes {
+		fmt.Fprintf(filter, "(%s=%s)", attribute, value)
+	}
+	filter.WriteString(")")
+	return filter.String()
+}
+
+// LoginName returns the value of the first login attribute from the attributes returned by Authenticate. It
+// names the user whichever identifier they logged in with, and is empty when the user doesn't have one.
+func (client *LdapClient) LoginName(attrs map[string][]string) string {
+	loginName := client.loginAttributes()[0]
+	for name, values := range attrs {
+		if strings.EqualFold(name, loginName) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// getAttributes returns the values of the requested attributes, or of every attribute the server returned when
+// all of them were requested, that pass the value filters
 func (client *LdapClient) getAttributes(entry *ldap.Entry, attributes []string) map[string][]string {
 	attrs := make(map[string][]string)
+	if containsFold(attributes, allUserAttributes) {
+		for _, attribute := range entry.Attributes {
+			attrs[attribute.Name] = client.filterValues(attribute.Name, attribute.Values)
+		}
+		return attrs
+	}
 	for _, attribute := range attributes {
-		attrs[attribute] = entry.GetAttributeValues(attribute)
+		attrs[attribute] = client.filterValues(attribute, entry.GetAttributeValues(attribute))
 	}
 	return attrs
 }
 
+// setGroups moves the user's groups to the configured group attribute, expanding nested AD groups if enabled
+func (client *LdapClient) setGroups(ctx context.Context, dn string, attrs map[string][]string) error {
+	source := ldapAttributeMemberUid
+	if client.Flavor == FlavorActiveDirectory {
+		source = ldapAttributeMemberOf
+		if client.NestedGroups {
+			groups, err := client.nestedGroups(ctx, dn)
+			if err != nil {
+				return err
+			}
+			attrs[source] = client.filterValues(source, groups)
+		}
+	}
+	if client.GroupAttribute != "" && client.GroupAttribute != source {
+		attrs[client.GroupAttribute] = attrs[source]
+		delete(attrs, source)
+	}
+	return nil
+}
+
+// nestedGroups returns the DNs of every group the user belongs to directly or through other groups
+func (client *LdapClient) nestedGroups(ctx context.Context, dn string) ([]string, error) {
+	base := client.GroupSearchBase
+	if base == "" {
+		base = client.SearchBase
+	}
+	request := buildSearchRequest(base,
+		fmt.Sprintf("(member:%s:=%s)", matchingRuleInChain, ldap.EscapeFilter(dn)), []string{"dn"})
+	result, err := client.sendRequest(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
 func buildSearchRequest(dn string,
 	filter string, attributes []string) *ldap.SearchRequest {
 	return ldap.NewSearchRequest(dn,
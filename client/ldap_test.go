@@ -0,0 +1,559 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLdapClient_getAttributes(t *testing.T) {
+	entry := ldap.NewEntry("cn=joe,ou=people,dc=example,dc=com", map[string][]string{
+		ldapAttributeCN:        {"joe"},
+		ldapAttributeMemberUid: {"admins", "developers", "users"},
+	})
+	client := New(Config{})
+	attrs := client.getAttributes(entry, []string{ldapAttributeCN, ldapAttributeMemberUid})
+	assert.Equal(t, []string{"joe"}, attrs[ldapAttributeCN])
+	assert.Equal(t, []string{"admins", "developers", "users"}, attrs[ldapAttributeMemberUid],
+		"all group memberships should be returned")
+}
+
+func TestLdapClient_getAttributes_valueFilters(t *testing.T) {
+	// Users belong to hundreds of groups, only a few of which matter to the applications
+	groups := []string{"cn=app-admins,ou=groups,dc=example,dc=com"}
+	for j := 0; j < 500; j++ {
+		groups = append(groups, "cn=team-"+strconv.Itoa(j)+",ou=groups,dc=example,dc=com")
+	}
+	groups = append(groups, "cn=app-users,ou=groups,dc=example,dc=com", "cn=vpn,ou=groups,dc=example,dc=com")
+	entry := ldap.NewEntry("cn=joe,ou=people,dc=example,dc=com", map[string][]string{
+		ldapAttributeCN:       {"joe"},
+		ldapAttributeMemberOf: groups,
+		ldapAttributeEmail:    {"joe@example.com", "joe@legacy.example.com"},
+	})
+	client := New(Config{ValueFilters: map[string]ValueFilter{
+		"memberof": {Prefixes: []string{"cn=app-"}, Pattern: "^cn=vpn,"},
+		"mail":     {Pattern: `@example\.com$`},
+	}})
+	attrs := client.getAttributes(entry, []string{ldapAttributeCN, ldapAttributeMemberOf, ldapAttributeEmail})
+	assert.Equal(t, []string{
+		"cn=app-admins,ou=groups,dc=example,dc=com",
+		"cn=app-users,ou=groups,dc=example,dc=com",
+		"cn=vpn,ou=groups,dc=example,dc=com",
+	}, attrs[ldapAttributeMemberOf])
+	assert.Equal(t, []string{"joe@example.com"}, attrs[ldapAttributeEmail])
+	assert.Equal(t, []string{"joe"}, attrs[ldapAttributeCN], "attributes without a filter are kept")
+
+	viper.Set("ldap", map[string]interface{}{
+		"value_filters": map[string]interface{}{"memberOf": map[string]interface{}{"pattern": "cn=(app"}},
+	})
+	defer viper.Set("ldap", nil)
+	_, err := LoadConfig()
+	assert.Error(t, err, "invalid patterns should be reported")
+}
+
+func TestLdapClient_attributes(t *testing.T) {
+	assert.Equal(t, DefaultAttributes, New(Config{}).attributes())
+	client := New(Config{Attributes: []string{ldapAttributeUid, "telephoneNumber"}})
+	assert.Equal(t, []string{ldapAttributeUid, "telephoneNumber"}, client.attributes())
+	client.Flavor = FlavorActiveDirectory
+	assert.Equal(t, []string{ldapAttributeUid, "telephoneNumber", ldapAttributeMemberOf}, client.attributes(),
+		"AD groups should be read")
+	client.Attributes = []string{"*"}
+	assert.Equal(t, []string{"*"}, client.attributes(), "memberOf is already included")
+
+	entry := ldap.NewEntry("cn=joe,ou=people,dc=example,dc=com", map[string][]string{
+		ldapAttributeCN:   {"joe"},
+		"department":      {"engineering"},
+		"telephoneNumber": {"555-0100"},
+	})
+	assert.Equal(t, map[string][]string{
+		ldapAttributeCN:   {"joe"},
+		"department":      {"engineering"},
+		"telephoneNumber": {"555-0100"},
+	}, client.getAttributes(entry, client.attributes()), "every attribute should be read")
+}
+
+func TestLdapClient_Authenticate_deadline(t *testing.T) {
+	// A server that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	client := New(Config{
+		Addr:             "ldap://" + listener.Addr().String(),
+		BindDN:           "cn=admin,dc=example,dc=com",
+		BindDNCredential: "secret",
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.Authenticate(ctx, "joe", "password")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+	assert.Less(t, time.Since(start), 5*time.Second, "should give up when the context expires")
+}
+
+func TestLdapClient_setGroups(t *testing.T) {
+	attrs := map[string][]string{ldapAttributeMemberUid: {"admins"}}
+	client := New(Config{GroupAttribute: "groups"})
+	if err := client.setGroups(context.Background(), "cn=joe,dc=example,dc=com", attrs); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string][]string{"groups": {"admins"}}, attrs, "posix groups come from memberUid")
+
+	attrs = map[string][]string{
+		ldapAttributeMemberUid: nil,
+		ldapAttributeMemberOf:  {"cn=admins,ou=groups,dc=example,dc=com"},
+	}
+	client = New(Config{Flavor: FlavorActiveDirectory, GroupAttribute: "groups"})
+	if err := client.setGroups(context.Background(), "cn=joe,dc=example,dc=com", attrs); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"cn=admins,ou=groups,dc=example,dc=com"}, attrs["groups"], "AD groups come from memberOf")
+	assert.NotContains(t, attrs, ldapAttributeMemberOf)
+}
+
+func TestLdapClient_Authenticate_unavailable(t *testing.T) {
+	// Nothing is listening once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	client := New(Config{
+		Addr:             "ldap://" + listener.Addr().String(),
+		BindDN:           "cn=admin,dc=example,dc=com",
+		BindDNCredential: "secret",
+	})
+	_, err = client.Authenticate(context.Background(), "joe", "password")
+	assert.True(t, errors.Is(err, ErrUnavailable), "unexpected error %v", err)
+	assert.False(t, errors.Is(err, ErrInvalidCredentials))
+}
+
+func TestNewLdapClient_invalidConfig(t *testing.T) {
+	viper.Set("ldap", "not a map")
+	_, err := NewLdapClient()
+	assert.Error(t, err, "invalid configuration should be reported rather than exiting")
+
+	viper.Set("ldap", map[string]interface{}{"addr": "ldap://localhost:389"})
+	defer viper.Set("ldap", nil)
+	client, err := NewLdapClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ldap://localhost:389", client.Addr, "should recover once the configuration is fixed")
+}
+
+// serveDirectory starts a directory that accepts any bind and answers searches with the entries, returning
+// at most the requested page size at a time, followed by the referrals. It returns the server's address and the
+// page sizes requested.
+func serveDirectory(t *testing.T, entries []string, referrals ...string) (string, chan uint32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	pages := make(chan uint32, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					request, err := ber.ReadPacket(conn)
+					if err != nil || len(request.Children) < 2 {
+						return
+					}
+					id := request.Children[0].Value.(int64)
+					switch request.Children[1].Tag {
+					case ldap.ApplicationBindRequest:
+						conn.Write(ldapResponse(id, ldapResult(ldap.ApplicationBindResponse)).Bytes())
+					case ldap.ApplicationSearchRequest:
+						var paging *ldap.ControlPaging
+						if len(request.Children) > 2 {
+							for _, child := range request.Children[2].Children {
+								if control, err := ldap.DecodeControl(child); err == nil {
+									paging, _ = control.(*ldap.ControlPaging)
+								}
+							}
+						}
+						if paging == nil {
+							return
+						}
+						pages <- paging.PagingSize
+						// The cookie is the offset of the page
+						start, _ := strconv.Atoi(string(paging.Cookie))
+						end := start + int(paging.PagingSize)
+						if end >= len(entries) {
+							end = len(entries)
+						}
+						for _, dn := range entries[start:end] {
+							entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+							entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+							entry.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes"))
+							conn.Write(ldapResponse(id, entry).Bytes())
+						}
+						for _, referral := range referrals {
+							reference := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 19, nil, "Search Result Reference")
+							reference.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, referral, "URI"))
+							conn.Write(ldapResponse(id, reference).Bytes())
+						}
+						next := &ldap.ControlPaging{}
+						if end < len(entries) {
+							next.SetCookie([]byte(strconv.Itoa(end)))
+						}
+						done := ldapResponse(id, ldapResult(ldap.ApplicationSearchResultDone))
+						controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+						controls.AppendChild(next.Encode())
+						done.AppendChild(controls)
+						conn.Write(done.Bytes())
+					default:
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return "ldap://" + listener.Addr().String(), pages
+}
+
+func ldapResponse(id int64, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func ldapResult(tag ber.Tag) *ber.Packet {
+	return ldapError(tag, ldap.LDAPResultSuccess, "")
+}
+
+func ldapError(tag ber.Tag, code uint16, message string) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+	return result
+}
+
+func TestLdapClient_sendRequest_paged(t *testing.T) {
+	groups := make([]string, 5)
+	for j := range groups {
+		groups[j] = "cn=group" + strconv.Itoa(j) + ",ou=groups,dc=example,dc=com"
+	}
+	addr, pages := serveDirectory(t, groups)
+	client := New(Config{
+		Addr:             addr,
+		BindDN:           "cn=admin,dc=example,dc=com",
+		BindDNCredential: "secret",
+		Flavor:           FlavorActiveDirectory,
+		NestedGroups:     true,
+		SearchBase:       "dc=example,dc=com",
+		PageSize:         2,
+	})
+	found, err := client.nestedGroups(context.Background(), "cn=joe,ou=people,dc=example,dc=com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, groups, found, "entries from every page should be returned")
+	close(pages)
+	requested := []uint32{}
+	for size := range pages {
+		requested = append(requested, size)
+	}
+	assert.Equal(t, []uint32{2, 2, 2}, requested)
+}
+
+func TestLdapClient_sendRequest_referrals(t *testing.T) {
+	other, _ := serveDirectory(t, []string{"cn=group2,ou=groups,dc=other,dc=example,dc=com"})
+	referral := other + "/dc=other,dc=example,dc=com"
+	addr, _ := serveDirectory(t, []string{"cn=group0,ou=groups,dc=example,dc=com"}, referral)
+	client := New(Config{
+		Addr:             addr,
+		BindDN:           "cn=admin,dc=example,dc=com",
+		BindDNCredential: "secret",
+		SearchBase:       "dc=example,dc=com",
+	})
+	request := func() *ldap.SearchRequest {
+		return buildSearchRequest(client.SearchBase, "(objectClass=group)", []string{"dn"})
+	}
+	dns := func(result *ldap.SearchResult) []string {
+		found := []string{}
+		for _, entry := range result.Entries {
+			found = append(found, entry.DN)
+		}
+		return found
+	}
+
+	result, err := client.sendRequest(context.Background(), request())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"cn=group0,ou=groups,dc=example,dc=com"}, dns(result), "referrals aren't followed by default")
+	assert.Equal(t, []string{referral}, result.Referrals)
+
+	client.FollowReferrals = true
+	client.ReferralHosts = []string{"127.0.0.1"}
+	result, err = client.sendRequest(context.Background(), request())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"cn=group0,ou=groups,dc=example,dc=com", "cn=group2,ou=groups,dc=other,dc=example,dc=com"},
+		dns(result))
+
+	client.ReferralHosts = []string{"dc.example.com"}
+	result, err = client.sendRequest(context.Background(), request())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"cn=group0,ou=groups,dc=example,dc=com"}, dns(result), "only listed hosts are followed")
+}
+
+func TestLdapClient_parseReferral(t *testing.T) {
+	client := New(Config{ReferralHosts: []string{"DC.other.example.com"}})
+	addr, base, err := client.parseReferral("ldaps://dc.other.example.com:636/DC=other,DC=example,DC=com??sub")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ldaps://dc.other.example.com:636", addr)
+		assert.Equal(t, "DC=other,DC=example,DC=com", base)
+	}
+	_, _, err = client.parseReferral("http://dc.other.example.com/")
+	assert.Error(t, err)
+	_, _, err = client.parseReferral("ldaps://dc.example.com/")
+	assert.Error(t, err, "only referrals to referral_hosts are followed")
+
+	viper.Set("ldap", map[string]interface{}{"follow_referrals": true})
+	defer viper.Set("ldap", nil)
+	_, err = LoadConfig()
+	assert.Error(t, err, "referral_hosts should be required")
+}
+
+func Test_errorReferrals(t *testing.T) {
+	// A referral result without the protocol op shouldn't panic
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "Message ID"))
+	err := &ldap.Error{ResultCode: ldap.LDAPResultReferral, Packet: packet}
+	assert.Empty(t, errorReferrals(err))
+}
+
+// serveUsers starts a directory that accepts any bind and answers searches with the users, by DN, whose attributes
+// match the equality or OR filter of the request
+func serveUsers(t *testing.T, users map[string]map[string][]string) string {
+	return serveAccounts(t, users, nil)
+}
+
+// testAccount is a user's password in a directory started by serveAccounts
+type testAccount struct {
+	password string
+	// reset by an administrator, so the user must change it before logging in
+	mustChange bool
+}
+
+// serveAccounts is serveUsers for a directory that checks the passwords of the accounts, by DN, and changes them
+// like Active Directory when the old unicodePwd value is removed and the new one added. Passwords containing weak
+// are refused. Binds as other DNs are accepted.
+func serveAccounts(t *testing.T, users map[string]map[string][]string, accounts map[string]*testAccount) string {
+	var lock sync.Mutex
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					request, err := ber.ReadPacket(conn)
+					if err != nil || len(request.Children) < 2 {
+						return
+					}
+					id := request.Children[0].Value.(int64)
+					switch request.Children[1].Tag {
+					case ldap.ApplicationBindRequest:
+						name, password := request.Children[1].Children[1].Data.String(), request.Children[1].Children[2].Data.String()
+						lock.Lock()
+						account := accounts[name]
+						switch {
+						case account == nil:
+							conn.Write(ldapResponse(id, ldapResult(ldap.ApplicationBindResponse)).Bytes())
+						case account.password != password:
+							conn.Write(ldapResponse(id, ldapError(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials,
+								"80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 52e, v4563")).Bytes())
+						case account.mustChange:
+							conn.Write(ldapResponse(id, ldapError(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials,
+								"80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 773, v4563")).Bytes())
+						default:
+							conn.Write(ldapResponse(id, ldapResult(ldap.ApplicationBindResponse)).Bytes())
+						}
+						lock.Unlock()
+					case ldap.ApplicationModifyRequest:
+						changes := request.Children[1].Children[1].Children
+						removed := decodeADPassword(changes[0].Children[1].Children[1].Children[0].Data.Bytes())
+						added := decodeADPassword(changes[1].Children[1].Children[1].Children[0].Data.Bytes())
+						lock.Lock()
+						account := accounts[request.Children[1].Children[0].Data.String()]
+						switch {
+						case account == nil:
+							conn.Write(ldapResponse(id, ldapError(ldap.ApplicationModifyResponse, ldap.LDAPResultNoSuchObject, "")).Bytes())
+						case removed != account.password:
+							conn.Write(ldapResponse(id, ldapError(ldap.ApplicationModifyResponse, ldap.LDAPResultConstraintViolation,
+								"00000056: AtrErr: DSID-03190F80, #1:\n\t0: 00000056: DSID-03190F80, problem 1005 (CONSTRAINT_ATT_TYPE)")).Bytes())
+						case strings.Contains(added, "weak"):
+							conn.Write(ldapResponse(id, ldapError(ldap.ApplicationModifyResponse, ldap.LDAPResultConstraintViolation,
+								"0000052D: Constraint violation - check_password_restrictions: the password is too short")).Bytes())
+						default:
+							account.password = added
+							account.mustChange = false
+							conn.Write(ldapResponse(id, ldapResult(ldap.ApplicationModifyResponse)).Bytes())
+						}
+						lock.Unlock()
+					case ldap.ApplicationSearchRequest:
+						filter := request.Children[1].Children[6]
+						for dn, attrs := range users {
+							if !matchFilter(filter, attrs) {
+								continue
+							}
+							entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+							entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+							list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+							for name, values := range attrs {
+								attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+								attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+								set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+								for _, value := range values {
+									set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+								}
+								attribute.AppendChild(set)
+								list.AppendChild(attribute)
+							}
+							entry.AppendChild(list)
+							conn.Write(ldapResponse(id, entry).Bytes())
+						}
+						done := ldapResponse(id, ldapResult(ldap.ApplicationSearchResultDone))
+						controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+						controls.AppendChild((&ldap.ControlPaging{}).Encode())
+						done.AppendChild(controls)
+						conn.Write(done.Bytes())
+					default:
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func matchFilter(filter *ber.Packet, attrs map[string][]string) bool {
+	switch filter.Tag {
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(child, attrs) {
+				return true
+			}
+		}
+	case ldap.FilterEqualityMatch:
+		for name, values := range attrs {
+			if strings.EqualFold(name, filter.Children[0].Data.String()) {
+				for _, value := range values {
+					if strings.EqualFold(value, filter.Children[1].Data.String()) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+func TestLdapClient_loginFilter(t *testing.T) {
+	assert.Equal(t, "(cn=joe)", New(Config{}).loginFilter("joe"))
+	client := New(Config{LoginAttributes: []string{ldapAttributeUid, ldapAttributeEmail, ldapAttributeCN}})
+	assert.Equal(t, "(|(uid=joe@example.com)(mail=joe@example.com)(cn=joe@example.com))", client.loginFilter("joe@example.com"))
+	assert.Equal(t, `(|(uid=\2a\29\28uid=\2a)(mail=\2a\29\28uid=\2a)(cn=\2a\29\28uid=\2a))`, client.loginFilter("*)(uid=*"),
+		"the username must not change the filter")
+}
+
+func TestLdapClient_Authenticate_loginAttributes(t *testing.T) {
+	addr := serveUsers(t, map[string]map[string][]string{
+		"cn=Joe Smith,ou=people,dc=example,dc=com": {
+			ldapAttributeCN:    {"Joe Smith"},
+			ldapAttributeUid:   {"jsmith"},
+			ldapAttributeEmail: {"joe@example.com"},
+		},
+		"cn=Jane Doe,ou=people,dc=example,dc=com": {
+			ldapAttributeCN:    {"Jane Doe"},
+			ldapAttributeUid:   {"jdoe"},
+			ldapAttributeEmail: {"jane@example.com"},
+		},
+	})
+	client := New(Config{
+		Addr:             addr,
+		BindDN:           "cn=admin,dc=example,dc=com",
+		BindDNCredential: "secret",
+		SearchBase:       "dc=example,dc=com",
+		LoginAttributes:  []string{ldapAttributeUid, ldapAttributeEmail},
+		Attributes:       []string{ldapAttributeCN, ldapAttributeEmail},
+	})
+	for _, login := range []string{"jsmith", "joe@example.com"} {
+		attrs, err := client.Authenticate(context.Background(), login, "password")
+		if assert.NoError(t, err, login) {
+			assert.Equal(t, []string{"Joe Smith"}, attrs[ldapAttributeCN], "%s should resolve the same entry", login)
+			assert.Equal(t, "jsmith", client.LoginName(attrs), "%s should be named by the first login attribute", login)
+		}
+	}
+	_, err := client.Authenticate(context.Background(), "Joe Smith", "password")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials), "cn isn't a login attribute")
+}
+
+func TestLdapClient_Authenticate_ambiguous(t *testing.T) {
+	// Jane's uid is Joe's mail address
+	addr := serveUsers(t, map[string]map[string][]string{
+		"cn=Joe Smith,ou=people,dc=example,dc=com": {
+			ldapAttributeCN:    {"Joe Smith"},
+			ldapAttributeUid:   {"jsmith"},
+			ldapAttributeEmail: {"joe@example.com"},
+		},
+		"cn=Jane Doe,ou=people,dc=example,dc=com": {
+			ldapAttributeCN:  {"Jane Doe"},
+			ldapAttributeUid: {"joe@example.com"},
+		},
+	})
+	client := New(Config{
+		Addr:             addr,
+		BindDN:           "cn=admin,dc=example,dc=com",
+		BindDNCredential: "secret",
+		SearchBase:       "dc=example,dc=com",
+		LoginAttributes:  []string{ldapAttributeUid, ldapAttributeEmail},
+	})
+	_, err := client.Authenticate(context.Background(), "joe@example.com", "password")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials), "a login matching several entries should fail: %v", err)
+	err = client.ChangePassword(context.Background(), "joe@example.com", "password", "new")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials), "a login matching several entries should fail: %v", err)
+}
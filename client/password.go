@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrPasswordRejected is returned when the directory refuses a new password, usually because it doesn't meet the
+// password policy
+var ErrPasswordRejected = errors.New("password rejected")
+
+const (
+	// Active Directory reports why a bind failed in the diagnostic message. 532 is an expired password and 773 one
+	// that must be changed at the next logon.
+	adPasswordExpired       = "data 532"
+	adPasswordMustChange    = "data 773"
+	ldapAttributeUnicodePwd = "unicodePwd"
+	// adWrongPassword is the Windows error for an incorrect current password when changing it
+	adWrongPassword = "00000056"
+)
+
+// mustChangePassword reports whether the bind was refused, or only allows changing the password, because the
+// password expired or was reset by an administrator. OpenLDAP reports it with the password policy control and
+// Active Directory in the diagnostic message.
+func mustChangePassword(result *ldap.SimpleBindResult, err error) bool {
+	if result != nil {
+		for _, control := range result.Controls {
+			if policy, ok := control.(*ldap.ControlBeheraPasswordPolicy); ok &&
+				(policy.Error == ldap.BeheraPasswordExpired || policy.Error == ldap.BeheraChangeAfterReset) {
+				return true
+			}
+		}
+	}
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultInvalidCredentials && ldapErr.Err != nil {
+		message := ldapErr.Err.Error()
+		return strings.Contains(message, adPasswordExpired) || strings.Contains(message, adPasswordMustChange)
+	}
+	return false
+}
+
+// ChangePassword replaces the user's password, which may have expired. Active Directory doesn't let users with
+// expired passwords bind, so the change is made as the service account by removing the old password and adding the
+// new one, which AD only allows when the old one is correct. Other directories are asked to change it with the
+// password modify extended operation while bound as the user.
+func (client *LdapClient) ChangePassword(ctx context.Context, username, oldPassword, newPassword string) error {
+	request := buildSearchRequest(client.SearchBase, client.loginFilter(username), []string{ldapAttributeCN})
+	result, servers, err := client.search(ctx, request)
+	if err != nil {
+		return unavailable(err)
+	}
+	if err = uniqueEntry(username, result); err != nil {
+		return err
+	}
+	for _, entry := range result.Entries {
+		if client.Flavor == FlavorActiveDirectory {
+			err = client.changeADPassword(ctx, servers[entry], entry.DN, oldPassword, newPassword)
+		} else {
+			err = client.modifyPassword(ctx, servers[entry], entry.DN, oldPassword, newPassword)
+		}
+		if err == ErrInvalidCredentials {
+			continue
+		}
+		return err
+	}
+	return ErrInvalidCredentials
+}
+
+func (client *LdapClient) changeADPassword(ctx context.Context, addr, dn, oldPassword, newPassword string) error {
+	conn, err := client.getConn(ctx, addr, client.BindDN, client.BindDNCredential)
+	if err != nil {
+		return unavailable(err)
+	}
+	defer conn.Close()
+	request := ldap.NewModifyRequest(dn, nil)
+	request.Delete(ldapAttributeUnicodePwd, []string{adPassword(oldPassword)})
+	request.Add(ldapAttributeUnicodePwd, []string{adPassword(newPassword)})
+	if err = conn.Modify(request); err != nil {
+		return passwordChangeError(ctx, err)
+	}
+	return nil
+}
+
+func (client *LdapClient) modifyPassword(ctx context.Context, addr, dn, oldPassword, newPassword string) error {
+	// The password policy lets users with expired or reset passwords bind to change them
+	conn, err := client.getConn(ctx, addr, dn, oldPassword)
+	if err != nil {
+		if ldap.IsErrorAnyOf(err, ldap.LDAPResultInvalidCredentials, ldap.ErrorEmptyPassword) {
+			log.Error(err)
+			return ErrInvalidCredentials
+		}
+		if errors.Is(err, ErrPasswordExpired) {
+			// Expired without grace logins, so only an administrator can change it
+			return err
+		}
+		return unavailable(err)
+	}
+	defer conn.Close()
+	if _, err = conn.PasswordModify(ldap.NewPasswordModifyRequest(dn, oldPassword, newPassword)); err != nil {
+		return passwordChangeError(ctx, err)
+	}
+	return nil
+}
+
+// passwordChangeError distinguishes a new password refused by the password policy from an incorrect old one and
+// from a failure to reach the directory
+func passwordChangeError(ctx context.Context, err error) error {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) {
+		return unavailable(contextError(ctx, err))
+	}
+	switch ldapErr.ResultCode {
+	case ldap.LDAPResultConstraintViolation, ldap.LDAPResultUnwillingToPerform:
+		log.Error(err)
+		if ldapErr.Err != nil && strings.Contains(ldapErr.Err.Error(), adWrongPassword) {
+			return ErrInvalidCredentials
+		}
+		return fmt.Errorf("%w: %s", ErrPasswordRejected, err)
+	case ldap.LDAPResultInvalidCredentials:
+		log.Error(err)
+		return ErrInvalidCredentials
+	default:
+		return unavailable(err)
+	}
+}
+
+// adPassword encodes a password as Active Directory expects unicodePwd values, quoted and in UTF-16LE
+func adPassword(password string) string {
+	encoded := utf16.Encode([]rune(`"` + password + `"`))
+	b := make([]byte, 0, len(encoded)*2)
+	for _, c := range encoded {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	return string(b)
+}
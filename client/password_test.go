@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeADPassword reverses adPassword
+func decodeADPassword(b []byte) string {
+	encoded := make([]uint16, len(b)/2)
+	for i := range encoded {
+		encoded[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+	}
+	return strings.Trim(string(utf16.Decode(encoded)), `"`)
+}
+
+func Test_adPassword(t *testing.T) {
+	assert.Equal(t, "\"\x00n\x00e\x00w\x00\"\x00", adPassword("new"))
+	assert.Equal(t, "pässwörd", decodeADPassword([]byte(adPassword("pässwörd"))))
+}
+
+func Test_mustChangePassword(t *testing.T) {
+	reset := ldap.NewControlBeheraPasswordPolicy()
+	reset.Error = ldap.BeheraChangeAfterReset
+	assert.True(t, mustChangePassword(&ldap.SimpleBindResult{Controls: []ldap.Control{reset}}, nil))
+	assert.False(t, mustChangePassword(&ldap.SimpleBindResult{Controls: []ldap.Control{ldap.NewControlBeheraPasswordPolicy()}}, nil))
+	expired := ldap.NewError(ldap.LDAPResultInvalidCredentials,
+		errors.New("80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 532, v4563"))
+	assert.True(t, mustChangePassword(nil, expired))
+	wrong := ldap.NewError(ldap.LDAPResultInvalidCredentials,
+		errors.New("80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 52e, v4563"))
+	assert.False(t, mustChangePassword(nil, wrong))
+}
+
+func TestLdapClient_ChangePassword(t *testing.T) {
+	dn := "cn=joe,ou=people,dc=example,dc=com"
+	account := &testAccount{password: "old", mustChange: true}
+	addr := serveAccounts(t, map[string]map[string][]string{
+		dn: {ldapAttributeCN: {"joe"}},
+	}, map[string]*testAccount{dn: account})
+	client := New(Config{
+		Addr:             addr,
+		BindDN:           "cn=admin,dc=example,dc=com",
+		BindDNCredential: "secret",
+		Flavor:           FlavorActiveDirectory,
+		SearchBase:       "dc=example,dc=com",
+	})
+	ctx := context.Background()
+	_, err := client.Authenticate(ctx, "joe", "old")
+	assert.Equal(t, ErrPasswordExpired, err)
+	_, err = client.Authenticate(ctx, "joe", "wrong")
+	assert.Equal(t, ErrInvalidCredentials, err, "an incorrect password shouldn't reveal the password expired")
+
+	assert.Equal(t, ErrInvalidCredentials, client.ChangePassword(ctx, "joe", "wrong", "new"))
+	assert.ErrorIs(t, client.ChangePassword(ctx, "joe", "old", "weak"), ErrPasswordRejected)
+	assert.Equal(t, ErrInvalidCredentials, client.ChangePassword(ctx, "jane", "old", "new"))
+	if assert.NoError(t, client.ChangePassword(ctx, "joe", "old", "new")) {
+		_, err = client.Authenticate(ctx, "joe", "new")
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultReferralHopLimit is the longest chain of referrals followed unless referral_hop_limit is configured
+const DefaultReferralHopLimit = 3
+
+// search runs the request against the directory and, when follow_referrals is enabled, the directories it refers
+// to. The address of the server that returned each entry is recorded so users bind where they were found.
+func (client *LdapClient) search(ctx context.Context,
+	request *ldap.SearchRequest) (*ldap.SearchResult, map[*ldap.Entry]string, error) {
+	result := &ldap.SearchResult{}
+	servers := make(map[*ldap.Entry]string)
+	if err := client.chase(ctx, client.Addr, request, 0, result, servers, map[string]bool{}); err != nil {
+		return nil, nil, err
+	}
+	return result, servers, nil
+}
+
+// chase adds the entries the server returns to result, then follows the server's referrals until the hop limit
+func (client *LdapClient) chase(ctx context.Context, addr string, request *ldap.SearchRequest, hops int,
+	result *ldap.SearchResult, servers map[*ldap.Entry]string, visited map[string]bool) error {
+	bindDN, credential := client.BindDN, client.BindDNCredential
+	if hops > 0 && client.ReferralBindDN != "" {
+		bindDN, credential = client.ReferralBindDN, client.ReferralBindDNCredential
+	}
+	found, err := client.searchServer(ctx, addr, bindDN, credential, request)
+	var referrals []string
+	switch {
+	case err == nil:
+		referrals = found.Referrals
+	case client.FollowReferrals:
+		// The base of the search is held by another directory
+		if referrals = errorReferrals(err); len(referrals) == 0 {
+			return err
+		}
+	default:
+		return err
+	}
+	for _, entry := range found.Entries {
+		servers[entry] = addr
+		result.Entries = append(result.Entries, entry)
+	}
+	if !client.FollowReferrals {
+		result.Referrals = append(result.Referrals, referrals...)
+		return nil
+	}
+	limit := client.ReferralHopLimit
+	if limit == 0 {
+		limit = DefaultReferralHopLimit
+	}
+	for _, referral := range referrals {
+		if visited[referral] {
+			continue
+		}
+		visited[referral] = true
+		if hops >= limit {
+			log.Warnf("not following referral to %s, the hop limit of %d was reached", referral, limit)
+			continue
+		}
+		referredAddr, base, err := client.parseReferral(referral)
+		if err != nil {
+			log.Warnf("not following referral to %s: %s", referral, err)
+			continue
+		}
+		if base == "" {
+			base = request.BaseDN
+		}
+		referred := buildSearchRequest(base, request.Filter, request.Attributes)
+		referred.Scope = request.Scope
+		if err = client.chase(ctx, referredAddr, referred, hops+1, result, servers, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseReferral returns the server address and base DN of an LDAP URL. Referrals to hosts that aren't listed in
+// referral_hosts are refused.
+func (client *LdapClient) parseReferral(referral string) (string, string, error) {
+	u, err := url.Parse(referral)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return "", "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if !containsFold(client.ReferralHosts, u.Hostname()) {
+		return "", "", errors.New("host is not listed in referral_hosts")
+	}
+	return u.Scheme + "://" + u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// errorReferrals returns the LDAP URLs of a referral result, which is returned when the base of the search is
+// held by another directory
+func errorReferrals(err error) []string {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.ResultCode != ldap.LDAPResultReferral || ldapErr.Packet == nil {
+		return nil
+	}
+	// The optional referral follows the result code, matched DN, and diagnostic message
+	if len(ldapErr.Packet.Children) < 2 {
+		return nil
+	}
+	response := ldapErr.Packet.Children[1]
+	if len(response.Children) < 4 {
+		return nil
+	}
+	referrals := make([]string, 0, len(response.Children[3].Children))
+	for _, uri := range response.Children[3].Children {
+		if value, ok := uri.Value.(string); ok {
+			referrals = append(referrals, value)
+		}
+	}
+	return referrals
+}
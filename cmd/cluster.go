@@ -37,9 +37,15 @@ Cache data is stored in Redis.`,
 			if err != nil {
 				return err
 			}
+			// Persistent NameIDs never expire
+			nameIDCache, err := redis.New(0)
+			if err != nil {
+				return err
+			}
 			return ServeCmd(&idp.IDP{
 				TempCache: tempCache,
 				UserCache: userCache,
+				NameIDs:   idp.NewNameIDStore(nameIDCache, idp.DefaultIDGenerator()),
 			}).RunE(cmd, args)
 		},
 		Args: cobra.NoArgs,
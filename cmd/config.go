@@ -0,0 +1,92 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/chriskery/sso-idp/idp"
+	"github.com/chriskery/sso-idp/settings"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ReadConfigData merges a YAML or JSON document over the config file. Containers without a mounted file can pass
+// their whole configuration in the CONFIG_DATA environment variable, including structures such as sps and ldap that
+// can't be set one variable at a time.
+func ReadConfigData(data string) error {
+	overrides, err := parseConfigData(data)
+	if err != nil || overrides == nil {
+		return err
+	}
+	log.Info("using configuration from CONFIG_DATA")
+	return viper.MergeConfigMap(overrides)
+}
+
+// parseConfigData reads the document passed in CONFIG_DATA, which is nil when there isn't one
+func parseConfigData(data string) (map[string]interface{}, error) {
+	if data == "" {
+		return nil, nil
+	}
+	// Read it separately so the type of the config file, which is used to save service providers, is kept
+	config := viper.New()
+	config.SetConfigType("yaml")
+	if err := config.ReadConfig(strings.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return config.AllSettings(), nil
+}
+
+// reloadConfig reads the config file and CONFIG_DATA again and applies them to the running IDP. They're read into a
+// copy of the configuration the IDP started with, which keeps the defaults, flags and environment variables, and
+// published once they validate. Requests read the published configuration without locking, so it's never changed.
+// When the new configuration can't be applied, the previous one is published again.
+func reloadConfig(identityProvider *idp.IDP) error {
+	data := viper.GetString("config-data")
+	// Checked before anything is read, so a broken document leaves the configuration alone
+	overrides, err := parseConfigData(data)
+	if err != nil {
+		return err
+	}
+	next := *viper.GetViper()
+	var notFound viper.ConfigFileNotFoundError
+	if err := next.ReadInConfig(); err != nil {
+		if !errors.As(err, &notFound) {
+			return err
+		}
+		// Without a config file the configuration is only what's in CONFIG_DATA. Reading it replaces what the copy
+		// shares with the configuration the IDP started with rather than merging into it.
+		next.SetConfigType("yaml")
+		if err := next.ReadConfig(strings.NewReader(data)); err != nil {
+			return err
+		}
+	} else if overrides != nil {
+		// Reading the file replaced what was merged from CONFIG_DATA
+		if err := next.MergeConfigMap(overrides); err != nil {
+			return err
+		}
+	}
+	if err := identityProvider.ValidateSettings(&next); err != nil {
+		return err
+	}
+	previous := settings.Current()
+	settings.Publish(&next)
+	if err := identityProvider.Reload(); err != nil {
+		settings.Publish(previous)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chriskery/sso-idp/idp"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadConfigData(t *testing.T) {
+	// The merged configuration can't be unset, so leave it as the default other tests write to config.yaml
+	defer viper.MergeConfigMap(map[string]interface{}{"attribute-templates": []interface{}{}})
+	err := ReadConfigData(`
+attribute-templates:
+- name: displayName
+  template: "{{.Name}}"
+`)
+	if assert.NoError(t, err) {
+		var templates []idp.AttributeTemplate
+		assert.NoError(t, viper.UnmarshalKey("attribute-templates", &templates))
+		assert.Equal(t, []idp.AttributeTemplate{{Name: "displayName", Template: "{{.Name}}"}}, templates)
+	}
+	assert.Error(t, ReadConfigData("attribute-templates: [unclosed"))
+	assert.NoError(t, ReadConfigData(""), "no document leaves the configuration alone")
+}
+
+func Test_reloadConfig_invalid(t *testing.T) {
+	previous := viper.ConfigFileUsed()
+	defer viper.SetConfigFile(previous)
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	viper.SetConfigFile(config)
+	lifetime := viper.GetString("assertion-lifetime")
+	if err := os.WriteFile(config, []byte("assertion-lifetime: 5 minutes\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := reloadConfig(&idp.IDP{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "assertion-lifetime")
+	}
+	assert.Equal(t, lifetime, viper.GetString("assertion-lifetime"), "the invalid configuration shouldn't be kept")
+}
@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/handlers"
 	log "github.com/sirupsen/logrus"
@@ -35,13 +36,28 @@ func ServeCmd(indentityProvider *idp.IDP) *cobra.Command {
 		Short: "runs idp server",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			indentityProvider.EnableTLS = viper.GetBool("tls_enable")
+			// Report every problem with the configuration rather than the first, before any are met by requests
+			if err := indentityProvider.Validate(); err != nil {
+				return err
+			}
 			// Listen for shutdown signal
 			stop := make(chan os.Signal, 1)
 			signal.Notify(stop, os.Interrupt)
+			shutdownTracing, err := idp.ConfigureTracing()
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := shutdownTracing(context.Background()); err != nil {
+					log.Errorf("unable to export remaining spans: %s", err)
+				}
+			}()
 			handler, err := indentityProvider.Handler()
 			if err != nil {
 				return err
 			}
+			defer indentityProvider.Close()
+			indentityProvider.WatchCertificateExpiry(viper.GetDuration("certificate-check-interval"))
 			server := &http.Server{
 				Handler: handlers.CombinedLoggingHandler(os.Stdout, hsts(handler)),
 				Addr:    viper.GetString("listen-address"),
@@ -51,6 +67,26 @@ func ServeCmd(indentityProvider *idp.IDP) *cobra.Command {
 				<-stop
 				server.Shutdown(context.Background())
 			}()
+			// Apply configuration changes on SIGHUP without dropping connections
+			reload := make(chan os.Signal, 1)
+			signal.Notify(reload, syscall.SIGHUP)
+			defer signal.Stop(reload)
+			// Closed once the server has shut down
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					case <-reload:
+					}
+					log.Info("reloading the configuration")
+					if err := reloadConfig(indentityProvider); err != nil {
+						log.Errorf("unable to reload the configuration: %s", err)
+					}
+				}
+			}()
 
 			log.Infof("listening for connections on %s", server.Addr)
 			if indentityProvider.EnableTLS {
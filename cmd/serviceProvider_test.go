@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bytes"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -26,9 +27,11 @@ func checkStringContains(t *testing.T, got, expected string) {
 	}
 }
 
-func addServiceProvider(metadata string) (output string, err error) {
+func addServiceProvider(t *testing.T, metadata string) (output string, err error) {
 	// set a dummy config file for the command to write to
-	viper.SetConfigFile("config.yaml")
+	previous := viper.ConfigFileUsed()
+	t.Cleanup(func() { viper.SetConfigFile(previous) })
+	viper.SetConfigFile(filepath.Join(t.TempDir(), "config.yaml"))
 
 	rootCmd := &cobra.Command{Use: "add", Args: cobra.NoArgs, Run: emptyRun}
 	rootCmd.AddCommand(serviceProviderCmd)
@@ -36,7 +39,7 @@ func addServiceProvider(metadata string) (output string, err error) {
 }
 
 func TestAddServiceProviderCommand(t *testing.T) {
-	output, err := addServiceProvider("../idp/testdata/sp-metadata.xml")
+	output, err := addServiceProvider(t, "../idp/testdata/sp-metadata.xml")
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -44,7 +47,7 @@ func TestAddServiceProviderCommand(t *testing.T) {
 }
 
 func TestAddServiceProviderCommandWrongFile(t *testing.T) {
-	_, err := addServiceProvider("dontexist.xml")
+	_, err := addServiceProvider(t, "dontexist.xml")
 	if err == nil {
 		t.Error("Expected 'no such file or directory' error")
 	} else {
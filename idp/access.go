@@ -0,0 +1,135 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrAccessDenied is returned when a user doesn't satisfy the AccessPolicy of the service provider
+var ErrAccessDenied = errors.New("access denied")
+
+// AccessPolicy limits which users may log in to a service provider. Users that don't satisfy every condition
+// it sets are sent a Response with the access-denied-status instead of an assertion.
+//
+//	sps:
+//	- entityid: https://admin.example.org
+//	  accesspolicy:
+//	    groups: [administrators]
+//	    attributes:
+//	      employeeType: [staff, faculty]
+//	    requireattributes: true
+type AccessPolicy struct {
+	// Groups, any of which the user must belong to
+	Groups []string `yaml:",omitempty"`
+	// Attribute listing the user's groups, defaults to memberOf
+	GroupAttribute string `yaml:",omitempty"`
+	// Attributes the user must have, with one of the listed values when any are listed
+	Attributes map[string][]string `yaml:",omitempty"`
+	// Deny users that have no attributes released to the service provider
+	RequireAttributes bool `yaml:",omitempty"`
+}
+
+// authorize checks the user against the AccessPolicy of the service provider that issued the request. The
+// error wraps ErrAccessDenied and describes the condition the user didn't satisfy.
+func (i *IDP) authorize(request *model.AuthnRequest, user *model.User) error {
+	sp, _ := i.getSP(request.Issuer)
+	if sp == nil || sp.AccessPolicy == nil {
+		return nil
+	}
+	policy := sp.AccessPolicy
+	if len(policy.Groups) > 0 {
+		groupAttribute := policy.GroupAttribute
+		if groupAttribute == "" {
+			groupAttribute = "memberOf"
+		}
+		if !hasAttributeValue(user, groupAttribute, policy.Groups) {
+			return fmt.Errorf("%w: %s is not a member of an allowed group", ErrAccessDenied, user.Name)
+		}
+	}
+	for name, values := range policy.Attributes {
+		if !hasAttributeValue(user, name, values) {
+			return fmt.Errorf("%w: %s does not have an allowed %s", ErrAccessDenied, user.Name, name)
+		}
+	}
+	if policy.RequireAttributes && len(i.releasedAttributes(user, request.Issuer).Attributes) == 0 {
+		return fmt.Errorf("%w: %s has no attributes to release", ErrAccessDenied, user.Name)
+	}
+	return nil
+}
+
+// logAccessDenied reports that the user was denied access to the service provider
+func (i *IDP) logAccessDenied(request *model.AuthnRequest, user *model.User, err error) {
+	log.Warnf("denied access to %s: %s", request.Issuer, err)
+	if auditor, ok := i.Auditor.(AccessAuditor); ok {
+		auditor.LogAccessDenied(user, request, err)
+	}
+}
+
+// hasAttributeValue reports whether the user has one of the values of the attribute, or any value when none
+// are listed. Attribute names are compared ignoring case since configuration keys are lowercased.
+func hasAttributeValue(user *model.User, name string, values []string) bool {
+	for _, att := range user.Attributes {
+		if !strings.EqualFold(att.Name, name) {
+			continue
+		}
+		for _, value := range att.Value {
+			if len(values) == 0 || contains(values, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// makeDeniedResponse answers the request with a Responder status refined by the access-denied-status. It
+// doesn't contain an assertion, so there's nothing to sign.
+func (i *IDP) makeDeniedResponse(request *model.AuthnRequest) *saml.Response {
+	return i.makeStatusResponse(request, settings.GetString("access-denied-status"))
+}
+
+// makeStatusResponse answers the request with a Responder status refined by the second-level status, without an
+// assertion
+func (i *IDP) makeStatusResponse(request *model.AuthnRequest, status string) *saml.Response {
+	inResponseTo := request.ID
+	if request.Unsolicited {
+		inResponseTo = ""
+	}
+	return &saml.Response{
+		StatusResponseType: saml.StatusResponseType{
+			Version:      "2.0",
+			ID:           i.IDs.NewID(),
+			IssueInstant: i.Clock.Now().UTC(),
+			InResponseTo: inResponseTo,
+			Destination:  request.AssertionConsumerServiceURL,
+			Issuer:       i.samlIssuer(),
+			Status: &saml.Status{
+				StatusCode: saml.StatusCode{
+					Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+					StatusCode: &saml.StatusCode{
+						Value: status,
+					},
+				},
+			},
+		},
+	}
+}
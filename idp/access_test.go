@@ -0,0 +1,111 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_authorize(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	i.sps["sp"] = &ServiceProvider{EntityID: "sp"}
+	viper.Set("attribute-release-rules", []map[string]interface{}{{"attribute": "mail", "sps": []string{"other"}}})
+	defer viper.Set("attribute-release-rules", []ReleaseRule{})
+	if err := i.configureReleaseRules(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { i.releaseRules = nil }()
+	staff := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "memberOf", Value: []string{"users", "admins"}},
+		{Name: "employeeType", Value: []string{"staff"}},
+	}}
+	mailOnly := &model.User{Name: "bob", Attributes: []*model.Attribute{{Name: "mail", Value: []string{"bob@example.com"}}}}
+	tests := []struct {
+		name    string
+		policy  *AccessPolicy
+		user    *model.User
+		allowed bool
+	}{
+		{"no policy", nil, mailOnly, true},
+		{"group", &AccessPolicy{Groups: []string{"admins"}}, staff, true},
+		{"not in group", &AccessPolicy{Groups: []string{"auditors"}}, staff, false},
+		{"group attribute", &AccessPolicy{Groups: []string{"staff"}, GroupAttribute: "employeetype"}, staff, true},
+		{"attribute value", &AccessPolicy{Attributes: map[string][]string{"employeetype": {"staff", "faculty"}}}, staff, true},
+		{"other attribute value", &AccessPolicy{Attributes: map[string][]string{"employeetype": {"faculty"}}}, staff, false},
+		{"any attribute value", &AccessPolicy{Attributes: map[string][]string{"mail": nil}}, mailOnly, true},
+		{"missing attribute", &AccessPolicy{Attributes: map[string][]string{"mail": nil}}, staff, false},
+		{"released attributes", &AccessPolicy{RequireAttributes: true}, staff, true},
+		{"no released attributes", &AccessPolicy{RequireAttributes: true}, mailOnly, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i.sps["sp"].AccessPolicy = tt.policy
+			err := i.authorize(&model.AuthnRequest{Issuer: "sp"}, tt.user)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, ErrAccessDenied), "expected access denied, got %v", err)
+			}
+		})
+	}
+}
+
+type accessAuditor struct {
+	auditor
+	denied []error
+}
+
+func (a *accessAuditor) LogAccessDenied(_ *model.User, _ *model.AuthnRequest, reason error) {
+	a.denied = append(a.denied, reason)
+}
+
+func TestIDP_respond_accessDenied(t *testing.T) {
+	bindings := map[string]string{
+		"post":     "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+		"artifact": "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+	}
+	for name, binding := range bindings {
+		t.Run(name, func(t *testing.T) {
+			sp := newTestSP(t, "https://"+name+".example.com", binding)
+			auditor := &accessAuditor{}
+			i := &IDP{Auditor: auditor}
+			startTestIDP(t, i, sp)
+			i.sps[sp.entityID].AccessPolicy = &AccessPolicy{Groups: []string{"admins"}}
+			resp, err := sp.login(sp.newSession(&model.User{Name: "joe"}), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			// The service provider is sent a status instead of an assertion
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			assert.Nil(t, sp.assertion)
+			if assert.NotNil(t, sp.status) && assert.NotNil(t, sp.status.StatusCode.StatusCode) {
+				assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Responder", sp.status.StatusCode.Value)
+				assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:RequestDenied", sp.status.StatusCode.StatusCode.Value)
+			}
+			if assert.Len(t, auditor.denied, 1) {
+				assert.True(t, errors.Is(auditor.denied[0], ErrAccessDenied))
+			}
+		})
+	}
+}
@@ -15,89 +15,141 @@
 package idp
 
 import (
+	"bytes"
 	"encoding/xml"
 	"github.com/chriskery/sso-idp/model"
 	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/store"
 	"net/http"
 	"net/url"
-	"time"
 
 	"github.com/golang/protobuf/proto"
 	log "github.com/sirupsen/logrus"
 )
 
 // DefaultArtifactResolveHandler is the default implementation for the artifact resolution handler. It can be used as is, wrapped in other handlers, or replaced completely.
+// Service providers authenticate with the client certificate they're registered with or by signing the
+// ArtifactResolve, and can only resolve the artifacts issued to them.
 func (i *IDP) DefaultArtifactResolveHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// We require transport authentication rather than message authentication
-		tlsCert, err := getCertFromRequest(r)
-		if err != nil {
-			i.Error(w, err.Error(), http.StatusUnauthorized)
-			return
+		if tlsCert, err := getCertFromRequest(r); err == nil {
+			log.Infof("received artifact resolution request from %s", getSubjectDN(tlsCert.Subject))
 		}
-		log.Infof("received artifact resolution request from %s", getSubjectDN(tlsCert.Subject))
 		i.processArtifactResolutionRequest(w, r)
 	}
 }
 
 func (i *IDP) processArtifactResolutionRequest(w http.ResponseWriter, r *http.Request) {
-	decoder := xml.NewDecoder(r.Body)
+	body, err := readSOAPRequest(w, r)
+	if err != nil {
+		log.Infof("unable to read ArtifactResolve: %s", err)
+		sendSOAPFault(i, w, faultCode(err), err.Error())
+		return
+	}
 	var resolveEnv saml.ArtifactResolveEnvelope
-	err := decoder.Decode(&resolveEnv)
-	// TODO confirm appropriate error response for this service
+	// Requests that can't be understood are SOAP faults, otherwise the status of the ArtifactResponse reports
+	// the failure
+	if err := xml.Unmarshal(body, &resolveEnv); err != nil {
+		log.Infof("unable to parse ArtifactResolve: %s", err)
+		sendSOAPFault(i, w, "SOAP-ENV:Client", "unable to parse ArtifactResolve: "+err.Error())
+		return
+	}
+
+	resolve := resolveEnv.Body.ArtifactResolve
+	sp, signed, err := i.authenticateSOAPRequest(r, body, resolve.RequestAbstractType, resolve.Signature)
+	if err == nil && signed != nil {
+		// Read the artifact from what was actually signed
+		resolve = saml.ArtifactResolve{}
+		err = xml.Unmarshal(signed, &resolve)
+	}
 	if err != nil {
-		i.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Warnf("rejected artifact resolution by %q: %s", resolveEnv.Body.ArtifactResolve.Issuer, err)
+		i.writeArtifactResponse(w, i.makeArtifactResponse(resolveEnv.Body.ArtifactResolve.ID,
+			"urn:oasis:names:tc:SAML:2.0:status:Requester", nil))
 		return
 	}
 
-	artifact := resolveEnv.Body.ArtifactResolve.Artifact
-	data, err := i.TempCache.Get(artifact)
+	artifact := resolve.Artifact
+	// Artifacts are one-time use. Take it out of the cache so the assertion can't be replayed, even by concurrent
+	// requests.
+	data, err := store.Take(i.TempCache, artifactKey(artifact))
+	if err == store.ErrNotFound {
+		// Unknown, expired, or already resolved artifact
+		log.Infof("artifact %s not found", artifact)
+		i.writeArtifactResponse(w, i.makeArtifactResponse(resolveEnv.Body.ArtifactResolve.ID,
+			"urn:oasis:names:tc:SAML:2.0:status:Requester", nil))
+		return
+	}
 	if err != nil {
-		i.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Errorf("unable to read artifact %s: %s", artifact, err)
+		sendSOAPFault(i, w, "SOAP-ENV:Server", "unable to read artifact")
 		return
 	}
 	artifactResponse := &model.ArtifactResponse{}
-	err = proto.Unmarshal(data, artifactResponse)
-	// TODO confirm appropriate error response for this service
+	if err = proto.Unmarshal(data, artifactResponse); err != nil {
+		log.Errorf("unable to read artifact %s: %s", artifact, err)
+		sendSOAPFault(i, w, "SOAP-ENV:Server", "unable to read artifact")
+		return
+	}
+	// The artifact only embeds the IDP's entity ID, so make sure it's resolved by the service provider whose
+	// request it answers. Otherwise one service provider could collect the assertions issued to another.
+	resolver := sp.EntityID
+	if target := artifactResponse.Request.GetIssuer(); resolver != target {
+		log.Warnf("rejected resolution by %q of an artifact issued to %s", resolver, target)
+		i.writeArtifactResponse(w, i.makeArtifactResponse(resolveEnv.Body.ArtifactResolve.ID,
+			"urn:oasis:names:tc:SAML:2.0:status:Requester", nil))
+		return
+	}
+	response, err := i.buildSignedResponse(r.Context(), artifactResponse.Request, artifactResponse.User)
 	if err != nil {
-		i.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Errorf("unable to build response to %s: %s", resolver, err)
+		i.writeArtifactResponse(w, i.makeArtifactResponse(resolveEnv.Body.ArtifactResolve.ID,
+			"urn:oasis:names:tc:SAML:2.0:status:Responder", nil))
 		return
 	}
-	now := time.Now().UTC()
-	response := i.makeAuthnResponse(artifactResponse.Request, artifactResponse.User)
-	artResponseEnv := saml.ArtifactResponseEnvelope{
+	i.writeArtifactResponse(w, i.makeArtifactResponse(resolveEnv.Body.ArtifactResolve.ID,
+		"urn:oasis:names:tc:SAML:2.0:status:Success", response))
+}
+
+func (i *IDP) makeArtifactResponse(inResponseTo, status string, response *saml.Response) saml.ArtifactResponseEnvelope {
+	return saml.ArtifactResponseEnvelope{
 		Body: saml.ArtifactResponseBody{
 			ArtifactResponse: saml.ArtifactResponse{
 				StatusResponseType: saml.StatusResponseType{
-					ID:           saml.NewID(),
-					IssueInstant: now,
-					InResponseTo: resolveEnv.Body.ArtifactResolve.ID,
+					ID:           i.IDs.NewID(),
+					IssueInstant: i.Clock.Now().UTC(),
+					InResponseTo: inResponseTo,
 					Version:      "2.0",
-					Issuer:       saml.NewIssuer(i.entityID),
+					Issuer:       i.samlIssuer(),
 					Status: &saml.Status{
 						StatusCode: saml.StatusCode{
-							Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
+							Value: status,
 						},
 					},
 				},
-				Response: *response,
+				Response: response,
 			},
 		},
 	}
+}
 
-	signature, err := i.signer.CreateSignature(response.Assertion)
-	// TODO confirm appropriate error response for this service
-	if err != nil {
-		i.Error(w, err.Error(), http.StatusInternalServerError)
+// writeArtifactResponse sends the envelope. The assertion must already be signed, since the signature is
+// computed over the assertion as it's encoded here. It's encoded before anything is written so a failure can
+// still be reported with a SOAP fault.
+func (i *IDP) writeArtifactResponse(w http.ResponseWriter, env saml.ArtifactResponseEnvelope) {
+	id := env.Body.ArtifactResponse.ID
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err := xml.NewEncoder(&b).Encode(env); err != nil {
+		log.Errorf("unable to encode ArtifactResponse %s: %s", id, err)
+		sendSOAPFault(i, w, "SOAP-ENV:Server", "unable to encode ArtifactResponse")
 		return
 	}
-	response.Assertion.Signature = signature
-	// TODO handle these errors. Probably can't do anything besides log, as we've already started to write the
-	// response.
-	_, err = w.Write([]byte(xml.Header))
-	encoder := xml.NewEncoder(w)
-	err = encoder.Encode(artResponseEnv)
-	err = encoder.Flush()
+	w.Header().Set("Content-Type", "text/xml")
+	if _, err := w.Write(b.Bytes()); err != nil {
+		// Nothing can be sent once writing has failed
+		log.Errorf("unable to send ArtifactResponse %s: %s", id, err)
+	}
 }
 
 func (i *IDP) sendArtifactResponse(authRequest *model.AuthnRequest, user *model.User,
@@ -107,7 +159,7 @@ func (i *IDP) sendArtifactResponse(authRequest *model.AuthnRequest, user *model.
 		i.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 	parameters := url.Values{}
-	artifact := getArtifact(i.entityID)
+	artifact := getArtifact(i.entityID, i.IDs.NewHandle())
 	// Store required data in the cache
 	response := &model.ArtifactResponse{
 		User:    user,
@@ -117,12 +169,20 @@ func (i *IDP) sendArtifactResponse(authRequest *model.AuthnRequest, user *model.
 	if err != nil {
 		i.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	i.TempCache.Set(artifact, data)
+	i.TempCache.Set(artifactKey(artifact), data)
 	parameters.Add("SAMLart", artifact)
-	parameters.Add("RelayState", authRequest.RelayState)
+	if authRequest.RelayState != "" {
+		parameters.Add("RelayState", authRequest.RelayState)
+	}
 	target.RawQuery = parameters.Encode()
 	// Don't send temporary redirect. We don't want the post resent
 	http.Redirect(w, r, target.String(), http.StatusFound)
 
 	return nil
 }
+
+// artifactKey is where the response to the artifact is kept in the TempCache. Authorization codes share the cache,
+// so artifacts are kept under their own prefix and a code can't resolve an artifact or the reverse.
+func artifactKey(artifact string) string {
+	return "artifact:" + artifact
+}
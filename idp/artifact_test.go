@@ -15,46 +15,257 @@
 package idp
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
-	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/sign"
 	"github.com/golang/protobuf/proto"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestIDP_sendArtifactResponse(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i)
+	i.sendArtifactResponse(&model.AuthnRequest{}, &model.User{}, httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+}
+
+const artifactBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"
+
+// cacheTestArtifact stores artifact 123456, which answers an AuthnRequest from the issuer
+func cacheTestArtifact(t *testing.T, i *IDP, request *model.AuthnRequest, user *model.User) {
+	data, err := proto.Marshal(&model.ArtifactResponse{Request: request, User: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.TempCache.Set(artifactKey("123456"), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// resolveTestArtifact sends the ArtifactResolve envelope with the client and returns the ArtifactResponse
+func resolveTestArtifact(t *testing.T, sp *testSP, client *http.Client, body []byte) *saml.ArtifactResponse {
+	_, env, err := sp.postArtifactResolve(client, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &env.Body.ArtifactResponse
+}
+
 func TestIDP_DefaultArtifactResolveHandler(t *testing.T) {
+	i := &IDP{}
+	sp := newTestSP(t, "https://sp.example.com", artifactBinding)
+	startTestIDP(t, i, sp)
+	cacheTestArtifact(t, i, &model.AuthnRequest{Issuer: sp.entityID}, &model.User{})
+	_, env, err := sp.resolveArtifact("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", env.Body.ArtifactResponse.Status.StatusCode.Value)
+}
+
+func TestIDP_DefaultArtifactResolveHandler_authentication(t *testing.T) {
+	i := &IDP{}
+	sp := newTestSP(t, "https://sp.example.com", artifactBinding)
+	other := newTestSP(t, "https://other.example.com", artifactBinding)
+	ts := startTestIDP(t, i, sp, other)
+	unsigned := sp.artifactResolve("123456", nil)
+	forged, err := ioutil.ReadFile(filepath.Join("testdata", "artifact-resolve-request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		client  *http.Client
+		body    []byte
+		success bool
+	}{
+		{"client certificate", sp.client(), unsigned, true},
+		{"signature", ts.Client(), sp.artifactResolve("123456", sp.signer), true},
+		{"unauthenticated", ts.Client(), unsigned, false},
+		{"another service provider's certificate", other.client(), unsigned, false},
+		{"another service provider's signature", ts.Client(), sp.artifactResolve("123456", other.signer), false},
+		{"unregistered issuer", ts.Client(), forged, false},
+	} {
+		cacheTestArtifact(t, i, &model.AuthnRequest{Issuer: sp.entityID}, &model.User{})
+		resp := resolveTestArtifact(t, sp, test.client, test.body)
+		if test.success {
+			assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", resp.Status.StatusCode.Value, test.name)
+			assert.NotNil(t, resp.Response, test.name)
+			continue
+		}
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Requester", resp.Status.StatusCode.Value, test.name)
+		assert.Nil(t, resp.Response, test.name)
+		// The artifact isn't consumed by requests that don't authenticate
+		_, err = i.TempCache.Get(artifactKey("123456"))
+		assert.NoError(t, err, test.name)
+	}
+}
+
+func TestIDP_DefaultArtifactResolveHandler_replay(t *testing.T) {
+	i := &IDP{}
+	sp := newTestSP(t, "https://sp.example.com", artifactBinding)
+	startTestIDP(t, i, sp)
+	cacheTestArtifact(t, i, &model.AuthnRequest{ID: "_authn", Issuer: sp.entityID}, &model.User{})
+	first := resolveTestArtifact(t, sp, sp.client(), sp.artifactResolve("123456", sp.signer))
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", first.Status.StatusCode.Value)
+	if assert.NotNil(t, first.Response, "expected a response on first resolution") {
+		assert.Equal(t, "_authn", first.Response.InResponseTo, "response should answer the AuthnRequest")
+	}
+	second := resolveTestArtifact(t, sp, sp.client(), sp.artifactResolve("123456", sp.signer))
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Requester", second.Status.StatusCode.Value)
+	assert.Nil(t, second.Response, "artifact should only resolve once")
+}
+
+func TestIDP_DefaultArtifactResolveHandler_otherServiceProvider(t *testing.T) {
+	i := &IDP{}
+	sp := newTestSP(t, "https://sp.example.com", artifactBinding)
+	other := newTestSP(t, "https://other.example.com", artifactBinding)
+	startTestIDP(t, i, sp, other)
+	cacheTestArtifact(t, i, &model.AuthnRequest{Issuer: other.entityID}, &model.User{})
+	resp := resolveTestArtifact(t, sp, sp.client(), sp.artifactResolve("123456", sp.signer))
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Requester", resp.Status.StatusCode.Value)
+	assert.Nil(t, resp.Response, "artifact issued to another service provider should not resolve")
+}
+
+func TestIDP_DefaultArtifactResolveHandler_fault(t *testing.T) {
 	i := &IDP{}
 	i.ArtifactResolveHandler = i.processArtifactResolutionRequest
 	ts := getTestIDP(t, i)
 	defer ts.Close()
-	in, err := os.Open(filepath.Join("testdata", "artifact-resolve-request.xml"))
+	resp, err := ts.Client().Post(ts.URL+viper.GetString("artifact-service-path"), "text/xml", strings.NewReader("<Envelope"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Need to cache user before attempting an artifact resolve
-	req := &model.ArtifactResponse{
-		Request: &model.AuthnRequest{},
-		User:    &model.User{},
-	}
-	data, err := proto.Marshal(req)
+	defer resp.Body.Close()
+	assert.Equal(t, 500, resp.StatusCode, "SOAP faults are sent with status 500")
+	assert.Equal(t, "text/xml", resp.Header.Get("Content-Type"))
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		t.Fatal(err)
 	}
-	i.TempCache.Set("123456", data)
-	resp, err := ts.Client().Post(ts.URL+viper.GetString("artifact-service-path"), "text/xml", in)
+	assert.Contains(t, string(data), `<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/"><SOAP-ENV:Body><SOAP-ENV:Fault><faultcode>SOAP-ENV:Client</faultcode>`)
+	env := &saml.SOAPFaultEnvelope{}
+	if err = xml.Unmarshal(data, env); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "SOAP-ENV:Client", env.Body.Fault.Code)
+	assert.Contains(t, env.Body.Fault.String, "unable to parse ArtifactResolve")
+}
+
+func TestIDP_DefaultArtifactResolveHandler_responder(t *testing.T) {
+	i := &IDP{}
+	sp := newTestSP(t, "https://sp.example.com", artifactBinding)
+	startTestIDP(t, i, sp)
+	// The response can't be signed for the service provider
+	registered, _ := i.getSP(sp.entityID)
+	unsignable := *registered
+	unsignable.DigestAlgorithm = "http://www.w3.org/2001/04/xmlenc#sha512"
+	i.sps[sp.entityID] = &unsignable
+	cacheTestArtifact(t, i, &model.AuthnRequest{Issuer: sp.entityID}, &model.User{})
+	resp := resolveTestArtifact(t, sp, sp.client(), sp.artifactResolve("123456", sp.signer))
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Responder", resp.Status.StatusCode.Value)
+	assert.Nil(t, resp.Response)
+}
+
+func TestIDP_DefaultArtifactResolveHandler_signed(t *testing.T) {
+	i := &IDP{}
+	sp := newTestSP(t, "https://sp.example.com", artifactBinding)
+	startTestIDP(t, i, sp)
+	cacheTestArtifact(t, i, &model.AuthnRequest{ID: "_authn", Issuer: sp.entityID}, &model.User{Name: "joe"})
+	body, env, err := sp.resolveArtifact("123456")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer resp.Body.Close()
-	assert.Equal(t, 200, resp.StatusCode, "failed to resolve artifact")
+	response := env.Body.ArtifactResponse.Response
+	if !assert.NotNil(t, response) || !assert.NotNil(t, response.Assertion.Signature, "assertion should be signed") {
+		return
+	}
+	signed, err := sign.NewValidator().Validate(string(body))
+	if assert.NoError(t, err, "emitted assertion should verify") {
+		if assert.Len(t, signed, 1) {
+			assert.Contains(t, signed[0], `ID="`+response.Assertion.ID+`"`)
+		}
+	}
+	// The signature covers the assertion as it was emitted
+	tampered := strings.Replace(string(body), ">joe</NameID>", ">eve</NameID>", 1)
+	assert.NotEqual(t, string(body), tampered)
+	_, err = sign.NewValidator().Validate(tampered)
+	assert.Error(t, err, "altered assertion should not verify")
 }
 
-func TestIDP_sendArtifactResponse(t *testing.T) {
+func TestIDP_DefaultArtifactResolveHandler_compressed(t *testing.T) {
 	i := &IDP{}
-	getTestIDP(t, i)
-	i.sendArtifactResponse(&model.AuthnRequest{}, &model.User{}, httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+	sp := newTestSP(t, "https://sp.example.com", artifactBinding)
+	startTestIDP(t, i, sp)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(sp.artifactResolve("123456", sp.signer)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resolve := func() *http.Response {
+		req, err := http.NewRequest(http.MethodPost, sp.idpServer.URL+viper.GetString("artifact-service-path"),
+			bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/xml")
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := sp.client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	cacheTestArtifact(t, i, &model.AuthnRequest{Issuer: sp.entityID}, &model.User{})
+	resp := resolve()
+	defer resp.Body.Close()
+	env := &saml.ArtifactResponseEnvelope{}
+	if err := xml.NewDecoder(resp.Body).Decode(env); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", env.Body.ArtifactResponse.Status.StatusCode.Value)
+
+	// The limit applies to the decompressed body
+	setConfig(t, "max-soap-body-size", compressed.Len())
+	resp = resolve()
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode, "the request should be too large")
+}
+
+func Test_inflate(t *testing.T) {
+	for name, newWriter := range map[string]func(io.Writer) io.WriteCloser{
+		"zlib": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"raw": func(w io.Writer) io.WriteCloser {
+			writer, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return writer
+		},
+	} {
+		var compressed bytes.Buffer
+		writer := newWriter(&compressed)
+		writer.Write([]byte("<Envelope/>"))
+		writer.Close()
+		reader, err := inflate(&compressed)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		data, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "<Envelope/>", string(data), name)
+	}
 }
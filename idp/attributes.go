@@ -15,13 +15,48 @@
 package idp
 
 import (
+	"context"
+	"errors"
+
 	"github.com/chriskery/sso-idp/model"
-	"github.com/spf13/viper"
+	"github.com/chriskery/sso-idp/settings"
 )
 
 // AttributeSource allows implementations to retrieve user attributes from any upstream source such as a database, LDAP, or Web service.
+// Implementations should abandon upstream calls when the context is done.
 type AttributeSource interface {
-	AddAttributes(*model.User, *model.AuthnRequest) error
+	AddAttributes(context.Context, *model.User, *model.AuthnRequest) error
+}
+
+// ErrUnknownSubject can be returned by an AttributeSource that doesn't know the user, such as the subject of an
+// attribute query. Attribute queries are answered with the UnknownPrincipal status.
+var ErrUnknownSubject = errors.New("unknown subject")
+
+// RequiredSource can be implemented by an AttributeSource to report whether its failures abort the login.
+// Sources that don't implement it are required.
+type RequiredSource interface {
+	Required() bool
+}
+
+type optionalSource struct {
+	AttributeSource
+}
+
+func (optionalSource) Required() bool {
+	return false
+}
+
+// OptionalAttributeSource wraps a source, such as a slow HR database, whose errors are logged and skipped so
+// the login succeeds with the attributes gathered from the other sources
+func OptionalAttributeSource(source AttributeSource) AttributeSource {
+	return optionalSource{source}
+}
+
+func required(source AttributeSource) bool {
+	if r, ok := source.(RequiredSource); ok {
+		return r.Required()
+	}
+	return true
 }
 
 type simpleSource struct {
@@ -34,7 +69,7 @@ type UserAttributes struct {
 	Attributes map[string][]string
 }
 
-func (ss *simpleSource) AddAttributes(user *model.User, _ *model.AuthnRequest) error {
+func (ss *simpleSource) AddAttributes(_ context.Context, user *model.User, _ *model.AuthnRequest) error {
 	if atts, ok := ss.users[user.Name]; ok {
 		user.AppendAttributes(atts)
 	}
@@ -44,7 +79,7 @@ func (ss *simpleSource) AddAttributes(user *model.User, _ *model.AuthnRequest) e
 // DefaultAttributeSource provides a default SAML attribute source that reads user information from the users key in the viper configuration
 func DefaultAttributeSource() (AttributeSource, error) {
 	userAttributes := []UserAttributes{}
-	err := viper.UnmarshalKey("users", &userAttributes)
+	err := settings.UnmarshalKey("users", &userAttributes)
 	if err != nil {
 		return nil, err
 	}
@@ -60,3 +95,36 @@ func DefaultAttributeSource() (AttributeSource, error) {
 	}
 	return &simpleSource{users}, nil
 }
+
+// AttributeTemplate computes the value of the named attribute from a Go text/template
+type AttributeTemplate struct {
+	Name     string
+	Template string
+}
+
+// transformerSource runs AttributeTransformers in order as an AttributeSource
+type transformerSource []AttributeTransformer
+
+// TemplateAttributeSource computes attributes from templates evaluated against the attributes added by the sources
+// that ran before it, so it should be last in AttributeSources. Each template is run by a template transformer, see
+// TemplateTransformer. Templates run in order, so later templates can use the results of earlier ones.
+func TemplateAttributeSource(templates []AttributeTemplate) (AttributeSource, error) {
+	source := make(transformerSource, 0, len(templates))
+	for _, t := range templates {
+		transformer, err := TransformerConfig{Type: "template", To: t.Name, Template: t.Template}.transformer()
+		if err != nil {
+			return nil, err
+		}
+		source = append(source, transformer)
+	}
+	return source, nil
+}
+
+func (ts transformerSource) AddAttributes(_ context.Context, user *model.User, req *model.AuthnRequest) error {
+	for _, transform := range ts {
+		if err := transform(user, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
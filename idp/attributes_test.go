@@ -15,6 +15,8 @@
 package idp
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -40,8 +42,93 @@ func TestNewAttributeSource(t *testing.T) {
 		t.Fatal(err)
 	}
 	user := &model.User{Name: "john"}
-	if err = attSrc.AddAttributes(user, nil); err != nil {
+	if err = attSrc.AddAttributes(context.Background(), user, nil); err != nil {
 		t.Fatal(err)
 	}
 	assert.Equal(t, 3, len(user.Attributes), "expected 3 attributes")
 }
+
+func TestTemplateAttributeSource(t *testing.T) {
+	source, err := TemplateAttributeSource([]AttributeTemplate{
+		{Name: "displayName", Template: "{{first .Attributes.givenName}} {{first .Attributes.sn}}"},
+		{Name: "eppn", Template: "{{first .Attributes.uid}}@example.org"},
+		{Name: "greeting", Template: "Hello {{first .Attributes.displayName}} from {{.Issuer}}"},
+		{Name: "nickname", Template: "{{first .Attributes.nickname}}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "givenName", Value: []string{"Joe"}},
+		{Name: "sn", Value: []string{"Smith"}},
+		{Name: "uid", Value: []string{"jsmith"}},
+	}}
+	if err = source.AddAttributes(context.Background(), user, &model.AuthnRequest{Issuer: "https://sp.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string][]string)
+	for _, att := range user.Attributes {
+		values[att.Name] = att.Value
+	}
+	assert.Equal(t, []string{"Joe Smith"}, values["displayName"])
+	assert.Equal(t, []string{"jsmith@example.org"}, values["eppn"])
+	assert.Equal(t, []string{"Hello Joe Smith from https://sp.example.org"}, values["greeting"])
+	assert.NotContains(t, values, "nickname", "empty results shouldn't be released")
+}
+
+func TestTemplateAttributeSource_errors(t *testing.T) {
+	_, err := TemplateAttributeSource([]AttributeTemplate{{Name: "bad", Template: "{{first .Attributes.uid"}})
+	assert.Error(t, err, "should reject templates that don't parse")
+	_, err = TemplateAttributeSource([]AttributeTemplate{{Template: "{{.Name}}"}})
+	assert.Error(t, err, "should require a name")
+	source, err := TemplateAttributeSource([]AttributeTemplate{{Name: "bad", Template: "{{.Name.first}}"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = source.AddAttributes(context.Background(), &model.User{Name: "joe"}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to compute attribute bad")
+	}
+}
+
+type failingSource struct{}
+
+func (failingSource) AddAttributes(context.Context, *model.User, *model.AuthnRequest) error {
+	return errors.New("database unavailable")
+}
+
+type staticSource []*model.Attribute
+
+func (s staticSource) AddAttributes(_ context.Context, user *model.User, _ *model.AuthnRequest) error {
+	user.AppendAttributes(s)
+	return nil
+}
+
+func TestIDP_setUserAttributes_optionalSource(t *testing.T) {
+	mail := staticSource{{Name: "mail", Value: []string{"joe@example.org"}}}
+	i := &IDP{AttributeSources: []AttributeSource{OptionalAttributeSource(failingSource{}), mail}}
+	user := &model.User{Name: "joe"}
+	if err := i.setUserAttributes(context.Background(), user, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, user.Attributes, 1, "attributes from the other sources should be kept")
+
+	i.AttributeSources = []AttributeSource{failingSource{}, mail}
+	assert.EqualError(t, i.setUserAttributes(context.Background(), &model.User{Name: "joe"}, nil), "database unavailable",
+		"sources are required by default")
+}
+
+type slowSource struct{}
+
+func (slowSource) AddAttributes(ctx context.Context, _ *model.User, _ *model.AuthnRequest) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestIDP_setUserAttributes_timeout(t *testing.T) {
+	viper.Set("attribute-source-timeout", "10ms")
+	defer viper.Set("attribute-source-timeout", "10s")
+	i := &IDP{AttributeSources: []AttributeSource{slowSource{}}}
+	err := i.setUserAttributes(context.Background(), &model.User{Name: "joe"}, nil)
+	assert.Equal(t, context.DeadlineExceeded, err, "hung sources should be abandoned")
+}
@@ -14,17 +14,80 @@ const (
 	PasswordLogin
 )
 
-// Auditor is responsible for capturing login events
+func (t LoginType) String() string {
+	switch t {
+	case CertificateLogin:
+		return "certificate"
+	case PasswordLogin:
+		return "password"
+	default:
+		return "unknown"
+	}
+}
+
+// LoginEvent describes a successful login. The assertion and session IDs correlate the audit record with the
+// service provider's logs and with the user's later activity at the IDP.
+type LoginEvent struct {
+	User    *model.User
+	Request *model.AuthnRequest
+	Type    LoginType
+	// ID of the assertion answering the request, empty for OpenID Connect
+	AssertionID string
+	SessionID   string
+}
+
+// LogoutInitiator identifies who ended a session
+type LogoutInitiator int
+
+const (
+	// ServiceProviderLogout is single logout requested by a service provider
+	ServiceProviderLogout LogoutInitiator = iota
+)
+
+func (i LogoutInitiator) String() string {
+	switch i {
+	case ServiceProviderLogout:
+		return "sp"
+	default:
+		return "unknown"
+	}
+}
+
+// LogoutEvent describes the end of a user's session
+type LogoutEvent struct {
+	User      *model.User
+	SessionID string
+	Initiator LogoutInitiator
+	// Entity ID of the service provider that requested a single logout
+	ServiceProvider string
+}
+
+// Auditor is responsible for capturing login and logout events
 type Auditor interface {
-	LogSuccess(*model.User, *model.AuthnRequest, LoginType)
+	LogSuccess(LoginEvent)
+	LogLogout(LogoutEvent)
+}
+
+// ServiceProviderAuditor can be implemented by an Auditor to record authentication requests rejected because
+// the service provider is unregistered or disabled
+type ServiceProviderAuditor interface {
+	LogRejectedServiceProvider(issuer string, reason error)
+}
+
+// AccessAuditor can be implemented by an Auditor to record logins denied by the AccessPolicy of a service provider
+type AccessAuditor interface {
+	LogAccessDenied(user *model.User, request *model.AuthnRequest, reason error)
 }
 
 type auditor struct{}
 
-func (a *auditor) LogSuccess(*model.User, *model.AuthnRequest, LoginType) {
+func (a *auditor) LogSuccess(LoginEvent) {
 	// Default audit doesn't do anything
 }
 
+func (a *auditor) LogLogout(LogoutEvent) {
+}
+
 // DefaultAuditor returns a do nothing Auditor implementation
 func DefaultAuditor() Auditor {
 	return &auditor{}
@@ -0,0 +1,61 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"time"
+
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/google/uuid"
+)
+
+// IDGenerator creates the identifiers the IDP hands out. Tests can provide one returning known values.
+type IDGenerator interface {
+	// NewID returns a unique ID for a SAML message or assertion, which must not start with a digit
+	NewID() string
+	// NewHandle returns an unguessable value referring to saved state, such as an artifact or login request
+	NewHandle() string
+}
+
+// Clock tells the IDP the current time
+type Clock interface {
+	Now() time.Time
+}
+
+type randomIDGenerator struct{}
+
+func (randomIDGenerator) NewID() string {
+	return saml.NewID()
+}
+
+func (randomIDGenerator) NewHandle() string {
+	return uuid.New().String()
+}
+
+// DefaultIDGenerator returns an IDGenerator creating random UUID based values
+func DefaultIDGenerator() IDGenerator {
+	return randomIDGenerator{}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock returns a Clock reading the system time
+func SystemClock() Clock {
+	return systemClock{}
+}
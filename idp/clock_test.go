@@ -0,0 +1,75 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// sequentialIDs numbers the IDs and handles it generates
+type sequentialIDs struct {
+	ids, handles int
+}
+
+func (s *sequentialIDs) NewID() string {
+	s.ids++
+	return fmt.Sprintf("_id%d", s.ids)
+}
+
+func (s *sequentialIDs) NewHandle() string {
+	s.handles++
+	return fmt.Sprintf("handle%d", s.handles)
+}
+
+// fixedClock is a Clock that only moves when the test says so
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	return c.now
+}
+
+func TestIDP_makeAuthnResponse_injectedIDsAndClock(t *testing.T) {
+	now := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+	i := &IDP{Clock: &fixedClock{now}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	// Start counting after the metadata was generated
+	i.IDs = &sequentialIDs{}
+
+	resp, err := i.makeAuthnResponse(&model.AuthnRequest{ID: "_request", Issuer: "sp"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "_id1", resp.ID)
+	assert.Equal(t, "_id2", resp.Assertion.ID)
+	assert.Equal(t, "_id3", resp.Assertion.AuthnStatement.SessionIndex)
+	assert.Equal(t, now, resp.IssueInstant)
+	assert.Equal(t, now, resp.Assertion.IssueInstant)
+	assert.Equal(t, now, resp.Assertion.AuthnStatement.AuthnInstant)
+	assert.Equal(t, now.Add(5*time.Minute), resp.Assertion.Conditions.NotOnOrAfter)
+	assert.Equal(t, now.Add(5*time.Minute),
+		resp.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter)
+
+	assert.Equal(t, getArtifact(i.entityID, "handle1"), getArtifact(i.entityID, "handle1"),
+		"artifacts should only depend on the entity ID and handle")
+	assert.NotEqual(t, getArtifact(i.entityID, "handle1"), getArtifact(i.entityID, "handle2"))
+}
@@ -0,0 +1,83 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/chriskery/sso-idp/settings"
+)
+
+// reloadParameter marks requests that were already reloaded from the IDP's own site
+const reloadParameter = "first-party"
+
+// Reloads the request from the IDP's site so the browser sends a session cookie it withheld from the cross-site request
+var reloadTemplate = template.Must(template.New("reload").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta http-equiv="refresh" content="0;url={{ . }}"></head>
+<body><p><a href="{{ . }}">Continue</a></p></body>
+</html>`))
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("unsupported cookie-same-site %s", value)
+	}
+}
+
+// sessionCookie returns the cookie identifying the user's session. SameSite=None is required for browsers to
+// send it with cross-site requests such as POST binding messages. It's always Secure, which None requires.
+func (i *IDP) sessionCookie(session string) *http.Cookie {
+	return &http.Cookie{
+		Name:     i.cookieName,
+		Path:     "/",
+		Value:    session,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: i.cookieSameSite,
+	}
+}
+
+// reloadFirstParty answers a cross-site GET without a session cookie with a page that reloads it from the IDP's
+// own site. Browsers that block third-party cookies send the cookie with the reload, so an existing session is
+// found rather than asking the user to log in again. It reports whether the request was reloaded.
+func (i *IDP) reloadFirstParty(w http.ResponseWriter, r *http.Request) bool {
+	if !settings.GetBool("first-party-session-reload") || r.Method != http.MethodGet ||
+		r.Header.Get("Sec-Fetch-Site") != "cross-site" || r.URL.Query().Get(reloadParameter) != "" {
+		return false
+	}
+	if _, err := r.Cookie(i.cookieName); err == nil {
+		return false
+	}
+	target := r.URL.RequestURI() + "&" + reloadParameter + "=1"
+	if r.URL.RawQuery == "" {
+		target = r.URL.RequestURI() + "?" + reloadParameter + "=1"
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = reloadTemplate.Execute(w, target)
+	return true
+}
@@ -0,0 +1,175 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/amdonov/xmlsig"
+	"github.com/beevik/etree"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+// DebugReport describes a decoded SAML message and how the IDP would treat it
+type DebugReport struct {
+	// Name of the message, such as AuthnRequest or LogoutRequest
+	Message string `json:"message"`
+	// redirect when the message was DEFLATE compressed, otherwise post
+	Binding string `json:"binding"`
+	XML     string `json:"xml"`
+	Issuer  string `json:"issuer,omitempty"`
+	// Whether the issuer is a registered service provider
+	IssuerKnown bool `json:"issuerKnown"`
+	// Status of the signature on the message itself: valid, absent, or the reason it was rejected
+	Signature string `json:"signature"`
+	// Location the response to an AuthnRequest would be sent to
+	AssertionConsumerService string   `json:"assertionConsumerService,omitempty"`
+	Errors                   []string `json:"errors,omitempty"`
+}
+
+// debugMessage holds the parts of any SAML message used by the debug report
+type debugMessage struct {
+	XMLName   xml.Name
+	Issuer    string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature *xmlsig.Signature
+}
+
+// DefaultDebugHandler decodes the SAMLRequest or SAMLResponse parameter, encoded for either the redirect or
+// POST binding, and reports on it without performing a login. Redirect binding signatures are checked when
+// the message is sent in the query string along with SigAlg and Signature. It's only routed when debug-endpoint
+// is set and requires HTTP Basic credentials for one of the debug-users.
+func (i *IDP) DefaultDebugHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !i.authorizeUsers(r, "debug-users") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="debug"`)
+			i.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			i.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parameter := "SAMLRequest"
+		if r.Form.Get(parameter) == "" {
+			parameter = "SAMLResponse"
+		}
+		report, err := i.debugReport(r, parameter)
+		if err != nil {
+			i.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(report)
+	}
+}
+
+// authorizeUsers checks the request's HTTP Basic credentials belong to one of the users listed in the setting
+func (i *IDP) authorizeUsers(r *http.Request, key string) bool {
+	userName, password, ok := r.BasicAuth()
+	if !ok || !contains(settings.GetStringSlice(key), userName) {
+		return false
+	}
+	ctx, cancel := withTimeout(r.Context(), "password-validation-timeout")
+	defer cancel()
+	if _, err := i.passwordValidator().Validate(ctx, userName, password); err != nil {
+		log.Infof("access for %s in %s denied: %s", userName, key, err)
+		return false
+	}
+	return true
+}
+
+func (i *IDP) debugReport(r *http.Request, parameter string) (*DebugReport, error) {
+	encoded := r.Form.Get(parameter)
+	if encoded == "" {
+		return nil, errors.New("SAMLRequest or SAMLResponse is required")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	report := &DebugReport{Binding: "post"}
+	message, err := inflateMessage(data)
+	if errors.Is(err, errMessageTooLarge) {
+		return nil, fmt.Errorf("%s %w", parameter, err)
+	}
+	if err == nil {
+		report.Binding = "redirect"
+		data = message
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, err
+	}
+	doc.Indent(2)
+	if report.XML, err = doc.WriteToString(); err != nil {
+		return nil, err
+	}
+	msg := &debugMessage{}
+	if err := xml.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	report.Message = msg.XMLName.Local
+	report.Issuer = strings.TrimSpace(msg.Issuer)
+	sp, ok := i.getSP(report.Issuer)
+	report.IssuerKnown = ok
+	if !ok {
+		report.Errors = append(report.Errors, "issuer is not a registered service provider")
+	}
+
+	report.Signature = "absent"
+	switch {
+	case r.URL.Query().Get("Signature") != "":
+		if !ok {
+			report.Signature = "unable to verify the signature of an unknown issuer"
+		} else if err := verifySignature(r.URL.RawQuery, r.URL.Query().Get("SigAlg"),
+			r.URL.Query().Get("Signature"), sp, i.Clock.Now()); err != nil {
+			report.Signature = err.Error()
+		} else {
+			report.Signature = "valid"
+		}
+	case msg.Signature != nil:
+		if _, err := i.SignatureValidator.Validate(string(data)); err != nil {
+			report.Signature = err.Error()
+		} else if !ok {
+			report.Signature = "unable to verify the signing key of an unknown issuer"
+		} else if err := sp.verifySigningKey(msg.Signature, i.Clock.Now()); err != nil {
+			report.Signature = err.Error()
+		} else {
+			report.Signature = "valid"
+		}
+	}
+
+	if report.Message == "AuthnRequest" && ok {
+		request := &saml.AuthnRequest{}
+		if err := xml.Unmarshal(data, request); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		} else if acs, err := sp.assertionConsumerService(request); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		} else {
+			report.AssertionConsumerService = acs.Location
+		}
+	}
+	return report, nil
+}
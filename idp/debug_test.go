@@ -0,0 +1,111 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_DefaultDebugHandler(t *testing.T) {
+	viper.Set("debug-endpoint", true)
+	viper.Set("debug-users", []string{"admin"})
+	defer viper.Set("debug-endpoint", false)
+	defer viper.Set("debug-users", []string{})
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{PasswordValidator: &stubValidator{}}
+	ts := startTestIDP(t, i, sp)
+	debugURL := ts.URL + viper.GetString("debug-service-path")
+
+	report := func(req *http.Request, user string) (*DebugReport, int) {
+		req.SetBasicAuth(user, "password")
+		resp, err := sp.client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, resp.StatusCode
+		}
+		report := &DebugReport{}
+		if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+			t.Fatal(err)
+		}
+		return report, resp.StatusCode
+	}
+
+	// Copy the SP's signed redirect binding query
+	target, err := url.Parse(sp.authnRequestURL("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, debugURL+"?"+target.RawQuery, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, status := report(req, "joe")
+	assert.Equal(t, http.StatusUnauthorized, status, "only debug users may decode messages")
+
+	req, err = http.NewRequest(http.MethodGet, debugURL+"?"+target.RawQuery, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirect, _ := report(req, "admin")
+	if assert.NotNil(t, redirect) {
+		assert.Equal(t, "AuthnRequest", redirect.Message)
+		assert.Equal(t, "redirect", redirect.Binding)
+		assert.Equal(t, sp.entityID, redirect.Issuer)
+		assert.True(t, redirect.IssuerKnown)
+		assert.Equal(t, "valid", redirect.Signature)
+		assert.Equal(t, sp.acs.URL+"/acs", redirect.AssertionConsumerService)
+		assert.Contains(t, redirect.XML, "\n  <Issuer")
+		assert.Empty(t, redirect.Errors)
+	}
+
+	// Messages that inflate past the limit aren't decoded
+	setConfig(t, "max-redirect-message-size", 10)
+	req, err = http.NewRequest(http.MethodGet, debugURL+"?"+target.RawQuery, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, status = report(req, "admin")
+	assert.Equal(t, http.StatusBadRequest, status)
+	setConfig(t, "max-redirect-message-size", 1048576)
+
+	// Signed POST binding logout request from an unregistered service provider
+	other := newTestSP(t, "https://other.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	other.idp, other.idpServer = i, ts
+	_, request := other.logoutRequest("joe", other.signer)
+	req, err = http.NewRequest(http.MethodPost, debugURL,
+		strings.NewReader(url.Values{"SAMLRequest": {request}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	post, _ := report(req, "admin")
+	if assert.NotNil(t, post) {
+		assert.Equal(t, "LogoutRequest", post.Message)
+		assert.Equal(t, "post", post.Binding)
+		assert.False(t, post.IssuerKnown)
+		assert.Equal(t, "unable to verify the signing key of an unknown issuer", post.Signature)
+		assert.Equal(t, []string{"issuer is not a registered service provider"}, post.Errors)
+	}
+}
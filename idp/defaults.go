@@ -21,22 +21,98 @@ import (
 
 func init() {
 	viper.SetDefault("cookie-name", "idp-sess")
+	viper.SetDefault("cookie-same-site", "")
+	viper.SetDefault("first-party-session-reload", false)
 	viper.SetDefault("tls-certificate", "")
 	viper.SetDefault("tls-private-key", "")
 	viper.SetDefault("tls-ca", "")
 	viper.SetDefault("listen-address", "127.0.0.1:9443")
 	viper.SetDefault("server-name", "localhost:9443")
+	viper.SetDefault("external-url", "")
+	viper.SetDefault("base-path", "")
 	viper.SetDefault("metadata-path", buildCompleteUrl("metadata"))
 	viper.SetDefault("sso-service-path", buildCompleteUrl("SAML2/Redirect/SSO"))
 	viper.SetDefault("slo-service-path", buildCompleteUrl("SAML2/Redirect/SLO"))
 	viper.SetDefault("ecp-service-path", buildCompleteUrl("SAML2/SOAP/ECP"))
 	viper.SetDefault("artifact-service-path", buildCompleteUrl("SAML2/SOAP/ArtifactResolution"))
 	viper.SetDefault("attribute-service-path", buildCompleteUrl("SAML2/SOAP/AttributeQuery"))
+	viper.SetDefault("debug-service-path", buildCompleteUrl("debug"))
+	viper.SetDefault("readiness-path", buildCompleteUrl("ready"))
+	viper.SetDefault("debug-endpoint", false)
+	viper.SetDefault("sp-list-path", buildCompleteUrl("sps"))
+	viper.SetDefault("sp-list-endpoint", false)
+	viper.SetDefault("admin-users", []string{})
+	viper.SetDefault("oidc-enabled", false)
+	viper.SetDefault("oidc-authorize-path", buildCompleteUrl("oidc/authorize"))
+	viper.SetDefault("oidc-token-path", buildCompleteUrl("oidc/token"))
+	viper.SetDefault("jwks-path", buildCompleteUrl("jwks.json"))
+	viper.SetDefault("jwks-endpoint", false)
+	viper.SetDefault("previous-signing-certificates", []string{})
+	viper.SetDefault("oidc-clients", []OIDCClient{})
+	viper.SetDefault("debug-users", []string{})
 	viper.SetDefault("temp-cache-duration", "5m")
 	viper.SetDefault("user-cache-duration", "8h")
+	viper.SetDefault("temp-cache-max-entries", 0)
+	viper.SetDefault("user-cache-max-entries", 0)
+	viper.SetDefault("persistent-nameid-failure-policy", "fail")
+	viper.SetDefault("max-attribute-values", 0)
+	viper.SetDefault("max-assertion-size", 0)
+	viper.SetDefault("assertion-limit-policy", "truncate")
+	viper.SetDefault("nameid-attribute", "")
+	viper.SetDefault("nameid-format", "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified")
+	viper.SetDefault("validator", "ldap")
+	viper.SetDefault("allow-static-passwords", false)
+	viper.SetDefault("password-validation-timeout", "10s")
+	viper.SetDefault("max-concurrent-logins", 0)
+	viper.SetDefault("max-soap-body-size", 1048576)
+	viper.SetDefault("max-redirect-message-size", 1048576)
+	viper.SetDefault("soap-actions", []string{})
+	viper.SetDefault("password-change-enabled", false)
+	viper.SetDefault("login-cancel-enabled", false)
+	viper.SetDefault("login-cancel-status", "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed")
+	viper.SetDefault("attribute-source-timeout", "10s")
+	viper.SetDefault("assertion-lifetime", "5m")
+	viper.SetDefault("assertion-not-before-skew", "1m")
+	viper.SetDefault("subject-confirmation-lifetime", "5m")
+	viper.SetDefault("max-authentication-age", "0s")
+	viper.SetDefault("logout-request-lifetime", "2m")
+	viper.SetDefault("tracing-endpoint", "")
+	viper.SetDefault("tracing-service-name", "sso-idp")
 	viper.SetDefault("signature-algorithm", "")
 	viper.SetDefault("digest-algorithm", "http://www.w3.org/2001/04/xmlenc#sha256")
+	viper.SetDefault("signing-backend", "file")
+	viper.SetDefault("signing-certificate", "")
+	viper.SetDefault("pkcs11.module", "")
+	viper.SetDefault("pkcs11.slot", 0)
+	viper.SetDefault("pkcs11.pin", "")
+	viper.SetDefault("pkcs11.key-label", "")
 	viper.SetDefault("saml-attribute-name-format", "urn:oasis:names:tc:SAML:2.0:attrname-format:basic")
+	viper.SetDefault("attribute-types", map[string]string{})
+	viper.SetDefault("attribute-scopes", map[string]string{})
+	viper.SetDefault("attribute-transformers", []TransformerConfig{})
+	viper.SetDefault("attribute-templates", []AttributeTemplate{})
+	viper.SetDefault("attribute-release-rules", []ReleaseRule{})
+	viper.SetDefault("access-denied-status", "urn:oasis:names:tc:SAML:2.0:status:RequestDenied")
+	viper.SetDefault("include-authenticating-authority", false)
+	viper.SetDefault("subject-confirmation-address", true)
+	viper.SetDefault("issuer-format", "urn:oasis:names:tc:SAML:2.0:nameid-format:entity")
+	viper.SetDefault("subject-locality-address", true)
+	viper.SetDefault("subject-locality-dns-name", true)
+	viper.SetDefault("trusted-proxies", []string{})
+	viper.SetDefault("authn-context-class-refs.password", "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport")
+	viper.SetDefault("authn-context-class-refs.certificate", "urn:oasis:names:tc:SAML:2.0:ac:classes:X509")
+	viper.SetDefault("allow-uncompressed-redirect", false)
+	viper.SetDefault("landing-url", "")
+	viper.SetDefault("require-signed-authn-requests", true)
+	viper.SetDefault("reject-expired-sp-certificates", true)
+	viper.SetDefault("sp-trust-anchors", "")
+	viper.SetDefault("sp-metadata-timeout", "30s")
+	viper.SetDefault("sp-metadata-retry-interval", "1m")
+	viper.SetDefault("certificate-expiry-warning", "720h")
+	viper.SetDefault("certificate-check-interval", "24h")
+	viper.SetDefault("sp-metadata-required", -1)
+	viper.SetDefault("persist-sp-metadata", true)
+	viper.SetDefault("sp-store", "config")
 }
 
 func buildCompleteUrl(subPath string) string {
@@ -15,31 +15,54 @@
 package idp
 
 import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
 
+	"github.com/amdonov/xmlsig"
 	"github.com/chriskery/sso-idp/model"
 	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
+// DefaultECPHandler is the default implementation for ECP requests. Clients authenticate with a client certificate
+// or, if they don't present one, HTTP Basic credentials.
 func (i *IDP) DefaultECPHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// We require transport authentication rather than message authentication
-		tlsCert, err := getCertFromRequest(r)
-		if tlsCert == nil || err != nil {
-			i.Error(w, "403 Forbidden", http.StatusForbidden)
+		if tlsCert, err := getCertFromRequest(r); err == nil {
+			log.Infof("received ecp request from %s", getSubjectDN(tlsCert.Subject))
+		} else if userName, _, ok := r.BasicAuth(); ok {
+			log.Infof("received ecp request from %s", userName)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ecp"`)
+			i.Error(w, "401 Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		log.Infof("received ecp request from %s", getSubjectDN(tlsCert.Subject))
 
 		request, user, err := i.processECPRequest(w, r)
-		if err != nil {
-			sendSOAPFault(i, w, "SOAP-ENV:Client", err.Error())
+		switch err {
+		case nil:
+		case ErrInvalidPassword:
+			w.Header().Set("WWW-Authenticate", `Basic realm="ecp"`)
+			i.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		case ErrBackendUnavailable, ErrBackendBusy:
+			i.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		default:
+			sendSOAPFault(i, w, faultCode(err), err.Error())
 			return
 		}
 
@@ -50,6 +73,7 @@ func (i *IDP) DefaultECPHandler() http.HandlerFunc {
 	}
 }
 
+// sendSOAPFault answers a SOAP request with a fault. SOAP 1.1 requires faults to be sent with status 500.
 func sendSOAPFault(i *IDP, w http.ResponseWriter, code, fault string) {
 	envelope := saml.SOAPFaultEnvelope{
 		Body: saml.SOAPFaultBody{
@@ -61,20 +85,197 @@ func sendSOAPFault(i *IDP, w http.ResponseWriter, code, fault string) {
 	}
 
 	var b strings.Builder
+	b.WriteString(xml.Header)
 	encoder := xml.NewEncoder(&b)
-	_ = encoder.Encode(envelope)
-	_ = encoder.Flush()
+	if err := encoder.Encode(envelope); err != nil {
+		i.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusInternalServerError)
+	_, _ = io.WriteString(w, b.String())
+}
+
+// soapRequestBody returns the body of a SOAP request, decompressed when the client sent it with a gzip or deflate
+// Content-Encoding. Reading more than max-soap-body-size bytes of the decompressed body fails, so a small
+// compressed request can't expand without bound.
+func soapRequestBody(w http.ResponseWriter, r *http.Request) (io.Reader, error) {
+	body := r.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gzip body: %v", err)
+		}
+		body = reader
+	case "deflate":
+		reader, err := inflate(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read deflate body: %v", err)
+		}
+		body = reader
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %s", encoding)
+	}
+	if limit := viper.GetInt64("max-soap-body-size"); limit > 0 {
+		return http.MaxBytesReader(w, body, limit), nil
+	}
+	return body, nil
+}
+
+// inflate reads a deflate Content-Encoding, which should be zlib wrapped but is sent as raw deflate by some clients
+func inflate(body io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(body)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// A zlib header declares the deflate method and is a multiple of 31
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// ecpHeaders are the SOAP header entries an ECP client may send along with its AuthnRequest
+var ecpHeaders = []xml.Name{
+	{Space: "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp", Local: "Request"},
+	{Space: "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp", Local: "RelayState"},
+	{Space: "urn:liberty:paos:2003-08", Local: "Request"},
+}
+
+// soapNextActor is the actor of SOAP header entries meant for the first recipient of the message
+const soapNextActor = "http://schemas.xmlsoap.org/soap/actor/next"
+
+// soapFault is a problem with a SOAP request, answered with a fault carrying the code
+type soapFault struct {
+	code    string
+	message string
+}
+
+func (f *soapFault) Error() string {
+	return f.message
+}
+
+// faultCode returns the code of a soapFault, or SOAP-ENV:Client for other errors
+func faultCode(err error) string {
+	if fault, ok := err.(*soapFault); ok {
+		return fault.code
+	}
+	return "SOAP-ENV:Client"
+}
+
+// soapRequestHeader holds the header entries of a SOAP request, whatever its body
+type soapRequestHeader struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Header  struct {
+		Entries []struct {
+			XMLName        xml.Name
+			Actor          string `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr"`
+			MustUnderstand string `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+		} `xml:",any"`
+	} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Header"`
+}
+
+// readSOAPRequest reads the body of a SOAP request. When soap-actions is set, the SOAPAction header must be one of
+// them. Header entries meant for the IDP with mustUnderstand set must be among the understood ones, otherwise the
+// request is rejected with a MustUnderstand fault rather than processed as if they weren't there. Errors are
+// *soapFault.
+func readSOAPRequest(w http.ResponseWriter, r *http.Request, understood ...xml.Name) ([]byte, error) {
+	if actions := settings.GetStringSlice("soap-actions"); len(actions) > 0 {
+		if action := strings.Trim(r.Header.Get("SOAPAction"), `"`); !contains(actions, action) {
+			return nil, &soapFault{"SOAP-ENV:Client", fmt.Sprintf("unsupported SOAPAction %q", action)}
+		}
+	}
+	body, err := soapRequestBody(w, r)
+	if err != nil {
+		return nil, &soapFault{"SOAP-ENV:Client", err.Error()}
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, &soapFault{"SOAP-ENV:Client", fmt.Sprintf("unable to read request: %v", err)}
+	}
+	var envelope soapRequestHeader
+	if err = xml.Unmarshal(data, &envelope); err != nil {
+		// Left for the caller to report when it parses the body
+		return data, nil
+	}
+	for _, entry := range envelope.Header.Entries {
+		if entry.Actor != "" && entry.Actor != soapNextActor {
+			continue
+		}
+		if entry.MustUnderstand != "1" && entry.MustUnderstand != "true" {
+			continue
+		}
+		if !containsName(understood, entry.XMLName) {
+			return nil, &soapFault{"SOAP-ENV:MustUnderstand",
+				fmt.Sprintf("header %s %s is not understood", entry.XMLName.Space, entry.XMLName.Local)}
+		}
+	}
+	return data, nil
+}
+
+// authenticateSOAPRequest returns the registered service provider that issued a request sent with the SOAP binding.
+// It must have presented the client certificate it's registered with or signed the request with its key. For signed
+// requests, what was signed is returned so the request is read from it rather than from the rest of the envelope.
+func (i *IDP) authenticateSOAPRequest(r *http.Request, body []byte, request saml.RequestAbstractType,
+	signature *xmlsig.Signature) (*ServiceProvider, []byte, error) {
+	if request.Issuer == "" {
+		return nil, nil, errors.New("request does not contain an issuer")
+	}
+	sp, err := i.serviceProvider(request.Issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := i.Clock.Now()
+	if err = sp.verifyClientCert(r, now); err == nil {
+		return sp, nil, nil
+	}
+	if signature == nil {
+		return nil, nil, errors.New("request must be signed or sent with the service provider's client certificate")
+	}
+	_, span := startSpan(r.Context(), "verify signature", sp.EntityID)
+	signed, err := func() ([]byte, error) {
+		referenced, err := i.SignatureValidator.Validate(string(body))
+		if err != nil {
+			return nil, err
+		}
+		var signedRequest saml.RequestAbstractType
+		if err = xml.Unmarshal([]byte(referenced[0]), &signedRequest); err != nil {
+			return nil, err
+		}
+		if signedRequest.ID == "" || signedRequest.ID != request.ID {
+			return nil, errors.New("signature does not reference the request")
+		}
+		if signedRequest.Issuer != sp.EntityID {
+			return nil, errors.New("signed request is from another issuer")
+		}
+		return []byte(referenced[0]), sp.verifySigningKey(signature, now)
+	}()
+	endSpan(span, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sp, signed, nil
+}
 
-	i.Error(w, b.String(), http.StatusInternalServerError)
+func containsName(names []xml.Name, name xml.Name) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (i *IDP) processECPRequest(w http.ResponseWriter, r *http.Request) (*model.AuthnRequest, *model.User, error) {
-	xml, err := ioutil.ReadAll(r.Body)
+	xml, err := readSOAPRequest(w, r, ecpHeaders...)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	authnReq, err := i.validateECPRequest(string(xml))
+	authnReq, err := i.validateECPRequest(r.Context(), string(xml))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -84,31 +285,36 @@ func (i *IDP) processECPRequest(w http.ResponseWriter, r *http.Request) (*model.
 		return nil, nil, err
 	}
 
+	// Prefer the client certificate, falling back to HTTP Basic
 	user, err := i.loginWithCert(r, request)
+	if user == nil && err == nil {
+		user, err = i.loginWithBasicAuth(r, request)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
+	if user == nil {
+		return nil, nil, ErrInvalidPassword
+	}
 
 	return request, user, nil
 }
 
 func (i *IDP) sendECPResponse(request *model.AuthnRequest, user *model.User, w io.Writer, r *http.Request) error {
-	response := i.makeAuthnResponse(request, user)
-	signature, err := i.signer.CreateSignature(response.Assertion)
+	response, err := i.buildSignedResponse(requestContext(r), request, user)
 	if err != nil {
 		return err
 	}
-	response.Assertion.Signature = signature
 
 	envelope := saml.ECPResponseEnvelope{
 		Header: saml.ECPResponseHeader{
 			ECPResponse: saml.ECPResponse{
-				Actor:                       "http://schemas.xmlsoap.org/soap/actor/next",
+				Actor:                       soapNextActor,
 				MustUnderstand:              1,
 				AssertionConsumerServiceURL: request.AssertionConsumerServiceURL,
 			},
 			ECPRequestAuthenticated: saml.ECPRequestAuthenticated{
-				Actor: "http://schemas.xmlsoap.org/soap/actor/next",
+				Actor: soapNextActor,
 			},
 		},
 		Body: saml.ECPResponseBody{
@@ -127,10 +333,13 @@ func (i *IDP) sendECPResponse(request *model.AuthnRequest, user *model.User, w i
 	return nil
 }
 
-func (i *IDP) validateECPRequest(body string) (*saml.AuthnRequest, error) {
+func (i *IDP) validateECPRequest(ctx context.Context, body string) (*saml.AuthnRequest, error) {
 	// TODO verify channel bindings
 
-	referenced, err := i.validator.Validate(body)
+	// The issuer is only read from what was signed
+	_, span := startSpan(ctx, "verify signature", "")
+	referenced, err := i.SignatureValidator.Validate(body)
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -146,9 +355,9 @@ func (i *IDP) validateECPRequest(body string) (*saml.AuthnRequest, error) {
 		return nil, errors.New("request does not contain an issuer")
 	}
 
-	sp, ok := i.sps[authnReq.Issuer]
-	if !ok {
-		return nil, errors.New("request from unregistered issuer")
+	sp, err := i.serviceProvider(authnReq.Issuer)
+	if err != nil {
+		return nil, err
 	}
 
 	// Determine the right assertion consumer service
@@ -17,8 +17,12 @@ package idp
 import (
 	"bytes"
 	"encoding/xml"
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/amdonov/xmlsig"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/chriskery/sso-idp/model"
@@ -45,3 +49,80 @@ func Test_sendECPResponse(t *testing.T) {
 
 	assert.Equal(t, "testsvc", e.Header.ECPResponse.AssertionConsumerServiceURL, "assertion consumer service url doesn't match")
 }
+
+// signedAuthnRequest is an AuthnRequest including the enveloped signature required by the ECP profile
+type signedAuthnRequest struct {
+	saml.AuthnRequest
+	Signature *xmlsig.Signature
+}
+
+func (sp *testSP) ecpRequest() []byte {
+	request := &signedAuthnRequest{AuthnRequest: saml.AuthnRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now().UTC(),
+			Issuer:       sp.entityID,
+		},
+		AssertionConsumerServiceURL: sp.acs.URL + "/acs",
+		ProtocolBinding:             sp.binding,
+	}}
+	signature, err := sp.signer.CreateSignature(request)
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	request.Signature = signature
+	data, err := xml.Marshal(request)
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	return data
+}
+
+func TestIDP_DefaultECPHandler_authentication(t *testing.T) {
+	sp := newTestSP(t, "https://ecp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:PAOS")
+	validator := &stubValidator{}
+	i := &IDP{PasswordValidator: validator}
+	ts := startTestIDP(t, i, sp)
+	tests := []struct {
+		name     string
+		client   *http.Client
+		basic    bool
+		err      error
+		status   int
+		authnCtx string
+	}{
+		{"no credentials", ts.Client(), false, nil, http.StatusUnauthorized, ""},
+		{"basic", ts.Client(), true, nil, http.StatusOK,
+			"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"},
+		{"invalid basic", ts.Client(), true, ErrInvalidPassword, http.StatusUnauthorized, ""},
+		{"certificate preferred", sp.client(), true, ErrInvalidPassword, http.StatusOK,
+			"urn:oasis:names:tc:SAML:2.0:ac:classes:X509"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator.err = tt.err
+			req, err := http.NewRequest(http.MethodPost, ts.URL+viper.GetString("ecp-service-path"),
+				bytes.NewReader(sp.ecpRequest()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.basic {
+				req.SetBasicAuth("joe", "password")
+			}
+			resp, err := tt.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if !assert.Equal(t, tt.status, resp.StatusCode) || tt.status != http.StatusOK {
+				return
+			}
+			var e saml.ECPResponseEnvelope
+			if err := xml.NewDecoder(resp.Body).Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.authnCtx, e.Body.Response.Assertion.AuthnStatement.AuthnContext.AuthnContextClassRef)
+		})
+	}
+}
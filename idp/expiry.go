@@ -0,0 +1,97 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/chriskery/sso-idp/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+// WatchCertificateExpiry logs a warning every interval about the certificates returned by expiringCertificates, so
+// they can be replaced before logins break. The checks run in the background until the IDP is closed. Call it once
+// Handler has configured the IDP. An interval that isn't positive turns the checks off.
+func (i *IDP) WatchCertificateExpiry(interval time.Duration) {
+	if interval <= 0 || i.done == nil {
+		return
+	}
+	go i.watchCertificateExpiry(interval, i.done)
+}
+
+// watchCertificateExpiry warns about the expiring certificates every interval until done is closed
+func (i *IDP) watchCertificateExpiry(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, warning := range i.expiringCertificates() {
+			log.Warn(warning)
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expiringCertificates describes the registered service providers' certificates, and the IDP's own signing and TLS
+// certificates, that expire within certificate-expiry-warning or already have
+func (i *IDP) expiringCertificates() []string {
+	now := i.Clock.Now()
+	var warnings []string
+	for _, summary := range i.spSummaries() {
+		if summary.CertificateExpiresSoon {
+			warnings = append(warnings, expiryWarning("certificate of "+summary.EntityID, *summary.CertificateNotAfter, now))
+		}
+	}
+	own := map[string][]byte{"signing certificate": i.signingCertificate}
+	if i.TLSConfig != nil && len(i.TLSConfig.Certificates) > 0 && len(i.TLSConfig.Certificates[0].Certificate) > 0 {
+		own["TLS certificate"] = i.TLSConfig.Certificates[0].Certificate[0]
+	}
+	for _, name := range []string{"signing certificate", "TLS certificate"} {
+		if len(own[name]) == 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(own[name])
+		if err != nil {
+			continue
+		}
+		if expiresSoon(cert, now) {
+			warnings = append(warnings, expiryWarning("IDP "+name, cert.NotAfter, now))
+		}
+	}
+	return warnings
+}
+
+// expiresSoon reports whether the certificate expires within certificate-expiry-warning
+func expiresSoon(cert *x509.Certificate, now time.Time) bool {
+	warning := settings.GetDuration("certificate-expiry-warning")
+	return warning > 0 && cert.NotAfter.Before(now.Add(warning))
+}
+
+func expiryWarning(name string, notAfter, now time.Time) string {
+	if notAfter.Before(now) {
+		return fmt.Sprintf("%s expired on %s", name, notAfter.Format(time.RFC3339))
+	}
+	// Hours until the last one, which is rounded up to the minute so it doesn't read as 0s
+	remaining := notAfter.Sub(now).Truncate(time.Hour)
+	if remaining == 0 {
+		remaining = (notAfter.Sub(now) + time.Minute - 1).Truncate(time.Minute)
+	}
+	return fmt.Sprintf("%s expires on %s, in %s", name, notAfter.Format(time.RFC3339), remaining)
+}
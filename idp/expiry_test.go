@@ -0,0 +1,81 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_expiringCertificates(t *testing.T) {
+	setConfig(t, "certificate-expiry-warning", "720h")
+	now := time.Now()
+	expiring, _ := newTestCertificate(t, now.Add(-time.Hour), now.Add(240*time.Hour+30*time.Minute), nil, nil)
+	expired, _ := newTestCertificate(t, now.Add(-48*time.Hour), now.Add(-time.Hour), nil, nil)
+	valid, _ := newTestCertificate(t, now.Add(-time.Hour), now.Add(365*24*time.Hour), nil, nil)
+	i := &IDP{
+		Clock: &fixedClock{now},
+		sps: map[string]*ServiceProvider{
+			"https://expiring.example.com": {EntityID: "https://expiring.example.com", certificate: expiring},
+			"https://valid.example.com":    {EntityID: "https://valid.example.com", certificate: valid},
+		},
+		signingCertificate: expired.Raw,
+	}
+	warnings := i.expiringCertificates()
+	if assert.Len(t, warnings, 2) {
+		assert.Contains(t, warnings[0], "certificate of https://expiring.example.com expires on")
+		assert.Contains(t, warnings[0], "in 240h0m0s")
+		assert.Contains(t, warnings[1], "IDP signing certificate expired on")
+	}
+	summaries := i.spSummaries()
+	if assert.Len(t, summaries, 2) {
+		assert.True(t, summaries[0].CertificateExpiresSoon)
+		assert.False(t, summaries[1].CertificateExpiresSoon)
+	}
+
+	setConfig(t, "certificate-expiry-warning", "0s")
+	assert.Empty(t, i.expiringCertificates(), "0 should turn the warnings off")
+}
+
+func Test_expiryWarning(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, "certificate expires on "+now.Add(90*time.Minute).Format(time.RFC3339)+", in 1h0m0s",
+		expiryWarning("certificate", now.Add(90*time.Minute), now))
+	assert.Contains(t, expiryWarning("certificate", now.Add(29*time.Minute+time.Second), now), "in 30m0s",
+		"the last hour should be counted in minutes")
+	assert.Contains(t, expiryWarning("certificate", now.Add(time.Second), now), "in 1m0s")
+	assert.Contains(t, expiryWarning("certificate", now.Add(-time.Second), now), "expired on")
+}
+
+func TestIDP_WatchCertificateExpiry(t *testing.T) {
+	setConfig(t, "certificate-expiry-warning", "720h")
+	i := &IDP{}
+	getTestIDP(t, i)
+	stopped := make(chan struct{})
+	go func() {
+		i.watchCertificateExpiry(time.Millisecond, i.done)
+		close(stopped)
+	}()
+	// Let it check a few times
+	time.Sleep(10 * time.Millisecond)
+	i.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the certificate expiry checks didn't stop when the IDP was closed")
+	}
+}
@@ -16,23 +16,29 @@ package idp
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"github.com/amdonov/xmlsig"
 	"github.com/chriskery/sso-idp/model"
 	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
 	"github.com/chriskery/sso-idp/sign"
 	"github.com/chriskery/sso-idp/store"
 	"github.com/chriskery/sso-idp/ui"
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"html/template"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
-	"text/template"
+	"time"
 )
 
 // IDP is the main data structure for the IDP. Public members can be used to alter behavior. Otherwise defaults are fine.
@@ -44,26 +50,84 @@ type IDP struct {
 	// Short term cache for saving state during authentication
 	TempCache store.Cache
 	// Longer term cache of authenticated users
-	UserCache              store.Cache
-	TLSConfig              *tls.Config
-	PasswordValidator      PasswordValidator
-	AttributeSources       []AttributeSource
+	UserCache store.Cache
+	// Users' logins, defaults to a store saving them in the UserCache
+	Sessions SessionStore
+	// Persistent NameIDs for service providers with the persistent NameIDFormat. Without one they're
+	// handled according to persistent-nameid-failure-policy.
+	NameIDs NameIDStore
+	// Saves the registered service providers, defaults to the store selected by the sp-store setting
+	ServiceProviders  SPStore
+	TLSConfig         *tls.Config
+	PasswordValidator PasswordValidator
+	AttributeSources  []AttributeSource
+	// Run in order after the AttributeSources. Defaults to the transformers in the attribute-transformers setting.
+	AttributeTransformers  []AttributeTransformer
 	MetadataHandler        http.HandlerFunc
 	ArtifactResolveHandler http.HandlerFunc
 	RedirectSSOHandler     http.HandlerFunc
+	PostSSOHandler         http.HandlerFunc
 	RedirectSLOHandler     http.HandlerFunc
+	PostSLOHandler         http.HandlerFunc
+	DebugHandler           http.HandlerFunc
+	SPListHandler          http.HandlerFunc
+	OIDCDiscoveryHandler   http.HandlerFunc
+	OIDCAuthorizeHandler   http.HandlerFunc
+	OIDCTokenHandler       http.HandlerFunc
+	JWKSHandler            http.HandlerFunc
 	ECPHandler             http.HandlerFunc
 	PasswordLoginHandler   http.HandlerFunc
+	PasswordChangeHandler  http.HandlerFunc
+	CancelLoginHandler     http.HandlerFunc
 	QueryHandler           http.HandlerFunc
+	ReadinessHandler       http.HandlerFunc
 	Error                  func(w http.ResponseWriter, error string, code int)
 	UIHandler              http.Handler
 	Auditor                Auditor
-	handler                http.Handler
-	signer                 sign.Signer
-	validator              sign.Validator
+	// Generates message IDs and the handles of saved state. Defaults to random UUIDs.
+	IDs IDGenerator
+	// Supplies the time for timestamps and expiry checks. Defaults to the system clock.
+	Clock Clock
+	// Signs assertions and other outbound messages. Defaults to an xmlsig signer using the TLS certificate.
+	Signer sign.Signer
+	// Validates signed inbound messages
+	SignatureValidator sign.Validator
+	handler            http.Handler
+	// closed by Close to stop the background work started by Handler
+	done      chan struct{}
+	closeOnce sync.Once
+	// creates signers for service providers requiring non-default algorithms, nil when Signer was provided
+	newSigner   func(options sign.Options) (sign.Signer, error)
+	signers     map[signingAlgorithms]sign.Signer
+	signersLock sync.Mutex
+	// guards sps, which can change while running when service providers are registered
+	spsLock sync.RWMutex
+	// entity IDs of registered service providers the ServiceProviders store doesn't hold, such as ones read from
+	// metadata that isn't persisted, which Reload keeps
+	unsavedSPs map[string]bool
+	// guards the PasswordValidator, AttributeSources, AttributeTransformers and releaseRules, which Reload replaces
+	configLock sync.RWMutex
+	// whether they were created from the configuration, rather than provided by the application, so Reload
+	// recreates them
+	configuredValidator    bool
+	configuredSources      bool
+	configuredTransformers bool
+	// metadata of the sp-medata-urls loaded so far and how much is needed to be ready, updated atomically
+	spMetadataCount    int32
+	spMetadataRequired int32
+	// keeps concurrent copies of a request from both being accepted
+	replayLock sync.Mutex
+	// limits the concurrent PasswordValidator and AttributeSource calls, nil when max-concurrent-logins is 0
+	backendCalls chan struct{}
+	// algorithms that can be negotiated with service providers, in order of preference
+	signatureAlgorithms []string
+	digestAlgorithms    []string
 
 	// properties set or derived from configuration settings
 	cookieName                        string
+	cookieSameSite                    http.SameSite
+	basePath                          string
+	baseURL                           string
 	serverName                        string
 	entityID                          string
 	artifactResolutionServiceLocation string
@@ -72,19 +136,43 @@ type IDP struct {
 	singleLogoutServiceLocation       string
 	ecpServiceLocation                string
 	postTemplate                      *template.Template
+	signingCertificate                []byte
 	sps                               map[string]*ServiceProvider
+	releaseRules                      []*ReleaseRule
+	oidcClients                       map[string]*OIDCClient
+	tokenSigner                       *jwtSigner
+	jwks                              JWKSet
+	trustedProxies                    []*net.IPNet
 	EnableTLS                         bool
 }
 
+// Close stops the background work started by Handler and WatchCertificateExpiry, such as the retries of
+// sp-medata-urls that failed to load and the certificate expiry checks. Call it once the server has shut down.
+func (i *IDP) Close() error {
+	i.closeOnce.Do(func() {
+		if i.done != nil {
+			close(i.done)
+		}
+	})
+	return nil
+}
+
 // Handler returns the IDP's http.Handler including all sub routes or an error
 func (i *IDP) Handler() (http.Handler, error) {
 	if i.handler == nil {
+		i.done = make(chan struct{})
 		if i.Error == nil {
 			i.Error = http.Error
 		}
 		if i.Auditor == nil {
 			i.Auditor = DefaultAuditor()
 		}
+		if i.IDs == nil {
+			i.IDs = DefaultIDGenerator()
+		}
+		if i.Clock == nil {
+			i.Clock = SystemClock()
+		}
 		if err := i.configureConstants(); err != nil {
 			return nil, err
 		}
@@ -94,19 +182,34 @@ func (i *IDP) Handler() (http.Handler, error) {
 		if err := i.configureCrypto(); err != nil {
 			return nil, err
 		}
+		if err := i.configureJWKS(); err != nil {
+			return nil, err
+		}
 		if err := i.configureStores(); err != nil {
 			return nil, err
 		}
 		if err := i.configureValidator(); err != nil {
 			return nil, err
 		}
+		if err := i.configureAttributeSources(); err != nil {
+			return nil, err
+		}
+		if err := i.configureAttributeTransformers(); err != nil {
+			return nil, err
+		}
+		if err := i.configureReleaseRules(); err != nil {
+			return nil, err
+		}
+		if err := i.configureOIDC(); err != nil {
+			return nil, err
+		}
 		if err := i.configureHandler(); err != nil {
 			return nil, err
 		}
 		if err := i.buildRoutes(); err != nil {
 			return nil, err
 		}
-		i.handler = i.Router
+		i.handler = traceHandler(i.Router)
 	}
 	return i.handler, nil
 }
@@ -117,84 +220,268 @@ func (i *IDP) configureConstants() error {
 		return err
 	}
 	i.postTemplate = pt
-	i.cookieName = viper.GetString("cookie-name")
-	serverName := viper.GetString("server-name")
-	i.entityID = viper.GetString("entity-id")
+	i.cookieName = settings.GetString("cookie-name")
+	if limit := settings.GetInt("max-concurrent-logins"); limit > 0 {
+		i.backendCalls = make(chan struct{}, limit)
+	}
+	if i.cookieSameSite, err = parseSameSite(settings.GetString("cookie-same-site")); err != nil {
+		return err
+	}
+	serverName := settings.GetString("server-name")
+	i.entityID = settings.GetString("entity-id")
 	schema := "http"
-	if viper.GetBool("tls_enable") {
+	if settings.GetBool("tls_enable") {
 		schema = "https"
 	}
+	i.basePath = strings.TrimSuffix(settings.GetString("base-path"), "/")
+	if i.basePath != "" && !strings.HasPrefix(i.basePath, "/") {
+		return fmt.Errorf("base-path must start with /: %s", i.basePath)
+	}
+	// external-url is the address clients use to reach the IDP, which differs from the local scheme
+	// when TLS is terminated by a proxy
+	i.baseURL = fmt.Sprintf("%s://%s", schema, serverName)
+	if externalURL := settings.GetString("external-url"); externalURL != "" {
+		u, err := url.Parse(externalURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("external-url must be an absolute URL: %s", externalURL)
+		}
+		i.baseURL = strings.TrimSuffix(externalURL, "/")
+		if i.entityID == "" {
+			i.entityID = i.baseURL + "/"
+		}
+	}
 	if i.entityID == "" {
 		i.entityID = fmt.Sprintf("%s://%s/", schema, serverName)
 	}
 	i.serverName = serverName
-	i.artifactResolutionServiceLocation = fmt.Sprintf("%s%s", serverName, viper.GetString("artifact-service-path"))
-	i.attributeServiceLocation = fmt.Sprintf("%s%s", serverName, viper.GetString("attribute-service-path"))
-	i.singleSignOnServiceLocation = fmt.Sprintf("%s%s", serverName, viper.GetString("sso-service-path"))
-	i.singleLogoutServiceLocation = fmt.Sprintf("%s%s", serverName, viper.GetString("slo-service-path"))
-	i.ecpServiceLocation = fmt.Sprintf("%s%s", serverName, viper.GetString("ecp-service-path"))
-	return nil
+	i.artifactResolutionServiceLocation = fmt.Sprintf("%s%s", i.baseURL, i.path("artifact-service-path"))
+	i.attributeServiceLocation = fmt.Sprintf("%s%s", i.baseURL, i.path("attribute-service-path"))
+	i.singleSignOnServiceLocation = fmt.Sprintf("%s%s", i.baseURL, i.path("sso-service-path"))
+	i.singleLogoutServiceLocation = fmt.Sprintf("%s%s", i.baseURL, i.path("slo-service-path"))
+	i.ecpServiceLocation = fmt.Sprintf("%s%s", i.baseURL, i.path("ecp-service-path"))
+	trustedProxies, err := parseCIDRs(settings.GetStringSlice("trusted-proxies"))
+	if err != nil {
+		return err
+	}
+	i.trustedProxies = trustedProxies
+	if err = checkNameIDPolicy(settings.GetString("persistent-nameid-failure-policy")); err != nil {
+		return err
+	}
+	return checkAssertionPolicy(settings.GetString("assertion-limit-policy"))
+}
+
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %v", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
 }
 
 func (i *IDP) configureSPs() error {
-	if err := initSPs(); err != nil {
+	if i.ServiceProviders == nil {
+		spStore, err := NewSPStore()
+		if err != nil {
+			return err
+		}
+		i.ServiceProviders = spStore
+	}
+	fetched, failed, err := initSPs()
+	if err != nil {
 		return err
 	}
-	var sps []*ServiceProvider
-	if err := viper.UnmarshalKey("sps", &sps); err != nil {
+	i.configureReadiness(len(fetched), len(fetched)+len(failed))
+	if len(failed) > 0 {
+		go i.retrySPMetadata(failed, settings.GetDuration("sp-metadata-retry-interval"), i.done)
+	}
+	// The fetched metadata is only saved when persist-sp-metadata is set
+	saved := false
+	if len(fetched) > 0 && settings.GetBool("persist-sp-metadata") {
+		if err := i.ServiceProviders.Save(fetched...); err != nil {
+			log.Errorf("unable to save sp metadata: %s", err)
+		} else {
+			saved = true
+		}
+	}
+	unsaved := make(map[string]bool)
+	if !saved {
+		for _, sp := range fetched {
+			unsaved[sp.EntityID] = true
+		}
+	}
+	sps, err := i.ServiceProviders.List()
+	if err != nil {
+		return err
+	}
+	sps = mergeServiceProviders(sps, fetched)
+	anchors, err := spTrustAnchors(settings.Current())
+	if err != nil {
 		return err
 	}
-	i.sps = make(map[string]*ServiceProvider, len(sps))
+	registered := make(map[string]*ServiceProvider, len(sps))
 	for j, sp := range sps {
-		if err := sp.parseCertificate(); err != nil {
+		if err := sp.validate(i.Clock.Now(), anchors); err != nil {
+			return err
+		}
+		if err := i.checkSignerAlgorithms(sp); err != nil {
 			return err
 		}
-		i.sps[sp.EntityID] = sps[j]
+		if err := i.checkSignerMethods(sp); err != nil {
+			log.Warn(err)
+		}
+		registered[sp.EntityID] = sps[j]
 	}
+	i.spsLock.Lock()
+	i.sps = registered
+	i.unsavedSPs = unsaved
+	i.spsLock.Unlock()
+	return nil
+}
+
+// getSP returns the registered service provider with the entity ID
+func (i *IDP) getSP(entityID string) (*ServiceProvider, bool) {
+	i.spsLock.RLock()
+	defer i.spsLock.RUnlock()
+	sp, ok := i.sps[entityID]
+	return sp, ok
+}
 
+// RegisterServiceProvider adds the service provider, or replaces the one with the same entity ID, while the IDP is
+// running. It's also saved to the ServiceProviders store when persist is true. Otherwise, it's only registered until
+// the IDP is restarted.
+func (i *IDP) RegisterServiceProvider(sp *ServiceProvider, persist bool) error {
+	anchors, err := spTrustAnchors(settings.Current())
+	if err != nil {
+		return err
+	}
+	if err = sp.validate(i.Clock.Now(), anchors); err != nil {
+		return err
+	}
+	if err = i.checkSignerAlgorithms(sp); err != nil {
+		return err
+	}
+	if err = i.checkSignerMethods(sp); err != nil {
+		log.Warn(err)
+	}
+	i.spsLock.Lock()
+	if i.sps == nil {
+		i.sps = make(map[string]*ServiceProvider)
+	}
+	if i.unsavedSPs == nil {
+		i.unsavedSPs = make(map[string]bool)
+	}
+	i.sps[sp.EntityID] = sp
+	if persist {
+		delete(i.unsavedSPs, sp.EntityID)
+	} else {
+		i.unsavedSPs[sp.EntityID] = true
+	}
+	i.spsLock.Unlock()
+	log.Infof("registered service provider %s", sp.EntityID)
+	if persist {
+		return i.ServiceProviders.Save(sp)
+	}
 	return nil
 }
 
-func initSPs() error {
-	var spMetadataUrls []*SPMetadataUrl
-	if err := viper.UnmarshalKey("sp-medata-urls", &spMetadataUrls); err != nil {
+// RegisterSPMetadata registers the service provider described by the metadata, such as refreshed metadata, keeping
+// the settings that aren't part of the metadata when it's already registered
+func (i *IDP) RegisterSPMetadata(metadata io.Reader, persist bool) error {
+	sp, err := ReadSPMetadata(metadata)
+	if err != nil {
 		return err
 	}
+	if existing, ok := i.getSP(sp.EntityID); ok {
+		sp.copySettings(existing)
+	}
+	return i.RegisterServiceProvider(sp, persist)
+}
+
+// initSPs fetches the metadata of the service providers listed in sp-medata-urls. Service providers whose
+// metadata couldn't be fetched are left out and their URLs returned.
+func initSPs() ([]*ServiceProvider, []string, error) {
+	var spMetadataUrls []*SPMetadataUrl
+	if err := settings.UnmarshalKey("sp-medata-urls", &spMetadataUrls); err != nil {
+		return nil, nil, err
+	}
+	urls := make([]string, len(spMetadataUrls))
+	for j, spMetadataUrl := range spMetadataUrls {
+		urls[j] = spMetadataUrl.Url
+	}
+	var sps []*ServiceProvider
+	var failed []string
+	for j, sp := range fetchSPs(urls) {
+		if sp == nil {
+			failed = append(failed, urls[j])
+			continue
+		}
+		sps = append(sps, sp)
+	}
+	return sps, failed, nil
+}
+
+// fetchSPs fetches the metadata at the URLs concurrently. The service providers are returned in the same order,
+// nil where the metadata couldn't be fetched.
+func fetchSPs(urls []string) []*ServiceProvider {
+	// Every fetch is bounded by the sp-metadata-timeout so a metadata server that's down can't hold up startup
+	fetched := make([]*ServiceProvider, len(urls))
 	waitGroup := sync.WaitGroup{}
-	var lock sync.Mutex
-	httpClient := http.DefaultClient
-	for _, spMetadataUrl := range spMetadataUrls {
-		log.Infof("begin to fetch sp %s", spMetadataUrl.Url)
+	for j, url := range urls {
+		log.Infof("begin to fetch sp %s", url)
 		waitGroup.Add(1)
-		go func(url string) {
+		go func(j int, url string) {
 			defer waitGroup.Done()
-			// Serve 256 bytes every second.
-			req, err := http.NewRequest("GET", url, nil)
+			sp, err := FetchSPMetadata(context.Background(), url)
 			if err != nil {
-				log.Error(err)
+				log.Errorf("fail to fetch sp %s: %s", url, err)
 				return
 			}
-			resp, err := httpClient.Do(req)
-			if err != nil {
-				log.Error(err)
-				return
+			fetched[j] = sp
+			log.Infof("success read sp %s metadata", url)
+		}(j, url)
+	}
+	// Collect the results once every fetch is done rather than letting them race to update the configuration
+	waitGroup.Wait()
+	return fetched
+}
+
+// retrySPMetadata fetches the metadata that couldn't be loaded at startup every sp-metadata-retry-interval,
+// registering each service provider once its metadata is loaded, until done is closed
+func (i *IDP) retrySPMetadata(urls []string, interval time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for len(urls) > 0 {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		persist := settings.GetBool("persist-sp-metadata")
+		var failed []string
+		for j, sp := range fetchSPs(urls) {
+			if sp == nil {
+				failed = append(failed, urls[j])
+				continue
 			}
-			if resp.Body != nil {
-				defer resp.Body.Close()
-				lock.Lock()
-				defer lock.Unlock()
-				if err = SaveSpFromMetadata(resp.Body); err != nil {
-					log.Error(err)
-					return
-				}
-				log.Infof("success read sp %s metadata", url)
-			} else {
-				log.Infof("fail to fetch sp %s", url)
+			if existing, ok := i.getSP(sp.EntityID); ok {
+				sp.copySettings(existing)
+			}
+			if err := i.RegisterServiceProvider(sp, persist); err != nil {
+				log.Errorf("unable to register sp %s: %s", urls[j], err)
+				failed = append(failed, urls[j])
+				continue
 			}
-		}(spMetadataUrl.Url)
+			i.spMetadataLoaded()
+		}
+		urls = failed
 	}
-	waitGroup.Wait()
-	return nil
 }
 
 func (i *IDP) configureCrypto() error {
@@ -208,57 +495,292 @@ func (i *IDP) configureCrypto() error {
 	if len(i.TLSConfig.Certificates) == 0 {
 		return errors.New("tlsConfig does not contain a certificate")
 	}
+	i.signers = make(map[signingAlgorithms]sign.Signer)
 	cert := i.TLSConfig.Certificates[0]
-	signer, err := xmlsig.NewSignerWithOptions(cert, xmlsig.SignerOptions{
-		SignatureAlgorithm: viper.GetString("signature-algorithm"),
-		DigestAlgorithm:    viper.GetString("digest-algorithm"),
-	})
-	i.signer = signer
+	// the key of the signing backend, unknown for a Signer provided by the application unless it's a
+	// sign.CertificateSigner
+	var key crypto.PrivateKey
+	if i.Signer == nil {
+		switch backend := settings.GetString("signing-backend"); backend {
+		case "file":
+		case "pkcs11":
+			// Only the certificate is loaded, the private key remains on the token
+			hsmCert, err := pkcs11Certificate(cert)
+			if err != nil {
+				return err
+			}
+			cert = hsmCert
+		default:
+			return fmt.Errorf("unsupported signing-backend %s", backend)
+		}
+		i.newSigner = func(options sign.Options) (sign.Signer, error) {
+			return sign.NewSigner(cert, options)
+		}
+		signer, err := i.newSigner(sign.Options{
+			SignatureAlgorithm: settings.GetString("signature-algorithm"),
+			DigestAlgorithm:    settings.GetString("digest-algorithm"),
+		})
+		if err != nil {
+			return err
+		}
+		i.Signer = signer
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		// The signer's algorithm is the configured one, or the default when none is
+		i.signatureAlgorithms = atLeastConfigured(sign.SignatureAlgorithms(leaf), signer.Algorithm())
+		i.digestAlgorithms = atLeastConfigured(sign.DigestAlgorithms, settings.GetString("digest-algorithm"))
+		key = cert.PrivateKey
+	} else {
+		// Nothing is known about a Signer provided by the application besides its algorithm and, when it's a
+		// sign.CertificateSigner, its certificate. Otherwise signing-certificate names the one published.
+		i.signatureAlgorithms = []string{i.Signer.Algorithm()}
+		i.digestAlgorithms = nil
+		if signer, ok := i.Signer.(sign.CertificateSigner); ok {
+			cert = signer.Certificate()
+			key = cert.PrivateKey
+		} else if path := settings.GetString("signing-certificate"); path != "" {
+			chain, err := readCertificates(path)
+			if err != nil {
+				return err
+			}
+			cert = tls.Certificate{Certificate: chain}
+		} else {
+			log.Warn("publishing the TLS certificate for the provided Signer, set signing-certificate to its certificate")
+		}
+		if len(cert.Certificate) == 0 {
+			return errors.New("the provided Signer's certificate is empty")
+		}
+	}
+	i.signingCertificate = cert.Certificate[0]
+	// Tokens are signed with the same key as assertions when it's supported by JWS
+	i.tokenSigner = nil
+	if key, ok := key.(crypto.Signer); ok {
+		if signer, err := newJWTSigner(key); err == nil {
+			i.tokenSigner = signer
+		} else if settings.GetBool("oidc-enabled") {
+			return err
+		}
+	}
+	if i.tokenSigner == nil && settings.GetBool("oidc-enabled") {
+		return errors.New("oidc-enabled requires the signing key, which isn't known for a Signer that doesn't implement sign.CertificateSigner")
+	}
+	if i.SignatureValidator == nil {
+		i.SignatureValidator = sign.NewValidator()
+	}
+	return nil
+}
 
-	i.validator = sign.NewValidator()
-	return err
+type signingAlgorithms struct {
+	signature string
+	digest    string
+}
+
+// atLeastConfigured returns the configured algorithm followed by the supported ones that are stronger, so that
+// negotiating with a service provider can't weaken signatures. The supported algorithms are listed strongest first.
+// All of them can be negotiated when none is configured, as the default signer falls back to the weakest.
+func atLeastConfigured(supported []string, configured string) []string {
+	if configured == "" {
+		return supported
+	}
+	if !contains(supported, configured) {
+		return []string{configured}
+	}
+	algorithms := []string{configured}
+	for _, algorithm := range supported {
+		if algorithm == configured {
+			break
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms
+}
+
+// negotiate returns the first algorithm the service provider declared that the IDP supports, or the
+// fallback when there isn't one
+func negotiate(declared, supported []string, fallback string) string {
+	for _, algorithm := range declared {
+		if contains(supported, algorithm) {
+			return algorithm
+		}
+	}
+	return fallback
+}
+
+// checkSignerAlgorithms rejects signing algorithms set for the service provider that can't be used. A Signer provided
+// by the application signs every message the same way, so only its own signature algorithm can be set.
+func (i *IDP) checkSignerAlgorithms(sp *ServiceProvider) error {
+	if i.Signer == nil || i.newSigner != nil {
+		return nil
+	}
+	if sp.SignatureAlgorithm != "" && sp.SignatureAlgorithm != i.Signer.Algorithm() {
+		return fmt.Errorf("signaturealgorithm %s of %s can't be used, the provided Signer signs with %s",
+			sp.SignatureAlgorithm, sp.EntityID, i.Signer.Algorithm())
+	}
+	if sp.DigestAlgorithm != "" {
+		return fmt.Errorf("digestalgorithm of %s can't be used with the provided Signer", sp.EntityID)
+	}
+	return nil
+}
+
+// checkSignerMethods reports the SigningMethods and DigestMethods declared by the service provider when a Signer
+// provided by the application can't be negotiated to them. They come from the service provider's metadata, so
+// they're only warned about and messages are signed with the Signer anyway.
+func (i *IDP) checkSignerMethods(sp *ServiceProvider) error {
+	if i.Signer == nil || i.newSigner != nil {
+		return nil
+	}
+	if len(sp.SigningMethods) > 0 && !contains(sp.SigningMethods, i.Signer.Algorithm()) {
+		return fmt.Errorf("%s doesn't declare %s, the signing method of the provided Signer", sp.EntityID,
+			i.Signer.Algorithm())
+	}
+	if len(sp.DigestMethods) > 0 {
+		return fmt.Errorf("digest methods declared by %s can't be negotiated with the provided Signer", sp.EntityID)
+	}
+	return nil
+}
+
+// signerFor returns the signer to use for messages sent to the service provider. Algorithms set for the service
+// provider are used first, then the ones negotiated from its declared SigningMethods and DigestMethods, and
+// finally the signature-algorithm and digest-algorithm settings.
+// Signers for service providers that override the signing algorithms are created once and cached.
+// A Signer provided by the application is always used as is, checkSignerAlgorithms keeps service providers from
+// expecting otherwise.
+func (i *IDP) signerFor(entityID string) (sign.Signer, error) {
+	sp, ok := i.getSP(entityID)
+	if !ok || i.newSigner == nil {
+		return i.Signer, nil
+	}
+	algorithms := signingAlgorithms{
+		signature: sp.SignatureAlgorithm,
+		digest:    sp.DigestAlgorithm,
+	}
+	if algorithms.signature == "" {
+		algorithms.signature = negotiate(sp.SigningMethods, i.signatureAlgorithms, settings.GetString("signature-algorithm"))
+	}
+	if algorithms.digest == "" {
+		algorithms.digest = negotiate(sp.DigestMethods, i.digestAlgorithms, settings.GetString("digest-algorithm"))
+	}
+	if algorithms.signature == settings.GetString("signature-algorithm") &&
+		algorithms.digest == settings.GetString("digest-algorithm") {
+		return i.Signer, nil
+	}
+	i.signersLock.Lock()
+	defer i.signersLock.Unlock()
+	if signer, ok := i.signers[algorithms]; ok {
+		return signer, nil
+	}
+	signer, err := i.newSigner(sign.Options{
+		SignatureAlgorithm: algorithms.signature,
+		DigestAlgorithm:    algorithms.digest,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create signer for %s: %v", entityID, err)
+	}
+	i.signers[algorithms] = signer
+	return signer, nil
 }
 
 func (i *IDP) configureStores() error {
 	if i.TempCache == nil {
-		cache, err := store.New(viper.GetDuration("temp-cache-duration"))
+		cache, err := store.NewWithLimit("temp cache", settings.GetDuration("temp-cache-duration"),
+			settings.GetInt("temp-cache-max-entries"))
 		if err != nil {
 			return err
 		}
 		i.TempCache = cache
 	}
 	if i.UserCache == nil {
-		cache, err := store.New(viper.GetDuration("user-cache-duration"))
+		cache, err := store.NewWithLimit("user cache", settings.GetDuration("user-cache-duration"),
+			settings.GetInt("user-cache-max-entries"))
 		if err != nil {
 			return err
 		}
 		i.UserCache = cache
 	}
+	if i.Sessions == nil {
+		i.Sessions = NewSessionStore(i.UserCache, i.Clock, i.IDs)
+	}
 	return nil
 }
 
 func (i *IDP) configureValidator() error {
 	if i.PasswordValidator == nil {
-		validator, err := LdapValidator()
+		validator, err := newPasswordValidator()
 		if err != nil {
 			return err
 		}
 		i.PasswordValidator = validator
+		i.configuredValidator = true
 	}
 	return nil
 }
 
+// newPasswordValidator returns the PasswordValidator selected by the validator setting
+func newPasswordValidator() (PasswordValidator, error) {
+	switch settings.GetString("validator") {
+	case "ldap":
+		return LdapValidator()
+	case "static":
+		return StaticPasswordValidator()
+	default:
+		return nil, fmt.Errorf("unsupported validator %s", settings.GetString("validator"))
+	}
+}
+
 func (i *IDP) configureAttributeSources() error {
 	if i.AttributeSources == nil {
-		source, err := DefaultAttributeSource()
+		sources, err := newAttributeSources()
 		if err != nil {
 			return err
 		}
-		i.AttributeSources = []AttributeSource{source}
+		i.AttributeSources = sources
+		i.configuredSources = true
 	}
 	return nil
 }
 
+// newAttributeSources returns the default AttributeSource followed by one for the attribute-templates
+func newAttributeSources() ([]AttributeSource, error) {
+	source, err := DefaultAttributeSource()
+	if err != nil {
+		return nil, err
+	}
+	sources := []AttributeSource{source}
+	templates := []AttributeTemplate{}
+	if err := settings.UnmarshalKey("attribute-templates", &templates); err != nil {
+		return nil, err
+	}
+	if len(templates) > 0 {
+		source, err := TemplateAttributeSource(templates)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+func (i *IDP) configureAttributeTransformers() error {
+	if i.AttributeTransformers == nil {
+		transformers, err := DefaultAttributeTransformers()
+		if err != nil {
+			return err
+		}
+		i.AttributeTransformers = transformers
+		i.configuredTransformers = true
+	}
+	return nil
+}
+
+// passwordValidator returns the PasswordValidator, which Reload may replace
+func (i *IDP) passwordValidator() PasswordValidator {
+	i.configLock.RLock()
+	defer i.configLock.RUnlock()
+	return i.PasswordValidator
+}
+
 func (i *IDP) configureHandler() error {
 	if i.Router == nil {
 		i.Router = httprouter.New()
@@ -280,10 +802,17 @@ func (i *IDP) configureHandler() error {
 	if i.RedirectSLOHandler == nil {
 		i.RedirectSLOHandler = i.DefaultRedirectSLOHandler()
 	}
+	// Handle logout requests using the POST binding
+	if i.PostSLOHandler == nil {
+		i.PostSLOHandler = i.DefaultPostSLOHandler()
+	}
 	// Handle redirect SSO requests
 	if i.RedirectSSOHandler == nil {
 		i.RedirectSSOHandler = i.DefaultRedirectSSOHandler()
 	}
+	if i.PostSSOHandler == nil {
+		i.PostSSOHandler = i.DefaultPostSSOHandler()
+	}
 
 	// Handle ECP requests
 	if i.ECPHandler == nil {
@@ -294,11 +823,42 @@ func (i *IDP) configureHandler() error {
 	if i.PasswordLoginHandler == nil {
 		i.PasswordLoginHandler = i.DefaultPasswordLoginHandler()
 	}
+	if i.PasswordChangeHandler == nil {
+		i.PasswordChangeHandler = i.DefaultPasswordChangeHandler()
+	}
+	if i.CancelLoginHandler == nil {
+		i.CancelLoginHandler = i.DefaultCancelLoginHandler()
+	}
 
 	// Handle attribute query
 	if i.QueryHandler == nil {
 		i.QueryHandler = i.DefaultQueryHandler()
 	}
+	if i.ReadinessHandler == nil {
+		i.ReadinessHandler = i.DefaultReadinessHandler()
+	}
+
+	// Decode SAML messages for operators when enabled
+	if i.DebugHandler == nil {
+		i.DebugHandler = i.DefaultDebugHandler()
+	}
+	if i.SPListHandler == nil {
+		i.SPListHandler = i.DefaultSPListHandler()
+	}
+
+	// Serve OpenID Connect relying parties when enabled
+	if i.OIDCDiscoveryHandler == nil {
+		i.OIDCDiscoveryHandler = i.DefaultOIDCDiscoveryHandler()
+	}
+	if i.OIDCAuthorizeHandler == nil {
+		i.OIDCAuthorizeHandler = i.DefaultOIDCAuthorizeHandler()
+	}
+	if i.OIDCTokenHandler == nil {
+		i.OIDCTokenHandler = i.DefaultOIDCTokenHandler()
+	}
+	if i.JWKSHandler == nil {
+		i.JWKSHandler = i.DefaultJWKSHandler()
+	}
 
 	// Handle UI rendering
 	if i.UIHandler == nil {
@@ -309,39 +869,203 @@ func (i *IDP) configureHandler() error {
 
 func (i *IDP) buildRoutes() error {
 	r := i.Router
-	r.HandlerFunc("GET", viper.GetString("metadata-path"), i.MetadataHandler)
-	r.HandlerFunc("POST", viper.GetString("artifact-service-path"), i.ArtifactResolveHandler)
-	r.HandlerFunc("GET", viper.GetString("slo-service-path"), i.RedirectSLOHandler)
-	r.HandlerFunc("GET", viper.GetString("sso-service-path"), i.RedirectSSOHandler)
-	r.HandlerFunc("POST", viper.GetString("ecp-service-path"), i.ECPHandler)
-	r.HandlerFunc("POST", "/idp/static/login.html", i.PasswordLoginHandler)
-	r.HandlerFunc("POST", viper.GetString("attribute-service-path"), i.QueryHandler)
-	r.Handler("GET", "/idp/static/*path", i.UIHandler)
-	r.Handler("GET", "/favicon.ico", i.UIHandler)
+	r.HandlerFunc("GET", i.path("metadata-path"), i.MetadataHandler)
+	r.HandlerFunc("POST", i.path("artifact-service-path"), i.ArtifactResolveHandler)
+	r.HandlerFunc("GET", i.path("slo-service-path"), i.RedirectSLOHandler)
+	r.HandlerFunc("POST", i.path("slo-service-path"), i.PostSLOHandler)
+	r.HandlerFunc("GET", i.path("sso-service-path"), i.RedirectSSOHandler)
+	r.HandlerFunc("POST", i.path("sso-service-path"), i.PostSSOHandler)
+	r.HandlerFunc("POST", i.path("ecp-service-path"), i.ECPHandler)
+	r.HandlerFunc("POST", i.loginPage(), i.PasswordLoginHandler)
+	if !strings.HasPrefix(i.loginPage(), i.path("static-path")+"/") {
+		// otherwise served by the static route below
+		r.Handler("GET", i.loginPage(), i.withLoginError(i.UIHandler))
+	}
+	if settings.GetBool("password-change-enabled") {
+		r.HandlerFunc("POST", i.changePasswordPage(), i.PasswordChangeHandler)
+		if !strings.HasPrefix(i.changePasswordPage(), i.path("static-path")+"/") {
+			r.Handler("GET", i.changePasswordPage(), i.withLoginError(i.UIHandler))
+		}
+	}
+	r.HandlerFunc("POST", i.path("attribute-service-path"), i.QueryHandler)
+	r.HandlerFunc("GET", i.path("readiness-path"), i.ReadinessHandler)
+	if settings.GetBool("debug-endpoint") {
+		r.HandlerFunc("GET", i.path("debug-service-path"), i.DebugHandler)
+		r.HandlerFunc("POST", i.path("debug-service-path"), i.DebugHandler)
+	}
+	if settings.GetBool("sp-list-endpoint") {
+		r.HandlerFunc("GET", i.path("sp-list-path"), i.SPListHandler)
+	}
+	if settings.GetBool("oidc-enabled") {
+		r.HandlerFunc("GET", i.basePath+"/.well-known/openid-configuration", i.OIDCDiscoveryHandler)
+		r.HandlerFunc("GET", i.path("oidc-authorize-path"), i.OIDCAuthorizeHandler)
+		r.HandlerFunc("POST", i.path("oidc-authorize-path"), i.OIDCAuthorizeHandler)
+		r.HandlerFunc("POST", i.path("oidc-token-path"), i.OIDCTokenHandler)
+	}
+	if settings.GetBool("oidc-enabled") || settings.GetBool("jwks-endpoint") {
+		r.HandlerFunc("GET", i.path("jwks-path"), i.JWKSHandler)
+	}
+	r.Handler("GET", i.path("static-path")+"/*path", i.withLoginError(i.UIHandler))
+	r.Handler("GET", i.basePath+"/favicon.ico", i.UIHandler)
 	return nil
 }
 
-func getIP(request *http.Request) net.IP {
-	addr := request.RemoteAddr
-	if strings.Contains(addr, ":") {
-		addr = strings.Split(addr, ":")[0]
+// path returns the route configured under key below the base-path the IDP is mounted at
+func (i *IDP) path(key string) string {
+	return i.basePath + settings.GetString(key)
+}
+
+// loginPage returns the path of the password login form
+func (i *IDP) loginPage() string {
+	return i.path("login-page-path")
+}
+
+// changePasswordPage returns the path of the form for changing an expired password
+func (i *IDP) changePasswordPage() string {
+	return i.path("password-change-page-path")
+}
+
+// getIP returns the client's IP address. When the immediate peer is a trusted proxy,
+// the Forwarded or X-Forwarded-For chain is walked from the nearest hop until an
+// address that isn't a trusted proxy is found.
+func (i *IDP) getIP(request *http.Request) net.IP {
+	ip := parseHostIP(request.RemoteAddr)
+	if !i.isTrustedProxy(ip) {
+		return ip
 	}
-	return net.ParseIP(addr)
+	hops := forwardedFor(request)
+	for j := len(hops) - 1; j >= 0; j-- {
+		hop := parseHostIP(hops[j])
+		if hop == nil {
+			// Can't trust anything further up the chain
+			break
+		}
+		ip = hop
+		if !i.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
 }
 
-func (i *IDP) setUserAttributes(user *model.User, req *model.AuthnRequest) error {
-	for _, source := range i.AttributeSources {
-		if err := source.AddAttributes(user, req); err != nil {
+// forwardedFor returns the client addresses recorded by proxies, ordered from the
+// original client to the nearest proxy. The standard Forwarded header is preferred.
+func forwardedFor(request *http.Request) []string {
+	var hops []string
+	for _, header := range request.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) == 2 && strings.EqualFold(parts[0], "for") {
+					hops = append(hops, parts[1])
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, header := range request.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	return hops
+}
+
+// parseHostIP extracts the IP from an address with or without a port for both
+// IPv4 and IPv6, such as 1.2.3.4, 1.2.3.4:80, ::1, [::1]:443 or "[2001:db8::1]:4711"
+func parseHostIP(node string) net.IP {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(strings.Trim(node, "[]"))
+}
+
+func (i *IDP) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range i.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *IDP) setUserAttributes(ctx context.Context, user *model.User, req *model.AuthnRequest) error {
+	i.configLock.RLock()
+	sources, transformers := i.AttributeSources, i.AttributeTransformers
+	i.configLock.RUnlock()
+	if len(sources) > 0 {
+		release, err := i.acquireBackend()
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	for _, source := range sources {
+		if err := addAttributes(ctx, source, user, req); err != nil {
+			if required(source) {
+				return err
+			}
+			log.Warnf("skipping optional attribute source for %s: %s", user.Name, err)
+		}
+	}
+	for _, transform := range transformers {
+		if err := transform(user, req); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// acquireBackend reserves one of the max-concurrent-logins calls to the PasswordValidator and AttributeSources.
+// Logins are turned away with ErrBackendBusy rather than queued when they're all in use, so a spike of logins
+// doesn't pile up on the directory. The returned function frees the call.
+func (i *IDP) acquireBackend() (func(), error) {
+	if i.backendCalls == nil {
+		return func() {}, nil
+	}
+	select {
+	case i.backendCalls <- struct{}{}:
+		return func() { <-i.backendCalls }, nil
+	default:
+		log.Warnf("turned away a login with %d backend calls in progress", cap(i.backendCalls))
+		return nil, ErrBackendBusy
+	}
+}
+
+// backendUnavailable reports whether the error means the login can't be checked right now, rather than failed
+func backendUnavailable(err error) bool {
+	return err == ErrBackendUnavailable || err == ErrBackendBusy
+}
+
+// addAttributes calls the source, limiting it to the attribute-source-timeout
+func addAttributes(ctx context.Context, source AttributeSource, user *model.User, req *model.AuthnRequest) error {
+	ctx, cancel := withTimeout(ctx, "attribute-source-timeout")
+	defer cancel()
+	return source.AddAttributes(ctx, user, req)
+}
+
+// withTimeout applies the duration setting to the context. A zero duration leaves the context's deadline unchanged.
+func withTimeout(ctx context.Context, key string) (context.Context, context.CancelFunc) {
+	if timeout := settings.GetDuration(key); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
 func (i *IDP) buildAttributes(attrs map[string][]string) []*model.Attribute {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	// Keep the attribute order stable between logins
+	sort.Strings(names)
 	attributes := make([]*model.Attribute, 0, len(attrs))
-	for attrKey, attrValue := range attrs {
-		attributes = append(attributes, &model.Attribute{Name: attrKey, Value: attrValue})
+	for _, name := range names {
+		attributes = append(attributes, &model.Attribute{Name: name, Value: attrs[name]})
 	}
 	return attributes
 }
@@ -15,11 +15,19 @@
 package idp
 
 import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
 	"net/http/httptest"
 	"path/filepath"
 	"testing"
 
+	"github.com/amdonov/xmlsig"
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/sign"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 )
 
 func getTestIDP(t *testing.T, i *IDP) *httptest.Server {
@@ -30,5 +38,307 @@ func getTestIDP(t *testing.T, i *IDP) *httptest.Server {
 	if err != nil {
 		t.Fatal(err)
 	}
-	return httptest.NewTLSServer(handler)
+	// Release the IDP's caches and background work once the test is over
+	t.Cleanup(func() { i.Close() })
+	ts := httptest.NewTLSServer(handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestIDP_getIP(t *testing.T) {
+	proxies, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &IDP{trustedProxies: proxies}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.5:443"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "192.168.1.5", i.getIP(req).String(), "untrusted peer should not be able to set the client address")
+	req.RemoteAddr = "10.1.1.1:443"
+	assert.Equal(t, "1.2.3.4", i.getIP(req).String(), "trusted proxy should supply the client address")
+	// Walk the chain through trusted proxies, ignoring anything the client claims
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.2.2.2")
+	assert.Equal(t, "1.2.3.4", i.getIP(req).String(), "should skip trusted hops")
+	// Forwarded is preferred over X-Forwarded-For
+	req.Header.Set("Forwarded", `for=5.6.7.8;proto=https, for="10.3.3.3:8080"`)
+	assert.Equal(t, "5.6.7.8", i.getIP(req).String(), "should use the Forwarded header")
+	req.Header.Set("Forwarded", `for="[2001:db8::1]:4711"`)
+	assert.Equal(t, "2001:db8::1", i.getIP(req).String(), "should parse IPv6 forwarded nodes")
+}
+
+func TestParseCIDRs_invalid(t *testing.T) {
+	_, err := parseCIDRs([]string{"not-a-network"})
+	assert.Error(t, err)
+}
+
+func TestIDP_getIP_remoteAddr(t *testing.T) {
+	i := &IDP{}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{"ipv4", "192.168.1.5:443", "192.168.1.5"},
+		{"ipv4 no port", "192.168.1.5", "192.168.1.5"},
+		{"ipv6", "[::1]:443", "::1"},
+		{"ipv6 full", "[2001:db8::68]:8443", "2001:db8::68"},
+		{"ipv6 no port", "2001:db8::68", "2001:db8::68"},
+		{"ipv6 brackets no port", "[::1]", "::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			assert.Equal(t, tt.want, i.getIP(req).String())
+		})
+	}
+}
+
+func TestIDP_signerFor(t *testing.T) {
+	i := &IDP{}
+	server := getTestIDP(t, i)
+	defer server.Close()
+	i.sps["https://sha1.example.com"] = &ServiceProvider{
+		EntityID:           "https://sha1.example.com",
+		SignatureAlgorithm: "http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+		DigestAlgorithm:    "http://www.w3.org/2000/09/xmldsig#sha1",
+	}
+	i.sps["https://invalid.example.com"] = &ServiceProvider{
+		EntityID:        "https://invalid.example.com",
+		DigestAlgorithm: "http://www.w3.org/2001/04/xmlenc#sha512",
+	}
+
+	signer, err := i.signerFor("https://unknown.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, i.Signer, signer, "service providers without overrides should use the default signer")
+
+	signer, err = i.signerFor("https://sha1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signer.CreateSignature(saml.Assertion{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "http://www.w3.org/2000/09/xmldsig#rsa-sha1", signature.SignedInfo.SignatureMethod.Algorithm)
+	assert.Equal(t, "http://www.w3.org/2000/09/xmldsig#sha1", signature.SignedInfo.Reference.DigestMethod.Algorithm)
+	cached, _ := i.signerFor("https://sha1.example.com")
+	assert.Equal(t, signer, cached, "signer should be reused")
+
+	_, err = i.signerFor("https://invalid.example.com")
+	assert.Error(t, err)
+}
+
+func TestIDP_signerFor_negotiated(t *testing.T) {
+	setConfig(t, "signature-algorithm", "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256")
+	i := &IDP{}
+	server := getTestIDP(t, i)
+	defer server.Close()
+	i.sps["https://sha1.example.com"] = &ServiceProvider{
+		EntityID:       "https://sha1.example.com",
+		SigningMethods: []string{"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256", "http://www.w3.org/2000/09/xmldsig#rsa-sha1"},
+		DigestMethods:  []string{"http://www.w3.org/2001/04/xmlenc#sha512", "http://www.w3.org/2000/09/xmldsig#sha1"},
+	}
+	i.sps["https://unsupported.example.com"] = &ServiceProvider{
+		EntityID:       "https://unsupported.example.com",
+		SigningMethods: []string{"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"},
+	}
+
+	signer, err := i.signerFor("https://sha1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, i.Signer, signer, "weaker algorithms than the configured ones shouldn't be negotiated")
+	signature, err := signer.CreateSignature(saml.Assertion{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256", signature.SignedInfo.SignatureMethod.Algorithm)
+	assert.Equal(t, "http://www.w3.org/2001/04/xmlenc#sha256", signature.SignedInfo.Reference.DigestMethod.Algorithm)
+
+	signer, err = i.signerFor("https://unsupported.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, i.Signer, signer, "should fall back to the configured algorithms")
+}
+
+func TestIDP_signerFor_negotiatedStronger(t *testing.T) {
+	setConfig(t, "signature-algorithm", "http://www.w3.org/2000/09/xmldsig#rsa-sha1")
+	setConfig(t, "digest-algorithm", "http://www.w3.org/2000/09/xmldsig#sha1")
+	i := &IDP{}
+	server := getTestIDP(t, i)
+	defer server.Close()
+	i.sps["https://sha256.example.com"] = &ServiceProvider{
+		EntityID:       "https://sha256.example.com",
+		SigningMethods: []string{"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"},
+		DigestMethods:  []string{"http://www.w3.org/2001/04/xmlenc#sha256"},
+	}
+	signer, err := i.signerFor("https://sha256.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signer.CreateSignature(saml.Assertion{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256", signature.SignedInfo.SignatureMethod.Algorithm,
+		"stronger algorithms should be negotiated")
+	assert.Equal(t, "http://www.w3.org/2001/04/xmlenc#sha256", signature.SignedInfo.Reference.DigestMethod.Algorithm)
+}
+
+type countingSigner struct {
+	sign.Signer
+	signatures int
+}
+
+func (s *countingSigner) CreateSignature(data interface{}) (*xmlsig.Signature, error) {
+	s.signatures++
+	return s.Signer.CreateSignature(data)
+}
+
+func TestIDP_Signer(t *testing.T) {
+	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
+	viper.Set("tls-ca", filepath.Join("testdata", "certificate.pem"))
+	tlsConfig, err := ConfigureTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultSigner, err := sign.NewSigner(tlsConfig.Certificates[0], sign.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &countingSigner{Signer: defaultSigner}
+	i := &IDP{TLSConfig: tlsConfig, Signer: signer}
+	server := getTestIDP(t, i)
+	defer server.Close()
+	i.sps["https://sha1.example.com"] = &ServiceProvider{
+		EntityID:        "https://sha1.example.com",
+		DigestAlgorithm: "http://www.w3.org/2000/09/xmldsig#sha1",
+	}
+	provided, err := i.signerFor("https://sha1.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, signer, provided, "provided signer should be used for all service providers")
+
+	// metadata has already been signed
+	signatures := signer.signatures
+	var b bytes.Buffer
+	if err = i.sendPostResponse(&model.AuthnRequest{Issuer: "https://sha1.example.com"}, &model.User{}, &b, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, signatures+1, signer.signatures, "assertion should have been signed by the provided signer")
+}
+
+func TestIDP_checkSignerAlgorithms(t *testing.T) {
+	sp := newTestSP(t, "https://signer.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{Signer: sp.signer}
+	other := "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	tests := []struct {
+		name      string
+		signature string
+		digest    string
+		wantErr   bool
+	}{
+		{"none", "", "", false},
+		{"signer's algorithm", sp.signer.Algorithm(), "", false},
+		{"other signature algorithm", other, "", true},
+		{"digest algorithm", "", "http://www.w3.org/2001/04/xmlenc#sha512", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := sp.serviceProvider()
+			provider.SignatureAlgorithm = tt.signature
+			provider.DigestAlgorithm = tt.digest
+			err := i.checkSignerAlgorithms(&provider)
+			if tt.wantErr {
+				assert.Error(t, err, "algorithms the provided Signer doesn't use should be rejected")
+			} else {
+				assert.NoError(t, err)
+			}
+			// The IDP's own signers can use any algorithm its key supports
+			assert.NoError(t, (&IDP{}).checkSignerAlgorithms(&provider))
+		})
+	}
+}
+
+func TestIDP_checkSignerMethods(t *testing.T) {
+	sp := newTestSP(t, "https://signer.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{Signer: sp.signer}
+	tests := []struct {
+		name    string
+		signing []string
+		digest  []string
+		wantErr bool
+	}{
+		{"none declared", nil, nil, false},
+		{"signer's method declared", []string{"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512", sp.signer.Algorithm()},
+			nil, false},
+		{"signer's method not declared", []string{"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"}, nil, true},
+		{"digest methods declared", nil, []string{"http://www.w3.org/2001/04/xmlenc#sha512"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := sp.serviceProvider()
+			provider.SigningMethods = tt.signing
+			provider.DigestMethods = tt.digest
+			err := i.checkSignerMethods(&provider)
+			if tt.wantErr {
+				assert.Error(t, err, "methods the provided Signer can't be negotiated to should be reported")
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, (&IDP{}).checkSignerMethods(&provider))
+		})
+	}
+	// Service providers are still registered, and signed for with the provided Signer
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	provider := sp.serviceProvider()
+	provider.SigningMethods = []string{"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"}
+	if assert.NoError(t, i.RegisterServiceProvider(&provider, false)) {
+		signer, err := i.signerFor(provider.EntityID)
+		assert.NoError(t, err)
+		assert.Equal(t, sp.signer, signer)
+	}
+}
+
+func TestIDP_configureCrypto_signerCertificate(t *testing.T) {
+	setConfig(t, "tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	setConfig(t, "tls-private-key", filepath.Join("testdata", "key.pem"))
+	setConfig(t, "tls-ca", filepath.Join("testdata", "certificate.pem"))
+	tlsConfig, err := ConfigureTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := newTestSP(t, "https://signer.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{TLSConfig: tlsConfig, Signer: &certificateSigner{sp.signer, sp.cert}}
+	if assert.NoError(t, i.configureCrypto()) {
+		assert.Equal(t, sp.cert.Certificate[0], i.signingCertificate, "the Signer's certificate should be published")
+	}
+
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: sp.cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, "signing-certificate", path)
+	i = &IDP{TLSConfig: tlsConfig, Signer: sp.signer}
+	if assert.NoError(t, i.configureCrypto()) {
+		assert.Equal(t, sp.cert.Certificate[0], i.signingCertificate, "signing-certificate should be published")
+	}
+}
+
+func TestIDP_configureConstants(t *testing.T) {
+	viper.Set("tls_enable", false)
+	viper.Set("external-url", "https://idp.example.org/")
+	defer viper.Set("external-url", "")
+	i := &IDP{}
+	if err := i.configureConstants(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://idp.example.org/", i.entityID, "entityID should follow external-url rather than local TLS")
+	assert.Equal(t, "https://idp.example.org/idp/SAML2/Redirect/SSO", i.singleSignOnServiceLocation)
+	assert.Equal(t, "https://idp.example.org/idp/SAML2/SOAP/ArtifactResolution", i.artifactResolutionServiceLocation)
+
+	viper.Set("external-url", "idp.example.org")
+	assert.Error(t, (&IDP{}).configureConstants(), "external-url must be absolute")
 }
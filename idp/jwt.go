@@ -0,0 +1,214 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/chriskery/sso-idp/settings"
+)
+
+// jwtSigner signs JSON Web Tokens, such as OpenID Connect ID tokens, with the IDP's signing key
+type jwtSigner struct {
+	key crypto.Signer
+	alg string
+	kid string
+}
+
+// JWK is the JSON Web Key representation of a public signing key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Elliptic curve and point
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JWKSet is a JSON Web Key Set
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func newJWTSigner(key crypto.Signer) (*jwtSigner, error) {
+	alg, err := jwtAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := keyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &jwtSigner{key, alg, kid}, nil
+}
+
+func jwtAlgorithm(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return "ES256", nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %T for signing tokens", key)
+}
+
+// keyID derives the kid from a hash of the public key, so it stays the same for as long as the key is used
+func keyID(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// sign returns the compact serialization of a JWT holding the claims
+func (s *jwtSigner) sign(claims interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	if s.alg == "ES256" {
+		// JWS uses the raw R and S values rather than the ASN.1 structure
+		if signature, err = rawECDSASignature(signature, 32); err != nil {
+			return "", err
+		}
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func rawECDSASignature(der []byte, size int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, errors.New("trailing data after ECDSA signature")
+	}
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
+
+// publicJWK returns the public key as a JWK
+func publicJWK(key crypto.PublicKey) (JWK, error) {
+	alg, err := jwtAlgorithm(key)
+	if err != nil {
+		return JWK{}, err
+	}
+	kid, err := keyID(key)
+	if err != nil {
+		return JWK{}, err
+	}
+	jwk := JWK{Use: "sig", Algorithm: alg, KeyID: kid}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32)))
+	}
+	return jwk, nil
+}
+
+// configureJWKS builds the key set from the signing certificate and, while keys are being rolled over, the
+// certificates listed in previous-signing-certificates so tokens signed with the old key still validate
+func (i *IDP) configureJWKS() error {
+	i.jwks = JWKSet{Keys: []JWK{}}
+	if !settings.GetBool("jwks-endpoint") && !settings.GetBool("oidc-enabled") {
+		return nil
+	}
+	certs := [][]byte{i.signingCertificate}
+	for _, path := range settings.GetStringSlice("previous-signing-certificates") {
+		previous, err := readCertificates(path)
+		if err != nil {
+			return err
+		}
+		// Only the first certificate is the signing certificate, the rest are its chain
+		certs = append(certs, previous[0])
+	}
+	for _, der := range certs {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		jwk, err := publicJWK(cert.PublicKey)
+		if err != nil {
+			return err
+		}
+		if !i.jwks.contains(jwk.KeyID) {
+			i.jwks.Keys = append(i.jwks.Keys, jwk)
+		}
+	}
+	return nil
+}
+
+func (set JWKSet) contains(kid string) bool {
+	for _, key := range set.Keys {
+		if key.KeyID == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultJWKSHandler publishes the public keys used to sign tokens as a JWK set
+func (i *IDP) DefaultJWKSHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, i.jwks)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,125 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_jwtSigner_ES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newJWTSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signer.sign(map[string]string{"sub": "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	assert.Len(t, parts, 3)
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	assert.JSONEq(t, `{"alg":"ES256","typ":"JWT","kid":"`+signer.kid+`"}`, string(header))
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if !assert.Len(t, signature, 64, "signature should be R and S concatenated") {
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	assert.True(t, ecdsa.Verify(&key.PublicKey, digest[:], r, s))
+
+	jwk, err := publicJWK(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, signer.kid, jwk.KeyID)
+	assert.Equal(t, "EC", jwk.KeyType)
+	assert.Equal(t, "P-256", jwk.Curve)
+
+	key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newJWTSigner(key)
+	assert.Error(t, err, "only P-256 is supported for ES256")
+}
+
+func TestIDP_DefaultJWKSHandler(t *testing.T) {
+	// Certificate for a key being rolled out of service
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "previous"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := filepath.Join(t.TempDir(), "previous.pem")
+	if err = ioutil.WriteFile(previous, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("jwks-endpoint", true)
+	// The current certificate is only published once
+	viper.Set("previous-signing-certificates", []string{previous, filepath.Join("testdata", "certificate.pem")})
+	defer viper.Set("jwks-endpoint", false)
+	defer viper.Set("previous-signing-certificates", []string{})
+	ts := getTestIDP(t, &IDP{})
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + viper.GetString("jwks-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	keys := &JWKSet{}
+	if err = json.NewDecoder(resp.Body).Decode(keys); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, keys.Keys, 2) {
+		return
+	}
+	assert.Equal(t, "RS256", keys.Keys[0].Algorithm, "current key should be listed first")
+	assert.Equal(t, "ES256", keys.Keys[1].Algorithm)
+	kid, err := keyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, kid, keys.Keys[1].KeyID)
+}
@@ -0,0 +1,191 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// TruncateAssertionPolicy drops attribute values from assertions over max-attribute-values or
+	// max-assertion-size
+	TruncateAssertionPolicy = "truncate"
+	// FailAssertionPolicy rejects the login when its assertion is over max-attribute-values or max-assertion-size
+	FailAssertionPolicy = "fail"
+)
+
+// TruncationAuditor can be implemented by an Auditor to record logins whose assertion had attribute values dropped
+// to stay within max-attribute-values and max-assertion-size
+type TruncationAuditor interface {
+	LogAttributesTruncated(user *model.User, request *model.AuthnRequest, reason error)
+}
+
+// limitAssertion keeps the assertion within max-attribute-values, the number of attribute values across all of its
+// attributes, and max-assertion-size, its size in bytes before it's signed, so users in thousands of groups don't
+// produce responses service providers can't accept. Depending on assertion-limit-policy, values are dropped from
+// the attributes with the most of them, or the login fails.
+func (i *IDP) limitAssertion(request *model.AuthnRequest, user *model.User, assertion *saml.Assertion) error {
+	maxValues, maxSize := settings.GetInt("max-attribute-values"), settings.GetInt("max-assertion-size")
+	if maxValues <= 0 && maxSize <= 0 || assertion.AttributeStatement == nil {
+		return nil
+	}
+	fail := settings.GetString("assertion-limit-policy") == FailAssertionPolicy
+	statement := assertion.AttributeStatement
+	var reasons []error
+	if values := countValues(statement); maxValues > 0 && values > maxValues {
+		reason := fmt.Errorf("%d attribute values exceed max-attribute-values %d", values, maxValues)
+		if fail {
+			return fmt.Errorf("assertion for %s: %v", user.Name, reason)
+		}
+		truncateValues(statement, maxValues)
+		reasons = append(reasons, reason)
+	}
+	if size, err := xmlSize(assertion); err != nil {
+		return err
+	} else if maxSize > 0 && size > maxSize {
+		reason := fmt.Errorf("assertion of %d bytes exceeds max-assertion-size %d", size, maxSize)
+		if fail {
+			return fmt.Errorf("assertion for %s: %v", user.Name, reason)
+		}
+		for size > maxSize {
+			dropped, err := dropValues(statement, size-maxSize)
+			if err != nil {
+				return err
+			}
+			if !dropped {
+				return fmt.Errorf("assertion for %s exceeds max-assertion-size %d without attributes", user.Name, maxSize)
+			}
+			if size, err = xmlSize(assertion); err != nil {
+				return err
+			}
+		}
+		reasons = append(reasons, reason)
+	}
+	for _, reason := range reasons {
+		log.Warnf("truncated the attributes of %s for %s: %s", user.Name, request.GetIssuer(), reason)
+		if auditor, ok := i.Auditor.(TruncationAuditor); ok {
+			auditor.LogAttributesTruncated(user, request, reason)
+		}
+	}
+	return nil
+}
+
+func checkAssertionPolicy(policy string) error {
+	if policy != TruncateAssertionPolicy && policy != FailAssertionPolicy {
+		return fmt.Errorf("unsupported assertion-limit-policy %s", policy)
+	}
+	return nil
+}
+
+func countValues(statement *saml.AttributeStatement) int {
+	count := 0
+	for _, attribute := range statement.Attribute {
+		count += len(attribute.AttributeValue)
+	}
+	return count
+}
+
+// truncateValues keeps max values, taking them from the attributes with the most values so attributes with few
+// values, such as the user's email address, are kept whole
+func truncateValues(statement *saml.AttributeStatement, max int) {
+	lengths := make([]int, len(statement.Attribute))
+	for j, attribute := range statement.Attribute {
+		lengths[j] = len(attribute.AttributeValue)
+	}
+	sorted := append([]int(nil), lengths...)
+	sort.Ints(sorted)
+	// Find the most values each attribute can keep, then hand out what's left over in order
+	limit, remaining := 0, max
+	for j, length := range sorted {
+		share := remaining / (len(sorted) - j)
+		if length > share {
+			limit = share
+			break
+		}
+		remaining -= length
+		limit = length
+	}
+	kept := 0
+	for _, length := range lengths {
+		kept += minInt(length, limit)
+	}
+	extra := max - kept
+	for j := range statement.Attribute {
+		keep := minInt(lengths[j], limit)
+		if lengths[j] > limit && extra > 0 {
+			keep++
+			extra--
+		}
+		statement.Attribute[j].AttributeValue = statement.Attribute[j].AttributeValue[:keep]
+	}
+	removeEmptyAttributes(statement)
+}
+
+// dropValues removes values, one at a time from the attribute with the most of them, until about excess bytes are
+// saved. It returns false when there are no values left to drop.
+func dropValues(statement *saml.AttributeStatement, excess int) (bool, error) {
+	dropped := false
+	for excess > 0 {
+		largest := -1
+		for j, attribute := range statement.Attribute {
+			if len(attribute.AttributeValue) > 0 &&
+				(largest < 0 || len(attribute.AttributeValue) > len(statement.Attribute[largest].AttributeValue)) {
+				largest = j
+			}
+		}
+		if largest < 0 {
+			break
+		}
+		values := statement.Attribute[largest].AttributeValue
+		size, err := xmlSize(values[len(values)-1])
+		if err != nil {
+			return false, err
+		}
+		statement.Attribute[largest].AttributeValue = values[:len(values)-1]
+		excess -= size
+		dropped = true
+	}
+	removeEmptyAttributes(statement)
+	return dropped, nil
+}
+
+func removeEmptyAttributes(statement *saml.AttributeStatement) {
+	attributes := statement.Attribute[:0]
+	for _, attribute := range statement.Attribute {
+		if len(attribute.AttributeValue) > 0 {
+			attributes = append(attributes, attribute)
+		}
+	}
+	statement.Attribute = attributes
+}
+
+func xmlSize(v interface{}) (int, error) {
+	data, err := xml.Marshal(v)
+	return len(data), err
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,128 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+type truncationAuditor struct {
+	auditor
+	truncated []error
+}
+
+func (a *truncationAuditor) LogAttributesTruncated(_ *model.User, _ *model.AuthnRequest, reason error) {
+	a.truncated = append(a.truncated, reason)
+}
+
+// groupsUser is in many groups, along with a few attributes with one value
+func groupsUser(groups int) *model.User {
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "cn", Value: []string{"Joe"}},
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "memberOf"},
+	}}
+	for j := 0; j < groups; j++ {
+		user.Attributes[2].Value = append(user.Attributes[2].Value, fmt.Sprintf("cn=group%d,ou=groups,dc=example,dc=com", j))
+	}
+	return user
+}
+
+func attributeValues(assertion *saml.Assertion) map[string]int {
+	values := map[string]int{}
+	for _, attribute := range assertion.AttributeStatement.Attribute {
+		values[attribute.Name] = len(attribute.AttributeValue)
+	}
+	return values
+}
+
+func TestIDP_BuildSignedResponse_maxAttributeValues(t *testing.T) {
+	audit := &truncationAuditor{}
+	i := &IDP{Auditor: audit}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	request := &model.AuthnRequest{ID: "_123", Issuer: "sp"}
+	setConfig(t, "max-attribute-values", 12)
+
+	resp, err := i.BuildSignedResponse(request, groupsUser(10))
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]int{"cn": 1, "mail": 1, "memberOf": 10}, attributeValues(resp.Assertion),
+			"attributes at the limit should be kept")
+		assert.NotNil(t, resp.Assertion.Signature)
+	}
+	assert.Empty(t, audit.truncated)
+
+	resp, err = i.BuildSignedResponse(request, groupsUser(100))
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]int{"cn": 1, "mail": 1, "memberOf": 10}, attributeValues(resp.Assertion),
+			"groups should be dropped rather than the other attributes")
+		assert.NotNil(t, resp.Assertion.Signature)
+	}
+	assert.Len(t, audit.truncated, 1, "truncation should be audited")
+
+	setConfig(t, "assertion-limit-policy", FailAssertionPolicy)
+	_, err = i.BuildSignedResponse(request, groupsUser(100))
+	assert.Error(t, err)
+	_, err = i.BuildSignedResponse(request, groupsUser(10))
+	assert.NoError(t, err)
+}
+
+func TestIDP_limitAssertion_maxAssertionSize(t *testing.T) {
+	audit := &truncationAuditor{}
+	i := &IDP{Auditor: audit}
+	request := &model.AuthnRequest{ID: "_123", Issuer: "sp"}
+	assertion := func() *saml.Assertion {
+		return &saml.Assertion{ID: "_456", Version: "2.0", AttributeStatement: groupsUser(100).AttributeStatement()}
+	}
+	size, err := xmlSize(assertion())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setConfig(t, "max-assertion-size", size)
+	limited := assertion()
+	if assert.NoError(t, i.limitAssertion(request, groupsUser(100), limited)) {
+		assert.Equal(t, map[string]int{"cn": 1, "mail": 1, "memberOf": 100}, attributeValues(limited))
+	}
+	assert.Empty(t, audit.truncated)
+
+	setConfig(t, "max-assertion-size", size/2)
+	if assert.NoError(t, i.limitAssertion(request, groupsUser(100), limited)) {
+		values := attributeValues(limited)
+		assert.Equal(t, 1, values["cn"])
+		assert.Equal(t, 1, values["mail"])
+		assert.Less(t, values["memberOf"], 100)
+		limitedSize, err := xmlSize(limited)
+		if assert.NoError(t, err) {
+			assert.LessOrEqual(t, limitedSize, size/2)
+		}
+	}
+	assert.Len(t, audit.truncated, 1)
+
+	setConfig(t, "assertion-limit-policy", FailAssertionPolicy)
+	assert.Error(t, i.limitAssertion(request, groupsUser(100), assertion()))
+}
+
+func Test_truncateValues(t *testing.T) {
+	statement := groupsUser(10).AttributeStatement()
+	truncateValues(statement, 2)
+	assert.Equal(t, map[string]int{"cn": 1, "mail": 1}, attributeValues(&saml.Assertion{AttributeStatement: statement}),
+		"attributes left without values should be removed")
+}
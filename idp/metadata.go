@@ -22,14 +22,15 @@ import (
 
 	"github.com/amdonov/xmlsig"
 	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
 )
 
 // DefaultMetadataHandler is the default implementation for the metadata display handler. It can be used as is, wrapped in other handlers, or replaced completely.
 func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
-	certData := i.TLSConfig.Certificates[0].Certificate[0]
+	certData := i.signingCertificate
 	keyDescriptor := saml.KeyDescriptor{
 		Use: "signing",
-		KeyInfo: xmlsig.KeyInfo{
+		KeyInfo: saml.KeyInfo{
 			X509Data: &xmlsig.X509Data{
 				X509Certificate: base64.StdEncoding.EncodeToString(certData),
 			},
@@ -39,13 +40,14 @@ func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
 	// build EntityDescriptor
 	ed := &saml.IDPEntityDescriptor{
 		EntityDescriptor: saml.EntityDescriptor{
-			ID:       saml.NewID(),
-			EntityID: i.entityID,
+			ID:         i.IDs.NewID(),
+			EntityID:   i.entityID,
+			Extensions: i.algorithmSupport(),
 		},
 		IDPSSODescriptor: saml.IDPSSODescriptor{
 			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
 			KeyDescriptor:              keyDescriptor,
-			WantAuthnRequestsSigned:    true,
+			WantAuthnRequestsSigned:    settings.GetBool("require-signed-authn-requests"),
 			ArtifactResolutionService: saml.ArtifactResolutionService{
 				Service: saml.Service{
 					Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
@@ -61,6 +63,18 @@ func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
 						Location: i.singleSignOnServiceLocation,
 					},
 				},
+				saml.SingleSignOnService{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+						Location: i.singleSignOnServiceLocation,
+					},
+				},
+				saml.SingleSignOnService{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST-SimpleSign",
+						Location: i.singleSignOnServiceLocation,
+					},
+				},
 				saml.SingleSignOnService{
 					Service: saml.Service{
 						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
@@ -75,6 +89,12 @@ func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
 						Location: i.singleLogoutServiceLocation,
 					},
 				},
+				saml.SingleLogoutService{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+						Location: i.singleLogoutServiceLocation,
+					},
+				},
 			},
 		},
 		AttributeAuthorityDescriptor: saml.AttributeAuthorityDescriptor{
@@ -89,7 +109,7 @@ func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
 			NameIDFormat: "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
 		},
 	}
-	sig, err := i.signer.CreateSignature(ed)
+	sig, err := i.Signer.CreateSignature(ed)
 	if err != nil {
 		return nil, err
 	}
@@ -110,3 +130,18 @@ func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
 		w.Write(metadata)
 	}, nil
 }
+
+// algorithmSupport declares the algorithms service providers can negotiate, in the IDP's order of preference
+func (i *IDP) algorithmSupport() *saml.Extensions {
+	if len(i.signatureAlgorithms) == 0 && len(i.digestAlgorithms) == 0 {
+		return nil
+	}
+	extensions := &saml.Extensions{}
+	for _, algorithm := range i.digestAlgorithms {
+		extensions.DigestMethods = append(extensions.DigestMethods, saml.AlgorithmMethod{Algorithm: algorithm})
+	}
+	for _, algorithm := range i.signatureAlgorithms {
+		extensions.SigningMethods = append(extensions.SigningMethods, saml.AlgorithmMethod{Algorithm: algorithm})
+	}
+	return extensions
+}
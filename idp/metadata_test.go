@@ -15,18 +15,69 @@
 package idp
 
 import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/url"
+	"regexp"
 	"testing"
 
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestIDP_DefaultMetadataHandler(t *testing.T) {
 	ts := getTestIDP(t, &IDP{})
 	// try to get server metadata
-	resp, err := ts.Client().Get(ts.URL + "/metadata")
+	resp, err := ts.Client().Get(ts.URL + viper.GetString("metadata-path"))
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer resp.Body.Close()
 	assert.Equal(t, 200, resp.StatusCode, "metadata not found")
 }
+
+func TestIDP_MetadataLocations(t *testing.T) {
+	viper.Set("tls_enable", true)
+	defer viper.Set("tls_enable", false)
+	ts := getTestIDP(t, &IDP{})
+	resp, err := ts.Client().Get(ts.URL + viper.GetString("metadata-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	metadata, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations := regexp.MustCompile(`Location="([^"]*)"`).FindAllStringSubmatch(string(metadata), -1)
+	assert.NotEmpty(t, locations, "metadata should advertise service locations")
+	for _, location := range locations {
+		u, err := url.Parse(location[1])
+		if assert.NoError(t, err) {
+			assert.Equal(t, "https", u.Scheme, "%s should be absolute", location[1])
+			assert.Equal(t, viper.GetString("server-name"), u.Host, "%s should be absolute", location[1])
+		}
+	}
+}
+
+func TestIDP_DefaultMetadataHandler_algorithmSupport(t *testing.T) {
+	ts := getTestIDP(t, &IDP{})
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + viper.GetString("metadata-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.NewDecoder(resp.Body).Decode(ed); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, ed.Extensions, "metadata should declare the supported algorithms") {
+		assert.Equal(t, []string{"http://www.w3.org/2001/04/xmlenc#sha256"},
+			saml.Algorithms(ed.Extensions.DigestMethods), "weaker algorithms than digest-algorithm shouldn't be declared")
+		// Without a signature-algorithm the signer defaults to RSA-SHA1, so the stronger one can be negotiated
+		assert.Equal(t, []string{"http://www.w3.org/2000/09/xmldsig#rsa-sha1", "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"},
+			saml.Algorithms(ed.Extensions.SigningMethods))
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/chriskery/sso-idp/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	persistentNameIDFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	transientNameIDFormat  = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+)
+
+const (
+	// FailNameIDPolicy rejects the login when the persistent NameID can't be read or saved
+	FailNameIDPolicy = "fail"
+	// TransientNameIDPolicy sends a one-time transient NameID when the persistent NameID can't be read or saved
+	TransientNameIDPolicy = "transient"
+)
+
+// NameIDStore keeps the persistent NameIDs issued to service providers. They're opaque, so service providers
+// don't learn the login name, and stay the same between logins.
+type NameIDStore interface {
+	// NameID returns the user's persistent NameID at the service provider, creating one on first use
+	NameID(entityID, user string) (string, error)
+}
+
+// NameIDFallbackAuditor can be implemented by an Auditor to record logins that were sent a transient NameID
+// because the persistent NameID was unavailable
+type NameIDFallbackAuditor interface {
+	LogNameIDFallback(user *model.User, entityID string, err error)
+}
+
+// NewNameIDStore returns a NameIDStore that saves NameIDs, which are handles from the IDGenerator, in the cache. The
+// cache must not expire entries, otherwise users get new NameIDs.
+func NewNameIDStore(cache store.Cache, ids IDGenerator) NameIDStore {
+	return &cacheNameIDStore{cache: cache, ids: ids}
+}
+
+type cacheNameIDStore struct {
+	cache store.Cache
+	ids   IDGenerator
+	// keeps concurrent logins from creating different NameIDs
+	lock sync.Mutex
+}
+
+func (s *cacheNameIDStore) NameID(entityID, user string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := "nameid:" + url.QueryEscape(entityID) + ":" + url.QueryEscape(user)
+	data, err := s.cache.Get(key)
+	if err == nil {
+		return string(data), nil
+	}
+	// Only create a NameID when there isn't one. Replacing one the cache failed to read would
+	// change the user's identity at the service provider.
+	if err != store.ErrNotFound {
+		return "", err
+	}
+	id := s.ids.NewHandle()
+	if err = s.cache.Set(key, []byte(id)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// persistentNameID reports whether the service provider is sent persistent NameIDs from the NameIDStore
+func (sp *ServiceProvider) persistentNameID() bool {
+	return sp != nil && sp.NameIDAttribute == "" && sp.NameIDFormat == persistentNameIDFormat
+}
+
+func checkNameIDPolicy(policy string) error {
+	if policy != FailNameIDPolicy && policy != TransientNameIDPolicy {
+		return fmt.Errorf("unsupported persistent-nameid-failure-policy %s", policy)
+	}
+	return nil
+}
+
+// nameID returns the NameID value and format for the user at the service provider. Its NameIDAttribute is only read
+// from the attributes the attribute-release-rules let the service provider receive.
+func (i *IDP) nameID(sp *ServiceProvider, user *model.User) (string, string) {
+	if sp == nil {
+		return user.Name, user.Format
+	}
+	return sp.nameID(i.releasedAttributes(user, sp.EntityID))
+}
+
+// subjectNameID returns the NameID value and format for the user at the service provider. When a persistent
+// NameID can't be read or saved, persistent-nameid-failure-policy decides between failing the login and
+// sending a transient NameID. The login name is never sent in its place.
+func (i *IDP) subjectNameID(sp *ServiceProvider, user *model.User) (string, string, error) {
+	if !sp.persistentNameID() {
+		value, format := i.nameID(sp, user)
+		return value, format, nil
+	}
+	err := errors.New("no NameIDStore is configured")
+	if i.NameIDs != nil {
+		var id string
+		if id, err = i.NameIDs.NameID(sp.EntityID, user.Name); err == nil {
+			return id, persistentNameIDFormat, nil
+		}
+	}
+	if settings.GetString("persistent-nameid-failure-policy") != TransientNameIDPolicy {
+		return "", "", fmt.Errorf("unable to get persistent NameID of %s for %s: %s", user.Name, sp.EntityID, err)
+	}
+	log.Warnf("sending transient NameID for %s to %s, persistent NameID unavailable: %s", user.Name, sp.EntityID, err)
+	if auditor, ok := i.Auditor.(NameIDFallbackAuditor); ok {
+		auditor.LogNameIDFallback(user, sp.EntityID, err)
+	}
+	return i.IDs.NewID(), transientNameIDFormat, nil
+}
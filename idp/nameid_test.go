@@ -0,0 +1,112 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/store"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// unavailableCache fails like a cache whose backend is down
+type unavailableCache struct{}
+
+func (unavailableCache) Set(string, []byte) error   { return errors.New("connection refused") }
+func (unavailableCache) Get(string) ([]byte, error) { return nil, errors.New("connection refused") }
+func (unavailableCache) Delete(string) error        { return errors.New("connection refused") }
+
+type fallbackAuditor struct {
+	auditor
+	fallbacks []string
+}
+
+func (a *fallbackAuditor) LogNameIDFallback(user *model.User, entityID string, err error) {
+	a.fallbacks = append(a.fallbacks, user.Name+" "+entityID)
+}
+
+func getPersistentNameIDTestIDP(t *testing.T, i *IDP) func() {
+	ts := getTestIDP(t, i)
+	i.sps["https://wiki.example.com"] = &ServiceProvider{
+		EntityID:     "https://wiki.example.com",
+		NameIDFormat: persistentNameIDFormat,
+	}
+	return ts.Close
+}
+
+func TestIDP_makeAuthnResponse_persistentNameID(t *testing.T) {
+	i := &IDP{NameIDs: NewNameIDStore(store.NewLRU(time.Hour, 10), &sequentialIDs{})}
+	defer getPersistentNameIDTestIDP(t, i)()
+	user := &model.User{Name: "joe"}
+	request := &model.AuthnRequest{Issuer: "https://wiki.example.com"}
+
+	resp, err := i.makeAuthnResponse(request, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameID := resp.Assertion.Subject.NameID
+	assert.Equal(t, persistentNameIDFormat, nameID.Format)
+	assert.Equal(t, "handle1", nameID.Value, "the login name must not be sent")
+
+	resp, err = i.makeAuthnResponse(request, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nameID.Value, resp.Assertion.Subject.NameID.Value, "NameID should not change between logins")
+
+	resp, err = i.makeAuthnResponse(request, &model.User{Name: "jane"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, nameID.Value, resp.Assertion.Subject.NameID.Value, "users should have different NameIDs")
+}
+
+func TestIDP_makeAuthnResponse_persistentNameIDFail(t *testing.T) {
+	for name, store := range map[string]NameIDStore{"unavailable": NewNameIDStore(unavailableCache{}, DefaultIDGenerator()), "missing": nil} {
+		t.Run(name, func(t *testing.T) {
+			i := &IDP{NameIDs: store}
+			defer getPersistentNameIDTestIDP(t, i)()
+			_, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "https://wiki.example.com"}, &model.User{Name: "joe"})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestIDP_makeAuthnResponse_persistentNameIDTransient(t *testing.T) {
+	viper.Set("persistent-nameid-failure-policy", TransientNameIDPolicy)
+	defer viper.Set("persistent-nameid-failure-policy", FailNameIDPolicy)
+	auditor := &fallbackAuditor{}
+	i := &IDP{NameIDs: NewNameIDStore(unavailableCache{}, DefaultIDGenerator()), Auditor: auditor}
+	defer getPersistentNameIDTestIDP(t, i)()
+
+	resp, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "https://wiki.example.com"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameID := resp.Assertion.Subject.NameID
+	assert.Equal(t, transientNameIDFormat, nameID.Format)
+	assert.NotEqual(t, "joe", nameID.Value, "the login name must not be sent")
+	assert.Equal(t, []string{"joe https://wiki.example.com"}, auditor.fallbacks)
+}
+
+func TestIDP_configureConstants_nameIDPolicy(t *testing.T) {
+	viper.Set("persistent-nameid-failure-policy", "ignore")
+	defer viper.Set("persistent-nameid-failure-policy", FailNameIDPolicy)
+	assert.Error(t, (&IDP{}).configureConstants())
+}
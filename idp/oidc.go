@@ -0,0 +1,313 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/chriskery/sso-idp/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// oidcCodeBinding marks saved requests from OpenID Connect relying parties, which are answered with an
+// authorization code rather than a SAML response
+const oidcCodeBinding = "urn:openid:connect:authorization-code"
+
+// OIDCClient is an OpenID Connect relying party registered under the oidc-clients key
+//
+//	oidc-clients:
+//	- client-id: portal
+//	  client-secret: $2a$10$...
+//	  redirect-uris: [https://portal.example.org/callback]
+type OIDCClient struct {
+	ID string `mapstructure:"client-id"`
+	// bcrypt hash, created with the hash command, or plain text
+	Secret       string   `mapstructure:"client-secret"`
+	RedirectURIs []string `mapstructure:"redirect-uris"`
+}
+
+func (c *OIDCClient) authenticate(secret string) bool {
+	if isBcryptHash(c.Secret) {
+		return bcrypt.CompareHashAndPassword([]byte(c.Secret), []byte(secret)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Secret), []byte(secret)) == 1
+}
+
+// tokenError is the error response of the token endpoint
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+}
+
+func (i *IDP) configureOIDC() error {
+	clients := []*OIDCClient{}
+	if err := settings.UnmarshalKey("oidc-clients", &clients); err != nil {
+		return err
+	}
+	i.oidcClients = make(map[string]*OIDCClient, len(clients))
+	for _, client := range clients {
+		if client.ID == "" || client.Secret == "" {
+			return errors.New("OpenID Connect clients require a client-id and client-secret")
+		}
+		if len(client.RedirectURIs) == 0 {
+			return errors.New("OpenID Connect clients require at least one redirect URI")
+		}
+		i.oidcClients[client.ID] = client
+	}
+	return nil
+}
+
+// issuer returns the OpenID Connect issuer identifier, the base URL of the IDP
+func (i *IDP) issuer() string {
+	return i.baseURL + i.basePath
+}
+
+// DefaultOIDCDiscoveryHandler serves the OpenID Provider configuration
+func (i *IDP) DefaultOIDCDiscoveryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		algorithms := []string{}
+		if i.tokenSigner != nil {
+			algorithms = append(algorithms, i.tokenSigner.alg)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                i.issuer(),
+			"authorization_endpoint":                i.baseURL + i.path("oidc-authorize-path"),
+			"token_endpoint":                        i.baseURL + i.path("oidc-token-path"),
+			"jwks_uri":                              i.baseURL + i.path("jwks-path"),
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code"},
+			"subject_types_supported":               []string{"public"},
+			"scopes_supported":                      []string{"openid"},
+			"id_token_signing_alg_values_supported": algorithms,
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		})
+	}
+}
+
+// DefaultOIDCAuthorizeHandler starts the authorization code flow. Users are authenticated exactly as they
+// are for SAML service providers, using an existing session, a client certificate or the login form.
+func (i *IDP) DefaultOIDCAuthorizeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			i.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Errors can't be returned to the relying party until its redirect URI is known to be registered
+		clientID := r.Form.Get("client_id")
+		client, ok := i.oidcClients[clientID]
+		if !ok {
+			i.Error(w, "request from an unregistered client", http.StatusBadRequest)
+			return
+		}
+		redirectURI := r.Form.Get("redirect_uri")
+		if !contains(client.RedirectURIs, redirectURI) {
+			i.Error(w, "redirect_uri is not registered for the client", http.StatusBadRequest)
+			return
+		}
+		log.Infof("received authorization request from %s", clientID)
+		state := r.Form.Get("state")
+		if r.Form.Get("response_type") != "code" {
+			redirectWithParameters(w, r, redirectURI, url.Values{
+				"error": {"unsupported_response_type"}, "state": {state}})
+			return
+		}
+		if !contains(strings.Fields(r.Form.Get("scope")), "openid") {
+			redirectWithParameters(w, r, redirectURI, url.Values{
+				"error": {"invalid_scope"}, "error_description": {"the openid scope is required"}, "state": {state}})
+			return
+		}
+		issueInstant, err := ptypes.TimestampProto(i.Clock.Now())
+		if err != nil {
+			i.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		request := &model.AuthnRequest{
+			ID:                          i.IDs.NewID(),
+			IssueInstant:                issueInstant,
+			Issuer:                      clientID,
+			AssertionConsumerServiceURL: redirectURI,
+			ProtocolBinding:             oidcCodeBinding,
+			RelayState:                  state,
+			Nonce:                       r.Form.Get("nonce"),
+		}
+		if err := i.authenticate(request, w, r); err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// sendAuthorizationCode redirects the user back to the relying party with a one-time code for the token endpoint
+func (i *IDP) sendAuthorizationCode(authRequest *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) error {
+	data, err := proto.Marshal(&model.ArtifactResponse{
+		User:    user,
+		Request: authRequest,
+	})
+	if err != nil {
+		return err
+	}
+	code := i.IDs.NewHandle()
+	if err = i.TempCache.Set(codeKey(code), data); err != nil {
+		return err
+	}
+	parameters := url.Values{"code": {code}}
+	if authRequest.RelayState != "" {
+		parameters.Set("state", authRequest.RelayState)
+	}
+	redirectWithParameters(w, r, authRequest.AssertionConsumerServiceURL, parameters)
+	return nil
+}
+
+func redirectWithParameters(w http.ResponseWriter, r *http.Request, target string, parameters url.Values) {
+	u, err := url.Parse(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	query := u.Query()
+	for name, values := range parameters {
+		if len(values) > 0 && values[0] != "" {
+			query[name] = values
+		}
+	}
+	u.RawQuery = query.Encode()
+	// Don't send temporary redirect. We don't want the post resent
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// DefaultOIDCTokenHandler exchanges an authorization code for an ID token. Clients authenticate with their
+// secret using either HTTP Basic or the client_id and client_secret parameters.
+func (i *IDP) DefaultOIDCTokenHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, http.StatusBadRequest, tokenError{"invalid_request", err.Error()})
+			return
+		}
+		clientID, secret, ok := r.BasicAuth()
+		if !ok {
+			clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+		}
+		client, ok := i.oidcClients[clientID]
+		if !ok || !client.authenticate(secret) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+			writeJSON(w, http.StatusUnauthorized, tokenError{"invalid_client", ""})
+			return
+		}
+		if r.PostForm.Get("grant_type") != "authorization_code" {
+			writeJSON(w, http.StatusBadRequest, tokenError{"unsupported_grant_type", ""})
+			return
+		}
+		grant, err := i.redeemCode(r.PostForm.Get("code"))
+		if err != nil {
+			log.Infof("unable to redeem code for %s: %s", clientID, err)
+			writeJSON(w, http.StatusBadRequest, tokenError{"invalid_grant", ""})
+			return
+		}
+		request := grant.Request
+		if request.Issuer != clientID || request.AssertionConsumerServiceURL != r.PostForm.Get("redirect_uri") {
+			writeJSON(w, http.StatusBadRequest, tokenError{"invalid_grant", "the code was issued to another client or redirect_uri"})
+			return
+		}
+		if i.tokenSigner == nil {
+			log.Error("unable to issue an ID token without a token signing key")
+			writeJSON(w, http.StatusInternalServerError, tokenError{"server_error", ""})
+			return
+		}
+		lifetime := settings.GetDuration("assertion-lifetime")
+		idToken, err := i.tokenSigner.sign(i.idTokenClaims(request, grant.User, lifetime))
+		if err != nil {
+			log.Error(err)
+			writeJSON(w, http.StatusInternalServerError, tokenError{"server_error", ""})
+			return
+		}
+		writeJSON(w, http.StatusOK, tokenResponse{
+			// Claims are only delivered in the ID token, so the access token isn't accepted anywhere
+			AccessToken: i.IDs.NewHandle(),
+			TokenType:   "Bearer",
+			ExpiresIn:   int(lifetime.Seconds()),
+			IDToken:     idToken,
+		})
+	}
+}
+
+// redeemCode returns the request and user saved for an authorization code. Codes are one-time use, so they're
+// taken from the cache and concurrent requests can't both redeem one.
+func (i *IDP) redeemCode(code string) (*model.ArtifactResponse, error) {
+	if code == "" {
+		return nil, errors.New("code is required")
+	}
+	data, err := store.Take(i.TempCache, codeKey(code))
+	if err != nil {
+		return nil, err
+	}
+	grant := &model.ArtifactResponse{}
+	if err = proto.Unmarshal(data, grant); err != nil {
+		return nil, err
+	}
+	// Codes are only saved for requests with the code binding, so this is a safeguard
+	if grant.Request == nil || grant.Request.ProtocolBinding != oidcCodeBinding {
+		return nil, errors.New("not an authorization code")
+	}
+	return grant, nil
+}
+
+// codeKey is where the request and user of an authorization code are kept in the TempCache, apart from artifacts
+func codeKey(code string) string {
+	return "code:" + code
+}
+
+// idTokenClaims returns the user's released attributes as claims along with the registered ID token claims.
+// Single valued attributes become strings and the rest arrays.
+func (i *IDP) idTokenClaims(request *model.AuthnRequest, user *model.User, lifetime time.Duration) map[string]interface{} {
+	claims := make(map[string]interface{})
+	for _, att := range i.releasedAttributes(user, request.Issuer).Attributes {
+		if len(att.Value) == 1 {
+			claims[att.Name] = att.Value[0]
+		} else {
+			claims[att.Name] = att.Value
+		}
+	}
+	now := i.Clock.Now()
+	claims["iss"] = i.issuer()
+	claims["sub"] = user.Name
+	claims["aud"] = request.Issuer
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(lifetime).Unix()
+	claims["acr"] = user.Context
+	if request.Nonce != "" {
+		claims["nonce"] = request.Nonce
+	}
+	return claims
+}
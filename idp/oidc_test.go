@@ -0,0 +1,222 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/sign"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_OIDC(t *testing.T) {
+	const callback = "https://portal.example.org/callback"
+	viper.Set("oidc-enabled", true)
+	viper.Set("oidc-clients", []map[string]interface{}{
+		{"client-id": "portal", "client-secret": "secret", "redirect-uris": []string{callback}},
+	})
+	defer viper.Set("oidc-enabled", false)
+	defer viper.Set("oidc-clients", []OIDCClient{})
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Get(ts.URL + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configuration := make(map[string]interface{})
+	err = json.NewDecoder(resp.Body).Decode(&configuration)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, i.issuer(), configuration["issuer"])
+	assert.Equal(t, []interface{}{"RS256"}, configuration["id_token_signing_alg_values_supported"])
+
+	// Log in using an existing session
+	session, err := i.Sessions.Create(&model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "mail", Value: []string{"joe@example.org"}},
+		{Name: "memberOf", Value: []string{"staff", "admins"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize := func(parameters url.Values) *url.URL {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+viper.GetString("oidc-authorize-path")+"?"+parameters.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(i.sessionCookie(session.ID))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if !assert.Equal(t, http.StatusFound, resp.StatusCode) {
+			t.FailNow()
+		}
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return location
+	}
+	location := authorize(url.Values{"client_id": {"portal"}, "redirect_uri": {callback}, "response_type": {"token"},
+		"scope": {"openid"}, "state": {"xyz"}})
+	assert.Equal(t, "unsupported_response_type", location.Query().Get("error"))
+	location = authorize(url.Values{"client_id": {"portal"}, "redirect_uri": {callback}, "response_type": {"code"},
+		"scope": {"openid email"}, "state": {"xyz"}, "nonce": {"n-0S6"}})
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	redeem := func(secret string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+viper.GetString("oidc-token-path"), strings.NewReader(url.Values{
+			"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {callback}}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("portal", secret)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := make(map[string]interface{})
+		if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+	status, _ := redeem("wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, body := redeem("secret")
+	if !assert.Equal(t, http.StatusOK, status, body) {
+		return
+	}
+	resp, err = client.Get(ts.URL + viper.GetString("jwks-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &JWKSet{}
+	err = json.NewDecoder(resp.Body).Decode(keys)
+	resp.Body.Close()
+	if err != nil || len(keys.Keys) != 1 {
+		t.Fatalf("unable to read JWKS: %v", err)
+	}
+	claims := verifyIDToken(t, keys.Keys[0], body["id_token"].(string))
+	assert.Equal(t, i.issuer(), claims["iss"])
+	assert.Equal(t, "joe", claims["sub"])
+	assert.Equal(t, "portal", claims["aud"])
+	assert.Equal(t, "n-0S6", claims["nonce"])
+	assert.Equal(t, "joe@example.org", claims["mail"])
+	assert.Equal(t, []interface{}{"staff", "admins"}, claims["memberOf"])
+
+	status, body = redeem("secret")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", body["error"], "codes should be one-time use")
+}
+
+// verifyIDToken checks the token's signature using an RSA key from the IDP's JWKS and returns its claims
+func verifyIDToken(t *testing.T, jwk JWK, token string) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed token %s", token)
+	}
+	n, _ := base64.RawURLEncoding.DecodeString(jwk.N)
+	e, _ := base64.RawURLEncoding.DecodeString(jwk.E)
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := make(map[string]interface{})
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+// certificateSigner is a Signer provided by an application that shares its key
+type certificateSigner struct {
+	sign.Signer
+	cert tls.Certificate
+}
+
+func (s *certificateSigner) Certificate() tls.Certificate {
+	return s.cert
+}
+
+func TestIDP_redeemCode_artifact(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i)
+	request := &model.AuthnRequest{ID: "_123", Issuer: "portal", ProtocolBinding: oidcCodeBinding}
+	cacheTestArtifact(t, i, request, &model.User{Name: "joe"})
+	// An artifact can't be redeemed as a code, and redeeming it doesn't consume the artifact
+	_, err := i.redeemCode("123456")
+	assert.Error(t, err)
+	_, err = i.TempCache.Get(artifactKey("123456"))
+	assert.NoError(t, err, "the artifact should still be resolvable")
+}
+
+func TestIDP_configureCrypto_tokenKey(t *testing.T) {
+	setConfig(t, "oidc-enabled", true)
+	setConfig(t, "tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	setConfig(t, "tls-private-key", filepath.Join("testdata", "key.pem"))
+	setConfig(t, "tls-ca", filepath.Join("testdata", "certificate.pem"))
+	tlsConfig, err := ConfigureTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := newTestSP(t, "https://signer.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	// The TLS key isn't used in place of a key that isn't known
+	i := &IDP{TLSConfig: tlsConfig, Signer: sp.signer}
+	assert.Error(t, i.configureCrypto(), "tokens can't be signed without the Signer's key")
+
+	i = &IDP{TLSConfig: tlsConfig, Signer: &certificateSigner{sp.signer, sp.cert}}
+	if assert.NoError(t, i.configureCrypto()) {
+		kid, err := keyID(sp.cert.PrivateKey.(crypto.Signer).Public())
+		if assert.NoError(t, err) {
+			assert.Equal(t, kid, i.tokenSigner.kid, "tokens should be signed with the Signer's key")
+		}
+	}
+}
@@ -15,23 +15,60 @@
 package idp
 
 import (
+	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"github.com/chriskery/sso-idp/client"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/chriskery/sso-idp/store"
+	"github.com/chriskery/sso-idp/ui"
 	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // ErrInvalidPassword should be returned by PasswordValidator if
 // the account doesn't exist or the password is incorrect.
 var ErrInvalidPassword = errors.New("invalid login or password")
 
-// PasswordValidator validates a user's password
+// ErrBackendUnavailable should be returned by PasswordValidator if
+// the credential store can't be reached.
+var ErrBackendUnavailable = errors.New("authentication service temporarily unavailable")
+
+// ErrBackendBusy is returned instead of calling the PasswordValidator or AttributeSources when
+// max-concurrent-logins calls to them are already in progress.
+var ErrBackendBusy = errors.New("too many logins in progress. Please try again shortly")
+
+// ErrPasswordExpired should be returned by PasswordValidator if
+// the password is correct but must be changed before the user can log in.
+var ErrPasswordExpired = errors.New("password expired")
+
+// ErrPasswordRejected should be returned by PasswordChanger if
+// the new password doesn't meet the password policy.
+var ErrPasswordRejected = errors.New("the new password doesn't meet the password policy")
+
+// PasswordValidator validates a user's password. Implementations should abandon upstream calls when the context is done.
 type PasswordValidator interface {
-	Validate(user, password string) (map[string][]string, error)
+	Validate(ctx context.Context, user, password string) (map[string][]string, error)
+}
+
+// LoginNamer can be implemented by a PasswordValidator whose users may log in with one of several identifiers,
+// such as their username or email address. It returns the name identifying the user, whichever one they used.
+type LoginNamer interface {
+	LoginName(user string, attrs map[string][]string) string
+}
+
+// PasswordChanger can be implemented by a PasswordValidator whose users may change their own passwords. When
+// password-change-enabled is set, users whose passwords expired are sent to the password change page rather than
+// turned away.
+type PasswordChanger interface {
+	ChangePassword(ctx context.Context, user, oldPassword, newPassword string) error
 }
 
 type ldapValidator struct {
@@ -44,13 +81,117 @@ type UserPassword struct {
 	Password string
 }
 
-func (l *ldapValidator) Validate(user, password string) (map[string][]string, error) {
-	return l.ldapClient.Authenticate(user, password)
+func (l *ldapValidator) Validate(ctx context.Context, user, password string) (map[string][]string, error) {
+	_, span := startSpan(ctx, "ldap authenticate", "")
+	attrs, err := l.ldapClient.Authenticate(ctx, user, password)
+	endSpan(span, err)
+	if errors.Is(err, client.ErrPasswordExpired) {
+		return nil, ErrPasswordExpired
+	}
+	if err != nil && !errors.Is(err, client.ErrInvalidCredentials) {
+		log.Error(err)
+		return nil, ErrBackendUnavailable
+	}
+	return attrs, err
+}
+
+func (l *ldapValidator) LoginName(user string, attrs map[string][]string) string {
+	if name := l.ldapClient.LoginName(attrs); name != "" {
+		return name
+	}
+	return user
+}
+
+func (l *ldapValidator) ChangePassword(ctx context.Context, user, oldPassword, newPassword string) error {
+	_, span := startSpan(ctx, "ldap change password", "")
+	err := l.ldapClient.ChangePassword(ctx, user, oldPassword, newPassword)
+	endSpan(span, err)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, client.ErrInvalidCredentials):
+		return ErrInvalidPassword
+	case errors.Is(err, client.ErrPasswordRejected):
+		log.Info(err)
+		return ErrPasswordRejected
+	case errors.Is(err, client.ErrPasswordExpired):
+		// The directory doesn't let the user change it, only an administrator can
+		log.Info(err)
+		return ErrPasswordExpired
+	default:
+		log.Error(err)
+		return ErrBackendUnavailable
+	}
+}
+
+type staticValidator struct {
+	passwords map[string]string
 }
 
-// LdapValidator returns a sample validator that compares passwords to the bcrypt stored values for a user's password defined in the users key of the IDP's configuration
+func (s *staticValidator) Validate(_ context.Context, user, password string) (map[string][]string, error) {
+	stored, ok := s.passwords[user]
+	if !ok {
+		return nil, ErrInvalidPassword
+	}
+	if isBcryptHash(stored) {
+		if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+			return nil, ErrInvalidPassword
+		}
+		return nil, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) != 1 {
+		return nil, ErrInvalidPassword
+	}
+	return nil, nil
+}
+
+func isBcryptHash(password string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(password, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// StaticPasswordValidator returns a validator for development that checks the passwords of the users key
+// of the IDP's configuration. Passwords may be bcrypt hashes, created with the hash command, or plain text.
+// It must be enabled with allow-static-passwords so it can't be selected by accident in production.
+func StaticPasswordValidator() (PasswordValidator, error) {
+	if !settings.GetBool("allow-static-passwords") {
+		return nil, errors.New("the static password validator is for development only, set allow-static-passwords to use it")
+	}
+	users := []UserPassword{}
+	if err := settings.UnmarshalKey("users", &users); err != nil {
+		return nil, err
+	}
+	log.Warn("USING STATIC PASSWORDS FROM CONFIGURATION, THIS IS NOT SAFE FOR PRODUCTION")
+	passwords := make(map[string]string)
+	for _, user := range users {
+		if user.Password == "" {
+			continue
+		}
+		if !isBcryptHash(user.Password) {
+			log.Warnf("password for %s is stored in plain text", user.Name)
+		}
+		passwords[user.Name] = user.Password
+	}
+	return &staticValidator{passwords}, nil
+}
+
+// LdapValidator returns a validator that checks passwords by binding to the directory configured under the ldap key
+// as the user. The attributes of the user's entry are returned on success.
 func LdapValidator() (PasswordValidator, error) {
-	return &ldapValidator{ldapClient: client.NewLdapClient()}, nil
+	config, err := client.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewLdapValidator(config), nil
+}
+
+// NewLdapValidator returns a validator that binds to the directory described by config
+func NewLdapValidator(config client.Config) PasswordValidator {
+	return &ldapValidator{ldapClient: client.New(config)}
 }
 
 // DefaultPasswordLoginHandler is the default implementation for the password login handler. It can be used as is, wrapped in other handlers, or replaced completely.
@@ -60,6 +201,10 @@ func (i *IDP) DefaultPasswordLoginHandler() http.HandlerFunc {
 			i.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if r.Form.Get("cancel") != "" && settings.GetBool("login-cancel-enabled") {
+			i.CancelLoginHandler(w, r)
+			return
+		}
 		requestID := r.Form.Get("requestId")
 		err := func() error {
 			data, err := i.TempCache.Get(requestID)
@@ -78,12 +223,179 @@ func (i *IDP) DefaultPasswordLoginHandler() http.HandlerFunc {
 				err = errors.New("invalid login or password. Please try again")
 				return err
 			}
+			if backendUnavailable(err) {
+				return err
+			}
+			if err == ErrPasswordExpired {
+				if i.passwordChanger() == nil {
+					return errors.New("your password has expired. Please contact your administrator to change it")
+				}
+				i.loginError(requestID, errors.New("your password has expired. Please choose a new one"))
+				http.Redirect(w, r, fmt.Sprintf("%s?requestId=%s", i.changePasswordPage(), url.QueryEscape(requestID)),
+					http.StatusFound)
+			}
 			return nil
 		}()
+		if backendUnavailable(err) {
+			i.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
-			http.Redirect(w, r, fmt.Sprintf("/idp/static/login.html?requestId=%s&error=%s",
-				url.QueryEscape(requestID), url.QueryEscape(err.Error())),
+			// The login page reports expired requests itself
+			if err != store.ErrNotFound {
+				i.loginError(requestID, err)
+			}
+			http.Redirect(w, r, fmt.Sprintf("%s?requestId=%s", i.loginPage(), url.QueryEscape(requestID)),
 				http.StatusFound)
 		}
 	}
 }
+
+// DefaultCancelLoginHandler is the default implementation for the cancel login handler. Users who give up on the
+// login form are sent back to the service provider with a Response carrying the login-cancel-status rather than
+// leaving it waiting. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultCancelLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			i.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requestID := r.Form.Get("requestId")
+		data, err := i.TempCache.Get(requestID)
+		if err == store.ErrNotFound {
+			// The login page reports expired requests
+			http.Redirect(w, r, fmt.Sprintf("%s?requestId=%s", i.loginPage(), url.QueryEscape(requestID)),
+				http.StatusFound)
+			return
+		}
+		if err != nil {
+			i.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req := &model.AuthnRequest{}
+		if err = proto.Unmarshal(data, req); err != nil {
+			i.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The request is answered, so it can't be used to log in afterwards
+		if err = i.TempCache.Delete(requestID); err != nil {
+			log.Errorf("unable to delete cancelled request %s: %s", requestID, err)
+		}
+		log.Infof("login to %s cancelled", req.Issuer)
+		if err = i.respondCancelled(req, w, r); err != nil {
+			i.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// passwordChanger returns the PasswordValidator if it can change passwords and password-change-enabled is set
+func (i *IDP) passwordChanger() PasswordChanger {
+	if !settings.GetBool("password-change-enabled") {
+		return nil
+	}
+	changer, _ := i.passwordValidator().(PasswordChanger)
+	return changer
+}
+
+// DefaultPasswordChangeHandler is the default implementation for the password change handler. Users whose
+// passwords expired choose a new one, which is then used to log them in and answer the request. It can be used as
+// is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultPasswordChangeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			i.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requestID := r.Form.Get("requestId")
+		err := func() error {
+			data, err := i.TempCache.Get(requestID)
+			if err != nil {
+				return err
+			}
+			req := &model.AuthnRequest{}
+			if err = proto.Unmarshal(data, req); err != nil {
+				return err
+			}
+			changer := i.passwordChanger()
+			if changer == nil {
+				return errors.New("passwords can't be changed here. Please contact your administrator")
+			}
+			userName, newPassword := r.Form.Get("username"), r.Form.Get("new-password")
+			if newPassword == "" {
+				return errors.New("please choose a new password")
+			}
+			if newPassword != r.Form.Get("confirm-password") {
+				return errors.New("the new passwords don't match. Please try again")
+			}
+			release, err := i.acquireBackend()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := withTimeout(r.Context(), "password-validation-timeout")
+			err = changer.ChangePassword(ctx, userName, r.Form.Get("password"), newPassword)
+			cancel()
+			release()
+			switch {
+			case err == ErrInvalidPassword:
+				return errors.New("invalid login or password. Please try again")
+			case err == ErrPasswordExpired:
+				return errors.New("your password can't be changed here. Please contact your administrator")
+			case err == ErrBackendUnavailable || errors.Is(err, context.DeadlineExceeded):
+				log.Errorf("password change for %s failed: %s", userName, err)
+				return ErrBackendUnavailable
+			case err != nil:
+				return err
+			}
+			log.Infof("password changed for %s", userName)
+			user, err := i.loginWithPassword(r, userName, newPassword, req)
+			if err != nil {
+				return err
+			}
+			return i.respond(req, user, w, r)
+		}()
+		if backendUnavailable(err) {
+			i.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			if err != store.ErrNotFound {
+				i.loginError(requestID, err)
+			}
+			http.Redirect(w, r, fmt.Sprintf("%s?requestId=%s", i.changePasswordPage(), url.QueryEscape(requestID)),
+				http.StatusFound)
+		}
+	}
+}
+
+// loginError keeps the error for the page showing the request's login form. It's kept out of the URL so it doesn't
+// end up in browser history and access logs.
+func (i *IDP) loginError(requestID string, err error) {
+	if requestID == "" {
+		return
+	}
+	if err := i.TempCache.Set(loginErrorKey(requestID), []byte(err.Error())); err != nil {
+		log.Errorf("unable to save login error: %s", err)
+	}
+}
+
+// loginErrorKey is where the error of the last login attempt for the request is kept in the TempCache
+func loginErrorKey(requestID string) string {
+	return "loginerror:" + requestID
+}
+
+// withLoginError has the login and password change pages show the error of the last attempt for the request, or
+// that the login expired when the request is gone. The error is only shown once.
+func (i *IDP) withLoginError(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.URL.Query().Get("requestId")
+		if (r.URL.Path == i.loginPage() || r.URL.Path == i.changePasswordPage()) && requestID != "" {
+			if _, err := i.TempCache.Get(requestID); err == store.ErrNotFound {
+				r = r.WithContext(ui.WithLoginError(r.Context(), "This login has expired. Please log in again", true))
+			} else if message, err := i.TempCache.Get(loginErrorKey(requestID)); err == nil {
+				i.TempCache.Delete(loginErrorKey(requestID))
+				r = r.WithContext(ui.WithLoginError(r.Context(), string(message), false))
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -15,19 +15,24 @@
 package idp
 
 import (
-	"errors"
+	"context"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
 
 	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/store"
 	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestIDP_DefaultPasswordLoginHandler(t *testing.T) {
-	i := &IDP{}
+	i := &IDP{PasswordValidator: stubValidator{ErrInvalidPassword}}
 	ts := getTestIDP(t, i)
 	defer ts.Close()
 	// Need to cache request before attempting a login
@@ -42,12 +47,357 @@ func TestIDP_DefaultPasswordLoginHandler(t *testing.T) {
 	client := ts.Client()
 	// Don't follow redirects. Want to see if we were going back to login form or not
 	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
-		return errors.New("no redirects allowed")
+		return http.ErrUseLastResponse
 	}
-	_, err = client.PostForm(ts.URL+"/ui/login.html", url.Values{"requestId": {"1234"}})
-	assert.True(t, strings.Contains(err.Error(), "Invalid+login+or+password"), "login should have failed")
-	if err == nil {
-		t.Fatal("login should have failed")
+	resp, err := client.PostForm(ts.URL+viper.GetString("login-page-path"), url.Values{"requestId": {"1234"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "login should have failed")
+	location := resp.Header.Get("Location")
+	assert.Equal(t, viper.GetString("login-page-path")+"?requestId=1234", location, "the error should be kept out of the URL")
+	loginPage := func(location string) string {
+		resp, err := client.Get(ts.URL + location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	assert.Contains(t, loginPage(location), `id="errorMsg">invalid login or password. Please try again`,
+		"login page should show the error")
+	assert.NotContains(t, loginPage(location), "invalid login or password", "the error should only be shown once")
+	assert.Contains(t, loginPage(viper.GetString("login-page-path")+"?requestId=expired"),
+		`id="errorMsg" data-expired="true">This login has expired`)
+}
+
+type stubValidator struct {
+	err error
+}
+
+func (v stubValidator) Validate(context.Context, string, string) (map[string][]string, error) {
+	return nil, v.err
+}
+
+func TestIDP_DefaultPasswordLoginHandler_backendUnavailable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		status   int
+		location string
+	}{
+		{"unavailable", ErrBackendUnavailable, http.StatusServiceUnavailable, ""},
+		{"timeout", context.DeadlineExceeded, http.StatusServiceUnavailable, ""},
+		{"invalid", ErrInvalidPassword, http.StatusFound, "requestId=1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := &IDP{PasswordValidator: stubValidator{tt.err}}
+			ts := getTestIDP(t, i)
+			defer ts.Close()
+			data, err := proto.Marshal(&model.AuthnRequest{ID: "2134"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			i.TempCache.Set("1234", data)
+			r := httptest.NewRequest(http.MethodPost, viper.GetString("login-page-path"),
+				strings.NewReader(url.Values{"requestId": {"1234"}, "username": {"joe"}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			i.DefaultPasswordLoginHandler()(w, r)
+			assert.Equal(t, tt.status, w.Code)
+			assert.Contains(t, w.Header().Get("Location"), tt.location)
+			assert.NotContains(t, w.Header().Get("Location"), "error")
+		})
+	}
+}
+
+// blockingValidator is a PasswordValidator that reports each call and waits until it's released
+type blockingValidator struct {
+	called  chan struct{}
+	release chan struct{}
+}
+
+func (v blockingValidator) Validate(context.Context, string, string) (map[string][]string, error) {
+	v.called <- struct{}{}
+	<-v.release
+	return nil, ErrInvalidPassword
+}
+
+func TestIDP_DefaultPasswordLoginHandler_maxConcurrentLogins(t *testing.T) {
+	viper.Set("max-concurrent-logins", 1)
+	defer viper.Set("max-concurrent-logins", 0)
+	validator := blockingValidator{make(chan struct{}), make(chan struct{})}
+	i := &IDP{PasswordValidator: validator}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	login := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, viper.GetString("login-page-path"),
+			strings.NewReader(url.Values{"requestId": {"1234"}, "username": {"joe"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		i.DefaultPasswordLoginHandler()(w, r)
+		return w
+	}
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- login() }()
+	<-validator.called
+	w := login()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "a login beyond the limit should be turned away")
+	assert.Contains(t, w.Body.String(), ErrBackendBusy.Error())
+	close(validator.release)
+	assert.Equal(t, http.StatusFound, (<-first).Code)
+
+	// The first login's call is over, so there's room for another
+	go func() { <-validator.called }()
+	assert.Equal(t, http.StatusFound, login().Code)
+}
+
+// changingValidator is a PasswordValidator whose users must change the password before they can log in
+type changingValidator struct {
+	passwords map[string]string
+	expired   map[string]bool
+}
+
+func (v *changingValidator) Validate(_ context.Context, user, password string) (map[string][]string, error) {
+	if stored, ok := v.passwords[user]; !ok || stored != password {
+		return nil, ErrInvalidPassword
+	}
+	if v.expired[user] {
+		return nil, ErrPasswordExpired
+	}
+	return nil, nil
+}
+
+func (v *changingValidator) ChangePassword(_ context.Context, user, oldPassword, newPassword string) error {
+	if stored, ok := v.passwords[user]; !ok || stored != oldPassword {
+		return ErrInvalidPassword
+	}
+	if len(newPassword) < 8 {
+		return ErrPasswordRejected
+	}
+	v.passwords[user] = newPassword
+	v.expired[user] = false
+	return nil
+}
+
+func TestIDP_DefaultPasswordChangeHandler(t *testing.T) {
+	viper.Set("password-change-enabled", true)
+	defer viper.Set("password-change-enabled", false)
+	// The built-in UI has to have the password change page
+	setConfig(t, "assets-path", "")
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	validator := &changingValidator{map[string]string{"joe": "expired"}, map[string]bool{"joe": true}}
+	i := &IDP{PasswordValidator: validator}
+	ts := startTestIDP(t, i, sp)
+	// Without the service provider's certificate, which would log in with PKI
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(sp.authnRequestURL("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	requestID, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(page string, form url.Values) *http.Response {
+		form.Set("requestId", requestID.Query().Get("requestId"))
+		resp, err := client.PostForm(ts.URL+page, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	get := func(location string) string {
+		resp, err := client.Get(ts.URL + location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	changePage := viper.GetString("password-change-page-path")
+
+	resp = post(viper.GetString("login-page-path"), url.Values{"username": {"joe"}, "password": {"expired"}})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	assert.True(t, strings.HasPrefix(location, changePage+"?requestId="), "should be sent to change the password")
+	page := get(location)
+	assert.Contains(t, page, `id="errorMsg">your password has expired. Please choose a new one`)
+	assert.Contains(t, page, `name="new-password"`, "should render the password change form")
+
+	tests := []struct {
+		name string
+		form url.Values
+		want string
+	}{
+		{"mismatch", url.Values{"username": {"joe"}, "password": {"expired"}, "new-password": {"changed-it"}, "confirm-password": {"changed-if"}}, "the new passwords don&#39;t match"},
+		{"wrong password", url.Values{"username": {"joe"}, "password": {"wrong"}, "new-password": {"changed-it"}, "confirm-password": {"changed-it"}}, "invalid login or password"},
+		{"rejected", url.Values{"username": {"joe"}, "password": {"expired"}, "new-password": {"short"}, "confirm-password": {"short"}}, "the new password doesn&#39;t meet the password policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := post(changePage, tt.form)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusFound, resp.StatusCode)
+			assert.Contains(t, get(resp.Header.Get("Location")), `id="errorMsg">`+tt.want)
+		})
+	}
+
+	resp = post(changePage, url.Values{"username": {"joe"}, "password": {"expired"}, "new-password": {"changed-it"}, "confirm-password": {"changed-it"}})
+	if resp, err = sp.deliver(resp); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	if assert.NotNil(t, sp.assertion, "should log in with the new password") {
+		assert.Equal(t, "joe", sp.assertion.Subject.NameID.Value)
+	}
+	assert.Equal(t, "state", sp.relayState)
+	assert.Equal(t, "changed-it", validator.passwords["joe"])
+}
+
+func TestIDP_DefaultPasswordLoginHandler_passwordExpired(t *testing.T) {
+	i := &IDP{PasswordValidator: &changingValidator{map[string]string{"joe": "expired"}, map[string]bool{"joe": true}}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	r := httptest.NewRequest(http.MethodPost, viper.GetString("login-page-path"),
+		strings.NewReader(url.Values{"requestId": {"1234"}, "username": {"joe"}, "password": {"expired"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	i.DefaultPasswordLoginHandler()(w, r)
+	assert.Equal(t, viper.GetString("login-page-path")+"?requestId=1234", w.Header().Get("Location"),
+		"the password can't be changed unless password-change-enabled is set")
+	message, err := i.TempCache.Get(loginErrorKey("1234"))
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(message), "contact your administrator")
+	}
+}
+
+func TestIDP_DefaultCancelLoginHandler(t *testing.T) {
+	viper.Set("login-cancel-enabled", true)
+	defer viper.Set("login-cancel-enabled", false)
+	bindings := map[string]string{
+		"post":     "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+		"artifact": "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+	}
+	for name, binding := range bindings {
+		t.Run(name, func(t *testing.T) {
+			sp := newTestSP(t, "https://"+name+".example.com", binding)
+			i := &IDP{PasswordValidator: stubValidator{ErrInvalidPassword}}
+			ts := startTestIDP(t, i, sp)
+			client := ts.Client()
+			client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+			resp, err := client.Get(sp.authnRequestURL("state"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			location, err := url.Parse(resp.Header.Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			requestID := location.Query().Get("requestId")
+			resp, err = client.PostForm(ts.URL+viper.GetString("login-page-path"),
+				url.Values{"requestId": {requestID}, "cancel": {"true"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp, err = sp.deliver(resp); err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			// The service provider is sent a status instead of an assertion
+			assert.Nil(t, sp.assertion)
+			if assert.NotNil(t, sp.status) && assert.NotNil(t, sp.status.StatusCode.StatusCode) {
+				assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Responder", sp.status.StatusCode.Value)
+				assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed", sp.status.StatusCode.StatusCode.Value)
+			}
+			_, err = i.TempCache.Get(requestID)
+			assert.Equal(t, store.ErrNotFound, err, "a cancelled request can't be used to log in")
+		})
+	}
+}
+
+func TestIDP_DefaultPasswordLoginHandler_cancelDisabled(t *testing.T) {
+	i := &IDP{PasswordValidator: stubValidator{ErrInvalidPassword}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	r := httptest.NewRequest(http.MethodPost, viper.GetString("login-page-path"),
+		strings.NewReader(url.Values{"requestId": {"1234"}, "cancel": {"true"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	i.DefaultPasswordLoginHandler()(w, r)
+	assert.Equal(t, viper.GetString("login-page-path")+"?requestId=1234", w.Header().Get("Location"),
+		"cancelling should be ignored unless login-cancel-enabled is set")
+	_, err = i.TempCache.Get("1234")
+	assert.NoError(t, err)
+}
+
+func TestStaticPasswordValidator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("users", []map[string]interface{}{
+		{"name": "joe", "password": "plain"},
+		{"name": "jane", "password": string(hash)},
+		{"name": "john"},
+	})
+	defer viper.Set("users", nil)
+	_, err = StaticPasswordValidator()
+	assert.Error(t, err, "should require allow-static-passwords")
+
+	viper.Set("allow-static-passwords", true)
+	defer viper.Set("allow-static-passwords", false)
+	validator, err := StaticPasswordValidator()
+	if err != nil {
+		t.Fatal(err)
 	}
-	assert.True(t, strings.Contains(err.Error(), "Invalid+login+or+password"), "login should have redirected to page with error")
+	ctx := context.Background()
+	_, err = validator.Validate(ctx, "joe", "plain")
+	assert.NoError(t, err)
+	_, err = validator.Validate(ctx, "jane", "hashed")
+	assert.NoError(t, err)
+	_, err = validator.Validate(ctx, "jane", string(hash))
+	assert.Equal(t, ErrInvalidPassword, err, "the hash isn't the password")
+	_, err = validator.Validate(ctx, "joe", "wrong")
+	assert.Equal(t, ErrInvalidPassword, err)
+	_, err = validator.Validate(ctx, "john", "")
+	assert.Equal(t, ErrInvalidPassword, err, "users without passwords can't log in")
+	_, err = validator.Validate(ctx, "nobody", "plain")
+	assert.Equal(t, ErrInvalidPassword, err)
 }
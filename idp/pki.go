@@ -15,15 +15,31 @@
 package idp
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
 	"net/http"
 	"strings"
 
 	"github.com/amdonov/xmlsig"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/chriskery/sso-idp/sign"
+	"github.com/spf13/viper"
 )
 
 func getCertFromRequest(r *http.Request) (*x509.Certificate, error) {
@@ -76,3 +92,181 @@ func getSubjectDN(subject pkix.Name) string {
 	}
 	return strings.Join(rdns, ", ")
 }
+
+// pkcs11Certificate pairs the signing certificate with the private key held by the configured PKCS#11 token.
+// The signing-certificate chain is used when provided, otherwise the TLS certificate chain.
+func pkcs11Certificate(tlsCert tls.Certificate) (tls.Certificate, error) {
+	chain := tlsCert.Certificate
+	if path := settings.GetString("signing-certificate"); path != "" {
+		var err error
+		if chain, err = readCertificates(path); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	key, err := sign.PKCS11Key(sign.PKCS11Config{
+		Module:   settings.GetString("pkcs11.module"),
+		Slot:     settings.GetInt("pkcs11.slot"),
+		Pin:      settings.GetString("pkcs11.pin"),
+		KeyLabel: settings.GetString("pkcs11.key-label"),
+	})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err = matchCertificate(key, chain[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: chain, PrivateKey: key}, nil
+}
+
+// matchCertificate returns an error when the certificate isn't for the key, so a token holding the wrong key fails
+// at startup rather than producing signatures no service provider can verify
+func matchCertificate(key crypto.Signer, der []byte) error {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	certKey, err := marshalPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	signingKey, err := marshalPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certKey, signingKey) {
+		return fmt.Errorf("the PKCS#11 key doesn't match the signing certificate %s", getSubjectDN(cert.Subject))
+	}
+	return nil
+}
+
+// readCertificates returns the DER encoded certificates in a PEM file
+func readCertificates(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, block.Bytes)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return certs, nil
+}
+
+// spTrustAnchors returns the certificates in the sp-trust-anchors of the configuration, which must have issued the
+// service providers' certificates, or nil when service provider certificates aren't verified
+func spTrustAnchors(config *viper.Viper) (*x509.CertPool, error) {
+	path := config.GetString("sp-trust-anchors")
+	if path == "" {
+		return nil, nil
+	}
+	certs, err := readCertificates(path)
+	if err != nil {
+		return nil, err
+	}
+	anchors := x509.NewCertPool()
+	for _, der := range certs {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		anchors.AddCert(cert)
+	}
+	return anchors, nil
+}
+
+// publicKeyFromKeyValue builds the public key from an XML Signature KeyValue
+func publicKeyFromKeyValue(kv *saml.KeyValue) (interface{}, error) {
+	switch {
+	case kv.RSAKeyValue != nil:
+		n, err := decodeCryptoBinary(kv.RSAKeyValue.Modulus)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeCryptoBinary(kv.RSAKeyValue.Exponent)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > math.MaxInt32 {
+			return nil, errors.New("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case kv.DSAKeyValue != nil:
+		values := make([]*big.Int, 4)
+		for j, v := range []string{kv.DSAKeyValue.P, kv.DSAKeyValue.Q, kv.DSAKeyValue.G, kv.DSAKeyValue.Y} {
+			value, err := decodeCryptoBinary(v)
+			if err != nil {
+				return nil, err
+			}
+			values[j] = value
+		}
+		return &dsa.PublicKey{
+			Parameters: dsa.Parameters{P: values[0], Q: values[1], G: values[2]},
+			Y:          values[3],
+		}, nil
+	case kv.ECKeyValue != nil:
+		var curve elliptic.Curve
+		switch kv.ECKeyValue.NamedCurve.URI {
+		case "urn:oid:1.2.840.10045.3.1.7":
+			curve = elliptic.P256()
+		case "urn:oid:1.3.132.0.34":
+			curve = elliptic.P384()
+		case "urn:oid:1.3.132.0.35":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported named curve %s", kv.ECKeyValue.NamedCurve.URI)
+		}
+		point, err := base64.StdEncoding.DecodeString(strings.TrimSpace(kv.ECKeyValue.PublicKey))
+		if err != nil {
+			return nil, err
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errors.New("invalid EC public key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("KeyValue does not contain a supported key")
+}
+
+func decodeCryptoBinary(value string) (*big.Int, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("KeyValue is missing a required value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// marshalPublicKey encodes the key as a PKIX SubjectPublicKeyInfo. The standard library can parse, but not
+// marshal, DSA keys so those are encoded here.
+func marshalPublicKey(key interface{}) ([]byte, error) {
+	dsaKey, ok := key.(*dsa.PublicKey)
+	if !ok {
+		return x509.MarshalPKIXPublicKey(key)
+	}
+	params, err := asn1.Marshal(dsa.Parameters{P: dsaKey.P, Q: dsaKey.Q, G: dsaKey.G})
+	if err != nil {
+		return nil, err
+	}
+	y, err := asn1.Marshal(dsaKey.Y)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 10040, 4, 1},
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		PublicKey: asn1.BitString{Bytes: y, BitLength: 8 * len(y)},
+	})
+}
@@ -1,9 +1,21 @@
 package idp
 
 import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"path/filepath"
 	"testing"
 
 	"github.com/amdonov/xmlsig"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGetCertFromXML(t *testing.T) {
@@ -37,3 +49,88 @@ VAMtigDCrxuwesx681g/cdi9oXWmRSB3wt7LXHcvxGWz9Db45iWyMRDh0scqdiQ=`,
 		t.Fatal("dn didn't match expected value")
 	}
 }
+
+func TestIDP_configureCrypto_signingBackend(t *testing.T) {
+	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
+	viper.Set("tls-ca", filepath.Join("testdata", "certificate.pem"))
+	defer viper.Set("signing-backend", "file")
+
+	viper.Set("signing-backend", "keyvault")
+	i := &IDP{}
+	assert.EqualError(t, i.configureCrypto(), "unsupported signing-backend keyvault")
+
+	viper.Set("signing-backend", "pkcs11")
+	viper.Set("pkcs11.module", "")
+	i = &IDP{}
+	assert.EqualError(t, i.configureCrypto(), "a PKCS#11 module is required")
+
+	viper.Set("pkcs11.module", filepath.Join("testdata", "missing-pkcs11.so"))
+	viper.Set("pkcs11.key-label", "idp")
+	defer viper.Set("pkcs11.module", "")
+	i = &IDP{}
+	assert.Error(t, i.configureCrypto(), "missing PKCS#11 module should fail")
+}
+
+func Test_matchCertificate(t *testing.T) {
+	signer := newTestSP(t, "https://signer.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	other := newTestSP(t, "https://other.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	key := signer.cert.PrivateKey.(crypto.Signer)
+	assert.NoError(t, matchCertificate(key, signer.cert.Certificate[0]))
+	assert.Error(t, matchCertificate(key, other.cert.Certificate[0]), "a certificate for another key should be rejected")
+}
+
+func TestPublicKeyFromKeyValue(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dsaKey dsa.PrivateKey
+	if err = dsa.GenerateParameters(&dsaKey.Parameters, rand.Reader, dsa.L1024N160); err != nil {
+		t.Fatal(err)
+	}
+	if err = dsa.GenerateKey(&dsaKey, rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	encode := func(i *big.Int) string {
+		return base64.StdEncoding.EncodeToString(i.Bytes())
+	}
+	ecValue := &saml.ECKeyValue{
+		PublicKey: base64.StdEncoding.EncodeToString(elliptic.Marshal(ecKey.Curve, ecKey.X, ecKey.Y)),
+	}
+	ecValue.NamedCurve.URI = "urn:oid:1.2.840.10045.3.1.7"
+	tests := []struct {
+		name     string
+		keyValue *saml.KeyValue
+		want     interface{}
+	}{
+		{"ec", &saml.KeyValue{ECKeyValue: ecValue}, &ecKey.PublicKey},
+		{"dsa", &saml.KeyValue{DSAKeyValue: &saml.DSAKeyValue{
+			P: encode(dsaKey.P),
+			Q: encode(dsaKey.Q),
+			G: encode(dsaKey.G),
+			Y: encode(dsaKey.Y),
+		}}, &dsaKey.PublicKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := publicKeyFromKeyValue(tt.keyValue)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, key)
+			// keys are saved to the configuration in PKIX form
+			der, err := marshalPublicKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := x509.ParsePKIXPublicKey(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, parsed)
+		})
+	}
+	_, err = publicKeyFromKeyValue(&saml.KeyValue{})
+	assert.Error(t, err)
+}
@@ -27,13 +27,10 @@ import (
 
 func (i *IDP) sendPostResponse(authRequest *model.AuthnRequest, user *model.User,
 	w io.Writer, r *http.Request) error {
-	response := i.makeAuthnResponse(authRequest, user)
-	// Don't need to change the response. Go ahead and sign it
-	signature, err := i.signer.CreateSignature(response.Assertion)
+	response, err := i.buildSignedResponse(requestContext(r), authRequest, user)
 	if err != nil {
 		return err
 	}
-	response.Assertion.Signature = signature
 	var xmlbuff bytes.Buffer
 	memWriter := bufio.NewWriter(&xmlbuff)
 	memWriter.Write([]byte(xml.Header))
@@ -67,9 +64,9 @@ you must press the Continue button once to proceed.
 </noscript>
 <form action="{{ .AssertionConsumerServiceURL }}" method="post" id="samlpost">
 <div>
-<input type="hidden" name="RelayState"
+{{ if .RelayState }}<input type="hidden" name="RelayState"
 value="{{ .RelayState }}"/>
-<input type="hidden" name="SAMLResponse"
+{{ end }}<input type="hidden" name="SAMLResponse"
 value="{{ .SAMLResponse }}"/>
 </div>
 <noscript>
@@ -16,10 +16,15 @@ package idp
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/xml"
 	"testing"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/beevik/etree"
 	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/sign"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,4 +46,57 @@ func TestIDP_sendPostResponse(t *testing.T) {
 	value, ok := doc.Find("#samlpost").Attr("action")
 	assert.True(t, ok, "failed to find form")
 	assert.Equal(t, "testsvc", value, "assertion consumer service url doesn't match")
+	// The response should be addressed to the assertion consumer service
+	samlResponse, ok := doc.Find("input[name=SAMLResponse]").Attr("value")
+	assert.True(t, ok, "failed to find SAMLResponse")
+	data, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &saml.Response{}
+	if err = xml.Unmarshal(data, response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "testsvc", response.Destination, "response destination doesn't match")
+}
+
+func TestIDP_sendPostResponse_typedAttributes(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i)
+	var b bytes.Buffer
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "age", Value: []string{"9"}, Type: "xs:integer"},
+	}}
+	if err := i.sendPostResponse(&model.AuthnRequest{AssertionConsumerServiceURL: "testsvc"}, user, &b, nil); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samlResponse, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+	data, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), `xmlns:xs="http://www.w3.org/2001/XMLSchema"`, "xs prefix should be declared")
+	assert.Contains(t, string(data), `xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="xs:integer"`)
+	// The namespace declarations must not break the assertion's signature
+	_, err = sign.NewValidator().Validate(string(data))
+	assert.NoError(t, err)
+
+	// Service providers may process the assertion apart from the Response, so it declares the prefix itself
+	parsed := etree.NewDocument()
+	if err = parsed.ReadFromBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	detached := etree.NewDocument()
+	detached.SetRoot(parsed.FindElement("//Assertion").Copy())
+	assertion, err := detached.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, assertion, `xmlns:xs="http://www.w3.org/2001/XMLSchema"`)
+	_, err = sign.NewValidator().Validate(assertion)
+	assert.NoError(t, err, "the detached assertion's signature should verify")
 }
@@ -1,93 +1,200 @@
 package idp
 
 import (
+	"bytes"
 	"encoding/xml"
 	"net/http"
-	"time"
 
 	"github.com/chriskery/sso-idp/model"
 	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
 	log "github.com/sirupsen/logrus"
 )
 
+// Statuses of responses to attribute queries the IDP can't answer
+const (
+	requesterStatus        = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	responderStatus        = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+	requestDeniedStatus    = "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"
+	unknownPrincipalStatus = "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal"
+)
+
+// unspecifiedAttributeNameFormat is the NameFormat of requested attributes that match any NameFormat
+const unspecifiedAttributeNameFormat = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+
 // DefaultQueryHandler is the default implementation for the attribute query handler. It can be used as is, wrapped in other handlers, or replaced completely.
+// It answers AttributeQuery messages sent with the SAML SOAP binding. Service providers authenticate with the client
+// certificate they're registered with or by signing the query. The subject's NameID is taken as the login name, and
+// its attributes are read from the AttributeSources and released following the attribute-release-rules. Queries
+// that can't be parsed are answered with a SOAP fault, other failures with the status of the Response.
 func (i *IDP) DefaultQueryHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := func() error {
-			decoder := xml.NewDecoder(r.Body)
-			attributeEnv := &saml.AttributeQueryEnv{}
-			if err := decoder.Decode(&attributeEnv); err != nil {
-				return err
-			}
-			query := attributeEnv.Body.Query
-			user := &model.User{
-				Name:   query.Subject.NameID.Value,
-				Format: query.Subject.NameID.Format,
-			}
-			if err := i.setUserAttributes(user, nil); err != nil {
-				return err
-			}
-			response := i.makeResponse(query.ID, query.Issuer, user)
-			env := &saml.AttributeRespEnv{
-				Body: saml.AttributeRespBody{
-					Response: *response,
-				},
-			}
-			now := time.Now().UTC()
-			fiveMinutes, _ := time.ParseDuration("5m")
-			fiveFromNow := now.Add(fiveMinutes)
-			attrResp := &saml.AttributeRespEnv{
-				Body: saml.AttributeRespBody{
-					Response: saml.Response{
-						StatusResponseType: saml.StatusResponseType{
-							Version:      "2.0",
-							ID:           saml.NewID(),
-							IssueInstant: now,
-							Status: &saml.Status{
-								StatusCode: saml.StatusCode{
-									Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
-								},
-							},
-							InResponseTo: query.ID,
-							Issuer:       saml.NewIssuer(i.entityID),
-						},
-						Assertion: &saml.Assertion{
-							Issuer:       saml.NewIssuer(i.entityID),
-							IssueInstant: now,
-							ID:           saml.NewID(),
-							Version:      "2.0",
-							Subject: &saml.Subject{
-								NameID: query.Subject.NameID,
-							},
-							AttributeStatement: user.AttributeStatement(),
-							Conditions: &saml.Conditions{
-								NotBefore:           now,
-								NotOnOrAfter:        fiveFromNow,
-								AudienceRestriction: &saml.AudienceRestriction{Audience: query.Issuer},
-							},
-						},
-					},
-				},
+		body, err := readSOAPRequest(w, r)
+		if err != nil {
+			log.Infof("unable to read AttributeQuery: %s", err)
+			sendSOAPFault(i, w, faultCode(err), err.Error())
+			return
+		}
+		env := &saml.AttributeQueryEnv{}
+		if err = xml.Unmarshal(body, env); err != nil {
+			log.Infof("unable to parse AttributeQuery: %s", err)
+			sendSOAPFault(i, w, "SOAP-ENV:Client", "unable to parse AttributeQuery: "+err.Error())
+			return
+		}
+		query := &env.Body.Query
+		response, err := i.answerAttributeQuery(r, body, query)
+		if err != nil {
+			log.Errorf("unable to answer attribute query from %s: %s", query.Issuer, err)
+			sendSOAPFault(i, w, "SOAP-ENV:Server", "unable to answer AttributeQuery")
+			return
+		}
+		i.writeAttributeResponse(w, saml.AttributeRespEnv{Body: saml.AttributeRespBody{Response: *response}})
+	}
+}
+
+// answerAttributeQuery returns the Response to the query, with a signed assertion of the subject's released
+// attributes or an error status
+func (i *IDP) answerAttributeQuery(r *http.Request, body []byte, query *saml.AttributeQuery) (*saml.Response, error) {
+	sp, err := i.authenticateAttributeQuery(r, body, query)
+	if err != nil {
+		log.Warnf("rejected attribute query from %q: %s", query.Issuer, err)
+		return i.makeQueryStatusResponse(query, requesterStatus, requestDeniedStatus), nil
+	}
+	// Transient and persistent NameIDs can't be mapped back to the user
+	subject := query.Subject.NameID
+	if subject == nil || subject.Value == "" ||
+		subject.Format == transientNameIDFormat || subject.Format == persistentNameIDFormat {
+		log.Infof("unable to resolve the subject of the attribute query from %s", sp.EntityID)
+		return i.makeQueryStatusResponse(query, requesterStatus, unknownPrincipalStatus), nil
+	}
+	user := &model.User{Name: subject.Value, Format: subject.Format}
+	request := &model.AuthnRequest{ID: query.ID, Issuer: sp.EntityID}
+	err = i.setUserAttributes(r.Context(), user, request)
+	switch {
+	case err == ErrUnknownSubject, err == nil && len(user.Attributes) == 0:
+		log.Infof("attribute query from %s for unknown subject %s", sp.EntityID, user.Name)
+		return i.makeQueryStatusResponse(query, requesterStatus, unknownPrincipalStatus), nil
+	case err != nil:
+		log.Errorf("unable to read the attributes of %s for %s: %s", user.Name, sp.EntityID, err)
+		return i.makeQueryStatusResponse(query, responderStatus, ""), nil
+	}
+	// Service providers the user may not log in to don't get the user's attributes either
+	if err = i.authorize(request, user); err != nil {
+		i.logAccessDenied(request, user, err)
+		return i.makeQueryStatusResponse(query, responderStatus, settings.GetString("access-denied-status")), nil
+	}
+	response := i.makeResponse(query.ID, sp.EntityID, user, subject.Value, subject.Format)
+	if len(query.Attribute) > 0 {
+		response.Assertion.AttributeStatement = requestedAttributes(response.Assertion.AttributeStatement, query.Attribute)
+	}
+	// The assertion must be about the subject that was queried
+	nameID := *subject
+	response.Assertion.Subject.NameID = &nameID
+	if err = i.limitAssertion(request, user, response.Assertion); err != nil {
+		log.Warnf("unable to answer attribute query from %s: %s", sp.EntityID, err)
+		return i.makeQueryStatusResponse(query, responderStatus, ""), nil
+	}
+	signer, err := i.signerFor(sp.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if err = signAssertion(signer, response.Assertion); err != nil {
+		return nil, err
+	}
+	log.Infof("answered attribute query from %s for %s", sp.EntityID, user.Name)
+	return response, nil
+}
+
+// authenticateAttributeQuery returns the registered service provider that sent the query, authenticated by
+// authenticateSOAPRequest. The query is replaced with what was signed.
+func (i *IDP) authenticateAttributeQuery(r *http.Request, body []byte, query *saml.AttributeQuery) (*ServiceProvider, error) {
+	sp, signed, err := i.authenticateSOAPRequest(r, body, query.RequestAbstractType, query.Signature)
+	if err != nil || signed == nil {
+		return sp, err
+	}
+	signedQuery := &saml.AttributeQuery{}
+	if err = xml.Unmarshal(signed, signedQuery); err != nil {
+		return nil, err
+	}
+	signedQuery.Signature = query.Signature
+	*query = *signedQuery
+	return sp, nil
+}
+
+// requestedAttributes limits the released attributes to those requested, matched by name and by NameFormat when
+// the request sets one other than unspecified. When values are requested, only those of the attribute's values are
+// returned. The statement is empty when nothing requested was released.
+func requestedAttributes(released *saml.AttributeStatement, requested []saml.Attribute) *saml.AttributeStatement {
+	statement := &saml.AttributeStatement{}
+	if released == nil {
+		return statement
+	}
+	for _, attribute := range released.Attribute {
+		for _, request := range requested {
+			if request.Name != attribute.Name {
+				continue
 			}
-			resp := attrResp.Body.Response
-			signature, err := i.signer.CreateSignature(resp.Assertion)
-			// TODO confirm appropriate error response for this service
-			if err != nil {
-				return err
+			if request.NameFormat != "" && request.NameFormat != unspecifiedAttributeNameFormat &&
+				request.NameFormat != attribute.NameFormat {
+				continue
 			}
-			resp.Assertion.Signature = signature
-			if _, err = w.Write([]byte(xml.Header)); err != nil {
-				return err
+			if len(request.AttributeValue) > 0 {
+				attribute.AttributeValue = requestedValues(attribute.AttributeValue, request.AttributeValue)
+				if len(attribute.AttributeValue) == 0 {
+					break
+				}
 			}
-			encoder := xml.NewEncoder(w)
-			if err = encoder.Encode(env); err != nil {
-				return err
+			statement.Attribute = append(statement.Attribute, attribute)
+			break
+		}
+	}
+	return statement
+}
+
+func requestedValues(released, requested []saml.AttributeValue) []saml.AttributeValue {
+	var values []saml.AttributeValue
+	for _, value := range released {
+		for _, request := range requested {
+			if request.Value == value.Value {
+				values = append(values, value)
+				break
 			}
-			return encoder.Flush()
-		}()
-		if err != nil {
-			log.Error(err)
-			i.Error(w, err.Error(), http.StatusBadRequest)
 		}
 	}
+	return values
+}
+
+// makeQueryStatusResponse answers the query with the status, refined by the second-level status when it's set,
+// without an assertion
+func (i *IDP) makeQueryStatusResponse(query *saml.AttributeQuery, status, subStatus string) *saml.Response {
+	code := saml.StatusCode{Value: status}
+	if subStatus != "" {
+		code.StatusCode = &saml.StatusCode{Value: subStatus}
+	}
+	return &saml.Response{
+		StatusResponseType: saml.StatusResponseType{
+			Version:      "2.0",
+			ID:           i.IDs.NewID(),
+			IssueInstant: i.Clock.Now().UTC(),
+			InResponseTo: query.ID,
+			Issuer:       i.samlIssuer(),
+			Status:       &saml.Status{StatusCode: code},
+		},
+	}
+}
+
+func (i *IDP) writeAttributeResponse(w http.ResponseWriter, env saml.AttributeRespEnv) {
+	id := env.Body.Response.ID
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err := xml.NewEncoder(&b).Encode(env); err != nil {
+		log.Errorf("unable to encode attribute Response %s: %s", id, err)
+		sendSOAPFault(i, w, "SOAP-ENV:Server", "unable to encode Response")
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	if _, err := w.Write(b.Bytes()); err != nil {
+		// Nothing can be sent once writing has failed
+		log.Errorf("unable to send attribute Response %s: %s", id, err)
+	}
 }
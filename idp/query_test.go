@@ -1,10 +1,17 @@
 package idp
 
 import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/sign"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -24,3 +31,202 @@ func TestIDP_DefaultQueryHandler(t *testing.T) {
 	defer resp.Body.Close()
 	assert.Equal(t, 200, resp.StatusCode)
 }
+
+func TestIDP_DefaultQueryHandler_soapFaults(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	query, err := ioutil.ReadFile(filepath.Join("testdata", "attribute-query-request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withHeader := func(header string) string {
+		return strings.Replace(string(query), "<Body", "<Header>"+header+"</Header><Body", 1)
+	}
+	setConfig(t, "soap-actions", []string{"http://www.oasis-open.org/committees/security"})
+	tests := []struct {
+		name   string
+		action string
+		body   string
+		fault  string
+	}{
+		{"soap action", `"http://www.oasis-open.org/committees/security"`, string(query), ""},
+		{"unsupported soap action", "urn:example:other", string(query), "SOAP-ENV:Client"},
+		{"missing soap action", "", string(query), "SOAP-ENV:Client"},
+		{"unknown header", `"http://www.oasis-open.org/committees/security"`,
+			withHeader(`<Unknown xmlns="urn:example" xmlns:S="http://schemas.xmlsoap.org/soap/envelope/" S:mustUnderstand="1"/>`),
+			"SOAP-ENV:MustUnderstand"},
+		{"optional header", `"http://www.oasis-open.org/committees/security"`,
+			withHeader(`<Unknown xmlns="urn:example"/>`), ""},
+		{"header for another actor", `"http://www.oasis-open.org/committees/security"`,
+			withHeader(`<Unknown xmlns="urn:example" xmlns:S="http://schemas.xmlsoap.org/soap/envelope/" S:mustUnderstand="1" S:actor="urn:example:gateway"/>`),
+			""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+viper.GetString("attribute-service-path"),
+				strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "text/xml")
+			if tt.action != "" {
+				req.Header.Set("SOAPAction", tt.action)
+			}
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if tt.fault == "" {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				return
+			}
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode, "SOAP faults are sent with status 500")
+			env := &saml.SOAPFaultEnvelope{}
+			if err := xml.NewDecoder(resp.Body).Decode(env); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.fault, env.Body.Fault.Code)
+		})
+	}
+}
+
+func TestIDP_DefaultQueryHandler_roundTrip(t *testing.T) {
+	sp := newTestSP(t, "https://query.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	other := newTestSP(t, "https://other.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{AttributeSources: []AttributeSource{&simpleSource{users: map[string][]*model.Attribute{
+		"joe": {{Name: "mail", Value: []string{"joe@example.com"}}},
+	}}}}
+	ts := startTestIDP(t, i, sp)
+	joe := &saml.NameID{Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", Value: "joe"}
+	tests := []struct {
+		name      string
+		client    *http.Client
+		subject   *saml.NameID
+		signer    sign.Signer
+		subStatus string
+	}{
+		{"client certificate", sp.client(), joe, nil, ""},
+		{"signed", ts.Client(), joe, sp.signer, ""},
+		{"unauthenticated", ts.Client(), joe, nil, requestDeniedStatus},
+		{"signed by another key", ts.Client(), joe, other.signer, requestDeniedStatus},
+		{"unknown subject", sp.client(),
+			&saml.NameID{Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", Value: "jane"}, nil,
+			unknownPrincipalStatus},
+		{"transient subject", sp.client(), &saml.NameID{Format: transientNameIDFormat, Value: "_123"}, nil,
+			unknownPrincipalStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document, response := sp.queryAttributes(tt.client, tt.subject, tt.signer)
+			assert.Equal(t, sp.requestID, response.InResponseTo)
+			if tt.subStatus != "" {
+				assert.Equal(t, requesterStatus, response.Status.StatusCode.Value)
+				if assert.NotNil(t, response.Status.StatusCode.StatusCode) {
+					assert.Equal(t, tt.subStatus, response.Status.StatusCode.StatusCode.Value)
+				}
+				assert.Nil(t, response.Assertion, "no assertion should be sent")
+				return
+			}
+			assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", response.Status.StatusCode.Value)
+			assertion := response.Assertion
+			if !assert.NotNil(t, assertion) || !assert.NotNil(t, assertion.Signature, "the assertion should be signed") {
+				return
+			}
+			referenced, err := sign.NewValidator().Validate(string(document))
+			if assert.NoError(t, err) && assert.Len(t, referenced, 1) {
+				assert.Contains(t, referenced[0], assertion.ID)
+			}
+			assert.Equal(t, joe.Value, assertion.Subject.NameID.Value, "the assertion should be about the subject queried")
+			assert.Equal(t, joe.Format, assertion.Subject.NameID.Format)
+			assert.Equal(t, sp.entityID, assertion.Conditions.AudienceRestriction.Audience)
+			if assert.NotNil(t, assertion.AttributeStatement) && assert.Len(t, assertion.AttributeStatement.Attribute, 1) {
+				attribute := assertion.AttributeStatement.Attribute[0]
+				assert.Equal(t, "mail", attribute.Name)
+				if assert.Len(t, attribute.AttributeValue, 1) {
+					assert.Equal(t, "joe@example.com", attribute.AttributeValue[0].Value)
+				}
+			}
+		})
+	}
+}
+
+func TestIDP_DefaultQueryHandler_requestedAttributes(t *testing.T) {
+	sp := newTestSP(t, "https://query.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{AttributeSources: []AttributeSource{&simpleSource{users: map[string][]*model.Attribute{
+		"joe": {
+			{Name: "cn", Value: []string{"Joe"}},
+			{Name: "mail", Value: []string{"joe@example.com"}},
+			{Name: "memberOf", Value: []string{"admins", "users"}},
+		},
+	}}}}
+	startTestIDP(t, i, sp)
+	joe := &saml.NameID{Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", Value: "joe"}
+	released := func(requested ...saml.Attribute) map[string][]string {
+		_, response := sp.queryAttributes(sp.client(), joe, nil, requested...)
+		if !assert.NotNil(t, response.Assertion) || !assert.NotNil(t, response.Assertion.AttributeStatement) {
+			return nil
+		}
+		attributes := map[string][]string{}
+		for _, attribute := range response.Assertion.AttributeStatement.Attribute {
+			for _, value := range attribute.AttributeValue {
+				attributes[attribute.Name] = append(attributes[attribute.Name], value.Value)
+			}
+		}
+		return attributes
+	}
+
+	assert.Len(t, released(), 3, "all attributes should be returned when none are requested")
+	assert.Equal(t, map[string][]string{"mail": {"joe@example.com"}, "memberOf": {"admins"}}, released(
+		saml.Attribute{Name: "mail"},
+		saml.Attribute{Name: "memberOf", AttributeValue: []saml.AttributeValue{{Value: "admins"}, {Value: "guests"}}},
+	))
+	assert.Empty(t, released(saml.Attribute{Name: "telephoneNumber"}), "the statement should be empty")
+	assert.Empty(t, released(saml.Attribute{Name: "mail", NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"}),
+		"attributes should only match their NameFormat")
+}
+
+func TestIDP_DefaultQueryHandler_accessDenied(t *testing.T) {
+	sp := newTestSP(t, "https://query.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	auditor := &accessAuditor{}
+	i := &IDP{Auditor: auditor, AttributeSources: []AttributeSource{&simpleSource{users: map[string][]*model.Attribute{
+		"joe": {
+			{Name: "mail", Value: []string{"joe@example.com"}},
+			{Name: "memberOf", Value: []string{"users"}},
+		},
+	}}}}
+	startTestIDP(t, i, sp)
+	i.sps[sp.entityID].AccessPolicy = &AccessPolicy{Groups: []string{"admins"}}
+	joe := &saml.NameID{Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", Value: "joe"}
+	_, response := sp.queryAttributes(sp.client(), joe, nil)
+	assert.Equal(t, responderStatus, response.Status.StatusCode.Value)
+	if assert.NotNil(t, response.Status.StatusCode.StatusCode) {
+		assert.Equal(t, requestDeniedStatus, response.Status.StatusCode.StatusCode.Value)
+	}
+	assert.Nil(t, response.Assertion, "no assertion should be sent")
+	assert.Len(t, auditor.denied, 1, "the denial should be audited")
+}
+
+func TestIDP_DefaultQueryHandler_limitAssertion(t *testing.T) {
+	sp := newTestSP(t, "https://query.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	audit := &truncationAuditor{}
+	i := &IDP{Auditor: audit, AttributeSources: []AttributeSource{&simpleSource{users: map[string][]*model.Attribute{
+		"joe": groupsUser(100).Attributes,
+	}}}}
+	startTestIDP(t, i, sp)
+	setConfig(t, "max-attribute-values", 12)
+	joe := &saml.NameID{Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", Value: "joe"}
+
+	_, response := sp.queryAttributes(sp.client(), joe, nil)
+	if assert.NotNil(t, response.Assertion) {
+		assert.Equal(t, map[string]int{"cn": 1, "mail": 1, "memberOf": 10}, attributeValues(response.Assertion))
+		assert.NotNil(t, response.Assertion.Signature)
+	}
+	assert.Len(t, audit.truncated, 1, "truncation should be audited")
+
+	setConfig(t, "assertion-limit-policy", FailAssertionPolicy)
+	_, response = sp.queryAttributes(sp.client(), joe, nil)
+	assert.Equal(t, responderStatus, response.Status.StatusCode.Value)
+	assert.Nil(t, response.Assertion, "no assertion should be sent")
+}
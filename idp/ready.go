@@ -0,0 +1,63 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/chriskery/sso-idp/settings"
+)
+
+// configureReadiness sets how many of the sp-medata-urls must be loaded before the IDP is ready. That's all of them
+// unless sp-metadata-required sets a lower minimum.
+func (i *IDP) configureReadiness(loaded, total int) {
+	required := settings.GetInt("sp-metadata-required")
+	if required < 0 || required > total {
+		required = total
+	}
+	atomic.StoreInt32(&i.spMetadataRequired, int32(required))
+	atomic.StoreInt32(&i.spMetadataCount, int32(loaded))
+}
+
+// spMetadataLoaded counts metadata loaded after startup
+func (i *IDP) spMetadataLoaded() {
+	atomic.AddInt32(&i.spMetadataCount, 1)
+}
+
+// ready reports whether enough service provider metadata has been loaded to accept requests
+func (i *IDP) ready() (bool, int32, int32) {
+	loaded := atomic.LoadInt32(&i.spMetadataCount)
+	required := atomic.LoadInt32(&i.spMetadataRequired)
+	return loaded >= required, loaded, required
+}
+
+// DefaultReadinessHandler reports the IDP isn't ready, with a 503 status, until the metadata of the service providers
+// it fetches has been loaded. Load balancers can hold back traffic until then rather than have service providers
+// rejected as unregistered.
+func (i *IDP) DefaultReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready, loaded, required := i.ready()
+		w.Header().Set("Cache-Control", "no-store")
+		if !ready {
+			i.Error(w, fmt.Sprintf("loaded the metadata of %d of %d service providers", loaded, required),
+				http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ready")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_DefaultReadinessHandler(t *testing.T) {
+	metadata, err := ioutil.ReadFile(filepath.Join("testdata", "sp-metadata.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The metadata server is down when the IDP starts
+	var up int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.Write(metadata)
+	}))
+	defer ts.Close()
+	viper.Set("sp-medata-urls", []SPMetadataUrl{{Url: ts.URL}})
+	defer viper.Set("sp-medata-urls", nil)
+	viper.Set("sp-metadata-retry-interval", "10ms")
+	defer viper.Set("sp-metadata-retry-interval", "1m")
+	viper.Set("persist-sp-metadata", false)
+	defer viper.Set("persist-sp-metadata", true)
+
+	i := &IDP{}
+	server := getTestIDP(t, i)
+	defer server.Close()
+	ready := func() int {
+		w := httptest.NewRecorder()
+		i.handler.ServeHTTP(w, httptest.NewRequest("GET", "/idp/ready", nil))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+	_, ok := i.getSP("dex")
+	assert.False(t, ok)
+
+	atomic.StoreInt32(&up, 1)
+	assert.Eventually(t, func() bool {
+		return ready() == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond, "should be ready once the metadata is loaded")
+	_, ok = i.getSP("dex")
+	assert.True(t, ok, "should be registered once the metadata is loaded")
+
+	// A lower minimum is ready without the metadata
+	viper.Set("sp-metadata-required", 0)
+	defer viper.Set("sp-metadata-required", -1)
+	i.configureReadiness(0, 1)
+	ok, _, _ = i.ready()
+	assert.True(t, ok)
+}
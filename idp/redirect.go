@@ -0,0 +1,122 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/chriskery/sso-idp/sign"
+	"github.com/spf13/viper"
+)
+
+// decodeRedirectMessage removes the base64 and DEFLATE encoding of an HTTP-Redirect binding message
+// and unmarshals the XML into v. Some SPs mistakenly send the XML without compressing it. These
+// messages are accepted when allow-uncompressed-redirect is set.
+func decodeRedirectMessage(parameter, encoded string, v interface{}) error {
+	if encoded == "" {
+		return fmt.Errorf("%s is missing", parameter)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("%s is not valid base64: %v", parameter, err)
+	}
+	message, err := inflateMessage(data)
+	if errors.Is(err, errMessageTooLarge) {
+		return fmt.Errorf("%s %w", parameter, err)
+	}
+	if err != nil {
+		trimmed := bytes.TrimSpace(data)
+		if !settings.GetBool("allow-uncompressed-redirect") || !bytes.HasPrefix(trimmed, []byte("<")) {
+			return fmt.Errorf("%s is not valid DEFLATE: %v", parameter, err)
+		}
+		message = trimmed
+	}
+	if err = xml.Unmarshal(message, v); err != nil {
+		return fmt.Errorf("%s does not contain a valid SAML message: %v", parameter, err)
+	}
+	return nil
+}
+
+// errMessageTooLarge is returned by inflateMessage for messages larger than max-redirect-message-size
+var errMessageTooLarge = errors.New("is larger than max-redirect-message-size once inflated")
+
+// inflateMessage removes the DEFLATE encoding of an HTTP-Redirect binding message. Reading more than
+// max-redirect-message-size bytes fails, so a small message can't expand without bound.
+func inflateMessage(data []byte) ([]byte, error) {
+	var reader io.Reader = flate.NewReader(bytes.NewReader(data))
+	limit := viper.GetInt64("max-redirect-message-size")
+	if limit > 0 {
+		reader = io.LimitReader(reader, limit+1)
+	}
+	message, err := ioutil.ReadAll(reader)
+	if err == io.ErrUnexpectedEOF && len(message) > 0 {
+		// Flushed but never closed by the sender, which is common. Use what was inflated.
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(message)) > limit {
+		return nil, errMessageTooLarge
+	}
+	return message, nil
+}
+
+// redirectURL encodes the message for the HTTP-Redirect binding and returns a signed URL targeting location.
+// parameter is either SAMLRequest or SAMLResponse.
+// https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf Section 3.4.4
+func redirectURL(signer sign.Signer, location, parameter string, message interface{}, relayState string) (string, error) {
+	target, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	writer, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	encoder := xml.NewEncoder(writer)
+	if err = encoder.Encode(message); err != nil {
+		return "", err
+	}
+	if err = writer.Close(); err != nil {
+		return "", err
+	}
+	// The signature covers the parameters in this exact order
+	query := parameter + "=" + url.QueryEscape(base64.StdEncoding.EncodeToString(b.Bytes()))
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(signer.Algorithm())
+	signature, err := signer.Sign([]byte(query))
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(signature)
+	if target.RawQuery != "" {
+		query = target.RawQuery + "&" + query
+	}
+	target.RawQuery = query
+	return target.String(), nil
+}
@@ -0,0 +1,115 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_redirectURL(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	logoutReq := &saml.LogoutRequest{
+		RequestAbstractType:    saml.RequestAbstractType{ID: "_123"},
+		SingleLogoutServiceUrl: "https://sp.example.com/slo",
+	}
+	target, err := redirectURL(i.Signer, logoutReq.SingleLogoutServiceUrl, "SAMLResponse", i.makeLogoutResponse(logoutReq), "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sp.example.com", u.Host)
+	params := u.Query()
+	assert.Equal(t, "state", params.Get("RelayState"))
+
+	// Signature should validate with the IdP's key
+	cert, err := x509.ParseCertificate(i.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifySignature(u.RawQuery, params.Get("SigAlg"), params.Get("Signature"), &ServiceProvider{publicKey: cert.PublicKey}, time.Now())
+	assert.NoError(t, err, "signature should be valid")
+
+	data, err := base64.StdEncoding.DecodeString(params.Get("SAMLResponse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &saml.LogoutResponse{}
+	if err = xml.NewDecoder(flate.NewReader(bytes.NewReader(data))).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "_123", response.InResponseTo)
+	assert.Equal(t, "https://sp.example.com/slo", response.Destination)
+}
+
+func Test_decodeRedirectMessage(t *testing.T) {
+	raw := `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_abc" Version="2.0"><saml:Issuer>sp</saml:Issuer></samlp:AuthnRequest>`
+	var b bytes.Buffer
+	writer, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(raw))
+	writer.Close()
+	deflated := base64.StdEncoding.EncodeToString(b.Bytes())
+	uncompressed := base64.StdEncoding.EncodeToString([]byte(raw))
+
+	req := &saml.AuthnRequest{}
+	if err = decodeRedirectMessage("SAMLRequest", deflated, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "_abc", req.ID)
+	assert.Equal(t, "sp", req.Issuer)
+
+	err = decodeRedirectMessage("SAMLRequest", uncompressed, &saml.AuthnRequest{})
+	if assert.Error(t, err, "uncompressed message should be rejected by default") {
+		assert.Contains(t, err.Error(), "SAMLRequest is not valid DEFLATE")
+	}
+
+	viper.Set("allow-uncompressed-redirect", true)
+	defer viper.Set("allow-uncompressed-redirect", false)
+	req = &saml.AuthnRequest{}
+	if err = decodeRedirectMessage("SAMLRequest", uncompressed, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "_abc", req.ID)
+
+	err = decodeRedirectMessage("SAMLRequest", base64.StdEncoding.EncodeToString([]byte("garbage")), &saml.AuthnRequest{})
+	assert.Error(t, err, "non-XML payloads should be rejected")
+	assert.Error(t, decodeRedirectMessage("SAMLRequest", "", &saml.AuthnRequest{}), "missing message should be rejected")
+
+	setConfig(t, "max-redirect-message-size", len(raw)-1)
+	err = decodeRedirectMessage("SAMLRequest", deflated, &saml.AuthnRequest{})
+	if assert.Error(t, err, "messages inflating past the limit should be rejected") {
+		assert.Contains(t, err.Error(), "SAMLRequest is larger than max-redirect-message-size")
+	}
+	setConfig(t, "max-redirect-message-size", len(raw))
+	assert.NoError(t, decodeRedirectMessage("SAMLRequest", deflated, &saml.AuthnRequest{}))
+}
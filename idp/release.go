@@ -0,0 +1,153 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/settings"
+)
+
+// ReleaseRule limits when an attribute is released. Values of the attribute governed by one or more rules are only
+// released when at least one of those rules matches. A rule matches when every condition it sets holds.
+//
+//	attribute-release-rules:
+//	- attribute: eduPersonEntitlement
+//	  values: [admin]
+//	  sps: [https://admin.example.org]
+//	  authn-contexts: [urn:oasis:names:tc:SAML:2.0:ac:classes:X509]
+//	  groups: [administrators]
+type ReleaseRule struct {
+	// Name of the governed attribute
+	Attribute string
+	// Values governed by the rule, all values when empty
+	Values []string
+	// Entity IDs of the service providers that may receive the values
+	SPs []string
+	// AuthnContextClassRefs of logins strong enough to release the values
+	AuthnContexts []string `mapstructure:"authn-contexts"`
+	// Groups, any of which the user must belong to
+	Groups []string
+	// Attribute listing the user's groups, defaults to memberOf
+	GroupAttribute string `mapstructure:"group-attribute"`
+}
+
+func (i *IDP) configureReleaseRules() error {
+	rules, err := loadReleaseRules()
+	if err != nil {
+		return err
+	}
+	i.releaseRules = rules
+	return nil
+}
+
+// loadReleaseRules reads the attribute-release-rules setting
+func loadReleaseRules() ([]*ReleaseRule, error) {
+	rules := []*ReleaseRule{}
+	if err := settings.UnmarshalKey("attribute-release-rules", &rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.Attribute == "" {
+			return nil, errors.New("attribute release rules require an attribute")
+		}
+		if rule.GroupAttribute == "" {
+			rule.GroupAttribute = "memberOf"
+		}
+	}
+	return rules, nil
+}
+
+// releasedAttributes returns a copy of the user holding only the attribute values that may be released to the
+// service provider. The user is left unchanged since it's shared between service providers during a session.
+func (i *IDP) releasedAttributes(user *model.User, issuer string) *model.User {
+	i.configLock.RLock()
+	rules := i.releaseRules
+	i.configLock.RUnlock()
+	if len(rules) == 0 {
+		return user
+	}
+	released := *user
+	released.Attributes = make([]*model.Attribute, 0, len(user.Attributes))
+	for _, att := range user.Attributes {
+		values := make([]string, 0, len(att.Value))
+		for _, value := range att.Value {
+			if releasable(rules, user, issuer, att.Name, value) {
+				values = append(values, value)
+			}
+		}
+		if len(values) > 0 {
+			filtered := *att
+			filtered.Value = values
+			released.Attributes = append(released.Attributes, &filtered)
+		}
+	}
+	return &released
+}
+
+func releasable(rules []*ReleaseRule, user *model.User, issuer, name, value string) bool {
+	governed := false
+	for _, rule := range rules {
+		if !rule.governs(name, value) {
+			continue
+		}
+		if rule.matches(user, issuer) {
+			return true
+		}
+		governed = true
+	}
+	return !governed
+}
+
+func (rule *ReleaseRule) governs(name, value string) bool {
+	if !strings.EqualFold(rule.Attribute, name) {
+		return false
+	}
+	return len(rule.Values) == 0 || contains(rule.Values, value)
+}
+
+func (rule *ReleaseRule) matches(user *model.User, issuer string) bool {
+	if len(rule.SPs) > 0 && !contains(rule.SPs, issuer) {
+		return false
+	}
+	if len(rule.AuthnContexts) > 0 && !contains(rule.AuthnContexts, user.Context) {
+		return false
+	}
+	if len(rule.Groups) > 0 {
+		for _, att := range user.Attributes {
+			if !strings.EqualFold(att.Name, rule.GroupAttribute) {
+				continue
+			}
+			for _, group := range att.Value {
+				if contains(rule.Groups, group) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"testing"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_releasedAttributes(t *testing.T) {
+	viper.Set("attribute-release-rules", []map[string]interface{}{
+		{"attribute": "eduPersonEntitlement", "values": []string{"admin"}, "sps": []string{"https://admin.example.org"}},
+		{"attribute": "eduPersonEntitlement", "values": []string{"admin"}, "groups": []string{"superusers"}},
+		{"attribute": "mail", "authn-contexts": []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:X509"}},
+	})
+	defer viper.Set("attribute-release-rules", []ReleaseRule{})
+	i := &IDP{}
+	if err := i.configureReleaseRules(); err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{
+		Name:    "joe",
+		Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+		Attributes: []*model.Attribute{
+			{Name: "eduPersonEntitlement", Value: []string{"admin", "staff"}},
+			{Name: "mail", Value: []string{"joe@example.org"}},
+		},
+	}
+	released := func(user *model.User, issuer string) map[string][]string {
+		values := make(map[string][]string)
+		for _, att := range i.releasedAttributes(user, issuer).Attributes {
+			values[att.Name] = att.Value
+		}
+		return values
+	}
+
+	values := released(user, "https://sp.example.org")
+	assert.Equal(t, []string{"staff"}, values["eduPersonEntitlement"], "admin should be withheld from other SPs")
+	assert.NotContains(t, values, "mail", "mail requires a certificate login")
+	assert.Len(t, user.Attributes[0].Value, 2, "the user shouldn't be modified")
+
+	values = released(user, "https://admin.example.org")
+	assert.Equal(t, []string{"admin", "staff"}, values["eduPersonEntitlement"])
+
+	user.Context = "urn:oasis:names:tc:SAML:2.0:ac:classes:X509"
+	user.Attributes = append(user.Attributes, &model.Attribute{Name: "memberOf", Value: []string{"superusers"}})
+	values = released(user, "https://sp.example.org")
+	assert.Equal(t, []string{"admin", "staff"}, values["eduPersonEntitlement"], "group members should receive admin")
+	assert.Equal(t, []string{"joe@example.org"}, values["mail"])
+}
+
+func TestIDP_configureReleaseRules_invalid(t *testing.T) {
+	viper.Set("attribute-release-rules", []map[string]interface{}{{"sps": []string{"https://sp.example.org"}}})
+	defer viper.Set("attribute-release-rules", []ReleaseRule{})
+	i := &IDP{}
+	assert.Error(t, i.configureReleaseRules(), "rules without an attribute should be rejected")
+}
@@ -0,0 +1,125 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/chriskery/sso-idp/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reload applies changes made to the configuration while the IDP is running, such as after the configuration file
+// is read again and published with settings.Publish. The service providers are read from the ServiceProviders store again, keeping those registered
+// from metadata or without being saved, and the attribute-release-rules are reloaded. The PasswordValidator,
+// AttributeSources and AttributeTransformers created from the configuration are recreated, while ones provided by
+// the application are kept. Everything is prepared before any of it is swapped in, so the IDP is left unchanged when
+// there's an error. Requests in progress finish with what they started with.
+func (i *IDP) Reload() error {
+	var err error
+	validator := i.passwordValidator()
+	if i.configuredValidator {
+		if validator, err = newPasswordValidator(); err != nil {
+			return err
+		}
+	}
+	i.configLock.RLock()
+	sources, transformers := i.AttributeSources, i.AttributeTransformers
+	i.configLock.RUnlock()
+	if i.configuredSources {
+		if sources, err = newAttributeSources(); err != nil {
+			return err
+		}
+	}
+	if i.configuredTransformers {
+		if transformers, err = DefaultAttributeTransformers(); err != nil {
+			return err
+		}
+	}
+	rules, err := loadReleaseRules()
+	if err != nil {
+		return err
+	}
+	if err = i.reloadSPs(); err != nil {
+		return err
+	}
+	i.configLock.Lock()
+	i.PasswordValidator = validator
+	i.AttributeSources = sources
+	i.AttributeTransformers = transformers
+	i.releaseRules = rules
+	i.configLock.Unlock()
+	log.Infof("reloaded the configuration with %d attribute release rules", len(rules))
+	return nil
+}
+
+// reloadSPs replaces the registered service providers with the ones in the ServiceProviders store. Unsaved ones,
+// such as those read from metadata, are kept with the settings from the store applied.
+func (i *IDP) reloadSPs() error {
+	stored, err := i.ServiceProviders.List()
+	if err != nil {
+		return err
+	}
+	anchors, err := spTrustAnchors(settings.Current())
+	if err != nil {
+		return err
+	}
+	registered := make(map[string]*ServiceProvider, len(stored))
+	for _, sp := range stored {
+		if err := sp.validate(i.Clock.Now(), anchors); err != nil {
+			return err
+		}
+		registered[sp.EntityID] = sp
+	}
+	i.spsLock.Lock()
+	defer i.spsLock.Unlock()
+	for entityID := range i.unsavedSPs {
+		existing, ok := i.sps[entityID]
+		if !ok {
+			continue
+		}
+		sp := *existing
+		if configured, ok := registered[entityID]; ok {
+			sp.copySettings(configured)
+		}
+		registered[entityID] = &sp
+	}
+	var added, updated, removed []string
+	for entityID, sp := range registered {
+		if existing, ok := i.sps[entityID]; !ok {
+			added = append(added, entityID)
+		} else if !reflect.DeepEqual(existing, sp) {
+			updated = append(updated, entityID)
+		}
+	}
+	for entityID := range i.sps {
+		if _, ok := registered[entityID]; !ok {
+			removed = append(removed, entityID)
+		}
+	}
+	i.sps = registered
+	logSPChanges("added", added)
+	logSPChanges("updated", updated)
+	logSPChanges("removed", removed)
+	return nil
+}
+
+func logSPChanges(change string, entityIDs []string) {
+	sort.Strings(entityIDs)
+	for _, entityID := range entityIDs {
+		log.Infof("%s service provider %s", change, entityID)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"testing"
+
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_Reload(t *testing.T) {
+	kept := newTestSP(t, "https://kept.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	removed := newTestSP(t, "https://removed.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	added := newTestSP(t, "https://added.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	unsaved := newTestSP(t, "https://unsaved.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	validator := stubValidator{ErrInvalidPassword}
+	i := &IDP{PasswordValidator: validator}
+	startTestIDP(t, i, kept, removed)
+	unsavedSP := unsaved.serviceProvider()
+	if err := i.RegisterServiceProvider(&unsavedSP, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store's settings still apply to service providers that weren't saved
+	unsavedSettings := unsaved.serviceProvider()
+	unsavedSettings.Disabled = true
+	setConfig(t, "sps", []ServiceProvider{kept.serviceProvider(), added.serviceProvider(), unsavedSettings})
+	setConfig(t, "attribute-release-rules", []map[string]interface{}{{"attribute": "mail", "sps": []string{kept.entityID}}})
+	if err := i.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, sp := range []*testSP{kept, added, unsaved} {
+		_, ok := i.getSP(sp.entityID)
+		assert.True(t, ok, "%s should be registered", sp.entityID)
+	}
+	_, ok := i.getSP(removed.entityID)
+	assert.False(t, ok, "service providers removed from the store should be unregistered")
+	if sp, ok := i.getSP(unsaved.entityID); ok {
+		assert.True(t, sp.Disabled)
+	}
+	assert.Len(t, i.releaseRules, 1)
+	assert.Equal(t, validator, i.passwordValidator(), "the application's PasswordValidator should be kept")
+
+	// Nothing is swapped in when part of the configuration is invalid
+	setConfig(t, "sps", []ServiceProvider{kept.serviceProvider()})
+	setConfig(t, "attribute-release-rules", []map[string]interface{}{{"sps": []string{kept.entityID}}})
+	assert.Error(t, i.Reload())
+	_, ok = i.getSP(added.entityID)
+	assert.True(t, ok)
+	assert.Len(t, i.releaseRules, 1)
+}
+
+func TestIDP_Reload_published(t *testing.T) {
+	sp := newTestSP(t, "https://wiki.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{PasswordValidator: stubValidator{ErrInvalidPassword}}
+	startTestIDP(t, i)
+	next := viper.New()
+	next.Set("sps", []ServiceProvider{sp.serviceProvider()})
+	next.Set("attribute-release-rules", []map[string]interface{}{{"attribute": "mail", "sps": []string{sp.entityID}}})
+	settings.Publish(next)
+	t.Cleanup(func() { settings.Publish(nil) })
+	if err := i.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	_, ok := i.getSP(sp.entityID)
+	assert.True(t, ok, "the service providers of the published configuration should be registered")
+	assert.Len(t, i.releaseRules, 1)
+
+	settings.Publish(nil)
+	if err := i.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	_, ok = i.getSP(sp.entityID)
+	assert.False(t, ok, "the configuration the IDP started with should be left alone")
+}
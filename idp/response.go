@@ -15,37 +15,42 @@
 package idp
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"errors"
 	"github.com/chriskery/sso-idp/model"
 	"github.com/chriskery/sso-idp/saml"
-	"github.com/golang/protobuf/proto"
-	"github.com/google/uuid"
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/chriskery/sso-idp/sign"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 func (i *IDP) respond(authRequest *model.AuthnRequest, user *model.User,
 	w http.ResponseWriter, r *http.Request) error {
 	// Save user information and set session cookie
-	data, err := proto.Marshal(user)
+	session, err := i.saveSession(r, user, authRequest)
 	if err != nil {
 		return err
 	}
-	session := uuid.New().String()
-	err = i.UserCache.Set(session, data)
-	if err != nil {
-		return err
+	http.SetCookie(w, i.sessionCookie(session.ID))
+	// The AuthnInstant is read from the session
+	authRequest.SessionID = session.ID
+	// Denied users are still answered, with an error rather than a code, so the client can explain the failure.
+	// SAML responses are authorized when BuildSignedResponse builds them.
+	if authRequest.ProtocolBinding == oidcCodeBinding {
+		if err := i.authorize(authRequest, user); err != nil {
+			i.logAccessDenied(authRequest, user, err)
+			redirectWithParameters(w, r, authRequest.AssertionConsumerServiceURL, url.Values{
+				"error": {"access_denied"}, "state": {authRequest.RelayState}})
+			return nil
+		}
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     i.cookieName,
-		Path:     "/",
-		Value:    session,
-		Secure:   true,
-		HttpOnly: true,
-	})
 	switch authRequest.ProtocolBinding {
 	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact":
 		return i.sendArtifactResponse(authRequest, user, w, r)
@@ -53,45 +58,173 @@ func (i *IDP) respond(authRequest *model.AuthnRequest, user *model.User,
 		return i.sendPostResponse(authRequest, user, w, r)
 	case "urn:oasis:names:tc:SAML:2.0:bindings:PAOS":
 		return i.sendECPResponse(authRequest, user, w, r)
+	case oidcCodeBinding:
+		return i.sendAuthorizationCode(authRequest, user, w, r)
+	default:
+		return errors.New("unsupported protocol binding")
+	}
+}
+
+// respondCancelled tells the service provider the user cancelled the login, so it can react without waiting for
+// its own timeout
+func (i *IDP) respondCancelled(authRequest *model.AuthnRequest, w http.ResponseWriter, r *http.Request) error {
+	switch authRequest.ProtocolBinding {
+	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact":
+		return i.sendArtifactResponse(authRequest, nil, w, r)
+	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST":
+		return i.sendPostResponse(authRequest, nil, w, r)
+	case oidcCodeBinding:
+		redirectWithParameters(w, r, authRequest.AssertionConsumerServiceURL, url.Values{
+			"error": {"access_denied"}, "error_description": {"login cancelled"}, "state": {authRequest.RelayState}})
+		return nil
 	default:
 		return errors.New("unsupported protocol binding")
 	}
 }
 
-func (i *IDP) makeAuthnResponse(request *model.AuthnRequest, user *model.User) *saml.Response {
-	now := time.Now().UTC()
-	fiveFromNow := now.Add(5 * time.Minute)
-	resp := i.makeResponse(request.ID, request.Issuer, user)
+// BuildSignedResponse returns the signed SAML Response for the authentication request without writing it
+// to a client. It allows applications embedding the IDP to deliver responses using their own bindings. Users
+// denied by the service provider's AccessPolicy get a Response with the access-denied-status and no assertion, and
+// are reported to the AccessAuditor. A nil user, for a login the user cancelled, gets one with the login-cancel-status.
+func (i *IDP) BuildSignedResponse(request *model.AuthnRequest, user *model.User) (*saml.Response, error) {
+	if user == nil {
+		return i.makeStatusResponse(request, settings.GetString("login-cancel-status")), nil
+	}
+	if err := i.authorize(request, user); err != nil {
+		i.logAccessDenied(request, user, err)
+		return i.makeDeniedResponse(request), nil
+	}
+	response, err := i.makeAuthnResponse(request, user)
+	if err != nil {
+		return nil, err
+	}
+	if err = i.limitAssertion(request, user, response.Assertion); err != nil {
+		return nil, err
+	}
+	signer, err := i.signerFor(request.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if err = signAssertion(signer, response.Assertion); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// signAssertion signs the assertion, then declares the xs prefix when its attribute values are typed. What's
+// signed must match the exclusive canonicalization of the assertion, which leaves the declaration out.
+func signAssertion(signer sign.Signer, assertion *saml.Assertion) error {
+	signature, err := signer.CreateSignature(assertion)
+	if err != nil {
+		return err
+	}
+	assertion.Signature = signature
+	if assertion.AttributeStatement.Typed() {
+		assertion.XS = saml.XMLSchemaNamespace
+	}
+	return nil
+}
+
+// buildSignedResponse is BuildSignedResponse traced as part of the request's SSO flow
+func (i *IDP) buildSignedResponse(ctx context.Context, request *model.AuthnRequest, user *model.User) (*saml.Response, error) {
+	_, span := startSpan(ctx, "build response", request.GetIssuer())
+	response, err := i.BuildSignedResponse(request, user)
+	endSpan(span, err)
+	return response, err
+}
+
+// authnInstant returns when the user logged in to the request's session, which is earlier than now when an existing
+// session answers the request, or now when the session isn't known
+func (i *IDP) authnInstant(request *model.AuthnRequest, now time.Time) time.Time {
+	if request.GetSessionID() == "" {
+		return now
+	}
+	session, err := i.Sessions.Get(request.SessionID)
+	if err != nil {
+		return now
+	}
+	authenticated, err := authenticationTime(session)
+	if err != nil {
+		log.Warnf("session of %s has an invalid authentication time: %s", session.User.GetName(), err)
+		return now
+	}
+	return authenticated.UTC()
+}
+
+func (i *IDP) makeAuthnResponse(request *model.AuthnRequest, user *model.User) (*saml.Response, error) {
+	now := i.Clock.Now().UTC()
+	sp, _ := i.getSP(request.Issuer)
+	nameID, format, err := i.subjectNameID(sp, user)
+	if err != nil {
+		return nil, err
+	}
+	// Unsolicited responses must not reference a request
+	inResponseTo := request.ID
+	if request.Unsolicited {
+		inResponseTo = ""
+	}
+	resp := i.makeResponse(inResponseTo, request.Issuer, user, nameID, format)
+	// Keep the ID reported to the Auditor when the user logged in
+	if request.AssertionID != "" {
+		resp.Assertion.ID = request.AssertionID
+	}
+	resp.Destination = request.AssertionConsumerServiceURL
 	// Add subject confirmation data and authentication statement
+	// The session respond stores in the UserCache expires after user-cache-duration
+	sessionNotOnOrAfter := now.Add(settings.GetDuration("user-cache-duration"))
 	resp.Assertion.AuthnStatement = &saml.AuthnStatement{
-		AuthnInstant: now,
-		SessionIndex: saml.NewID(),
-		SubjectLocality: &saml.SubjectLocality{
-			DNSName: i.serverName,
-		},
+		AuthnInstant:        i.authnInstant(request, now),
+		SessionIndex:        i.IDs.NewID(),
+		SessionNotOnOrAfter: &sessionNotOnOrAfter,
+		SubjectLocality:     i.subjectLocality(user),
 		AuthnContext: &saml.AuthnContext{
 			AuthnContextClassRef: user.Context,
 		},
 	}
+	if settings.GetBool("include-authenticating-authority") {
+		resp.Assertion.AuthnStatement.AuthnContext.AuthenticatingAuthority = i.authenticatingAuthorities(user)
+	}
+	// Unlike the Conditions, bearer confirmation data isn't backdated. The SSO profile forbids a NotBefore.
 	resp.Assertion.Subject.SubjectConfirmation = &saml.SubjectConfirmation{
 		Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
 		SubjectConfirmationData: &saml.SubjectConfirmationData{
-			Address:      net.ParseIP(user.IP),
-			InResponseTo: request.ID,
+			InResponseTo: inResponseTo,
 			Recipient:    request.AssertionConsumerServiceURL,
-			NotOnOrAfter: fiveFromNow,
+			NotOnOrAfter: now.Add(sp.subjectConfirmationLifetime()),
 		},
 	}
-	return resp
+	// SPs that validate the address reject assertions when the IdP only sees a proxy
+	if settings.GetBool("subject-confirmation-address") {
+		resp.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Address = net.ParseIP(user.IP)
+	}
+	return resp, nil
 }
 
-func (i *IDP) makeResponse(id, issuer string, user *model.User) *saml.Response {
-	now := time.Now().UTC()
-	fiveFromNow := now.Add(5 * time.Minute)
+// subjectLocality returns the user's IP address and the IDP's server name, unless disabled by
+// subject-locality-address or subject-locality-dns-name. It's omitted when both are disabled.
+func (i *IDP) subjectLocality(user *model.User) *saml.SubjectLocality {
+	locality := &saml.SubjectLocality{}
+	if settings.GetBool("subject-locality-address") {
+		locality.Address = net.ParseIP(user.IP)
+	}
+	if settings.GetBool("subject-locality-dns-name") {
+		locality.DNSName = i.serverName
+	}
+	if locality.Address == nil && locality.DNSName == "" {
+		return nil
+	}
+	return locality
+}
+
+// makeResponse returns a Response with an unsigned assertion of the user's released attributes about the NameID
+func (i *IDP) makeResponse(id, issuer string, user *model.User, nameID, format string) *saml.Response {
+	now := i.Clock.Now().UTC()
+	sp, _ := i.getSP(issuer)
+	attributes := i.releasedAttributes(user, issuer).AttributeStatement()
 	s := &saml.Response{
 		StatusResponseType: saml.StatusResponseType{
 			Version:      "2.0",
-			ID:           saml.NewID(),
+			ID:           i.IDs.NewID(),
 			IssueInstant: now,
 			Status: &saml.Status{
 				StatusCode: saml.StatusCode{
@@ -99,28 +232,28 @@ func (i *IDP) makeResponse(id, issuer string, user *model.User) *saml.Response {
 				},
 			},
 			InResponseTo: id,
-			Issuer:       saml.NewIssuer(i.entityID),
+			Issuer:       i.samlIssuer(),
 		},
 		Assertion: &saml.Assertion{
-			ID:           saml.NewID(),
+			ID:           i.IDs.NewID(),
 			IssueInstant: now,
-			Issuer:       saml.NewIssuer(i.entityID),
+			Issuer:       i.samlIssuer(),
 			Version:      "2.0",
 			Subject: &saml.Subject{
 				NameID: &saml.NameID{
-					Format:          user.Format,
+					Format:          format,
 					NameQualifier:   i.entityID,
 					SPNameQualifier: issuer,
-					Value:           user.Name,
+					Value:           nameID,
 				},
 				SubjectConfirmation: &saml.SubjectConfirmation{
 					Method: "urn:oasis:names:tc:SAML:2.0:cm:sender-vouches",
 				},
 			},
-			AttributeStatement: user.AttributeStatement(),
+			AttributeStatement: attributes,
 			Conditions: &saml.Conditions{
-				NotOnOrAfter: fiveFromNow,
-				NotBefore:    now,
+				NotOnOrAfter: now.Add(sp.assertionLifetime()),
+				NotBefore:    now.Add(-sp.notBeforeSkew()),
 				AudienceRestriction: &saml.AudienceRestriction{
 					Audience: issuer,
 				},
@@ -130,7 +263,24 @@ func (i *IDP) makeResponse(id, issuer string, user *model.User) *saml.Response {
 	return s
 }
 
-func getArtifact(entityID string) string {
+// samlIssuer returns the Issuer of the IDP's messages and assertions. The Format is set by issuer-format, which
+// can be empty for service providers that only accept the implied entity format.
+func (i *IDP) samlIssuer() *saml.Issuer {
+	return &saml.Issuer{Format: settings.GetString("issuer-format"), Value: i.entityID}
+}
+
+// authenticatingAuthorities lists the IdP followed by any upstream authorities recorded for the user
+func (i *IDP) authenticatingAuthorities(user *model.User) []string {
+	authorities := []string{i.entityID}
+	for _, authority := range user.AuthenticatingAuthorities {
+		if authority != "" && authority != i.entityID {
+			authorities = append(authorities, authority)
+		}
+	}
+	return authorities
+}
+
+func getArtifact(entityID, handle string) string {
 	// The artifact isn't just a random session id. It's a base64-encoded byte array
 	// that's 44 bytes in length. The first two bytes must be 04 for SAML 2. The second
 	// two bytes are the index of the artifact resolution endpoint in the IdP metadata. Something like 02
@@ -147,7 +297,7 @@ func getArtifact(entityID string) string {
 		artifact[i] = source[i-4]
 	}
 	// Message ID
-	message := sha1.Sum([]byte(uuid.New().String()))
+	message := sha1.Sum([]byte(handle))
 	for i := 24; i < 44; i++ {
 		artifact[i] = message[i-24]
 	}
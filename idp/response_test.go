@@ -15,10 +15,17 @@
 package idp
 
 import (
+	"encoding/xml"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/sign"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestIDP_respond(t *testing.T) {
@@ -32,3 +39,264 @@ func TestIDP_respond(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIDP_makeAuthnResponse_authenticatingAuthority(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	req := &model.AuthnRequest{ID: "123", Issuer: "sp"}
+	user := &model.User{AuthenticatingAuthorities: []string{"https://upstream.example.com/"}}
+	resp, err := i.makeAuthnResponse(req, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, resp.Assertion.AuthnStatement.AuthnContext.AuthenticatingAuthority, "authorities should be omitted by default")
+
+	viper.Set("include-authenticating-authority", true)
+	defer viper.Set("include-authenticating-authority", false)
+	resp, err = i.makeAuthnResponse(req, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{i.entityID, "https://upstream.example.com/"},
+		resp.Assertion.AuthnStatement.AuthnContext.AuthenticatingAuthority)
+}
+
+func TestIDP_makeAuthnResponse_unsolicited(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	user := &model.User{Name: "joe", IP: "127.0.0.1"}
+
+	resp, err := i.makeAuthnResponse(&model.AuthnRequest{ID: "_123", Issuer: "sp"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, strings.Count(string(data), `InResponseTo="_123"`), "solicited response should reference the request")
+
+	resp, err = i.makeAuthnResponse(&model.AuthnRequest{Issuer: "sp", Unsolicited: true}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), "InResponseTo", "unsolicited response must not contain InResponseTo")
+}
+
+func TestIDP_makeAuthnResponse_validity(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	lifetime, skew, confirmation := time.Hour, 2*time.Minute, 10*time.Minute
+	i.sps["https://slow.example.com"] = &ServiceProvider{
+		EntityID:                    "https://slow.example.com",
+		AssertionLifetime:           &lifetime,
+		NotBeforeSkew:               &skew,
+		SubjectConfirmationLifetime: &confirmation,
+	}
+	user := &model.User{Name: "joe"}
+
+	resp, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "sp"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conditions := resp.Assertion.Conditions
+	assert.Equal(t, 5*time.Minute, conditions.NotOnOrAfter.Sub(resp.IssueInstant))
+	assert.Equal(t, -time.Minute, conditions.NotBefore.Sub(resp.IssueInstant))
+	assert.Equal(t, 5*time.Minute,
+		resp.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter.Sub(resp.Assertion.AuthnStatement.AuthnInstant))
+
+	resp, err = i.makeAuthnResponse(&model.AuthnRequest{Issuer: "https://slow.example.com"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conditions = resp.Assertion.Conditions
+	assert.Equal(t, time.Hour, conditions.NotOnOrAfter.Sub(resp.IssueInstant))
+	assert.Equal(t, -2*time.Minute, conditions.NotBefore.Sub(resp.IssueInstant))
+	assert.Equal(t, 10*time.Minute,
+		resp.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter.Sub(resp.Assertion.AuthnStatement.AuthnInstant))
+
+	// 0 overrides the global settings too
+	setConfig(t, "sps", []map[string]interface{}{{"entityid": "https://exact.example.com", "notbeforeskew": "0s"}})
+	sps, err := NewConfigSPStore().List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.sps["https://exact.example.com"] = sps[0]
+	resp, err = i.makeAuthnResponse(&model.AuthnRequest{Issuer: "https://exact.example.com"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conditions = resp.Assertion.Conditions
+	assert.Equal(t, resp.IssueInstant, conditions.NotBefore, "the NotBefore shouldn't be backdated")
+	assert.Equal(t, 5*time.Minute, conditions.NotOnOrAfter.Sub(resp.IssueInstant), "unset settings should be global")
+}
+
+func TestIDP_makeAuthnResponse_notBeforeSkew(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	viper.Set("assertion-not-before-skew", "3m")
+	defer viper.Set("assertion-not-before-skew", "1m")
+
+	resp, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "sp"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the start is backdated
+	assert.Equal(t, -3*time.Minute, resp.Assertion.Conditions.NotBefore.Sub(resp.IssueInstant))
+	assert.Equal(t, 5*time.Minute, resp.Assertion.Conditions.NotOnOrAfter.Sub(resp.IssueInstant))
+}
+
+func TestIDP_makeAuthnResponse_sessionNotOnOrAfter(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	viper.Set("user-cache-duration", "2h")
+	defer viper.Set("user-cache-duration", "8h")
+	resp, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "sp"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statement := resp.Assertion.AuthnStatement
+	if assert.NotNil(t, statement.SessionNotOnOrAfter) {
+		assert.Equal(t, 2*time.Hour, statement.SessionNotOnOrAfter.Sub(statement.AuthnInstant),
+			"should match the session lifetime")
+	}
+}
+
+func TestIDP_makeAuthnResponse_subjectLocality(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	user := &model.User{Name: "joe", IP: "192.0.2.10"}
+	tests := []struct {
+		name     string
+		address  bool
+		dnsName  bool
+		expected string
+	}{
+		{"both", true, true, `<SubjectLocality xmlns="urn:oasis:names:tc:SAML:2.0:assertion" Address="192.0.2.10" DNSName="` +
+			i.serverName + `"></SubjectLocality>`},
+		{"address", true, false, `<SubjectLocality xmlns="urn:oasis:names:tc:SAML:2.0:assertion" Address="192.0.2.10"></SubjectLocality>`},
+		{"DNS name", false, true, `<SubjectLocality xmlns="urn:oasis:names:tc:SAML:2.0:assertion" DNSName="` +
+			i.serverName + `"></SubjectLocality>`},
+		{"neither", false, false, ""},
+	}
+	defer viper.Set("subject-locality-address", true)
+	defer viper.Set("subject-locality-dns-name", true)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("subject-locality-address", tt.address)
+			viper.Set("subject-locality-dns-name", tt.dnsName)
+			resp, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "sp"}, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			locality := resp.Assertion.AuthnStatement.SubjectLocality
+			if tt.expected == "" {
+				assert.Nil(t, locality)
+				return
+			}
+			data, err := xml.Marshal(locality)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expected, string(data))
+		})
+	}
+}
+
+func TestIDP_makeAuthnResponse_issuerFormat(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	resp, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "sp"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := `Format="urn:oasis:names:tc:SAML:2.0:nameid-format:entity">` + i.entityID + `</Issuer>`
+	assert.Equal(t, 2, strings.Count(string(data), issuer), "response and assertion issuers should have the entity format")
+
+	viper.Set("issuer-format", "")
+	defer viper.Set("issuer-format", "urn:oasis:names:tc:SAML:2.0:nameid-format:entity")
+	data, err = xml.Marshal(i.makeLogoutResponse(&saml.LogoutRequest{}).Issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">`+i.entityID+`</Issuer>`, string(data))
+}
+
+func TestIDP_makeAuthnResponse_nameIDAttribute(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	i.sps["https://mail.example.com"] = &ServiceProvider{
+		EntityID:        "https://mail.example.com",
+		NameIDAttribute: "mail",
+		NameIDFormat:    "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress",
+	}
+	user := &model.User{
+		Name:       "joe",
+		Format:     "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
+		Attributes: []*model.Attribute{{Name: "mail", Value: []string{"joe@example.com"}}},
+	}
+	subject := func(issuer string) *saml.NameID {
+		resp, err := i.makeAuthnResponse(&model.AuthnRequest{ID: "_123", Issuer: issuer}, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Assertion.Subject.NameID
+	}
+
+	nameID := subject("https://mail.example.com")
+	assert.Equal(t, "joe@example.com", nameID.Value)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress", nameID.Format)
+
+	nameID = subject("sp")
+	assert.Equal(t, "joe", nameID.Value, "other service providers should get the login name")
+
+	// The attribute is only used when the service provider may receive it
+	setConfig(t, "attribute-release-rules", []map[string]interface{}{{"attribute": "mail", "sps": []string{"sp"}}})
+	rules, err := loadReleaseRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.releaseRules = rules
+	nameID = subject("https://mail.example.com")
+	assert.Equal(t, "joe", nameID.Value, "an attribute withheld by the release rules shouldn't be sent as the NameID")
+	i.releaseRules = nil
+
+	user.Attributes = nil
+	nameID = subject("https://mail.example.com")
+	assert.Equal(t, "joe", nameID.Value, "should fall back to the login name without the attribute")
+	assert.Equal(t, "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", nameID.Format)
+}
+
+func TestIDP_BuildSignedResponse(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	resp, err := i.BuildSignedResponse(&model.AuthnRequest{ID: "_123", Issuer: "sp"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "_123", resp.InResponseTo)
+	assert.NotNil(t, resp.Assertion.Signature, "assertion should be signed")
+	data, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sign.NewValidator().Validate(string(data))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,183 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// SessionStore keeps track of users' logins to the IDP
+type SessionStore interface {
+	// Create starts a new session for the user
+	Create(user *model.User) (*model.Session, error)
+	// Get returns the session or an error if it doesn't exist or has expired
+	Get(id string) (*model.Session, error)
+	// Update saves changes to an existing session
+	Update(session *model.Session) error
+	Delete(id string) error
+	// ListByUser returns all the current sessions of the named user
+	ListByUser(name string) ([]*model.Session, error)
+}
+
+// NewSessionStore returns a SessionStore that saves sessions in the cache. Each user's sessions are indexed
+// under an additional key so they can be listed. The index is only guarded against concurrent updates within
+// this process. Sessions are stamped with their creation time read from the clock, and their IDs are handles from
+// the IDGenerator.
+func NewSessionStore(cache store.Cache, clock Clock, ids IDGenerator) SessionStore {
+	return &cacheSessionStore{cache: cache, clock: clock, ids: ids}
+}
+
+type cacheSessionStore struct {
+	cache store.Cache
+	clock Clock
+	ids   IDGenerator
+	// guards the per user indexes
+	lock sync.Mutex
+}
+
+func (s *cacheSessionStore) Create(user *model.User) (*model.Session, error) {
+	created, err := ptypes.TimestampProto(s.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	session := &model.Session{
+		ID:            s.ids.NewHandle(),
+		User:          user,
+		Created:       created,
+		Authenticated: created,
+	}
+	if err := s.Update(session); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids, err := s.index(user.Name)
+	if err != nil {
+		return nil, err
+	}
+	ids.IDs = append(ids.IDs, session.ID)
+	if err = s.setIndex(user.Name, ids); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *cacheSessionStore) Get(id string) (*model.Session, error) {
+	data, err := s.cache.Get(sessionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	session := &model.Session{}
+	if err = proto.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *cacheSessionStore) Update(session *model.Session) error {
+	data, err := proto.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return s.cache.Set(sessionKey(session.ID), data)
+}
+
+func (s *cacheSessionStore) Delete(id string) error {
+	session, err := s.Get(id)
+	if err != nil {
+		// Nothing to delete
+		return nil
+	}
+	if err = s.cache.Delete(sessionKey(id)); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids, err := s.index(session.User.GetName())
+	if err != nil {
+		return err
+	}
+	remaining := ids.IDs[:0]
+	for _, other := range ids.IDs {
+		if other != id {
+			remaining = append(remaining, other)
+		}
+	}
+	ids.IDs = remaining
+	return s.setIndex(session.User.GetName(), ids)
+}
+
+func (s *cacheSessionStore) ListByUser(name string) ([]*model.Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids, err := s.index(name)
+	if err != nil {
+		return nil, err
+	}
+	indexed := len(ids.IDs)
+	sessions := make([]*model.Session, 0, indexed)
+	current := ids.IDs[:0]
+	for _, id := range ids.IDs {
+		// Expired sessions are dropped from the index
+		if session, err := s.Get(id); err == nil {
+			sessions = append(sessions, session)
+			current = append(current, id)
+		}
+	}
+	if len(current) == indexed {
+		return sessions, nil
+	}
+	ids.IDs = current
+	return sessions, s.setIndex(name, ids)
+}
+
+// index returns the IDs of the user's sessions, which may include expired ones
+func (s *cacheSessionStore) index(name string) (*model.SessionIDs, error) {
+	ids := &model.SessionIDs{}
+	data, err := s.cache.Get(indexKey(name))
+	if err != nil {
+		// No sessions yet
+		return ids, nil
+	}
+	if err = proto.Unmarshal(data, ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *cacheSessionStore) setIndex(name string, ids *model.SessionIDs) error {
+	data, err := proto.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return s.cache.Set(indexKey(name), data)
+}
+
+// sessionKey is where the session is kept. The cache can share its keyspace with others, such as the TempCache when
+// both are in the same Redis, so sessions and their indexes are kept under their own prefixes.
+func sessionKey(id string) string {
+	return "session:" + id
+}
+
+// indexKey is where the IDs of the user's sessions are kept
+func indexKey(name string) string {
+	return "usersessions:" + url.QueryEscape(name)
+}
@@ -0,0 +1,86 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStore(t *testing.T) {
+	now := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+	sessions := NewSessionStore(store.NewLRU(time.Minute, 10), &fixedClock{now}, &sequentialIDs{})
+	first, err := sessions.Create(&model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, now.Unix(), first.Created.GetSeconds(), "session should be stamped with the clock's time")
+	assert.Equal(t, "handle1", first.ID, "the ID should come from the IDGenerator")
+	second, err := sessions.Create(&model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sessions.Create(&model.User{Name: "jane"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first.ServiceProviders = append(first.ServiceProviders, "https://sp.example.com/")
+	assert.NoError(t, sessions.Update(first))
+	saved, err := sessions.Get(first.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "joe", saved.User.Name)
+		assert.Equal(t, []string{"https://sp.example.com/"}, saved.ServiceProviders)
+	}
+
+	listed, err := sessions.ListByUser("joe")
+	assert.NoError(t, err)
+	assert.Len(t, listed, 2)
+
+	assert.NoError(t, sessions.Delete(first.ID))
+	_, err = sessions.Get(first.ID)
+	assert.Error(t, err)
+	listed, err = sessions.ListByUser("joe")
+	if assert.NoError(t, err) && assert.Len(t, listed, 1) {
+		assert.Equal(t, second.ID, listed[0].ID)
+	}
+	// Deleting a missing session isn't an error
+	assert.NoError(t, sessions.Delete(first.ID))
+}
+
+func TestSessionStore_sharedCache(t *testing.T) {
+	// The TempCache saves state under handles from the same IDGenerator when both are in one Redis
+	cache := store.NewLRU(time.Minute, 10)
+	if err := cache.Set("handle1", []byte("login request")); err != nil {
+		t.Fatal(err)
+	}
+	sessions := NewSessionStore(cache, SystemClock(), &sequentialIDs{})
+	session, err := sessions.Create(&model.User{Name: "handle1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "handle1", session.ID)
+	data, err := cache.Get("handle1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "login request", string(data), "sessions shouldn't replace other entries")
+	}
+	listed, err := sessions.ListByUser("handle1")
+	if assert.NoError(t, err) {
+		assert.Len(t, listed, 1)
+	}
+}
@@ -15,14 +15,27 @@
 package idp
 
 import (
+	"bytes"
+	"context"
+	"crypto"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
-	"github.com/spf13/viper"
+	"fmt"
 	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/amdonov/xmlsig"
+	"github.com/chriskery/sso-idp/model"
 	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
+	log "github.com/sirupsen/logrus"
 )
 
 // ServiceProvider stores the Service Provider metadata required by the IdP
@@ -31,20 +44,399 @@ type ServiceProvider struct {
 	AssertionConsumerServices []AssertionConsumerService
 	SingleLogoutServices      []SingleLogoutService
 	Certificate               string
-	// Could be an RSA or DSA public key
-	publicKey interface{}
+	// base64 encoded DER public key for service providers that publish a KeyValue rather than a certificate
+	PublicKey string `yaml:",omitempty"`
+	// Overrides require-signed-authn-requests for this service provider
+	RequireSignedAuthnRequests *bool `yaml:",omitempty"`
+	// How AuthnRequests are authenticated, MessageSignatureAuth (default) or TransportAuth
+	AuthMode string `yaml:",omitempty"`
+	// Override the global signature-algorithm and digest-algorithm for this service provider. With a Signer provided
+	// by the application, only its own signature algorithm can be set.
+	SignatureAlgorithm string `yaml:",omitempty"`
+	DigestAlgorithm    string `yaml:",omitempty"`
+	// Algorithms the service provider supports in order of preference, read from the algorithm support
+	// extensions of its metadata. The first one the IDP also supports is used when the algorithm isn't set above.
+	// A Signer provided by the application isn't negotiated, and a warning is logged when it doesn't match.
+	SigningMethods []string `yaml:",omitempty"`
+	DigestMethods  []string `yaml:",omitempty"`
+	// Override the global assertion-lifetime, assertion-not-before-skew, and subject-confirmation-lifetime. The skew
+	// may be 0, such as to turn it off for a service provider, while the lifetimes must be positive.
+	AssertionLifetime           *time.Duration `yaml:",omitempty"`
+	NotBeforeSkew               *time.Duration `yaml:",omitempty"`
+	SubjectConfirmationLifetime *time.Duration `yaml:",omitempty"`
+	// Overrides the global max-authentication-age, making users log in again when their session is older
+	MaxAuthenticationAge time.Duration `yaml:",omitempty"`
+	// Attribute, such as mail, that supplies the NameID instead of the login name. Overrides the global
+	// nameid-attribute and nameid-format.
+	NameIDAttribute string `yaml:",omitempty"`
+	NameIDFormat    string `yaml:",omitempty"`
+	// Suspends logins to the service provider while keeping its configuration and certificate
+	Disabled bool `yaml:",omitempty"`
+	// Further assertion consumer URLs the service provider may request, such as per-tenant URLs. A * in the host
+	// matches a single label, https://*.example.com/acs, and the path is matched using path.Match.
+	AllowedACSURLs []string `yaml:",omitempty"`
+	// Limits which users may log in to the service provider
+	AccessPolicy *AccessPolicy `yaml:",omitempty"`
+	// Could be an RSA, DSA, or ECDSA public key
+	publicKey   interface{}
+	certificate *x509.Certificate
+}
+
+const (
+	// MessageSignatureAuth authenticates requests using the signature on the message
+	MessageSignatureAuth = "message-signature"
+	// TransportAuth authenticates requests using the client certificate presented over mutual TLS
+	TransportAuth = "transport"
+)
+
+// validate parses the service provider's certificate and checks it and the allowed ACS URLs before it's registered.
+// A certificate outside of its validity period is only logged, since the messages signed with it are rejected
+// anyway, so that one service provider can't keep the IDP from starting or reloading.
+func (sp *ServiceProvider) validate(now time.Time, anchors *x509.CertPool) error {
+	if err := sp.parseCertificate(); err != nil {
+		return err
+	}
+	if err := sp.checkCertificate(now); err != nil {
+		log.Warnf("%s, messages from the service provider will be rejected", err)
+	}
+	if err := sp.verifyChain(anchors); err != nil {
+		return err
+	}
+	if err := sp.checkValidity(); err != nil {
+		return err
+	}
+	return sp.checkAllowedACSURLs()
+}
+
+// requireSignedAuthnRequests reports whether AuthnRequests from the service provider must be signed
+func (sp *ServiceProvider) requireSignedAuthnRequests() bool {
+	if sp.RequireSignedAuthnRequests != nil {
+		return *sp.RequireSignedAuthnRequests
+	}
+	return settings.GetBool("require-signed-authn-requests")
+}
+
+// copySettings keeps locally configured settings that aren't part of the SP's metadata
+func (sp *ServiceProvider) copySettings(from *ServiceProvider) {
+	sp.RequireSignedAuthnRequests = from.RequireSignedAuthnRequests
+	sp.AuthMode = from.AuthMode
+	sp.SignatureAlgorithm = from.SignatureAlgorithm
+	sp.DigestAlgorithm = from.DigestAlgorithm
+	sp.AssertionLifetime = from.AssertionLifetime
+	sp.NotBeforeSkew = from.NotBeforeSkew
+	sp.SubjectConfirmationLifetime = from.SubjectConfirmationLifetime
+	sp.MaxAuthenticationAge = from.MaxAuthenticationAge
+	sp.NameIDAttribute = from.NameIDAttribute
+	sp.NameIDFormat = from.NameIDFormat
+	sp.Disabled = from.Disabled
+	sp.AllowedACSURLs = from.AllowedACSURLs
+	sp.AccessPolicy = from.AccessPolicy
+}
+
+// nameIDAttribute returns the attribute that supplies the NameID and its format. Without its own NameIDAttribute
+// the service provider uses nameid-attribute, unless it's sent persistent NameIDs.
+func (sp *ServiceProvider) nameIDAttribute() (string, string) {
+	if sp.NameIDAttribute != "" {
+		return sp.NameIDAttribute, sp.NameIDFormat
+	}
+	if sp.NameIDFormat == persistentNameIDFormat {
+		return "", ""
+	}
+	return settings.GetString("nameid-attribute"), settings.GetString("nameid-format")
+}
+
+// nameID returns the NameID value and format for the user. The configured NameID attribute is used when
+// the user has a value for it, otherwise the login name.
+func (sp *ServiceProvider) nameID(user *model.User) (string, string) {
+	if sp == nil {
+		return user.Name, user.Format
+	}
+	attribute, format := sp.nameIDAttribute()
+	if attribute == "" {
+		return user.Name, user.Format
+	}
+	for _, att := range user.Attributes {
+		if strings.EqualFold(att.Name, attribute) && len(att.Value) > 0 && att.Value[0] != "" {
+			if format == "" {
+				format = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+			}
+			return att.Value[0], format
+		}
+	}
+	log.Warnf("%s has no %s attribute for the NameID, using the login name", user.Name, attribute)
+	return user.Name, user.Format
+}
+
+// assertionLifetime is how long assertions for the service provider are valid
+func (sp *ServiceProvider) assertionLifetime() time.Duration {
+	if sp != nil && sp.AssertionLifetime != nil {
+		return *sp.AssertionLifetime
+	}
+	return settings.GetDuration("assertion-lifetime")
+}
+
+// notBeforeSkew backdates the NotBefore of assertions so service providers with slow clocks don't reject them as
+// not yet valid
+func (sp *ServiceProvider) notBeforeSkew() time.Duration {
+	if sp != nil && sp.NotBeforeSkew != nil {
+		return *sp.NotBeforeSkew
+	}
+	return settings.GetDuration("assertion-not-before-skew")
+}
+
+// subjectConfirmationLifetime is how long the service provider has to deliver a bearer assertion
+func (sp *ServiceProvider) subjectConfirmationLifetime() time.Duration {
+	if sp != nil && sp.SubjectConfirmationLifetime != nil {
+		return *sp.SubjectConfirmationLifetime
+	}
+	return settings.GetDuration("subject-confirmation-lifetime")
+}
+
+// maxAuthenticationAge is how long ago users may have logged in for their session to be used with the service
+// provider, or 0 for as long as the session lasts
+func (sp *ServiceProvider) maxAuthenticationAge() time.Duration {
+	if sp != nil && sp.MaxAuthenticationAge > 0 {
+		return sp.MaxAuthenticationAge
+	}
+	return settings.GetDuration("max-authentication-age")
+}
+
+// allowedACSURL reports whether the location matches one of the AllowedACSURLs
+func (sp *ServiceProvider) allowedACSURL(location string) bool {
+	u, err := url.Parse(location)
+	if err != nil || u.User != nil || u.Fragment != "" {
+		return false
+	}
+	for _, pattern := range sp.AllowedACSURLs {
+		if p, err := url.Parse(pattern); err == nil && matchACSURL(p, u) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchACSURL(pattern, u *url.URL) bool {
+	if pattern.Scheme != u.Scheme || pattern.Port() != u.Port() || pattern.RawQuery != u.RawQuery {
+		return false
+	}
+	// Wildcards only stand for whole labels so they can't reach into another domain
+	patternLabels := strings.Split(pattern.Hostname(), ".")
+	labels := strings.Split(u.Hostname(), ".")
+	if len(patternLabels) != len(labels) {
+		return false
+	}
+	for i, label := range labels {
+		if label == "" || (patternLabels[i] != "*" && !strings.EqualFold(patternLabels[i], label)) {
+			return false
+		}
+	}
+	matched, err := path.Match(pattern.Path, u.Path)
+	return err == nil && matched
+}
+
+// checkAllowedACSURLs rejects AllowedACSURLs that can't be matched
+// checkValidity rejects overrides that would issue assertions that are already expired or not yet valid
+func (sp *ServiceProvider) checkValidity() error {
+	if sp.AssertionLifetime != nil && *sp.AssertionLifetime <= 0 {
+		return fmt.Errorf("assertionlifetime of %s must be positive: %s", sp.EntityID, *sp.AssertionLifetime)
+	}
+	if sp.SubjectConfirmationLifetime != nil && *sp.SubjectConfirmationLifetime <= 0 {
+		return fmt.Errorf("subjectconfirmationlifetime of %s must be positive: %s", sp.EntityID,
+			*sp.SubjectConfirmationLifetime)
+	}
+	if sp.NotBeforeSkew != nil && *sp.NotBeforeSkew < 0 {
+		return fmt.Errorf("notbeforeskew of %s must not be negative: %s", sp.EntityID, *sp.NotBeforeSkew)
+	}
+	return nil
+}
+
+func (sp *ServiceProvider) checkAllowedACSURLs() error {
+	for _, pattern := range sp.AllowedACSURLs {
+		p, err := url.Parse(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid allowed ACS URL %s for %s: %s", pattern, sp.EntityID, err)
+		}
+		if p.Scheme == "" || p.Host == "" {
+			return fmt.Errorf("allowed ACS URL %s for %s must be absolute", pattern, sp.EntityID)
+		}
+		if _, err = path.Match(p.Path, ""); err != nil {
+			return fmt.Errorf("invalid allowed ACS URL %s for %s: %s", pattern, sp.EntityID, err)
+		}
+	}
+	return nil
+}
+
+// verifyClientCert confirms the request was sent over mutual TLS using the service provider's certificate
+func (sp *ServiceProvider) verifyClientCert(r *http.Request, now time.Time) error {
+	if err := sp.checkCertificate(now); err != nil {
+		return err
+	}
+	cert, err := getCertFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if sp.certificate == nil || !bytes.Equal(cert.Raw, sp.certificate.Raw) {
+		return errors.New("client certificate does not match the service provider's certificate")
+	}
+	return nil
+}
+
+// assertionConsumerService determines the service that receives the response to the request. It's the service
+// with the requested index, then the one at the requested URL, and otherwise the default. A URL sent along
+// with an index must match the indexed service.
+func (sp *ServiceProvider) assertionConsumerService(request *saml.AuthnRequest) (*AssertionConsumerService, error) {
+	var acs *AssertionConsumerService
+	switch {
+	case request.AssertionConsumerServiceIndex != nil:
+		index := *request.AssertionConsumerServiceIndex
+		for i, a := range sp.AssertionConsumerServices {
+			if a.Index == index {
+				acs = &sp.AssertionConsumerServices[i]
+				break
+			}
+		}
+		if acs == nil {
+			return nil, fmt.Errorf("service provider does not have an assertion consumer service with index %d", index)
+		}
+	case request.AssertionConsumerServiceURL != "":
+		for i, a := range sp.AssertionConsumerServices {
+			if a.Location == request.AssertionConsumerServiceURL {
+				acs = &sp.AssertionConsumerServices[i]
+				break
+			}
+		}
+		if acs == nil && sp.allowedACSURL(request.AssertionConsumerServiceURL) {
+			acs = &AssertionConsumerService{Binding: request.ProtocolBinding, Location: request.AssertionConsumerServiceURL}
+		}
+	default:
+		if len(sp.AssertionConsumerServices) == 0 {
+			return nil, errors.New("unable to determine assertion consumer service")
+		}
+		// As with metadata, the first service is the default unless another is marked as the default
+		acs = &sp.AssertionConsumerServices[0]
+		for i, a := range sp.AssertionConsumerServices {
+			if a.IsDefault {
+				acs = &sp.AssertionConsumerServices[i]
+				break
+			}
+		}
+	}
+	if request.AssertionConsumerServiceURL != "" && (acs == nil || request.AssertionConsumerServiceURL != acs.Location) {
+		return nil, errors.New("assertion consumer location in request does not match metadata")
+	}
+	return acs, nil
+}
+
+// verifySigningKey confirms an XML signature was made using the service provider's key
+func (sp *ServiceProvider) verifySigningKey(signature *xmlsig.Signature, now time.Time) error {
+	if err := sp.checkCertificate(now); err != nil {
+		return err
+	}
+	if signature == nil || signature.KeyInfo.X509Data == nil {
+		return errors.New("signature does not include a certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature.KeyInfo.X509Data.X509Certificate))
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !key.Equal(sp.publicKey) {
+		return errors.New("message was not signed by the service provider")
+	}
+	return nil
 }
 
 func (sp *ServiceProvider) parseCertificate() error {
-	block, err := base64.StdEncoding.DecodeString(sp.Certificate)
+	if sp.Certificate == "" && sp.PublicKey != "" {
+		der, err := base64.StdEncoding.DecodeString(sp.PublicKey)
+		if err != nil {
+			return errors.New("failed to decode the public key")
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return errors.New("failed to parse public key: " + err.Error())
+		}
+		sp.publicKey = key
+		return nil
+	}
+	der, err := decodeCertificate(sp.Certificate)
 	if err != nil {
-		return errors.New("failed to parse PEM block containing the public key")
+		return fmt.Errorf("failed to decode the certificate of %s: %s", sp.EntityID, err)
 	}
-	cert, err := x509.ParseCertificate(block)
+	cert, err := x509.ParseCertificate(der)
 	if err != nil {
 		return errors.New("failed to parse certificate: " + err.Error())
 	}
 	sp.publicKey = cert.PublicKey
+	sp.certificate = cert
+	return nil
+}
+
+const (
+	pemCertificateHeader = "-----BEGIN CERTIFICATE-----"
+	pemCertificateFooter = "-----END CERTIFICATE-----"
+)
+
+// decodeCertificate returns the DER bytes of a base64 encoded certificate, as found in metadata, or a PEM
+// block pasted into the configuration. Whitespace, including the line breaks and indentation YAML adds,
+// is ignored.
+func decodeCertificate(value string) ([]byte, error) {
+	if start := strings.Index(value, pemCertificateHeader); start >= 0 {
+		value = value[start+len(pemCertificateHeader):]
+		end := strings.Index(value, pemCertificateFooter)
+		if end < 0 {
+			return nil, errors.New("PEM certificate is missing its END CERTIFICATE line")
+		}
+		value = value[:end]
+	}
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+}
+
+// checkCertificate rejects the service provider's certificate outside of its validity period. Federations that
+// tolerate expired certificates can disable reject-expired-sp-certificates to only log a warning. Service
+// providers configured with a public key have no validity period.
+func (sp *ServiceProvider) checkCertificate(now time.Time) error {
+	if sp.certificate == nil {
+		return nil
+	}
+	var err error
+	switch {
+	case now.Before(sp.certificate.NotBefore):
+		err = fmt.Errorf("certificate of %s is not valid before %s", sp.EntityID,
+			sp.certificate.NotBefore.Format(time.RFC3339))
+	case now.After(sp.certificate.NotAfter):
+		err = fmt.Errorf("certificate of %s expired on %s", sp.EntityID, sp.certificate.NotAfter.Format(time.RFC3339))
+	default:
+		return nil
+	}
+	if settings.GetBool("reject-expired-sp-certificates") {
+		return err
+	}
+	log.Warn(err)
+	return nil
+}
+
+// verifyChain confirms the service provider's certificate was issued by one of the trust anchors. It's
+// checked as of the start of the certificate's validity, since expiry is handled by checkCertificate.
+func (sp *ServiceProvider) verifyChain(anchors *x509.CertPool) error {
+	if anchors == nil {
+		return nil
+	}
+	if sp.certificate == nil {
+		return fmt.Errorf("%s has no certificate to verify against the trust anchors", sp.EntityID)
+	}
+	_, err := sp.certificate.Verify(x509.VerifyOptions{
+		Roots:       anchors,
+		CurrentTime: sp.certificate.NotBefore,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate of %s is not trusted: %s", sp.EntityID, err)
+	}
 	return nil
 }
 
@@ -82,13 +474,26 @@ func convertMetadata(spMeta *saml.SPEntityDescriptor) (*ServiceProvider, error)
 	if spMeta == nil {
 		return nil, errors.New("service provider entity descriptor not found")
 	}
-	x509Data := spMeta.SPSSODescriptor.KeyDescriptor.KeyInfo.X509Data
-	if x509Data == nil {
-		return nil, errors.New("service provider's SSO descriptor does not contain required X509Data element")
-	}
 	sp := &ServiceProvider{
-		Certificate: x509Data.X509Certificate,
-		EntityID:    spMeta.EntityDescriptor.EntityID,
+		EntityID: spMeta.EntityDescriptor.EntityID,
+	}
+	keyInfo := spMeta.SPSSODescriptor.KeyDescriptor.KeyInfo
+	switch {
+	case keyInfo.X509Data != nil:
+		sp.Certificate = keyInfo.X509Data.X509Certificate
+	case keyInfo.KeyValue != nil:
+		// Some service providers only publish their raw public key
+		key, err := publicKeyFromKeyValue(keyInfo.KeyValue)
+		if err != nil {
+			return nil, err
+		}
+		der, err := marshalPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		sp.PublicKey = base64.StdEncoding.EncodeToString(der)
+	default:
+		return nil, errors.New("service provider's SSO descriptor does not contain required X509Data or KeyValue element")
 	}
 	sp.AssertionConsumerServices = make([]AssertionConsumerService, len(spMeta.SPSSODescriptor.AssertionConsumerService))
 	sp.SingleLogoutServices = make([]SingleLogoutService, len(spMeta.SPSSODescriptor.SingleLogoutService))
@@ -109,30 +514,85 @@ func convertMetadata(spMeta *saml.SPEntityDescriptor) (*ServiceProvider, error)
 			Location:  val.Location,
 		}
 	}
+	// Algorithms can be declared for the entity or its SSO role, which takes precedence
+	extensions := spMeta.SPSSODescriptor.Extensions
+	if extensions == nil {
+		extensions = spMeta.EntityDescriptor.Extensions
+	}
+	if extensions != nil {
+		sp.SigningMethods = saml.Algorithms(extensions.SigningMethods)
+		sp.DigestMethods = saml.Algorithms(extensions.DigestMethods)
+	}
 	return sp, nil
 }
 
+// FetchSPMetadata reads a service provider's metadata from the URL. The request is abandoned when the context is
+// done or the sp-metadata-timeout passes.
+func FetchSPMetadata(ctx context.Context, metadataURL string) (*ServiceProvider, error) {
+	ctx, cancel := withTimeout(ctx, "sp-metadata-timeout")
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Don't try to parse error pages as metadata
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code, %d, when requesting metadata", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !isXMLContentType(contentType) {
+		return nil, fmt.Errorf("unexpected content type, %q, when requesting metadata", contentType)
+	}
+	return ReadSPMetadata(resp.Body)
+}
+
+// isXMLContentType accepts the XML media types, including application/samlmetadata+xml
+func isXMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
 func SaveSpFromMetadata(metadata io.ReadCloser) error {
 	serviceProvider, err := ReadSPMetadata(metadata)
 	if err != nil {
 		return err
 	}
-	// Get the existing sps
-	var sps []*ServiceProvider
-	if err = viper.UnmarshalKey("sps", &sps); err != nil {
+	return SaveServiceProviders(serviceProvider)
+}
+
+// SaveServiceProviders adds the service providers to the SPStore selected by the sp-store setting, keeping the local
+// settings of those already saved
+func SaveServiceProviders(serviceProviders ...*ServiceProvider) error {
+	spStore, err := NewSPStore()
+	if err != nil {
 		return err
 	}
-	found := false
-	for i, client := range sps {
-		if client.EntityID == serviceProvider.EntityID {
-			sps[i] = serviceProvider
-			found = true
-			break
+	return spStore.Save(serviceProviders...)
+}
+
+// mergeServiceProviders adds the service providers to sps. Those replacing a service provider with the same entity
+// ID keep its locally configured settings.
+func mergeServiceProviders(sps, serviceProviders []*ServiceProvider) []*ServiceProvider {
+	for _, serviceProvider := range serviceProviders {
+		found := false
+		for i, client := range sps {
+			if client.EntityID == serviceProvider.EntityID {
+				serviceProvider.copySettings(client)
+				sps[i] = serviceProvider
+				found = true
+				break
+			}
+		}
+		if !found {
+			sps = append(sps, serviceProvider)
 		}
 	}
-	if !found {
-		sps = append(sps, serviceProvider)
-	}
-	viper.Set("sps", sps)
-	return viper.WriteConfig()
+	return sps
 }
@@ -15,10 +15,27 @@
 package idp
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -46,3 +63,429 @@ func TestReadInvalidSPMetadata(t *testing.T) {
 		t.Fatal("expected failure")
 	}
 }
+
+func TestReadSPMetadata_algorithmSupport(t *testing.T) {
+	in, err := os.Open(filepath.Join("testdata", "sp-metadata-algsupport.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	sp, err := ReadSPMetadata(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512",
+		"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"}, sp.SigningMethods)
+	assert.Equal(t, []string{"http://www.w3.org/2001/04/xmlenc#sha512",
+		"http://www.w3.org/2001/04/xmlenc#sha256"}, sp.DigestMethods)
+}
+
+func TestReadSPMetadata_keyValue(t *testing.T) {
+	in, err := os.Open(filepath.Join("testdata", "sp-metadata-keyvalue.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	sp, err := ReadSPMetadata(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, sp.Certificate)
+	assert.NotEmpty(t, sp.PublicKey)
+	if err = sp.parseCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	key, ok := sp.publicKey.(*rsa.PublicKey)
+	if assert.True(t, ok, "expected an RSA key") {
+		assert.Equal(t, 65537, key.E)
+		assert.Equal(t, 2048, key.N.BitLen())
+	}
+}
+
+// newTestCertificate returns a certificate valid between the times, signed by the parent or self-signed
+func newTestCertificate(t *testing.T, notBefore, notAfter time.Time, parent *x509.Certificate,
+	parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "sp"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestServiceProvider_assertionConsumerService(t *testing.T) {
+	sp := &ServiceProvider{
+		AssertionConsumerServices: []AssertionConsumerService{
+			{Index: 0, Location: "https://sp.example.com/zero"},
+			{Index: 1, Location: "https://sp.example.com/one", IsDefault: true},
+			{Index: 2, Location: "https://sp.example.com/two"},
+		},
+	}
+	resolve := func(request string) (string, error) {
+		authnRequest := &saml.AuthnRequest{}
+		if err := xml.Unmarshal([]byte(request), authnRequest); err != nil {
+			t.Fatal(err)
+		}
+		acs, err := sp.assertionConsumerService(authnRequest)
+		if err != nil {
+			return "", err
+		}
+		return acs.Location, nil
+	}
+
+	location, err := resolve(`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol" AssertionConsumerServiceIndex="0"/>`)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp.example.com/zero", location, "index 0 should not be mistaken for no index")
+	location, err = resolve(`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol" AssertionConsumerServiceURL="https://sp.example.com/two"/>`)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp.example.com/two", location)
+	location, err = resolve(`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol"/>`)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp.example.com/one", location, "should use the default service")
+
+	_, err = resolve(`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol" AssertionConsumerServiceIndex="3"/>`)
+	assert.Error(t, err, "unknown index should be rejected")
+	_, err = resolve(`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol" AssertionConsumerServiceURL="https://evil.example.com/"/>`)
+	assert.Error(t, err, "unknown URL should be rejected")
+	_, err = resolve(`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol" AssertionConsumerServiceIndex="0" AssertionConsumerServiceURL="https://sp.example.com/one"/>`)
+	assert.Error(t, err, "URL should match the indexed service")
+
+	sp.AssertionConsumerServices[1].IsDefault = false
+	location, err = resolve(`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol"/>`)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp.example.com/zero", location, "first service should be the default when none is marked")
+}
+
+func TestServiceProvider_assertionConsumerService_allowedURLs(t *testing.T) {
+	sp := &ServiceProvider{
+		EntityID: "https://saas.example.com",
+		AssertionConsumerServices: []AssertionConsumerService{
+			{Location: "https://saas.example.com/acs", IsDefault: true},
+		},
+		AllowedACSURLs: []string{"https://*.saas.example.com/saml/acs", "https://saas.example.com/tenants/*/acs"},
+	}
+	assert.NoError(t, sp.checkAllowedACSURLs())
+	for _, location := range []string{
+		"https://acme.saas.example.com/saml/acs",
+		"https://saas.example.com/tenants/acme/acs",
+	} {
+		acs, err := sp.assertionConsumerService(&saml.AuthnRequest{AssertionConsumerServiceURL: location})
+		if assert.NoError(t, err, location) {
+			assert.Equal(t, location, acs.Location)
+		}
+	}
+	for _, location := range []string{
+		"https://evil.example.com/saml/acs",
+		"https://evil.com/.saas.example.com/saml/acs",
+		"https://a.b.saas.example.com/saml/acs",
+		"http://acme.saas.example.com/saml/acs",
+		"https://acme.saas.example.com:8443/saml/acs",
+		"https://acme.saas.example.com/saml/acs?next=https://evil.example.com",
+		"https://user@acme.saas.example.com/saml/acs",
+		"https://saas.example.com/tenants/acme/other/acs",
+	} {
+		_, err := sp.assertionConsumerService(&saml.AuthnRequest{AssertionConsumerServiceURL: location})
+		assert.Error(t, err, "%s should not be allowed", location)
+	}
+
+	sp.AllowedACSURLs = []string{"/acs"}
+	assert.Error(t, sp.checkAllowedACSURLs(), "patterns must be absolute")
+}
+
+func TestServiceProvider_checkValidity(t *testing.T) {
+	duration := func(d time.Duration) *time.Duration { return &d }
+	valid := newTestSP(t, "https://sp.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST").serviceProvider()
+	valid.AssertionLifetime = duration(time.Minute)
+	valid.SubjectConfirmationLifetime = duration(time.Minute)
+	valid.NotBeforeSkew = duration(0)
+	assert.NoError(t, valid.checkValidity(), "the skew may be turned off")
+	assert.NoError(t, valid.validate(time.Now(), nil))
+	tests := []struct {
+		name    string
+		change  func(sp *ServiceProvider)
+		setting string
+	}{
+		{"no assertion lifetime", func(sp *ServiceProvider) { sp.AssertionLifetime = duration(0) }, "assertionlifetime"},
+		{"negative assertion lifetime", func(sp *ServiceProvider) { sp.AssertionLifetime = duration(-time.Minute) }, "assertionlifetime"},
+		{"no subject confirmation lifetime", func(sp *ServiceProvider) { sp.SubjectConfirmationLifetime = duration(0) }, "subjectconfirmationlifetime"},
+		{"negative subject confirmation lifetime", func(sp *ServiceProvider) { sp.SubjectConfirmationLifetime = duration(-time.Minute) }, "subjectconfirmationlifetime"},
+		{"negative skew", func(sp *ServiceProvider) { sp.NotBeforeSkew = duration(-time.Minute) }, "notbeforeskew"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := valid
+			tt.change(&sp)
+			err := sp.checkValidity()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.setting+" of https://sp.example.com")
+			}
+			assert.Error(t, sp.validate(time.Now(), nil), "the service provider should not be registered")
+		})
+	}
+}
+
+func TestServiceProvider_checkCertificate(t *testing.T) {
+	now := time.Now()
+	expired, _ := newTestCertificate(t, now.Add(-2*time.Hour), now.Add(-time.Hour), nil, nil)
+	sp := &ServiceProvider{EntityID: "https://sp.example.com", Certificate: base64.StdEncoding.EncodeToString(expired.Raw)}
+	if err := sp.parseCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	err := sp.checkCertificate(now)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "certificate of https://sp.example.com expired")
+	}
+	assert.NoError(t, sp.checkCertificate(now.Add(-90*time.Minute)))
+	assert.Error(t, sp.checkCertificate(now.Add(-3*time.Hour)), "certificate should not be valid yet")
+	assert.Error(t, sp.verifySigningKey(nil, now), "signatures should be rejected once the certificate expires")
+
+	viper.Set("reject-expired-sp-certificates", false)
+	defer viper.Set("reject-expired-sp-certificates", true)
+	assert.NoError(t, sp.checkCertificate(now))
+
+	assert.NoError(t, (&ServiceProvider{}).checkCertificate(now), "public keys don't expire")
+}
+
+func TestIDP_configureSPs_expiredCertificate(t *testing.T) {
+	now := time.Now()
+	expired, _ := newTestCertificate(t, now.Add(-2*time.Hour), now.Add(-time.Hour), nil, nil)
+	viper.Set("sps", []ServiceProvider{{EntityID: "https://sp.example.com",
+		Certificate: base64.StdEncoding.EncodeToString(expired.Raw)}})
+	defer viper.Set("sps", nil)
+	i := &IDP{Clock: &fixedClock{now}}
+	if !assert.NoError(t, i.configureSPs(), "an expired certificate shouldn't keep the IDP from starting") {
+		return
+	}
+	sp, ok := i.getSP("https://sp.example.com")
+	if assert.True(t, ok, "service provider should be registered") {
+		assert.Error(t, sp.verifySigningKey(nil, now), "its messages should be rejected")
+	}
+	assert.NoError(t, i.reloadSPs(), "an expired certificate shouldn't fail reloads")
+}
+
+func TestInitSPs_metadataTimeout(t *testing.T) {
+	// A metadata server that never answers
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hung.Close()
+	defer close(release)
+	viper.Set("sp-medata-urls", []SPMetadataUrl{{Url: hung.URL}})
+	defer viper.Set("sp-medata-urls", nil)
+	viper.Set("sp-metadata-timeout", "50ms")
+	defer viper.Set("sp-metadata-timeout", "30s")
+
+	_, err := FetchSPMetadata(context.Background(), hung.URL)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+	start := time.Now()
+	sps, failed, err := initSPs()
+	assert.NoError(t, err, "startup should continue without the metadata")
+	assert.Empty(t, sps)
+	assert.Equal(t, []string{hung.URL}, failed)
+	assert.Less(t, time.Since(start), 5*time.Second, "should give up when the timeout passes")
+}
+
+func TestIDP_configureSPs_severalURLs(t *testing.T) {
+	metadata, err := ioutil.ReadFile(filepath.Join("testdata", "sp-metadata.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each path serves metadata for a different entity
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.Write([]byte(strings.Replace(string(metadata), `entityID="dex"`, `entityID="`+r.URL.Path[1:]+`"`, 1)))
+	}))
+	defer ts.Close()
+	urls := []SPMetadataUrl{}
+	for _, entityID := range []string{"sp1", "sp2", "sp3", "sp4"} {
+		urls = append(urls, SPMetadataUrl{Url: ts.URL + "/" + entityID})
+	}
+	viper.Set("sp-medata-urls", urls)
+	defer viper.Set("sp-medata-urls", nil)
+	// sp2 is already configured with local settings
+	viper.Set("sps", []ServiceProvider{{EntityID: "sp2", Disabled: true}})
+	defer viper.Set("sps", nil)
+	config := setConfigFile(t)
+
+	i := &IDP{Clock: &fixedClock{time.Now()}}
+	if err = i.configureSPs(); err != nil {
+		t.Fatal(err)
+	}
+	for _, entityID := range []string{"sp1", "sp2", "sp3", "sp4"} {
+		sp, ok := i.getSP(entityID)
+		if assert.True(t, ok, "%s should be registered", entityID) {
+			assert.Equal(t, entityID == "sp2", sp.Disabled, "local settings should be kept")
+		}
+	}
+	saved := viper.New()
+	saved.SetConfigFile(config)
+	if err = saved.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	var sps []*ServiceProvider
+	if err = saved.UnmarshalKey("sps", &sps); err != nil {
+		t.Fatal(err)
+	}
+	entityIDs := []string{}
+	for _, sp := range sps {
+		entityIDs = append(entityIDs, sp.EntityID)
+		assert.Len(t, sp.AssertionConsumerServices, 1, "%s should be read from its metadata", sp.EntityID)
+		assert.Equal(t, sp.EntityID == "sp2", sp.Disabled, "local settings should be kept")
+	}
+	assert.ElementsMatch(t, []string{"sp1", "sp2", "sp3", "sp4"}, entityIDs, "no update should be lost")
+}
+
+func TestIDP_RegisterSPMetadata(t *testing.T) {
+	i := &IDP{Clock: &fixedClock{time.Now()}}
+	viper.Set("sps", []ServiceProvider{})
+	defer viper.Set("sps", nil)
+	if err := i.configureSPs(); err != nil {
+		t.Fatal(err)
+	}
+	register := func(persist bool) error {
+		in, err := os.Open(filepath.Join("testdata", "sp-metadata.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		return i.RegisterSPMetadata(in, persist)
+	}
+	config := setConfigFile(t)
+
+	if err := register(false); err != nil {
+		t.Fatal(err)
+	}
+	sp, ok := i.getSP("dex")
+	if !assert.True(t, ok, "should be registered while running") {
+		return
+	}
+	_, err := os.Stat(config)
+	assert.True(t, os.IsNotExist(err), "configuration should only be written when persisting")
+
+	// Refreshed metadata keeps the local settings
+	sp.Disabled = true
+	if err = register(true); err != nil {
+		t.Fatal(err)
+	}
+	refreshed, _ := i.getSP("dex")
+	assert.NotSame(t, sp, refreshed)
+	assert.True(t, refreshed.Disabled)
+	saved := viper.New()
+	saved.SetConfigFile(config)
+	if assert.NoError(t, saved.ReadInConfig()) {
+		var sps []*ServiceProvider
+		if assert.NoError(t, saved.UnmarshalKey("sps", &sps)) && assert.Len(t, sps, 1) {
+			assert.Equal(t, "dex", sps[0].EntityID)
+		}
+	}
+}
+
+func TestFetchSPMetadata_invalidResponse(t *testing.T) {
+	metadata, err := ioutil.ReadFile(filepath.Join("testdata", "sp-metadata.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		wantErr     string
+	}{
+		{"not found", http.StatusNotFound, "text/html", "unexpected status code, 404, when requesting metadata"},
+		{"html", http.StatusOK, "text/html; charset=utf-8", `unexpected content type, "text/html; charset=utf-8", when requesting metadata`},
+		{"no content type", http.StatusOK, "", `unexpected content type, "", when requesting metadata`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = []string{tt.contentType}
+				w.WriteHeader(tt.status)
+				w.Write(metadata)
+			}))
+			defer ts.Close()
+			_, err := FetchSPMetadata(context.Background(), ts.URL)
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+	for _, contentType := range []string{"application/samlmetadata+xml", "application/xml", "text/xml; charset=utf-8"} {
+		assert.True(t, isXMLContentType(contentType), contentType)
+	}
+}
+
+func TestServiceProvider_verifyChain(t *testing.T) {
+	now := time.Now()
+	ca, caKey := newTestCertificate(t, now.Add(-time.Hour), now.Add(time.Hour), nil, nil)
+	issued, _ := newTestCertificate(t, now.Add(-time.Hour), now.Add(time.Hour), ca, caKey)
+	selfSigned, _ := newTestCertificate(t, now.Add(-time.Hour), now.Add(time.Hour), nil, nil)
+	anchors := filepath.Join(t.TempDir(), "anchors.pem")
+	if err := ioutil.WriteFile(anchors, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("sp-trust-anchors", anchors)
+	defer viper.Set("sp-trust-anchors", "")
+	pool, err := spTrustAnchors(viper.GetViper())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, (&ServiceProvider{certificate: issued}).verifyChain(pool))
+	assert.Error(t, (&ServiceProvider{certificate: selfSigned}).verifyChain(pool))
+	assert.Error(t, (&ServiceProvider{}).verifyChain(pool), "public keys can't be verified against the anchors")
+	assert.NoError(t, (&ServiceProvider{certificate: selfSigned}).verifyChain(nil), "without anchors nothing is verified")
+}
+
+func TestServiceProvider_parseCertificate_formats(t *testing.T) {
+	now := time.Now()
+	cert, _ := newTestCertificate(t, now.Add(-time.Hour), now.Add(time.Hour), nil, nil)
+	encoded := base64.StdEncoding.EncodeToString(cert.Raw)
+	armored := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	tests := []struct {
+		name        string
+		certificate string
+		wantErr     bool
+	}{
+		{"base64 DER", encoded, false},
+		{"PEM", armored, false},
+		{"PEM on one line", strings.Join(strings.Fields(armored), " "), false},
+		{"indented PEM", "\n    " + strings.ReplaceAll(armored, "\n", "\n    "), false},
+		{"base64 DER with whitespace", " " + encoded[:40] + "\n\t" + encoded[40:] + "\r\n", false},
+		{"PEM without END line", strings.Split(armored, "-----END")[0], true},
+		{"invalid", "not a certificate", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := &ServiceProvider{EntityID: "https://sp.example.com", Certificate: tt.certificate}
+			err := sp.parseCertificate()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, cert.Raw, sp.certificate.Raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SPSummary describes a registered service provider for the service provider list
+type SPSummary struct {
+	EntityID                  string       `json:"entityId"`
+	AssertionConsumerServices []SPEndpoint `json:"assertionConsumerServices"`
+	SingleLogoutServices      []SPEndpoint `json:"singleLogoutServices"`
+	// SHA-256 fingerprint of the certificate, empty for service providers configured with a public key
+	CertificateFingerprint string     `json:"certificateFingerprint,omitempty"`
+	CertificateNotAfter    *time.Time `json:"certificateNotAfter,omitempty"`
+	// Whether the certificate expires within certificate-expiry-warning or already has
+	CertificateExpiresSoon bool `json:"certificateExpiresSoon"`
+	Disabled               bool `json:"disabled"`
+}
+
+// SPEndpoint is an assertion consumer or single logout service of a service provider
+type SPEndpoint struct {
+	Index     uint32 `json:"index"`
+	IsDefault bool   `json:"isDefault"`
+	Binding   string `json:"binding"`
+	Location  string `json:"location"`
+}
+
+// DefaultSPListHandler lists the registered service providers as JSON, so operators can confirm that imported or
+// refreshed metadata took effect. It's only routed when sp-list-endpoint is set and requires HTTP Basic credentials
+// for one of the admin-users. Nothing is hidden since service providers' certificates are public.
+func (i *IDP) DefaultSPListHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !i.authorizeUsers(r, "admin-users") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			i.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(i.spSummaries())
+	}
+}
+
+// spSummaries describes the registered service providers in order of their entity IDs
+func (i *IDP) spSummaries() []SPSummary {
+	now := i.Clock.Now()
+	i.spsLock.RLock()
+	summaries := make([]SPSummary, 0, len(i.sps))
+	for _, sp := range i.sps {
+		summary := SPSummary{
+			EntityID:                  sp.EntityID,
+			AssertionConsumerServices: make([]SPEndpoint, len(sp.AssertionConsumerServices)),
+			SingleLogoutServices:      make([]SPEndpoint, len(sp.SingleLogoutServices)),
+			Disabled:                  sp.Disabled,
+		}
+		for j, acs := range sp.AssertionConsumerServices {
+			summary.AssertionConsumerServices[j] = SPEndpoint(acs)
+		}
+		for j, slo := range sp.SingleLogoutServices {
+			summary.SingleLogoutServices[j] = SPEndpoint(slo)
+		}
+		if sp.certificate != nil {
+			summary.CertificateFingerprint = fingerprint(sp.certificate.Raw)
+			notAfter := sp.certificate.NotAfter.UTC()
+			summary.CertificateNotAfter = &notAfter
+			summary.CertificateExpiresSoon = expiresSoon(sp.certificate, now)
+		}
+		summaries = append(summaries, summary)
+	}
+	i.spsLock.RUnlock()
+	sort.Slice(summaries, func(a, b int) bool {
+		return summaries[a].EntityID < summaries[b].EntityID
+	})
+	return summaries
+}
+
+// fingerprint returns the SHA-256 hash of the DER certificate as colon separated hex, as shown by openssl
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for j, b := range sum {
+		hex[j] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
@@ -0,0 +1,76 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_DefaultSPListHandler(t *testing.T) {
+	setConfig(t, "sp-list-endpoint", true)
+	setConfig(t, "admin-users", []string{"admin"})
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{PasswordValidator: &stubValidator{}}
+	ts := startTestIDP(t, i, sp)
+
+	list := func(user string) ([]SPSummary, int) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+viper.GetString("sp-list-path"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.SetBasicAuth(user, "password")
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, resp.StatusCode
+		}
+		var summaries []SPSummary
+		if err := json.NewDecoder(resp.Body).Decode(&summaries); err != nil {
+			t.Fatal(err)
+		}
+		return summaries, resp.StatusCode
+	}
+
+	_, status := list("")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	_, status = list("joe")
+	assert.Equal(t, http.StatusUnauthorized, status, "only admin-users may list service providers")
+	summaries, status := list("admin")
+	assert.Equal(t, http.StatusOK, status)
+	if assert.Len(t, summaries, 1) {
+		summary := summaries[0]
+		assert.Equal(t, sp.entityID, summary.EntityID)
+		assert.Equal(t, []SPEndpoint{{IsDefault: true, Binding: sp.binding, Location: sp.acs.URL + "/acs"}},
+			summary.AssertionConsumerServices)
+		assert.Len(t, summary.SingleLogoutServices, 1)
+		assert.Equal(t, fingerprint(sp.cert.Certificate[0]), summary.CertificateFingerprint)
+		assert.NotNil(t, summary.CertificateNotAfter)
+	}
+}
+
+func Test_fingerprint(t *testing.T) {
+	assert.Equal(t, "E3:B0:C4:42:98:FC:1C:14:9A:FB:F4:C8:99:6F:B9:24:27:AE:41:E4:64:9B:93:4C:A4:95:99:1B:78:52:B8:55",
+		fingerprint(nil))
+}
@@ -0,0 +1,263 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/chriskery/sso-idp/store"
+	"github.com/go-redis/redis"
+	"github.com/spf13/viper"
+)
+
+const (
+	// ConfigSPStore saves service providers to the sps setting of the configuration file
+	ConfigSPStore = "config"
+	// RedisSPStore saves service providers in Redis so every instance of a cluster shares them
+	RedisSPStore = "redis"
+)
+
+// SPStore keeps the service providers registered with the IDP
+type SPStore interface {
+	// List returns every saved service provider
+	List() ([]*ServiceProvider, error)
+	// Get returns the service provider with the entity ID or store.ErrNotFound
+	Get(entityID string) (*ServiceProvider, error)
+	// Save adds the service providers, replacing those with the same entity ID while keeping their locally
+	// configured settings
+	Save(serviceProviders ...*ServiceProvider) error
+	// Delete removes the service provider with the entity ID
+	Delete(entityID string) error
+}
+
+// NewSPStore returns the SPStore selected by the sp-store setting
+func NewSPStore() (SPStore, error) {
+	return newSPStore(settings.Current())
+}
+
+func newSPStore(config *viper.Viper) (SPStore, error) {
+	switch name := config.GetString("sp-store"); name {
+	case ConfigSPStore:
+		return NewConfigSPStore(), nil
+	case RedisSPStore:
+		return NewRedisSPStore(redis.NewClient(&redis.Options{
+			Addr:     config.GetString("redis.address"),
+			Password: config.GetString("redis.password"),
+		})), nil
+	default:
+		return nil, fmt.Errorf("unknown sp-store %s, must be %s or %s", name, ConfigSPStore, RedisSPStore)
+	}
+}
+
+// NewConfigSPStore returns an SPStore that saves service providers to the sps setting and writes the
+// configuration file
+func NewConfigSPStore() SPStore {
+	return &configSPStore{}
+}
+
+type configSPStore struct {
+	// the configuration holding the sps setting, or nil for the current one
+	config *viper.Viper
+}
+
+func (s *configSPStore) settings() *viper.Viper {
+	if s.config != nil {
+		return s.config
+	}
+	return settings.Current()
+}
+
+// savedSPs are the service providers last written to the configuration file. The sps setting isn't changed to match,
+// since requests read the published configuration without locking. They're used instead of the sps setting until it or the configuration file is
+// replaced, such as when the configuration is reloaded. The lock also keeps concurrent saves from losing each other's
+// updates.
+var savedSPs struct {
+	sync.Mutex
+	saved bool
+	// the configuration file and sps setting they were saved over
+	file    string
+	setting interface{}
+	sps     []*ServiceProvider
+}
+
+func (s *configSPStore) List() ([]*ServiceProvider, error) {
+	savedSPs.Lock()
+	defer savedSPs.Unlock()
+	sps, _, err := listConfigSPs(s.settings())
+	return sps, err
+}
+
+// listConfigSPs returns the service providers last saved, or those in the sps setting of the configuration when it
+// has been replaced since, along with the sps setting. It's called holding the savedSPs lock.
+func listConfigSPs(config *viper.Viper) ([]*ServiceProvider, interface{}, error) {
+	setting := config.Get("sps")
+	if savedSPs.saved && savedSPs.file == config.ConfigFileUsed() && reflect.DeepEqual(savedSPs.setting, setting) {
+		config = viper.New()
+		config.Set("sps", savedSPs.sps)
+	}
+	var sps []*ServiceProvider
+	if err := config.UnmarshalKey("sps", &sps); err != nil {
+		return nil, nil, err
+	}
+	return sps, setting, nil
+}
+
+func (s *configSPStore) Get(entityID string) (*ServiceProvider, error) {
+	sps, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, sp := range sps {
+		if sp.EntityID == entityID {
+			return sp, nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (s *configSPStore) Save(serviceProviders ...*ServiceProvider) error {
+	savedSPs.Lock()
+	defer savedSPs.Unlock()
+	config := s.settings()
+	sps, setting, err := listConfigSPs(config)
+	if err != nil {
+		return err
+	}
+	return writeSPs(config.ConfigFileUsed(), setting, mergeServiceProviders(sps, serviceProviders))
+}
+
+func (s *configSPStore) Delete(entityID string) error {
+	savedSPs.Lock()
+	defer savedSPs.Unlock()
+	config := s.settings()
+	sps, setting, err := listConfigSPs(config)
+	if err != nil {
+		return err
+	}
+	kept := make([]*ServiceProvider, 0, len(sps))
+	for _, sp := range sps {
+		if sp.EntityID != entityID {
+			kept = append(kept, sp)
+		}
+	}
+	if len(kept) == len(sps) {
+		return nil
+	}
+	return writeSPs(config.ConfigFileUsed(), setting, kept)
+}
+
+// writeSPs replaces the sps setting of the configuration file, leaving the rest of the file as it was, and remembers
+// them as the savedSPs. Writing the whole configuration would copy the defaults and CONFIG_DATA, which can hold
+// credentials such as ldap.binddn_credential, into the file. It's called holding the savedSPs lock.
+func writeSPs(configFile string, setting interface{}, sps []*ServiceProvider) error {
+	if configFile == "" {
+		return errors.New("there's no configuration file to save service providers to")
+	}
+	file := viper.New()
+	file.SetConfigFile(configFile)
+	if err := file.ReadInConfig(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	file.Set("sps", sps)
+	if err := file.WriteConfig(); err != nil {
+		return err
+	}
+	savedSPs.saved = true
+	savedSPs.file = configFile
+	savedSPs.setting = setting
+	savedSPs.sps = sps
+	return nil
+}
+
+// redisSPStoreKey is the hash holding the service providers, keyed by entity ID
+const redisSPStoreKey = "sps"
+
+// NewRedisSPStore returns an SPStore that saves service providers in Redis
+func NewRedisSPStore(client *redis.Client) SPStore {
+	return &redisSPStore{client: client}
+}
+
+type redisSPStore struct {
+	client *redis.Client
+}
+
+func (s *redisSPStore) List() ([]*ServiceProvider, error) {
+	values, err := s.client.HGetAll(redisSPStoreKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	sps := make([]*ServiceProvider, 0, len(values))
+	for entityID, value := range values {
+		sp := &ServiceProvider{}
+		if err = json.Unmarshal([]byte(value), sp); err != nil {
+			return nil, fmt.Errorf("unable to read service provider %s: %s", entityID, err)
+		}
+		sps = append(sps, sp)
+	}
+	// Hashes aren't ordered
+	sort.Slice(sps, func(i, j int) bool {
+		return sps[i].EntityID < sps[j].EntityID
+	})
+	return sps, nil
+}
+
+func (s *redisSPStore) Get(entityID string) (*ServiceProvider, error) {
+	value, err := s.client.HGet(redisSPStoreKey, entityID).Result()
+	if err == redis.Nil {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	sp := &ServiceProvider{}
+	if err = json.Unmarshal([]byte(value), sp); err != nil {
+		return nil, fmt.Errorf("unable to read service provider %s: %s", entityID, err)
+	}
+	return sp, nil
+}
+
+func (s *redisSPStore) Save(serviceProviders ...*ServiceProvider) error {
+	if len(serviceProviders) == 0 {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(serviceProviders))
+	for _, sp := range serviceProviders {
+		existing, err := s.Get(sp.EntityID)
+		switch {
+		case err == nil:
+			sp.copySettings(existing)
+		case err != store.ErrNotFound:
+			return err
+		}
+		value, err := json.Marshal(sp)
+		if err != nil {
+			return err
+		}
+		fields[sp.EntityID] = value
+	}
+	// Every service provider is written at once
+	return s.client.HMSet(redisSPStoreKey, fields).Err()
+}
+
+func (s *redisSPStore) Delete(entityID string) error {
+	return s.client.HDel(redisSPStoreKey, entityID).Err()
+}
@@ -0,0 +1,135 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/chriskery/sso-idp/store"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSPStore(t *testing.T, spStore SPStore) {
+	if err := spStore.Save(&ServiceProvider{EntityID: "sp1", Disabled: true}, &ServiceProvider{EntityID: "sp2"}); err != nil {
+		t.Fatal(err)
+	}
+	// Refreshed metadata keeps the local settings
+	if err := spStore.Save(&ServiceProvider{EntityID: "sp1", Certificate: "refreshed"}); err != nil {
+		t.Fatal(err)
+	}
+	sp, err := spStore.Get("sp1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "refreshed", sp.Certificate)
+		assert.True(t, sp.Disabled, "local settings should be kept")
+	}
+	_, err = spStore.Get("sp3")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	if err = spStore.Delete("sp2"); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, spStore.Delete("sp3"), "deleting a missing service provider isn't an error")
+	sps, err := spStore.List()
+	if assert.NoError(t, err) && assert.Len(t, sps, 1) {
+		assert.Equal(t, "sp1", sps[0].EntityID)
+	}
+}
+
+func TestConfigSPStore(t *testing.T) {
+	viper.Set("sps", []ServiceProvider{})
+	defer viper.Set("sps", nil)
+	config := setConfigFile(t)
+	if err := os.WriteFile(config, []byte("listen-address: 127.0.0.1:8443\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Settings from CONFIG_DATA and the defaults aren't written to the file
+	setConfig(t, "ldap", map[string]interface{}{"binddn_credential": "secret"})
+	testSPStore(t, NewConfigSPStore())
+
+	saved := viper.New()
+	saved.SetConfigFile(config)
+	if assert.NoError(t, saved.ReadInConfig()) {
+		assert.Equal(t, "127.0.0.1:8443", saved.GetString("listen-address"), "the rest of the file should be kept")
+		assert.False(t, saved.IsSet("ldap"))
+		assert.False(t, saved.IsSet("cookie-name"))
+		var sps []*ServiceProvider
+		if assert.NoError(t, saved.UnmarshalKey("sps", &sps)) && assert.Len(t, sps, 1) {
+			assert.Equal(t, "sp1", sps[0].EntityID)
+		}
+	}
+}
+
+func TestConfigSPStore_saved(t *testing.T) {
+	setConfig(t, "sps", []ServiceProvider{})
+	setConfigFile(t)
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST").serviceProvider()
+	i := &IDP{ServiceProviders: NewConfigSPStore(), Clock: SystemClock()}
+	assert.NoError(t, i.RegisterServiceProvider(&sp, true))
+	sps, err := NewConfigSPStore().List()
+	if assert.NoError(t, err) && assert.Len(t, sps, 1, "the saved service provider should be listed") {
+		assert.Equal(t, sp.EntityID, sps[0].EntityID)
+	}
+	// Such as when the configuration file is read again
+	setConfig(t, "sps", []ServiceProvider{{EntityID: "https://other.example.org"}})
+	sps, err = NewConfigSPStore().List()
+	if assert.NoError(t, err) && assert.Len(t, sps, 1) {
+		assert.Equal(t, "https://other.example.org", sps[0].EntityID,
+			"replacing the sps setting should replace the saved service providers")
+	}
+}
+
+func TestRedisSPStore(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	viper.Set("sp-store", RedisSPStore)
+	defer viper.Set("sp-store", ConfigSPStore)
+	spStore, err := NewSPStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSPStore(t, spStore)
+
+	// Another instance sharing the store registers the same service providers
+	if err = spStore.Delete("sp1"); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(filepath.Join("testdata", "sp-metadata.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if err = SaveSpFromMetadata(in); err != nil {
+		t.Fatal(err)
+	}
+	i := &IDP{Clock: &fixedClock{time.Now()}}
+	if err = i.configureSPs(); err != nil {
+		t.Fatal(err)
+	}
+	_, ok := i.getSP("dex")
+	assert.True(t, ok)
+
+	viper.Set("sp-store", "file")
+	_, err = NewSPStore()
+	assert.EqualError(t, err, "unknown sp-store file, must be config or redis")
+}
@@ -16,7 +16,7 @@ package idp
 
 import (
 	"bytes"
-	"compress/flate"
+	"context"
 	"crypto"
 	"crypto/dsa"
 	"crypto/rsa"
@@ -31,55 +31,97 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/chriskery/sso-idp/model"
 	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/chriskery/sso-idp/store"
 	"github.com/golang/protobuf/proto"
-	"github.com/google/uuid"
+	"github.com/golang/protobuf/ptypes"
 	log "github.com/sirupsen/logrus"
 )
 
-func (i *IDP) validateAuthRequest(request *saml.AuthnRequest, r *http.Request) error {
+// ErrUnregisteredServiceProvider is returned for requests from unknown issuers
+var ErrUnregisteredServiceProvider = errors.New("request from an unregistered issuer")
+
+// ErrDisabledServiceProvider is returned for requests from service providers that are disabled
+var ErrDisabledServiceProvider = errors.New("service provider is disabled")
+
+// serviceProvider returns the service provider that issued an authentication, logout, artifact resolution or
+// attribute request. Requests from unregistered or disabled service providers are rejected and reported to the
+// Auditor.
+func (i *IDP) serviceProvider(issuer string) (*ServiceProvider, error) {
+	sp, ok := i.getSP(issuer)
+	var err error
+	switch {
+	case !ok:
+		err = ErrUnregisteredServiceProvider
+	case sp.Disabled:
+		err = ErrDisabledServiceProvider
+	default:
+		return sp, nil
+	}
+	log.Warnf("rejected request from %s: %s", issuer, err)
+	if auditor, ok := i.Auditor.(ServiceProviderAuditor); ok {
+		auditor.LogRejectedServiceProvider(issuer, err)
+	}
+	return nil, err
+}
+
+// validateAuthRequest checks the request is from a registered service provider and authenticated the way the
+// service provider requires. verify checks the signature of the binding and is nil for unsigned requests.
+func (i *IDP) validateAuthRequest(request *saml.AuthnRequest, r *http.Request, verify func(*ServiceProvider) error) error {
 	// Only accept requests from registered service providers
 	if request.Issuer == "" {
 		return errors.New("request does not contain an issuer")
 	}
 	log.Infof("received authentication request from %s", request.Issuer)
-	sp, ok := i.sps[request.Issuer]
-	if !ok {
-		return errors.New("request from an unregistered issuer")
-	}
-	// Determine the right assertion consumer service
-	var acs *AssertionConsumerService
-	for i, a := range sp.AssertionConsumerServices {
-		// Find either the matching service or the default
-		if a.Index == request.AssertionConsumerServiceIndex {
-			acs = &sp.AssertionConsumerServices[i]
-			break
-		}
-		if a.Location == request.AssertionConsumerServiceURL {
-			acs = &sp.AssertionConsumerServices[i]
-			break
-		}
-		if a.IsDefault {
-			acs = &sp.AssertionConsumerServices[i]
-		}
+	sp, err := i.serviceProvider(request.Issuer)
+	if err != nil {
+		return err
 	}
-	if acs == nil {
-		return errors.New("unable to determine assertion consumer service")
+	acs, err := sp.assertionConsumerService(request)
+	if err != nil {
+		return err
 	}
 	// Don't allow a different URL than specified in the metadata
 	if request.AssertionConsumerServiceURL == "" {
 		request.AssertionConsumerServiceURL = acs.Location
-	} else if request.AssertionConsumerServiceURL != acs.Location {
-		return errors.New("assertion consumer location in request does not match metadata")
 	}
 	// At this point, we're OK with the request
+	switch sp.AuthMode {
+	case "", MessageSignatureAuth:
+	case TransportAuth:
+		// The SP authenticates with its certificate rather than signing the request
+		return sp.verifyClientCert(r, i.Clock.Now())
+	default:
+		return fmt.Errorf("unsupported auth mode %s", sp.AuthMode)
+	}
 	// Need to validate the signature
-	// Have to use the raw query as pointed out in the spec.
-	// https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf
-	// Line 621
-	return verifySignature(r.URL.RawQuery, r.Form.Get("SigAlg"), r.Form.Get("Signature"), sp)
+	if verify == nil {
+		if sp.requireSignedAuthnRequests() {
+			return errors.New("AuthnRequest must be signed")
+		}
+		return nil
+	}
+	_, span := startSpan(r.Context(), "verify signature", sp.EntityID)
+	err = verify(sp)
+	endSpan(span, err)
+	return err
+}
+
+// redirectSignature returns the verification of a signed HTTP-Redirect binding request, or nil when it's unsigned
+func (i *IDP) redirectSignature(r *http.Request) func(*ServiceProvider) error {
+	if r.Form.Get("Signature") == "" {
+		return nil
+	}
+	return func(sp *ServiceProvider) error {
+		// Have to use the raw query as pointed out in the spec.
+		// https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf
+		// Line 621
+		return verifySignature(r.URL.RawQuery, r.Form.Get("SigAlg"), r.Form.Get("Signature"), sp, i.Clock.Now())
+	}
 }
 
 func (i *IDP) validateLogoutRequest(request *saml.LogoutRequest, r *http.Request) error {
@@ -87,10 +129,13 @@ func (i *IDP) validateLogoutRequest(request *saml.LogoutRequest, r *http.Request
 	if request.Issuer == "" {
 		return errors.New("request does not contain an issuer")
 	}
-	log.Infof("received authentication request from %s", request.Issuer)
-	sp, ok := i.sps[request.Issuer]
-	if !ok {
-		return errors.New("request from an unregistered issuer")
+	log.Infof("received logout request from %s", request.Issuer)
+	sp, err := i.serviceProvider(request.Issuer)
+	if err != nil {
+		return err
+	}
+	if err = i.checkLogoutRequest(sp, request, r); err != nil {
+		return err
 	}
 	// Determine the right assertion consumer service
 	if len(sp.SingleLogoutServices) == 0 {
@@ -107,7 +152,67 @@ func (i *IDP) validateLogoutRequest(request *saml.LogoutRequest, r *http.Request
 	return nil
 }
 
-func verifySignature(rawQuery, alg, expectedSig string, sp *ServiceProvider) error {
+// checkLogoutRequest rejects LogoutRequests that weren't issued within logout-request-lifetime, have expired, were
+// sent to another endpoint, or were already received. When the request comes with a session, its NameID must be
+// the one sent to the service provider for the session's user, so a service provider can't end other users'
+// sessions.
+func (i *IDP) checkLogoutRequest(sp *ServiceProvider, request *saml.LogoutRequest, r *http.Request) error {
+	now := i.Clock.Now()
+	lifetime := settings.GetDuration("logout-request-lifetime")
+	if issued := request.IssueInstant; issued.IsZero() || now.Sub(issued) > lifetime || issued.Sub(now) > lifetime {
+		return errors.New("LogoutRequest was not issued within logout-request-lifetime")
+	}
+	if request.NotOnOrAfter != nil && !now.Before(*request.NotOnOrAfter) {
+		return errors.New("LogoutRequest has expired")
+	}
+	if request.Destination != "" && request.Destination != i.singleLogoutServiceLocation {
+		return fmt.Errorf("LogoutRequest was sent to %s", request.Destination)
+	}
+	if session := i.currentSession(r); session != nil {
+		nameID, err := i.sessionNameID(sp, session.User)
+		if err != nil {
+			return err
+		}
+		if request.NameID == nil || request.NameID.Value != nameID {
+			return errors.New("LogoutRequest is not for the user logged in to the session")
+		}
+	}
+	return i.rejectReplay("logout", sp.EntityID, request.ID)
+}
+
+// sessionNameID returns the NameID the service provider was sent for the user. Transient NameIDs sent in place of
+// unavailable persistent ones aren't kept, so they can't be matched.
+func (i *IDP) sessionNameID(sp *ServiceProvider, user *model.User) (string, error) {
+	if !sp.persistentNameID() {
+		nameID, _ := i.nameID(sp, user)
+		return nameID, nil
+	}
+	if i.NameIDs == nil {
+		return "", errors.New("no NameIDStore is configured")
+	}
+	return i.NameIDs.NameID(sp.EntityID, user.Name)
+}
+
+// rejectReplay returns an error when a message with the ID was already received from the issuer within
+// temp-cache-duration, and otherwise remembers it
+func (i *IDP) rejectReplay(message, issuer, id string) error {
+	if id == "" {
+		return fmt.Errorf("%s request does not contain an ID", message)
+	}
+	key := "replay:" + message + ":" + url.QueryEscape(issuer) + ":" + url.QueryEscape(id)
+	i.replayLock.Lock()
+	defer i.replayLock.Unlock()
+	_, err := i.TempCache.Get(key)
+	if err == nil {
+		return fmt.Errorf("%s request %s was already received", message, id)
+	}
+	if err != store.ErrNotFound {
+		return err
+	}
+	return i.TempCache.Set(key, []byte(id))
+}
+
+func verifySignature(rawQuery, alg, expectedSig string, sp *ServiceProvider, now time.Time) error {
 	// Split up the parts
 	params := strings.Split(rawQuery, "&")
 	pMap := make(map[string]string, len(params))
@@ -119,12 +224,35 @@ func verifySignature(rawQuery, alg, expectedSig string, sp *ServiceProvider) err
 		pMap[parts[0]] = parts[1]
 	}
 	// Order them
-	sigparts := []string{fmt.Sprintf("SAMLRequest=%s", pMap["SAMLRequest"])}
+	message := "SAMLRequest"
+	if _, ok := pMap[message]; !ok {
+		message = "SAMLResponse"
+	}
+	sigparts := []string{fmt.Sprintf("%s=%s", message, pMap[message])}
 	if state, ok := pMap["RelayState"]; ok {
 		sigparts = append(sigparts, fmt.Sprintf("RelayState=%s", state))
 	}
 	sigparts = append(sigparts, fmt.Sprintf("SigAlg=%s", pMap["SigAlg"]))
-	sig := []byte(strings.Join(sigparts, "&"))
+	return verifySignedContent([]byte(strings.Join(sigparts, "&")), alg, expectedSig, sp, now)
+}
+
+// verifySimpleSign checks the signature of a message sent using the HTTP-POST-SimpleSign binding. Unlike the
+// redirect binding, the form values are signed as they were sent rather than URL encoded.
+// https://docs.oasis-open.org/security/saml/Post2.0/saml-binding-simplesign-cs-02.pdf Section 3.5.4
+func verifySimpleSign(form url.Values, parameter string, sp *ServiceProvider, now time.Time) error {
+	content := parameter + "=" + form.Get(parameter)
+	if _, ok := form["RelayState"]; ok {
+		content += "&RelayState=" + form.Get("RelayState")
+	}
+	content += "&SigAlg=" + form.Get("SigAlg")
+	return verifySignedContent([]byte(content), form.Get("SigAlg"), form.Get("Signature"), sp, now)
+}
+
+// verifySignedContent checks the base64 encoded signature the service provider made over the content
+func verifySignedContent(sig []byte, alg, expectedSig string, sp *ServiceProvider, now time.Time) error {
+	if err := sp.checkCertificate(now); err != nil {
+		return err
+	}
 	// Validate the signature
 	signature, err := base64.StdEncoding.DecodeString(expectedSig)
 	if err != nil {
@@ -139,16 +267,28 @@ func verifySignature(rawQuery, alg, expectedSig string, sp *ServiceProvider) err
 		return verifyDSA(sp, signature, sum)
 	case "http://www.w3.org/2000/09/xmldsig#rsa-sha1":
 		sum := sha1Sum(sig)
-		return rsa.VerifyPKCS1v15(sp.publicKey.(*rsa.PublicKey), crypto.SHA1, sum, signature)
+		return verifyRSA(sp, crypto.SHA1, signature, sum)
 	case "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":
 		sum := sha256Sum(sig)
-		return rsa.VerifyPKCS1v15(sp.publicKey.(*rsa.PublicKey), crypto.SHA256, sum, signature)
+		return verifyRSA(sp, crypto.SHA256, signature, sum)
 	default:
 		return fmt.Errorf("unsupported signature algorithm, %s", alg)
 	}
 }
 
+func verifyRSA(sp *ServiceProvider, hash crypto.Hash, signature, sum []byte) error {
+	key, ok := sp.publicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("signature algorithm does not match the service provider's key")
+	}
+	return rsa.VerifyPKCS1v15(key, hash, sum, signature)
+}
+
 func verifyDSA(sp *ServiceProvider, signature, sum []byte) error {
+	key, ok := sp.publicKey.(*dsa.PublicKey)
+	if !ok {
+		return errors.New("signature algorithm does not match the service provider's key")
+	}
 	dsaSig := new(dsaSignature)
 	if rest, err := asn1.Unmarshal(signature, dsaSig); err != nil {
 		return err
@@ -158,7 +298,7 @@ func verifyDSA(sp *ServiceProvider, signature, sum []byte) error {
 	if dsaSig.R.Sign() <= 0 || dsaSig.S.Sign() <= 0 {
 		return errors.New("DSA signature contained zero or negative values")
 	}
-	if !dsa.Verify(sp.publicKey.(*dsa.PublicKey), sum, dsaSig.R, dsaSig.S) {
+	if !dsa.Verify(key, sum, dsaSig.R, dsaSig.S) {
 		return errors.New("DSA verification failure")
 	}
 	return nil
@@ -189,23 +329,22 @@ func (i *IDP) DefaultRedirectSSOHandler() http.HandlerFunc {
 				return errors.New("RelayState cannot be longer than 80 characters")
 			}
 
-			samlReq := r.Form.Get("SAMLRequest")
-			// URL decoding is already performed
-			// remove base64 encoding
-			reqBytes, err := base64.StdEncoding.DecodeString(samlReq)
-			if err != nil {
-				return err
+			// Users that open the SSO endpoint directly, such as from a bookmark, don't have a request
+			if r.Form.Get("SAMLRequest") == "" {
+				if landing := settings.GetString("landing-url"); landing != "" {
+					http.Redirect(w, r, landing, http.StatusFound)
+					return nil
+				}
+				return errors.New("SAMLRequest is required")
 			}
-			// Remove deflate
-			req := flate.NewReader(bytes.NewReader(reqBytes))
-			// Read the XML
-			decoder := xml.NewDecoder(req)
+
+			// URL decoding is already performed
 			loginReq := &saml.AuthnRequest{}
-			if err = decoder.Decode(loginReq); err != nil {
+			if err = decodeRedirectMessage("SAMLRequest", r.Form.Get("SAMLRequest"), loginReq); err != nil {
 				return err
 			}
 
-			if err = i.validateAuthRequest(loginReq, r); err != nil {
+			if err = i.validateAuthRequest(loginReq, r, i.redirectSignature(r)); err != nil {
 				return err
 			}
 
@@ -214,38 +353,132 @@ func (i *IDP) DefaultRedirectSSOHandler() http.HandlerFunc {
 			if err != nil {
 				return err
 			}
+			return i.authenticate(saveableRequest, w, r)
+		}()
+		i.ssoError(w, err)
+	}
+}
 
-			// check for existing session
-			if user := i.getUserFromSession(r); user != nil {
-				return i.respond(saveableRequest, user, w, r)
-			}
-
-			// check to see if they presented a client cert
-			if user, err := i.loginWithCert(r, saveableRequest); user != nil {
-				return i.respond(saveableRequest, user, w, r)
-			} else if err != nil {
+// DefaultPostSSOHandler is the default implementation for the HTTP-POST binding login handler. Requests may be
+// signed using the POST-SimpleSign binding or an enveloped XML signature.
+func (i *IDP) DefaultPostSSOHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
 				return err
 			}
-
-			// need to display the login form
-			data, err := proto.Marshal(saveableRequest)
+			relayState := r.PostForm.Get("RelayState")
+			if len(relayState) > 80 {
+				return errors.New("RelayState cannot be longer than 80 characters")
+			}
+			loginReq, verify, err := i.postAuthnRequest(r.Context(), r.PostForm)
 			if err != nil {
 				return err
 			}
-			id := uuid.New().String()
-			err = i.TempCache.Set(id, data)
+			if err = i.validateAuthRequest(loginReq, r, verify); err != nil {
+				return err
+			}
+			saveableRequest, err := model.NewAuthnRequest(loginReq, relayState)
 			if err != nil {
 				return err
 			}
-			http.Redirect(w, r, fmt.Sprintf("/idp/static/login.html?requestId=%s",
-				url.QueryEscape(id)), http.StatusTemporaryRedirect)
-			return nil
+			return i.authenticate(saveableRequest, w, r)
 		}()
+		i.ssoError(w, err)
+	}
+}
+
+// postAuthnRequest decodes an AuthnRequest sent using the HTTP-POST binding and returns the verification of its
+// signature, or nil when it's unsigned. SimpleSign is detected by the Signature form field.
+func (i *IDP) postAuthnRequest(ctx context.Context, form url.Values) (*saml.AuthnRequest, func(*ServiceProvider) error, error) {
+	data, err := base64.StdEncoding.DecodeString(form.Get("SAMLRequest"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("SAMLRequest is not valid base64: %v", err)
+	}
+	request := &saml.AuthnRequest{}
+	if err = xml.Unmarshal(data, request); err != nil {
+		return nil, nil, fmt.Errorf("SAMLRequest does not contain a valid SAML message: %v", err)
+	}
+	switch {
+	case form.Get("Signature") != "":
+		return request, func(sp *ServiceProvider) error {
+			return verifySimpleSign(form, "SAMLRequest", sp, i.Clock.Now())
+		}, nil
+	case request.Signature != nil:
+		_, span := startSpan(ctx, "verify signature", request.Issuer)
+		referenced, err := i.SignatureValidator.Validate(string(data))
+		endSpan(span, err)
 		if err != nil {
-			log.Error(err)
-			i.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, nil, err
+		}
+		// Read the signature from the message and the rest from what was actually signed
+		signed := &saml.AuthnRequest{}
+		if err = xml.Unmarshal([]byte(referenced[0]), signed); err != nil {
+			return nil, nil, err
+		}
+		if signed.ID == "" || signed.ID != request.ID {
+			return nil, nil, errors.New("signature does not reference the AuthnRequest")
 		}
+		signature := request.Signature
+		return signed, func(sp *ServiceProvider) error {
+			return sp.verifySigningKey(signature, i.Clock.Now())
+		}, nil
+	default:
+		return request, nil, nil
+	}
+}
+
+// ssoError reports a failed authentication request to the user
+func (i *IDP) ssoError(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+	case ErrDisabledServiceProvider:
+		i.Error(w, err.Error(), http.StatusForbidden)
+	case ErrBackendBusy:
+		i.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		log.Error(err)
+		i.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// authenticate responds to the request using an existing session or a client certificate. Otherwise, the
+// request is saved and the user is sent to the login form.
+func (i *IDP) authenticate(request *model.AuthnRequest, w http.ResponseWriter, r *http.Request) error {
+	// check for existing session
+	if session := i.currentSession(r); session != nil {
+		if !i.mustReauthenticate(request, session) {
+			log.Infof("found existing session for %s", session.User.GetName())
+			return i.respond(request, session.User, w, r)
+		}
+		log.Infof("%s must log in again for %s", session.User.GetName(), request.Issuer)
+	}
+
+	// check to see if they presented a client cert
+	if user, err := i.loginWithCert(r, request); user != nil {
+		return i.respond(request, user, w, r)
+	} else if err != nil {
+		return err
+	}
+
+	// a session cookie may have been withheld from the cross-site request
+	if i.reloadFirstParty(w, r) {
+		return nil
+	}
+
+	// need to display the login form
+	data, err := proto.Marshal(request)
+	if err != nil {
+		return err
+	}
+	id := i.IDs.NewHandle()
+	err = i.TempCache.Set(id, data)
+	if err != nil {
+		return err
 	}
+	http.Redirect(w, r, fmt.Sprintf("%s?requestId=%s", i.loginPage(),
+		url.QueryEscape(id)), http.StatusTemporaryRedirect)
+	return nil
 }
 
 func (i *IDP) DefaultRedirectSLOHandler() http.HandlerFunc {
@@ -254,27 +487,17 @@ func (i *IDP) DefaultRedirectSLOHandler() http.HandlerFunc {
 			if err := r.ParseForm(); err != nil {
 				return err
 			}
-			samlReq := r.Form.Get("SAMLRequest")
 			// URL decoding is already performed
-			// remove base64 encoding
-			reqBytes, err := base64.StdEncoding.DecodeString(samlReq)
-			if err != nil {
-				return err
-			}
-			// Remove deflate
-			req := flate.NewReader(bytes.NewReader(reqBytes))
-			// Read the XML
-			decoder := xml.NewDecoder(req)
 			logoutReq := &saml.LogoutRequest{}
-			if err = decoder.Decode(logoutReq); err != nil {
+			if err := decodeRedirectMessage("SAMLRequest", r.Form.Get("SAMLRequest"), logoutReq); err != nil {
 				return err
 			}
 
-			if err = i.validateLogoutRequest(logoutReq, r); err != nil {
+			if err := i.validateLogoutRequest(logoutReq, r); err != nil {
 				return err
 			}
 
-			i.deleteUserFromSession(r)
+			i.endSession(r, ServiceProviderLogout, logoutReq.Issuer)
 
 			http.SetCookie(w, &http.Cookie{
 				Name:   i.cookieName,
@@ -291,7 +514,16 @@ func (i *IDP) DefaultRedirectSLOHandler() http.HandlerFunc {
 				w.Write(i.LogoutPost(logoutReq))
 				w.Write([]byte(`</body></html>`))
 			case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect":
-				http.Redirect(w, r, logoutReq.SingleLogoutServiceUrl, http.StatusFound)
+				signer, err := i.signerFor(logoutReq.Issuer)
+				if err != nil {
+					return err
+				}
+				target, err := redirectURL(signer, logoutReq.SingleLogoutServiceUrl, "SAMLResponse",
+					i.makeLogoutResponse(logoutReq), r.Form.Get("RelayState"))
+				if err != nil {
+					return err
+				}
+				http.Redirect(w, r, target, http.StatusFound)
 			default:
 				return errors.New("unsupported protocol binding")
 			}
@@ -304,21 +536,146 @@ func (i *IDP) DefaultRedirectSLOHandler() http.HandlerFunc {
 	}
 }
 
+// DefaultPostSLOHandler is the default implementation for logout requests sent using the POST binding. The
+// LogoutRequest must be signed by the service provider. A signed LogoutResponse is posted back to the
+// service provider's HTTP-POST single logout service.
+func (i *IDP) DefaultPostSLOHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			data, err := base64.StdEncoding.DecodeString(r.Form.Get("SAMLRequest"))
+			if err != nil {
+				return err
+			}
+			logoutReq, location, err := i.validatePostLogoutRequest(r, string(data))
+			if err != nil {
+				return err
+			}
+
+			i.endSession(r, ServiceProviderLogout, logoutReq.Issuer)
+			http.SetCookie(w, &http.Cookie{
+				Name:   i.cookieName,
+				MaxAge: -1,
+			})
+
+			logoutReq.SingleLogoutServiceUrl = location
+			response := i.makeLogoutResponse(logoutReq)
+			signer, err := i.signerFor(logoutReq.Issuer)
+			if err != nil {
+				return err
+			}
+			signature, err := signer.CreateSignature(response)
+			if err != nil {
+				return err
+			}
+			response.Signature = signature
+			var b bytes.Buffer
+			b.WriteString(xml.Header)
+			if err := xml.NewEncoder(&b).Encode(response); err != nil {
+				return err
+			}
+			w.Header().Set("Content-Type", "text/html")
+			return i.postTemplate.Execute(w, struct {
+				RelayState                  string
+				SAMLResponse                string
+				AssertionConsumerServiceURL string
+			}{
+				r.Form.Get("RelayState"),
+				base64.StdEncoding.EncodeToString(b.Bytes()),
+				location,
+			})
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// validatePostLogoutRequest verifies the signature on a LogoutRequest, checks it with checkLogoutRequest, and
+// returns it along with the location of the service provider's HTTP-POST single logout service
+func (i *IDP) validatePostLogoutRequest(r *http.Request, data string) (*saml.LogoutRequest, string, error) {
+	ctx := r.Context()
+	// Read the signature from the message and the rest from what was actually signed
+	signed := &saml.LogoutRequest{}
+	if err := xml.Unmarshal([]byte(data), signed); err != nil {
+		return nil, "", err
+	}
+	_, span := startSpan(ctx, "verify signature", signed.Issuer)
+	referenced, err := i.SignatureValidator.Validate(data)
+	endSpan(span, err)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(referenced) != 1 {
+		return nil, "", errors.New("LogoutRequest must have a single signed reference")
+	}
+	request := &saml.LogoutRequest{}
+	if err := xml.Unmarshal([]byte(referenced[0]), request); err != nil {
+		return nil, "", err
+	}
+	if request.ID == "" || request.ID != signed.ID {
+		return nil, "", errors.New("signature does not reference the LogoutRequest")
+	}
+	if request.Issuer == "" {
+		return nil, "", errors.New("request does not contain an issuer")
+	}
+	log.Infof("received logout request from %s", request.Issuer)
+	sp, err := i.serviceProvider(request.Issuer)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := sp.verifySigningKey(signed.Signature, i.Clock.Now()); err != nil {
+		return nil, "", err
+	}
+	if err := i.checkLogoutRequest(sp, request, r); err != nil {
+		return nil, "", err
+	}
+	for _, slo := range sp.SingleLogoutServices {
+		if slo.Binding == "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" {
+			return request, slo.Location, nil
+		}
+	}
+	return nil, "", errors.New("service provider does not have an HTTP-POST single logout service")
+}
+
+func (i *IDP) makeLogoutResponse(request *saml.LogoutRequest) *saml.LogoutResponse {
+	return &saml.LogoutResponse{
+		StatusResponseType: saml.StatusResponseType{
+			Version:      "2.0",
+			ID:           i.IDs.NewID(),
+			IssueInstant: i.Clock.Now().UTC(),
+			Destination:  request.SingleLogoutServiceUrl,
+			InResponseTo: request.ID,
+			Issuer:       i.samlIssuer(),
+			Status: &saml.Status{
+				StatusCode: saml.StatusCode{
+					Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
+				},
+			},
+		},
+	}
+}
+
 func (i *IDP) loginWithCert(r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
 	// check to see if they presented a client cert
 	if clientCert, err := getCertFromRequest(r); err == nil {
 		user := &model.User{
 			Name:            getSubjectDN(clientCert.Subject),
 			Format:          "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
-			Context:         "urn:oasis:names:tc:SAML:2.0:ac:classes:X509",
-			IP:              getIP(r).String(),
+			Context:         authnContextClassRef(CertificateLogin, nil),
+			IP:              i.getIP(r).String(),
 			X509Certificate: clientCert.Raw,
 		}
 		// Add attributes
-		if err := i.setUserAttributes(user, authnReq); err != nil {
+		if err := i.setUserAttributes(r.Context(), user, authnReq); err != nil {
+			return nil, err
+		}
+		if err := i.logLogin(r, user, authnReq, CertificateLogin); err != nil {
 			return nil, err
 		}
-		i.Auditor.LogSuccess(user, authnReq, CertificateLogin)
 		log.Infof("successful PKI login for %s", user.Name)
 		return user, nil
 	}
@@ -326,49 +683,192 @@ func (i *IDP) loginWithCert(r *http.Request, authnReq *model.AuthnRequest) (*mod
 }
 
 func (i *IDP) loginWithPasswordForm(r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
-	userName := r.Form.Get("username")
-	attrs, err := i.PasswordValidator.Validate(userName, r.Form.Get("password"))
+	return i.loginWithPassword(r, r.Form.Get("username"), r.Form.Get("password"), authnReq)
+}
+
+// loginWithBasicAuth logs in using HTTP Basic credentials. It returns nil if the request doesn't have any.
+func (i *IDP) loginWithBasicAuth(r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
+	userName, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	return i.loginWithPassword(r, userName, password, authnReq)
+}
+
+func (i *IDP) loginWithPassword(r *http.Request, userName, password string, authnReq *model.AuthnRequest) (*model.User, error) {
+	release, err := i.acquireBackend()
+	if err != nil {
+		return nil, err
+	}
+	validator := i.passwordValidator()
+	ctx, cancel := withTimeout(r.Context(), "password-validation-timeout")
+	ctx, span := startSpan(ctx, "validate password", authnReq.GetIssuer())
+	attrs, err := validator.Validate(ctx, userName, password)
+	endSpan(span, err)
+	cancel()
+	release()
+	if err == ErrBackendUnavailable || errors.Is(err, context.DeadlineExceeded) {
+		log.Errorf("password validation for %s failed: %s", userName, err)
+		return nil, ErrBackendUnavailable
+	}
+	if err == ErrPasswordExpired {
+		log.Infof("password for %s has expired", userName)
+		return nil, ErrPasswordExpired
+	}
 	if err != nil {
 		log.Info(err)
 		return nil, ErrInvalidPassword
 	}
 	//They have provided the right password
+	if namer, ok := validator.(LoginNamer); ok {
+		userName = namer.LoginName(userName, attrs)
+	}
 	user := &model.User{
 		Name:       userName,
 		Format:     "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
-		Context:    "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
-		IP:         getIP(r).String(),
+		Context:    authnContextClassRef(PasswordLogin, validator),
+		IP:         i.getIP(r).String(),
 		Attributes: i.buildAttributes(attrs)}
-	i.Auditor.LogSuccess(user, authnReq, PasswordLogin)
+	if err := i.logLogin(r, user, authnReq, PasswordLogin); err != nil {
+		return nil, err
+	}
 	log.Infof("successful password login for %s", user.Name)
 	return user, nil
 }
 
-func (i *IDP) getUserFromSession(r *http.Request) *model.User {
+// logLogin reports the login to the Auditor. The session and the ID of the assertion that answers the request
+// are assigned now, and saved with the request so respond uses them, letting audit records be correlated.
+func (i *IDP) logLogin(r *http.Request, user *model.User, authnReq *model.AuthnRequest, loginType LoginType) error {
+	session, err := i.saveSession(r, user, authnReq)
+	if err != nil {
+		return err
+	}
+	// Logging in again restarts the clock of the max-authentication-age
+	if session.Authenticated, err = ptypes.TimestampProto(i.Clock.Now()); err != nil {
+		return err
+	}
+	if err = i.Sessions.Update(session); err != nil {
+		return err
+	}
+	authnReq.SessionID = session.ID
+	if authnReq.ProtocolBinding != oidcCodeBinding {
+		authnReq.AssertionID = i.IDs.NewID()
+	}
+	i.Auditor.LogSuccess(LoginEvent{
+		User:        user,
+		Request:     authnReq,
+		Type:        loginType,
+		AssertionID: authnReq.AssertionID,
+		SessionID:   session.ID,
+	})
+	return nil
+}
+
+// AuthnContextProvider can be implemented by a PasswordValidator to assert
+// its own AuthnContextClassRef rather than the configured default
+type AuthnContextProvider interface {
+	AuthnContextClassRef() string
+}
+
+// authnContextClassRef determines the AuthnContextClassRef asserted for a login
+func authnContextClassRef(loginType LoginType, validator interface{}) string {
+	if provider, ok := validator.(AuthnContextProvider); ok {
+		if ref := provider.AuthnContextClassRef(); ref != "" {
+			return ref
+		}
+	}
+	return settings.GetString(fmt.Sprintf("authn-context-class-refs.%s", loginType))
+}
+
+// currentSession returns the session identified by the request's cookie, or nil if it doesn't have one
+func (i *IDP) currentSession(r *http.Request) *model.Session {
 	// check for cookie to see if user has a current session
 	if cookie, err := r.Cookie(i.cookieName); err == nil {
 		// Found a session cookie
-		if data, err := i.UserCache.Get(cookie.Value); err == nil {
-			// Cookie matched user in cache
-			user := &model.User{}
-			if err = proto.Unmarshal(data, user); err == nil {
-				log.Infof("found existing session for %s", user.Name)
-				return user
-			}
+		if session, err := i.Sessions.Get(cookie.Value); err == nil {
+			return session
 		}
 	}
 	return nil
 }
 
-func (i *IDP) deleteUserFromSession(r *http.Request) {
-	// check for cookie to see if user has a current session
-	if cookie, err := r.Cookie(i.cookieName); err == nil {
-		// Found a session cookie
-		if _, err := i.UserCache.Get(cookie.Value); err == nil {
-			_ = i.UserCache.Delete(cookie.Value)
-			return
+func (i *IDP) getUserFromSession(r *http.Request) *model.User {
+	if session := i.currentSession(r); session != nil {
+		log.Infof("found existing session for %s", session.User.GetName())
+		return session.User
+	}
+	return nil
+}
+
+// mustReauthenticate reports whether the user has to log in again despite having a session, because the service
+// provider asked with ForceAuthn or they logged in longer ago than its max-authentication-age
+func (i *IDP) mustReauthenticate(request *model.AuthnRequest, session *model.Session) bool {
+	if request.ForceAuthn {
+		return true
+	}
+	sp, _ := i.getSP(request.Issuer)
+	maxAge := sp.maxAuthenticationAge()
+	if maxAge <= 0 {
+		return false
+	}
+	t, err := authenticationTime(session)
+	if err != nil {
+		log.Warnf("session of %s has an invalid authentication time: %s", session.User.GetName(), err)
+		return true
+	}
+	return i.Clock.Now().Sub(t) > maxAge
+}
+
+// authenticationTime returns when the user last logged in to the session. Sessions saved before the time was
+// recorded were authenticated when they were created.
+func authenticationTime(session *model.Session) (time.Time, error) {
+	authenticated := session.Authenticated
+	if authenticated == nil {
+		authenticated = session.Created
+	}
+	return ptypes.Timestamp(authenticated)
+}
+
+// saveSession records that the user logged in to the service provider. The session started by the login is
+// used when there was one, then the request's session when it belongs to the user, otherwise a new one is created.
+func (i *IDP) saveSession(r *http.Request, user *model.User, request *model.AuthnRequest) (*model.Session, error) {
+	issuer := request.GetIssuer()
+	session := i.currentSession(r)
+	if request.GetSessionID() != "" {
+		if login, err := i.Sessions.Get(request.SessionID); err == nil {
+			session = login
+		}
+	}
+	if session == nil || session.User.GetName() != user.Name {
+		var err error
+		if session, err = i.Sessions.Create(user); err != nil {
+			return nil, err
 		}
 	}
+	session.User = user
+	if issuer != "" && !contains(session.ServiceProviders, issuer) {
+		session.ServiceProviders = append(session.ServiceProviders, issuer)
+	}
+	return session, i.Sessions.Update(session)
+}
+
+// endSession deletes the request's session and reports the logout to the Auditor
+func (i *IDP) endSession(r *http.Request, initiator LogoutInitiator, issuer string) {
+	session := i.currentSession(r)
+	if session == nil {
+		return
+	}
+	if err := i.Sessions.Delete(session.ID); err != nil {
+		log.Errorf("unable to delete session of %s: %s", session.User.GetName(), err)
+		return
+	}
+	log.Infof("ended session of %s, requested by %s", session.User.GetName(), initiator)
+	i.Auditor.LogLogout(LogoutEvent{
+		User:            session.User,
+		SessionID:       session.ID,
+		Initiator:       initiator,
+		ServiceProvider: issuer,
+	})
 }
 
 type dsaSignature struct {
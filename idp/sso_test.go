@@ -15,15 +15,25 @@
 package idp
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"encoding/xml"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/PuerkitoBio/goquery"
 	"github.com/chriskery/sso-idp/model"
-	"github.com/golang/protobuf/proto"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/sign"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -87,7 +97,8 @@ func TestIDP_loginWithCert(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	i := &IDP{}
+	auditor := &recordingAuditor{}
+	i := &IDP{Auditor: auditor}
 	ts := getTestIDP(t, i)
 	defer ts.Close()
 	req := httptest.NewRequest("GET", "/", nil)
@@ -95,7 +106,41 @@ func TestIDP_loginWithCert(t *testing.T) {
 	req.TLS = &tls.ConnectionState{
 		PeerCertificates: []*x509.Certificate{cert},
 	}
-	i.loginWithCert(req, nil)
+	authnReq := &model.AuthnRequest{Issuer: "sp"}
+	user, err := i.loginWithCert(req, authnReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, auditor.logins, 1) {
+		login := auditor.logins[0]
+		assert.Equal(t, CertificateLogin, login.Type)
+		assert.Equal(t, user, login.User)
+		assert.NotEmpty(t, login.SessionID)
+		assert.NotEmpty(t, login.AssertionID)
+		session, err := i.Sessions.Get(login.SessionID)
+		if assert.NoError(t, err, "login should start the session in the audit record") {
+			assert.Equal(t, user.Name, session.User.GetName())
+		}
+		// The response uses the audited assertion ID
+		resp, err := i.makeAuthnResponse(authnReq, user)
+		if assert.NoError(t, err) {
+			assert.Equal(t, login.AssertionID, resp.Assertion.ID)
+		}
+	}
+}
+
+// recordingAuditor keeps the events it's sent
+type recordingAuditor struct {
+	logins  []LoginEvent
+	logouts []LogoutEvent
+}
+
+func (a *recordingAuditor) LogSuccess(event LoginEvent) {
+	a.logins = append(a.logins, event)
+}
+
+func (a *recordingAuditor) LogLogout(event LogoutEvent) {
+	a.logouts = append(a.logouts, event)
 }
 
 func TestIDP_getUserFromSession(t *testing.T) {
@@ -111,12 +156,733 @@ func TestIDP_getUserFromSession(t *testing.T) {
 		Secure:   true,
 		HttpOnly: true,
 	})
+	assert.True(t, nil == i.getUserFromSession(req), "should not have returned a user for an unknown session")
 	user := &model.User{Name: "joe"}
-	data, err := proto.Marshal(user)
+	session, err := i.Sessions.Create(user)
 	if err != nil {
 		t.Fatal(err)
 	}
-	i.UserCache.Set("12345", data)
-	i.getUserFromSession(req)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(i.sessionCookie(session.ID))
 	assert.Equal(t, user.Name, i.getUserFromSession(req).Name, "should have returned a user")
 }
+
+type contextValidator struct{}
+
+func (v *contextValidator) Validate(_ context.Context, user, password string) (map[string][]string, error) {
+	return nil, nil
+}
+
+func (v *contextValidator) AuthnContextClassRef() string {
+	return "urn:oasis:names:tc:SAML:2.0:ac:classes:Smartcard"
+}
+
+func Test_authnContextClassRef(t *testing.T) {
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:ac:classes:X509", authnContextClassRef(CertificateLogin, nil))
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport", authnContextClassRef(PasswordLogin, nil))
+	viper.Set("authn-context-class-refs.password", "urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorContract")
+	defer viper.Set("authn-context-class-refs.password", "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport")
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorContract", authnContextClassRef(PasswordLogin, nil))
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:ac:classes:Smartcard", authnContextClassRef(PasswordLogin, &contextValidator{}))
+}
+
+func TestIDP_validateAuthRequest_unsigned(t *testing.T) {
+	i := &IDP{sps: map[string]*ServiceProvider{
+		"sp": {
+			EntityID: "sp",
+			AssertionConsumerServices: []AssertionConsumerService{
+				{IsDefault: true, Location: "https://sp.example.com/acs"},
+			},
+		},
+	}}
+	r := httptest.NewRequest("GET", "/?SAMLRequest=abc", nil)
+	if err := r.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	err := i.validateAuthRequest(&saml.AuthnRequest{RequestAbstractType: saml.RequestAbstractType{Issuer: "sp"}}, r, i.redirectSignature(r))
+	assert.EqualError(t, err, "AuthnRequest must be signed")
+
+	optional := false
+	i.sps["sp"].RequireSignedAuthnRequests = &optional
+	err = i.validateAuthRequest(&saml.AuthnRequest{RequestAbstractType: saml.RequestAbstractType{Issuer: "sp"}}, r, i.redirectSignature(r))
+	assert.NoError(t, err, "unsigned request should be accepted when signatures aren't required")
+}
+
+func TestIDP_validateAuthRequest_transport(t *testing.T) {
+	block, _ := pem.Decode([]byte(certPEM))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := &ServiceProvider{
+		EntityID:    "sp",
+		AuthMode:    TransportAuth,
+		Certificate: base64.StdEncoding.EncodeToString(cert.Raw),
+		AssertionConsumerServices: []AssertionConsumerService{
+			{IsDefault: true, Location: "https://sp.example.com/acs"},
+		},
+	}
+	if err = sp.parseCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	// The certificate expired in 2014, so check it as of when it was valid
+	i := &IDP{sps: map[string]*ServiceProvider{"sp": sp}, Clock: &fixedClock{cert.NotBefore.Add(time.Hour)}}
+	request := &saml.AuthnRequest{RequestAbstractType: saml.RequestAbstractType{Issuer: "sp"}}
+	r := httptest.NewRequest("GET", "/?SAMLRequest=abc", nil)
+	assert.Error(t, i.validateAuthRequest(request, r, i.redirectSignature(r)), "request without a client certificate should fail")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	assert.NoError(t, i.validateAuthRequest(request, r, i.redirectSignature(r)), "unsigned request with the SP's certificate should succeed")
+}
+
+func TestIDP_DefaultRedirectSSOHandler_roundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		binding string
+	}{
+		{"post", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"},
+		{"artifact", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := newTestSP(t, "https://"+tt.name+".example.com", tt.binding)
+			i := &IDP{}
+			startTestIDP(t, i, sp)
+			session := sp.newSession(&model.User{Name: "joe", Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"})
+			resp, err := sp.login(session, "state")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if !assert.Equal(t, http.StatusOK, resp.StatusCode, "assertion consumer service rejected the response") {
+				body, _ := io.ReadAll(resp.Body)
+				t.Log(string(body))
+				return
+			}
+			assert.Equal(t, "joe", sp.assertion.Subject.NameID.Value)
+			assert.Equal(t, "state", sp.relayState)
+		})
+	}
+}
+
+func TestIDP_DefaultRedirectSSOHandler_unregisteredSP(t *testing.T) {
+	sp := newTestSP(t, "https://registered.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{}
+	startTestIDP(t, i, sp)
+	// Another service provider using the same IDP but unknown to it
+	other := newTestSP(t, "https://unregistered.example.com", sp.binding)
+	other.idp, other.idpServer = i, sp.idpServer
+	_, err := other.login(sp.newSession(&model.User{Name: "joe"}), "")
+	assert.EqualError(t, err, "expected post form from IDP, got status 400")
+	assert.Nil(t, other.assertion)
+}
+
+type rejectionAuditor struct {
+	auditor
+	rejected map[string]error
+}
+
+func (a *rejectionAuditor) LogRejectedServiceProvider(issuer string, reason error) {
+	a.rejected[issuer] = reason
+}
+
+func TestIDP_DefaultRedirectSSOHandler_disabledSP(t *testing.T) {
+	sp := newTestSP(t, "https://disabled.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	auditor := &rejectionAuditor{rejected: make(map[string]error)}
+	i := &IDP{Auditor: auditor}
+	startTestIDP(t, i, sp)
+	i.sps[sp.entityID].Disabled = true
+	other := newTestSP(t, "https://unregistered.example.com", sp.binding)
+	other.idp, other.idpServer = i, sp.idpServer
+
+	resp, err := sp.client().Get(sp.authnRequestURL(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "service provider is disabled\n", string(body))
+
+	_, err = other.login(sp.newSession(&model.User{Name: "joe"}), "")
+	assert.EqualError(t, err, "expected post form from IDP, got status 400")
+	assert.Equal(t, map[string]error{
+		sp.entityID:    ErrDisabledServiceProvider,
+		other.entityID: ErrUnregisteredServiceProvider,
+	}, auditor.rejected)
+}
+
+func TestIDP_DefaultPostSSOHandler(t *testing.T) {
+	sp := newTestSP(t, "https://post.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{}
+	ts := startTestIDP(t, i, sp)
+	enveloped := func() url.Values {
+		request := sp.authnRequest()
+		signature, err := sp.signer.CreateSignature(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Signature = signature
+		data, err := xml.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(data)}, "RelayState": {"state"}}
+	}
+	tests := []struct {
+		name    string
+		form    func() url.Values
+		wantErr bool
+	}{
+		{"SimpleSign", func() url.Values { return sp.simpleSignForm("state") }, false},
+		{"SimpleSign without RelayState", func() url.Values { return sp.simpleSignForm("") }, false},
+		{"SimpleSign with changed RelayState", func() url.Values {
+			form := sp.simpleSignForm("state")
+			form.Set("RelayState", "other")
+			return form
+		}, true},
+		{"SimpleSign with added RelayState", func() url.Values {
+			form := sp.simpleSignForm("")
+			form.Set("RelayState", "other")
+			return form
+		}, true},
+		{"enveloped signature", enveloped, false},
+		{"unsigned", func() url.Values {
+			form := sp.simpleSignForm("state")
+			form.Del("Signature")
+			return form
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp.assertion = nil
+			form := tt.form()
+			req, err := http.NewRequest(http.MethodPost, ts.URL+viper.GetString("sso-service-path"),
+				strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(sp.newSession(&model.User{Name: "joe"}))
+			resp, err := sp.client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr {
+				resp.Body.Close()
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+				return
+			}
+			acsResp, err := sp.deliver(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer acsResp.Body.Close()
+			assert.Equal(t, http.StatusOK, acsResp.StatusCode)
+			if assert.NotNil(t, sp.assertion) {
+				assert.Equal(t, "joe", sp.assertion.Subject.NameID.Value)
+			}
+			assert.Equal(t, form.Get("RelayState"), sp.relayState)
+		})
+	}
+}
+
+func TestIDP_DefaultPostSLOHandler(t *testing.T) {
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	auditor := &recordingAuditor{}
+	i := &IDP{Auditor: auditor}
+	ts := startTestIDP(t, i, sp)
+	session := sp.newSession(&model.User{Name: "joe"})
+	id, request := sp.logoutRequest("joe", sp.signer)
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+viper.GetString("slo-service-path"),
+		strings.NewReader(url.Values{"SAMLRequest": {request}, "RelayState": {"state"}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(session)
+	resp, err := sp.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+	_, err = i.Sessions.Get(session.Value)
+	assert.Error(t, err, "session should have been deleted")
+	if assert.Len(t, auditor.logouts, 1, "logout should be audited") {
+		logout := auditor.logouts[0]
+		assert.Equal(t, "joe", logout.User.GetName())
+		assert.Equal(t, session.Value, logout.SessionID)
+		assert.Equal(t, ServiceProviderLogout, logout.Initiator)
+		assert.Equal(t, "https://sp.example.org", logout.ServiceProvider)
+	}
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	action, _ := doc.Find("#samlpost").Attr("action")
+	assert.Equal(t, sp.acs.URL+"/slo", action)
+	relayState, _ := doc.Find("input[name=RelayState]").Attr("value")
+	assert.Equal(t, "state", relayState)
+	encoded, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sign.NewValidator().Validate(string(data))
+	assert.NoError(t, err, "LogoutResponse should be signed")
+	response := &saml.LogoutResponse{}
+	if err = xml.Unmarshal(data, response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, id, response.InResponseTo)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", response.Status.StatusCode.Value)
+}
+
+func TestIDP_DefaultPostSLOHandler_invalidSignature(t *testing.T) {
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	other := newTestSP(t, "https://other.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{}
+	ts := startTestIDP(t, i, sp)
+	tests := []struct {
+		name   string
+		signer sign.Signer
+	}{
+		{"unsigned", nil},
+		{"wrong key", other.signer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := sp.newSession(&model.User{Name: "joe"})
+			_, request := sp.logoutRequest("joe", tt.signer)
+			req, err := http.NewRequest(http.MethodPost, ts.URL+viper.GetString("slo-service-path"),
+				strings.NewReader(url.Values{"SAMLRequest": {request}}.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(session)
+			resp, err := sp.client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			_, err = i.Sessions.Get(session.Value)
+			assert.NoError(t, err, "session should be kept")
+		})
+	}
+}
+
+func TestIDP_DefaultPostSLOHandler_checks(t *testing.T) {
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{}
+	ts := startTestIDP(t, i, sp)
+	logout := func(request string, session *http.Cookie) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+viper.GetString("slo-service-path"),
+			strings.NewReader(url.Values{"SAMLRequest": {request}}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(session)
+		resp, err := sp.client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, test := range []struct {
+		name   string
+		modify func(*saml.LogoutRequest)
+	}{
+		{"another user", func(request *saml.LogoutRequest) { request.NameID.Value = "eve" }},
+		{"stale", func(request *saml.LogoutRequest) { request.IssueInstant = time.Now().Add(-time.Hour) }},
+		{"expired", func(request *saml.LogoutRequest) {
+			expired := time.Now().Add(-time.Second)
+			request.NotOnOrAfter = &expired
+		}},
+		{"another destination", func(request *saml.LogoutRequest) {
+			request.Destination = "https://idp.example.org/idp/SAML2/Redirect/SLO"
+		}},
+	} {
+		session := sp.newSession(&model.User{Name: "joe"})
+		request := sp.newLogoutRequest("joe")
+		test.modify(request)
+		assert.Equal(t, http.StatusBadRequest, logout(sp.encodeLogoutRequest(request, sp.signer), session), test.name)
+		_, err := i.Sessions.Get(session.Value)
+		assert.NoError(t, err, "%s: session should be kept", test.name)
+	}
+
+	_, request := sp.logoutRequest("joe", sp.signer)
+	assert.Equal(t, http.StatusOK, logout(request, sp.newSession(&model.User{Name: "joe"})))
+	session := sp.newSession(&model.User{Name: "joe"})
+	assert.Equal(t, http.StatusBadRequest, logout(request, session), "a replayed request should be rejected")
+	_, err := i.Sessions.Get(session.Value)
+	assert.NoError(t, err, "session should be kept")
+}
+
+func TestIDP_DefaultPostSLOHandler_disabledSP(t *testing.T) {
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{}
+	ts := startTestIDP(t, i, sp)
+	registered, _ := i.getSP(sp.entityID)
+	disabled := *registered
+	disabled.Disabled = true
+	i.sps[sp.entityID] = &disabled
+	session := sp.newSession(&model.User{Name: "joe"})
+	_, request := sp.logoutRequest("joe", sp.signer)
+	req, err := http.NewRequest(http.MethodPost, ts.URL+viper.GetString("slo-service-path"),
+		strings.NewReader(url.Values{"SAMLRequest": {request}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(session)
+	resp, err := sp.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "disabled service providers can't log users out")
+	_, err = i.Sessions.Get(session.Value)
+	assert.NoError(t, err, "session should be kept")
+
+	// Nor can they resolve artifacts
+	cacheTestArtifact(t, i, &model.AuthnRequest{Issuer: sp.entityID}, &model.User{})
+	artifactResponse := resolveTestArtifact(t, sp, sp.client(), sp.artifactResolve("123456", sp.signer))
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Requester", artifactResponse.Status.StatusCode.Value)
+}
+
+func TestIDP_DefaultRedirectSSOHandler_noRequest(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(ts.URL + viper.GetString("sso-service-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "should fail without a landing page")
+
+	viper.Set("landing-url", "https://portal.example.org/")
+	defer viper.Set("landing-url", "")
+	resp, err = client.Get(ts.URL + viper.GetString("sso-service-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://portal.example.org/", resp.Header.Get("Location"))
+}
+
+func TestIDP_DefaultRedirectSSOHandler_basePath(t *testing.T) {
+	viper.Set("base-path", "/auth/")
+	defer viper.Set("base-path", "")
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{}
+	ts := startTestIDP(t, i, sp)
+	// Without a client certificate the user is sent to the login form
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(sp.authnRequestURL(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	login, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/auth/idp/static/login.html", login.Path, "login redirect should be below the base path")
+
+	resp, err = client.Get(ts.URL + login.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "login form should be served below the base path")
+}
+
+func TestIDP_DefaultPasswordLoginHandler_relayState(t *testing.T) {
+	tests := []struct {
+		name       string
+		binding    string
+		relayState string
+	}{
+		{"post", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST", `return="/app?a=1&b=2"`},
+		{"artifact", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact", `return="/app?a=1&b=2"`},
+		{"post without state", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := newTestSP(t, "https://sp.example.org", tt.binding)
+			i := &IDP{PasswordValidator: stubValidator{}}
+			ts := startTestIDP(t, i, sp)
+			// Without a client certificate the user is sent to the login form
+			client := ts.Client()
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+			resp, err := client.Get(sp.authnRequestURL(tt.relayState))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			login, err := url.Parse(resp.Header.Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err = client.PostForm(ts.URL+login.Path, url.Values{
+				"requestId": {login.Query().Get("requestId")},
+				"username":  {"joe"},
+				"password":  {"password"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err = sp.deliver(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if !assert.Equal(t, http.StatusOK, resp.StatusCode, "assertion consumer service rejected the response") {
+				return
+			}
+			assert.Equal(t, "joe", sp.assertion.Subject.NameID.Value)
+			assert.Equal(t, tt.relayState, sp.relayState, "RelayState should survive the login form")
+		})
+	}
+}
+
+type attributeValidator map[string][]string
+
+func (v attributeValidator) Validate(context.Context, string, string) (map[string][]string, error) {
+	return v, nil
+}
+
+func TestIDP_loginWithPassword_nameIDAttribute(t *testing.T) {
+	viper.Set("nameid-attribute", "mail")
+	viper.Set("nameid-format", "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress")
+	defer viper.Set("nameid-attribute", "")
+	defer viper.Set("nameid-format", "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified")
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	// The directory finds users by cn
+	i := &IDP{PasswordValidator: attributeValidator{"cn": {"Joe Smith"}, "mail": {"joe@example.org"}}}
+	ts := startTestIDP(t, i, sp)
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(sp.authnRequestURL(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	login, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.PostForm(ts.URL+login.Path, url.Values{
+		"requestId": {login.Query().Get("requestId")},
+		"username":  {"Joe Smith"},
+		"password":  {"password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = sp.deliver(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if assert.Equal(t, http.StatusOK, resp.StatusCode, "assertion consumer service rejected the response") {
+		assert.Equal(t, "joe@example.org", sp.assertion.Subject.NameID.Value)
+		assert.Equal(t, "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress", sp.assertion.Subject.NameID.Format)
+	}
+
+	user := &model.User{
+		Name:       "Joe Smith",
+		Format:     "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
+		Attributes: []*model.Attribute{{Name: "uid", Value: []string{"joe"}}},
+	}
+	name, format := (&ServiceProvider{}).nameID(user)
+	assert.Equal(t, "Joe Smith", name, "should fall back to the login name")
+	assert.Equal(t, "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", format)
+	name, _ = (&ServiceProvider{NameIDAttribute: "uid"}).nameID(user)
+	assert.Equal(t, "joe", name, "the service provider's own attribute should take precedence")
+	name, _ = (&ServiceProvider{NameIDFormat: persistentNameIDFormat}).nameID(user)
+	assert.Equal(t, "Joe Smith", name, "persistent NameIDs shouldn't come from the attribute")
+}
+
+// namedValidator names users by their uid, whichever identifier they log in with
+type namedValidator struct {
+	attributeValidator
+}
+
+func (v namedValidator) LoginName(_ string, attrs map[string][]string) string {
+	return attrs["uid"][0]
+}
+
+func TestIDP_loginWithPassword_loginName(t *testing.T) {
+	i := &IDP{PasswordValidator: namedValidator{attributeValidator{"uid": {"jsmith"}, "mail": {"joe@example.org"}}}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	for _, login := range []string{"jsmith", "joe@example.org"} {
+		user, err := i.loginWithPassword(httptest.NewRequest("POST", "/", nil), login, "password", &model.AuthnRequest{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "jsmith", user.Name, "%s should be carried forward as the uid", login)
+		}
+	}
+}
+
+func TestIDP_DefaultRedirectSSOHandler_maxAuthenticationAge(t *testing.T) {
+	strict := newTestSP(t, "https://strict.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	lenient := newTestSP(t, "https://lenient.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{PasswordValidator: stubValidator{}}
+	ts := startTestIDP(t, i, strict, lenient)
+	i.sps[strict.entityID].MaxAuthenticationAge = time.Hour
+	session := strict.newSession(&model.User{Name: "joe"})
+	// The user logged in two hours ago
+	saved, err := i.Sessions.Get(session.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Authenticated, err = ptypes.TimestampProto(time.Now().Add(-2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Sessions.Update(saved); err != nil {
+		t.Fatal(err)
+	}
+	// Without the service providers' certificates, which would log in with PKI
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	sso := func(sp *testSP) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, sp.authnRequestURL(""), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(session)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := sso(strict)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "the strict service provider should require a login")
+	login, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, i.loginPage(), login.Path)
+
+	resp, err = lenient.deliver(sso(lenient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if assert.NotNil(t, lenient.assertion, "the session is still good for other service providers") {
+		assert.WithinDuration(t, time.Now().Add(-2*time.Hour), lenient.assertion.AuthnStatement.AuthnInstant, time.Minute,
+			"the AuthnInstant should be when the user logged in")
+	}
+
+	// Logging in again restarts the clock
+	form := url.Values{"requestId": {login.Query().Get("requestId")}, "username": {"joe"}, "password": {"secret"}}
+	req, err := http.NewRequest(http.MethodPost, ts.URL+i.loginPage(), strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(session)
+	if resp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = strict.deliver(resp); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.NotNil(t, strict.assertion)
+	strict.assertion = nil
+	if resp, err = strict.deliver(sso(strict)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if assert.NotNil(t, strict.assertion, "the session should be used after logging in again") {
+		assert.WithinDuration(t, time.Now(), strict.assertion.AuthnStatement.AuthnInstant, time.Minute)
+	}
+
+	// ForceAuthn always requires a login
+	lenient.forceAuthn = true
+	resp = sso(lenient)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+}
+
+func TestIDP_DefaultRedirectSSOHandler_firstPartyReload(t *testing.T) {
+	viper.Set("cookie-same-site", "none")
+	viper.Set("first-party-session-reload", true)
+	defer viper.Set("cookie-same-site", "")
+	defer viper.Set("first-party-session-reload", false)
+	sp := newTestSP(t, "https://sp.example.org", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{}
+	ts := startTestIDP(t, i, sp)
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	// The browser withholds the session cookie from the cross-site request
+	req, err := http.NewRequest(http.MethodGet, sp.authnRequestURL("state"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload, ok := doc.Find("a").Attr("href")
+	if !assert.True(t, ok, "should reload the request from the IDP's site") {
+		return
+	}
+	assert.Contains(t, reload, "first-party=1")
+
+	// and sends it once the request comes from the IDP's own site
+	req, err = http.NewRequest(http.MethodGet, ts.URL+reload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	req.AddCookie(sp.newSession(&model.User{Name: "joe"}))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "existing session should be used")
+	cookies := resp.Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, http.SameSiteNoneMode, cookies[0].SameSite)
+		assert.True(t, cookies[0].Secure)
+	}
+}
@@ -0,0 +1,495 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/xmlsig"
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/sign"
+	"github.com/spf13/viper"
+)
+
+// testSP is a lightweight service provider for end-to-end tests. It signs its AuthnRequests,
+// hosts an assertion consumer service, and validates the signed assertions returned by the IDP.
+type testSP struct {
+	t         *testing.T
+	entityID  string
+	binding   string
+	cert      tls.Certificate
+	signer    sign.Signer
+	acs       *httptest.Server
+	idp       *IDP
+	idpServer *httptest.Server
+
+	// ID of the last AuthnRequest sent to the IDP
+	requestID string
+	// sent with the AuthnRequests
+	forceAuthn bool
+	// results recorded by the assertion consumer service
+	assertion  *saml.Assertion
+	relayState string
+	status     *saml.Status
+}
+
+// newTestSP creates a service provider that expects responses using the provided binding
+func newTestSP(t *testing.T, entityID, binding string) *testSP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: entityID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	signer, err := xmlsig.NewSignerWithOptions(cert, xmlsig.SignerOptions{
+		SignatureAlgorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+		DigestAlgorithm:    "http://www.w3.org/2001/04/xmlenc#sha256",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := &testSP{
+		t:        t,
+		entityID: entityID,
+		binding:  binding,
+		cert:     cert,
+		signer:   signer,
+	}
+	sp.acs = httptest.NewServer(http.HandlerFunc(sp.serveACS))
+	t.Cleanup(sp.acs.Close)
+	return sp
+}
+
+// serviceProvider returns the IDP's configuration for the test service provider
+func (sp *testSP) serviceProvider() ServiceProvider {
+	return ServiceProvider{
+		EntityID:    sp.entityID,
+		Certificate: base64.StdEncoding.EncodeToString(sp.cert.Certificate[0]),
+		AssertionConsumerServices: []AssertionConsumerService{
+			{
+				IsDefault: true,
+				Binding:   sp.binding,
+				Location:  sp.acs.URL + "/acs",
+			},
+		},
+		SingleLogoutServices: []SingleLogoutService{
+			{
+				IsDefault: true,
+				Binding:   "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+				Location:  sp.acs.URL + "/slo",
+			},
+		},
+	}
+}
+
+// startTestIDP registers the service providers with the IDP and starts it. Unlike getTestIDP, the
+// server requests client certificates so that the artifact resolution service can be exercised.
+func startTestIDP(t *testing.T, i *IDP, sps ...*testSP) *httptest.Server {
+	configs := make([]ServiceProvider, len(sps))
+	for j, sp := range sps {
+		configs[j] = sp.serviceProvider()
+	}
+	// Don't leave the service providers registered with IDPs started by later tests
+	previous := viper.Get("sps")
+	t.Cleanup(func() { viper.Set("sps", previous) })
+	viper.Set("sps", configs)
+	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
+	viper.Set("tls-ca", filepath.Join("testdata", "certificate.pem"))
+	handler, err := i.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { i.Close() })
+	ts := httptest.NewUnstartedServer(handler)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	for _, sp := range sps {
+		sp.idp = i
+		sp.idpServer = ts
+	}
+	return ts
+}
+
+// client returns an HTTP client that trusts the IDP, presents the service provider's certificate,
+// and doesn't follow redirects so each step of the flow can be inspected.
+func (sp *testSP) client() *http.Client {
+	transport := sp.idpServer.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{sp.cert}
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// newSession starts a session for the user and returns the matching session cookie
+func (sp *testSP) newSession(user *model.User) *http.Cookie {
+	session, err := sp.idp.Sessions.Create(user)
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	return &http.Cookie{Name: sp.idp.cookieName, Value: session.ID}
+}
+
+// authnRequest returns a new AuthnRequest for the IDP's single sign-on service
+func (sp *testSP) authnRequest() *saml.AuthnRequest {
+	sp.requestID = saml.NewID()
+	return &saml.AuthnRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           sp.requestID,
+			Version:      "2.0",
+			IssueInstant: time.Now().UTC(),
+			Issuer:       sp.entityID,
+			Destination:  sp.idpServer.URL + sp.idp.path("sso-service-path"),
+		},
+		AssertionConsumerServiceURL: sp.acs.URL + "/acs",
+		ProtocolBinding:             sp.binding,
+		ForceAuthn:                  sp.forceAuthn,
+	}
+}
+
+// authnRequestURL returns a signed HTTP-Redirect binding URL for a new AuthnRequest
+func (sp *testSP) authnRequestURL(relayState string) string {
+	request := sp.authnRequest()
+	target, err := redirectURL(sp.signer, request.Destination, "SAMLRequest", request, relayState)
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	return target
+}
+
+// simpleSignForm returns the form fields of a new AuthnRequest sent using the HTTP-POST-SimpleSign binding
+func (sp *testSP) simpleSignForm(relayState string) url.Values {
+	data, err := xml.Marshal(sp.authnRequest())
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	form := url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(data)},
+		"SigAlg":      {sp.signer.Algorithm()},
+	}
+	content := "SAMLRequest=" + form.Get("SAMLRequest")
+	if relayState != "" {
+		form.Set("RelayState", relayState)
+		content += "&RelayState=" + relayState
+	}
+	content += "&SigAlg=" + form.Get("SigAlg")
+	signature, err := sp.signer.Sign([]byte(content))
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	form.Set("Signature", signature)
+	return form
+}
+
+// logoutRequest returns a LogoutRequest for the user encoded for the HTTP-POST binding, signed using signer
+func (sp *testSP) logoutRequest(user string, signer sign.Signer) (string, string) {
+	request := sp.newLogoutRequest(user)
+	return request.ID, sp.encodeLogoutRequest(request, signer)
+}
+
+// newLogoutRequest returns a LogoutRequest for the user addressed to the IDP's single logout service
+func (sp *testSP) newLogoutRequest(user string) *saml.LogoutRequest {
+	return &saml.LogoutRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now().UTC(),
+			Issuer:       sp.entityID,
+			Destination:  sp.idp.singleLogoutServiceLocation,
+		},
+		NameID: &saml.NameID{Value: user},
+	}
+}
+
+// encodeLogoutRequest encodes the LogoutRequest for the HTTP-POST binding, signed using signer
+func (sp *testSP) encodeLogoutRequest(request *saml.LogoutRequest, signer sign.Signer) string {
+	if signer != nil {
+		signature, err := signer.CreateSignature(request)
+		if err != nil {
+			sp.t.Fatal(err)
+		}
+		request.Signature = signature
+	}
+	data, err := xml.Marshal(request)
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// login sends an AuthnRequest for the session and delivers the IDP's response to the assertion
+// consumer service. It returns the response from the assertion consumer service.
+func (sp *testSP) login(session *http.Cookie, relayState string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, sp.authnRequestURL(relayState), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.AddCookie(session)
+	resp, err := sp.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return sp.deliver(resp)
+}
+
+// deliver plays the part of the browser, taking the IDP's response to the service provider
+func (sp *testSP) deliver(resp *http.Response) (*http.Response, error) {
+	defer resp.Body.Close()
+	switch sp.binding {
+	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST":
+		// The IDP returns a form that the browser posts to the assertion consumer service
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("expected post form from IDP, got status %d", resp.StatusCode)
+		}
+		doc, err := goquery.NewDocumentFromReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		action, _ := doc.Find("#samlpost").Attr("action")
+		form := url.Values{}
+		doc.Find("#samlpost input[type=hidden]").Each(func(_ int, s *goquery.Selection) {
+			name, _ := s.Attr("name")
+			value, _ := s.Attr("value")
+			form.Set(name, value)
+		})
+		return http.PostForm(action, form)
+	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact":
+		// The IDP redirects the browser to the assertion consumer service with an artifact
+		if resp.StatusCode != http.StatusFound {
+			return nil, fmt.Errorf("expected redirect from IDP, got status %d", resp.StatusCode)
+		}
+		return http.Get(resp.Header.Get("Location"))
+	default:
+		return nil, fmt.Errorf("unsupported binding %s", sp.binding)
+	}
+}
+
+func (sp *testSP) serveACS(w http.ResponseWriter, r *http.Request) {
+	err := func() error {
+		if err := r.ParseForm(); err != nil {
+			return err
+		}
+		var document []byte
+		var response *saml.Response
+		switch {
+		case r.Form.Get("SAMLResponse") != "":
+			data, err := base64.StdEncoding.DecodeString(r.Form.Get("SAMLResponse"))
+			if err != nil {
+				return err
+			}
+			response = &saml.Response{}
+			if err = xml.Unmarshal(data, response); err != nil {
+				return err
+			}
+			document = data
+		case r.Form.Get("SAMLart") != "":
+			data, env, err := sp.resolveArtifact(r.Form.Get("SAMLart"))
+			if err != nil {
+				return err
+			}
+			if env.Body.ArtifactResponse.Response == nil {
+				return fmt.Errorf("artifact response did not contain a response, status %s",
+					env.Body.ArtifactResponse.Status.StatusCode.Value)
+			}
+			response = env.Body.ArtifactResponse.Response
+			document = data
+		default:
+			return errors.New("request did not contain a SAML response")
+		}
+		sp.status = response.Status
+		if err := sp.validateResponse(document, response); err != nil {
+			return err
+		}
+		sp.assertion = response.Assertion
+		sp.relayState = r.Form.Get("RelayState")
+		return nil
+	}()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (sp *testSP) resolveArtifact(artifact string) ([]byte, *saml.ArtifactResponseEnvelope, error) {
+	return sp.postArtifactResolve(sp.client(), sp.artifactResolve(artifact, sp.signer))
+}
+
+// artifactResolve returns an ArtifactResolve envelope for the artifact, signed when signer is set
+func (sp *testSP) artifactResolve(artifact string, signer sign.Signer) []byte {
+	resolve := saml.ArtifactResolveEnvelope{
+		Body: saml.ArtifactResolveBody{
+			ArtifactResolve: saml.ArtifactResolve{
+				RequestAbstractType: saml.RequestAbstractType{
+					ID:           saml.NewID(),
+					IssueInstant: time.Now().UTC(),
+					Issuer:       sp.entityID,
+					Version:      "2.0",
+				},
+				Artifact: artifact,
+			},
+		},
+	}
+	if signer != nil {
+		signature, err := signer.CreateSignature(resolve.Body.ArtifactResolve)
+		if err != nil {
+			sp.t.Fatal(err)
+		}
+		resolve.Body.ArtifactResolve.Signature = signature
+	}
+	body, err := xml.Marshal(resolve)
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	return body
+}
+
+// postArtifactResolve sends the ArtifactResolve envelope and returns the response document along with the envelope
+// it contains
+func (sp *testSP) postArtifactResolve(client *http.Client, body []byte) ([]byte, *saml.ArtifactResponseEnvelope, error) {
+	resp, err := client.Post(sp.idpServer.URL+viper.GetString("artifact-service-path"),
+		"text/xml", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status code from artifact resolve request %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	env := &saml.ArtifactResponseEnvelope{}
+	if err = xml.Unmarshal(data, env); err != nil {
+		return nil, nil, err
+	}
+	return data, env, nil
+}
+
+// queryAttributes sends an AttributeQuery about the subject, signed when signer is set, and returns the response
+// document along with the Response it contains. All of the attributes are queried unless some are requested.
+func (sp *testSP) queryAttributes(client *http.Client, subject *saml.NameID, signer sign.Signer,
+	requested ...saml.Attribute) ([]byte, *saml.Response) {
+	sp.requestID = saml.NewID()
+	query := saml.AttributeQueryEnv{
+		Body: saml.AttributeQueryBody{
+			Query: saml.AttributeQuery{
+				RequestAbstractType: saml.RequestAbstractType{
+					ID:           sp.requestID,
+					IssueInstant: time.Now().UTC(),
+					Issuer:       sp.entityID,
+					Version:      "2.0",
+				},
+				Subject:   saml.Subject{NameID: subject},
+				Attribute: requested,
+			},
+		},
+	}
+	if signer != nil {
+		signature, err := signer.CreateSignature(query.Body.Query)
+		if err != nil {
+			sp.t.Fatal(err)
+		}
+		query.Body.Query.Signature = signature
+	}
+	body, err := xml.Marshal(query)
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	resp, err := client.Post(sp.idpServer.URL+viper.GetString("attribute-service-path"), "text/xml",
+		bytes.NewReader(body))
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		sp.t.Fatalf("unexpected status code from attribute query %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		sp.t.Fatal(err)
+	}
+	env := &saml.AttributeRespEnv{}
+	if err = xml.Unmarshal(data, env); err != nil {
+		sp.t.Fatal(err)
+	}
+	return data, &env.Body.Response
+}
+
+// validateResponse checks the assertion is signed by the IDP and addressed to this service provider
+func (sp *testSP) validateResponse(document []byte, response *saml.Response) error {
+	assertion := response.Assertion
+	if assertion == nil || assertion.Signature == nil {
+		return errors.New("response did not contain a signed assertion")
+	}
+	referenced, err := sign.NewValidator().Validate(string(document))
+	if err != nil {
+		return err
+	}
+	if len(referenced) != 1 || !strings.Contains(referenced[0], assertion.ID) {
+		return errors.New("signature does not reference the assertion")
+	}
+	cert, err := getCertFromXML(assertion.Signature.KeyInfo.X509Data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.Raw, sp.idp.TLSConfig.Certificates[0].Certificate[0]) {
+		return errors.New("assertion was not signed by the IDP")
+	}
+	if response.InResponseTo != sp.requestID {
+		return fmt.Errorf("response is for request %s, expected %s", response.InResponseTo, sp.requestID)
+	}
+	if assertion.Conditions.AudienceRestriction.Audience != sp.entityID {
+		return errors.New("assertion audience does not match service provider")
+	}
+	if recipient := assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient; recipient != sp.acs.URL+"/acs" {
+		return fmt.Errorf("assertion is for recipient %s", recipient)
+	}
+	return nil
+}
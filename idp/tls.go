@@ -17,8 +17,8 @@ package idp
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"github.com/chriskery/sso-idp/settings"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 	"io/ioutil"
 )
 
@@ -29,7 +29,7 @@ var (
 
 // ConfigureTLS not requiring users to present client certificates.
 func ConfigureTLS() (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(viper.GetString("tls-certificate"), viper.GetString("tls-private-key"))
+	cert, err := tls.LoadX509KeyPair(settings.GetString("tls-certificate"), settings.GetString("tls-private-key"))
 	if err != nil {
 		log.Errorf("tls-certificate not found ,use default tls cert:%s", err.Error())
 		defaultCert, err := tls.X509KeyPair(defaultX509Cert, defaultX509Key)
@@ -38,7 +38,7 @@ func ConfigureTLS() (*tls.Config, error) {
 		}
 		cert = defaultCert
 	}
-	ca := viper.GetString("tls-ca")
+	ca := settings.GetString("tls-ca")
 
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
@@ -0,0 +1,119 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/chriskery/sso-idp/settings"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/chriskery/sso-idp/idp"
+
+// Span attributes identifying the service provider and whether the traced operation succeeded
+const (
+	entityIDKey = attribute.Key("sp.entity_id")
+	outcomeKey  = attribute.Key("outcome")
+)
+
+// ConfigureTracing exports spans of the SSO flow to the OTLP/HTTP collector at tracing-endpoint, such as
+// http://localhost:4318. Tracing is off when it isn't set. The returned function flushes the remaining spans and
+// should be called before exiting.
+func ConfigureTracing() (func(context.Context) error, error) {
+	endpoint := settings.GetString("tracing-endpoint")
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracing-endpoint: %w", err)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch u.Scheme {
+	case "http":
+		options = append(options, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("tracing-endpoint %s must be an http or https URL", endpoint)
+	}
+	if u.Path != "" && u.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(settings.GetString("tracing-service-name")))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// traceHandler starts a span for each request, continuing the trace of a caller that sent its W3C trace context
+func traceHandler(next http.Handler) http.Handler {
+	propagator := propagation.TraceContext{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPTargetKey.String(r.URL.Path)))
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// startSpan starts a span of the SSO flow for the service provider, whose entity ID is empty when it isn't known yet
+func startSpan(ctx context.Context, name, entityID string) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name)
+	if entityID != "" {
+		span.SetAttributes(entityIDKey.String(entityID))
+	}
+	return ctx, span
+}
+
+// endSpan records the outcome of the span's operation and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetAttributes(outcomeKey.String("failure"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(outcomeKey.String("success"))
+	}
+	span.End()
+}
+
+// requestContext returns the request's context, which carries its span, or the background context without one
+func requestContext(r *http.Request) context.Context {
+	if r == nil {
+		return context.Background()
+	}
+	return r.Context()
+}
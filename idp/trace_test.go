@@ -0,0 +1,92 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestIDP_tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+
+	sp := newTestSP(t, "https://post.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	i := &IDP{}
+	startTestIDP(t, i, sp)
+	req, err := http.NewRequest(http.MethodGet, sp.authnRequestURL("state"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(sp.newSession(&model.User{Name: "joe", Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"}))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := sp.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"verify signature", "build response"} {
+		span, ok := spans[name]
+		if !assert.True(t, ok, "missing %s span", name) {
+			continue
+		}
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String(),
+			"%s span should continue the caller's trace", name)
+		assert.Contains(t, span.Attributes(), entityIDKey.String(sp.entityID))
+		assert.Contains(t, span.Attributes(), outcomeKey.String("success"))
+	}
+}
+
+func Test_endSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+	_, span := tracer.Start(context.Background(), "verify signature")
+	endSpan(span, ErrInvalidPassword)
+	if assert.Len(t, recorder.Ended(), 1) {
+		ended := recorder.Ended()[0]
+		assert.Equal(t, []attribute.KeyValue{outcomeKey.String("failure")}, ended.Attributes())
+		assert.Equal(t, ErrInvalidPassword.Error(), ended.Status().Description)
+	}
+}
+
+func TestConfigureTracing(t *testing.T) {
+	previous := viper.GetString("tracing-endpoint")
+	t.Cleanup(func() { viper.Set("tracing-endpoint", previous) })
+	viper.Set("tracing-endpoint", "")
+	shutdown, err := ConfigureTracing()
+	if assert.NoError(t, err) {
+		assert.NoError(t, shutdown(context.Background()))
+	}
+	viper.Set("tracing-endpoint", "localhost:4318")
+	_, err = ConfigureTracing()
+	assert.Error(t, err, "the endpoint should be a URL")
+}
@@ -0,0 +1,156 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/chriskery/sso-idp/settings"
+)
+
+// AttributeTransformer shapes a user's attributes after all AttributeSources have run, for example to rename
+// attributes or compute derived values.
+type AttributeTransformer func(*model.User, *model.AuthnRequest) error
+
+// TransformerConfig describes a built-in transformer configured under the attribute-transformers key
+type TransformerConfig struct {
+	// rename, static, or template
+	Type string
+	// Attribute to rename for the rename transformer
+	From string
+	// Attribute that is renamed to or set by the transformer
+	To string
+	// Values for the static transformer
+	Values []string
+	// Go text/template for the template transformer
+	Template string
+}
+
+// RenameTransformer renames the from attribute to to, merging values if the user already has an attribute named to
+func RenameTransformer(from, to string) AttributeTransformer {
+	return func(user *model.User, _ *model.AuthnRequest) error {
+		var target *model.Attribute
+		for _, att := range user.Attributes {
+			if strings.EqualFold(att.Name, to) {
+				target = att
+				break
+			}
+		}
+		attributes := user.Attributes[:0]
+		for _, att := range user.Attributes {
+			if !strings.EqualFold(att.Name, from) || att == target {
+				attributes = append(attributes, att)
+				continue
+			}
+			if target == nil {
+				att.Name = to
+				target = att
+				attributes = append(attributes, att)
+				continue
+			}
+			for _, value := range att.Value {
+				if !contains(target.Value, value) {
+					target.Value = append(target.Value, value)
+				}
+			}
+		}
+		user.Attributes = attributes
+		return nil
+	}
+}
+
+// StaticTransformer adds an attribute with fixed values to every user
+func StaticTransformer(name string, values ...string) AttributeTransformer {
+	return func(user *model.User, _ *model.AuthnRequest) error {
+		user.AppendAttributes([]*model.Attribute{{Name: name, Value: append([]string(nil), values...)}})
+		return nil
+	}
+}
+
+// TemplateTransformer adds an attribute computed from a text/template. The template is executed with the user's
+// Name, their Attributes as a map of names to values, and the Issuer of the request. The first function returns the
+// first value of an attribute or an empty string, so "{{first .Attributes.givenName}} {{first .Attributes.sn}}"
+// builds a display name. Nothing is added when the template produces an empty string.
+func TemplateTransformer(name, text string) (AttributeTransformer, error) {
+	tmpl, err := template.New(name).Funcs(template.FuncMap{"first": first}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for attribute %s: %s", name, err)
+	}
+	return func(user *model.User, req *model.AuthnRequest) error {
+		data := struct {
+			Name       string
+			Issuer     string
+			Attributes map[string][]string
+		}{user.Name, req.GetIssuer(), make(map[string][]string)}
+		for _, att := range user.Attributes {
+			data.Attributes[att.Name] = append(data.Attributes[att.Name], att.Value...)
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, data); err != nil {
+			return fmt.Errorf("failed to compute attribute %s: %s", name, err)
+		}
+		if value := b.String(); value != "" {
+			user.AppendAttributes([]*model.Attribute{{Name: name, Value: []string{value}}})
+		}
+		return nil
+	}, nil
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// DefaultAttributeTransformers builds the built-in transformers listed under the attribute-transformers key
+func DefaultAttributeTransformers() ([]AttributeTransformer, error) {
+	configs := []TransformerConfig{}
+	if err := settings.UnmarshalKey("attribute-transformers", &configs); err != nil {
+		return nil, err
+	}
+	transformers := make([]AttributeTransformer, 0, len(configs))
+	for _, config := range configs {
+		transformer, err := config.transformer()
+		if err != nil {
+			return nil, err
+		}
+		transformers = append(transformers, transformer)
+	}
+	return transformers, nil
+}
+
+func (config TransformerConfig) transformer() (AttributeTransformer, error) {
+	if config.To == "" {
+		return nil, fmt.Errorf("%s attribute transformer requires to", config.Type)
+	}
+	switch config.Type {
+	case "rename":
+		if config.From == "" {
+			return nil, fmt.Errorf("rename attribute transformer for %s requires from", config.To)
+		}
+		return RenameTransformer(config.From, config.To), nil
+	case "static":
+		return StaticTransformer(config.To, config.Values...), nil
+	case "template":
+		return TemplateTransformer(config.To, config.Template)
+	default:
+		return nil, fmt.Errorf("unknown attribute transformer type %q", config.Type)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/chriskery/sso-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultAttributeTransformers(t *testing.T) {
+	viper.Set("attribute-transformers", []map[string]interface{}{
+		{"type": "rename", "from": "mail", "to": "email"},
+		{"type": "static", "to": "organization", "values": []string{"Example"}},
+		{"type": "template", "to": "displayName", "template": "{{first .Attributes.givenName}} {{first .Attributes.sn}}"},
+		{"type": "template", "to": "nickname", "template": "{{first .Attributes.nickname}}"},
+	})
+	defer viper.Set("attribute-transformers", []TransformerConfig{})
+	transformers, err := DefaultAttributeTransformers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &IDP{AttributeTransformers: transformers}
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "givenName", Value: []string{"Joe"}},
+		{Name: "sn", Value: []string{"Smith"}},
+	}}
+	if err = i.setUserAttributes(context.Background(), user, nil); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string][]string)
+	for _, att := range user.Attributes {
+		values[att.Name] = att.Value
+	}
+	assert.Equal(t, []string{"joe@example.com"}, values["email"])
+	assert.NotContains(t, values, "mail")
+	assert.Equal(t, []string{"Example"}, values["organization"])
+	assert.Equal(t, []string{"Joe Smith"}, values["displayName"])
+	assert.NotContains(t, values, "nickname", "empty template results shouldn't be released")
+}
+
+func TestRenameTransformer_merge(t *testing.T) {
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "email", Value: []string{"joe@example.com"}},
+		{Name: "mail", Value: []string{"joe@example.com", "joe.smith@example.com"}},
+		{Name: "cn", Value: []string{"Joe"}},
+	}}
+	if err := RenameTransformer("mail", "email")(user, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*model.Attribute{
+		{Name: "email", Value: []string{"joe@example.com", "joe.smith@example.com"}},
+		{Name: "cn", Value: []string{"Joe"}},
+	}, user.Attributes, "values should be merged into the existing attribute without duplicates")
+}
+
+func TestDefaultAttributeTransformers_invalid(t *testing.T) {
+	for _, config := range []map[string]interface{}{
+		{"type": "uppercase", "to": "email"},
+		{"type": "rename", "to": "email"},
+		{"type": "static"},
+		{"type": "template", "to": "displayName", "template": "{{first"},
+	} {
+		viper.Set("attribute-transformers", []map[string]interface{}{config})
+		_, err := DefaultAttributeTransformers()
+		assert.Error(t, err, "expected %v to be rejected", config)
+	}
+	viper.Set("attribute-transformers", []TransformerConfig{})
+}
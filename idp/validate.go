@@ -0,0 +1,253 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chriskery/sso-idp/settings"
+	"github.com/chriskery/sso-idp/sign"
+	"github.com/chriskery/sso-idp/ui"
+	"github.com/spf13/viper"
+)
+
+// durationSettings are the settings read with GetDuration, which quietly treats values it can't parse as 0
+var durationSettings = []string{
+	"assertion-lifetime",
+	"assertion-not-before-skew",
+	"attribute-source-timeout",
+	"certificate-check-interval",
+	"certificate-expiry-warning",
+	"login-page-cache-duration",
+	"logout-request-lifetime",
+	"max-authentication-age",
+	"password-validation-timeout",
+	"sp-metadata-retry-interval",
+	"sp-metadata-timeout",
+	"subject-confirmation-lifetime",
+	"temp-cache-duration",
+	"ui-cache-duration",
+	"user-cache-duration",
+}
+
+// pathSettings are the routes the IDP serves, relative to the base-path
+var pathSettings = []string{
+	"artifact-service-path",
+	"attribute-service-path",
+	"debug-service-path",
+	"ecp-service-path",
+	"jwks-path",
+	"login-page-path",
+	"metadata-path",
+	"oidc-authorize-path",
+	"oidc-token-path",
+	"password-change-page-path",
+	"readiness-path",
+	"slo-service-path",
+	"sp-list-path",
+	"sso-service-path",
+	"static-path",
+}
+
+// ConfigError lists every problem Validate found with the configuration
+type ConfigError []error
+
+func (e ConfigError) Error() string {
+	problems := make([]string, len(e))
+	for j, err := range e {
+		problems[j] = err.Error()
+	}
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(problems, "; "))
+}
+
+func (e *ConfigError) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// Validate checks the whole configuration without starting the IDP and returns a ConfigError listing every problem
+// found. Handler stops at the first problem, and some, such as a duration that can't be parsed or a service
+// provider's algorithm the signing key doesn't support, otherwise only surface when requests are handled.
+func (i *IDP) Validate() error {
+	return i.ValidateSettings(settings.Current())
+}
+
+// ValidateSettings checks a configuration the same way as Validate before it's published, such as one read when the
+// configuration is reloaded, so requests never see a configuration that doesn't validate
+func (i *IDP) ValidateSettings(config *viper.Viper) error {
+	var problems ConfigError
+	for _, key := range durationSettings {
+		if _, err := time.ParseDuration(config.GetString(key)); err != nil {
+			problems.add(fmt.Errorf("%s must be a duration such as 5m: %v", key, err))
+		}
+	}
+	for _, key := range pathSettings {
+		if path := config.GetString(key); !strings.HasPrefix(path, "/") {
+			problems.add(fmt.Errorf("%s must be a path starting with /: %q", key, path))
+		}
+	}
+	if basePath := config.GetString("base-path"); basePath != "" && !strings.HasPrefix(basePath, "/") {
+		problems.add(fmt.Errorf("base-path must start with /: %s", basePath))
+	}
+	if externalURL := config.GetString("external-url"); externalURL != "" {
+		if u, err := url.Parse(externalURL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems.add(fmt.Errorf("external-url must be an absolute URL: %s", externalURL))
+		}
+	}
+	_, err := parseSameSite(config.GetString("cookie-same-site"))
+	problems.add(err)
+	_, err = parseCIDRs(config.GetStringSlice("trusted-proxies"))
+	problems.add(err)
+	// LogoutRequest IDs are remembered in the TempCache for as long as the requests are accepted
+	if 2*config.GetDuration("logout-request-lifetime") > config.GetDuration("temp-cache-duration") {
+		problems.add(errors.New("logout-request-lifetime must be at most half of temp-cache-duration"))
+	}
+	problems.add(checkNameIDPolicy(config.GetString("persistent-nameid-failure-policy")))
+	problems.add(checkAssertionPolicy(config.GetString("assertion-limit-policy")))
+	signatureAlgorithms := i.validateCertificates(config, &problems)
+	if signatureAlgorithms != nil {
+		problems.add(checkAlgorithm("signature-algorithm", config.GetString("signature-algorithm"), signatureAlgorithms))
+		problems.add(checkAlgorithm("digest-algorithm", config.GetString("digest-algorithm"), sign.DigestAlgorithms))
+	}
+	i.validateServiceProviders(config, &problems, signatureAlgorithms)
+	if i.UIHandler == nil {
+		problems.add(ui.Validate(config))
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// validateCertificates checks the TLS and signing certificates can be loaded. It returns the signature algorithms
+// supported by the signing key, or nil when they aren't known.
+func (i *IDP) validateCertificates(config *viper.Viper, problems *ConfigError) []string {
+	var cert tls.Certificate
+	if i.TLSConfig != nil {
+		if len(i.TLSConfig.Certificates) == 0 {
+			problems.add(errors.New("tlsConfig does not contain a certificate"))
+			return nil
+		}
+		cert = i.TLSConfig.Certificates[0]
+	} else {
+		certFile, keyFile := config.GetString("tls-certificate"), config.GetString("tls-private-key")
+		if certFile == "" && keyFile == "" {
+			// ConfigureTLS falls back to the built in certificate
+			cert, _ = tls.X509KeyPair(defaultX509Cert, defaultX509Key)
+		} else {
+			var err error
+			if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+				problems.add(fmt.Errorf("unable to load tls-certificate and tls-private-key: %v", err))
+				return nil
+			}
+		}
+		if ca := config.GetString("tls-ca"); ca != "" {
+			if data, err := ioutil.ReadFile(ca); err != nil {
+				problems.add(fmt.Errorf("unable to read tls-ca: %v", err))
+			} else if !x509.NewCertPool().AppendCertsFromPEM(data) {
+				problems.add(fmt.Errorf("tls-ca %s does not contain any PEM certificates", ca))
+			}
+		}
+	}
+	if i.Signer != nil {
+		// Nothing is known about a Signer provided by the application
+		return nil
+	}
+	chain := cert.Certificate
+	switch backend := config.GetString("signing-backend"); backend {
+	case "file":
+	case "pkcs11":
+		if path := config.GetString("signing-certificate"); path != "" {
+			var err error
+			if chain, err = readCertificates(path); err != nil {
+				problems.add(fmt.Errorf("unable to read signing-certificate: %v", err))
+				return nil
+			}
+		}
+	default:
+		problems.add(fmt.Errorf("unsupported signing-backend %s", backend))
+		return nil
+	}
+	if len(chain) == 0 {
+		problems.add(errors.New("the signing certificate is empty"))
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		problems.add(fmt.Errorf("unable to parse the signing certificate: %v", err))
+		return nil
+	}
+	return sign.SignatureAlgorithms(leaf)
+}
+
+// validateServiceProviders checks the registered service providers' certificates and, when the signature
+// algorithms of the signing key are known, the algorithms they're set to use
+func (i *IDP) validateServiceProviders(config *viper.Viper, problems *ConfigError, signatureAlgorithms []string) {
+	spStore := i.ServiceProviders
+	if _, ok := spStore.(*configSPStore); ok {
+		// The sps setting of the configuration being validated rather than of the published one
+		spStore = &configSPStore{config: config}
+	} else if spStore == nil {
+		var err error
+		if spStore, err = newSPStore(config); err != nil {
+			problems.add(err)
+			return
+		}
+	}
+	sps, err := spStore.List()
+	if err != nil {
+		problems.add(fmt.Errorf("unable to read the service providers: %v", err))
+		return
+	}
+	anchors, err := spTrustAnchors(config)
+	problems.add(err)
+	clock := i.Clock
+	if clock == nil {
+		clock = SystemClock()
+	}
+	for _, sp := range sps {
+		if sp.EntityID == "" {
+			problems.add(errors.New("a service provider is missing its entityid"))
+			continue
+		}
+		problems.add(sp.validate(clock.Now(), anchors))
+		switch sp.AuthMode {
+		case "", MessageSignatureAuth, TransportAuth:
+		default:
+			problems.add(fmt.Errorf("unsupported auth mode %s for %s", sp.AuthMode, sp.EntityID))
+		}
+		problems.add(i.checkSignerAlgorithms(sp))
+		if signatureAlgorithms != nil {
+			problems.add(checkAlgorithm("signaturealgorithm of "+sp.EntityID, sp.SignatureAlgorithm, signatureAlgorithms))
+			problems.add(checkAlgorithm("digestalgorithm of "+sp.EntityID, sp.DigestAlgorithm, sign.DigestAlgorithms))
+		}
+	}
+}
+
+// checkAlgorithm reports an algorithm that's set but not supported
+func checkAlgorithm(name, algorithm string, supported []string) error {
+	if algorithm == "" || contains(supported, algorithm) {
+		return nil
+	}
+	return fmt.Errorf("%s %s is not supported, use one of %s", name, algorithm, strings.Join(supported, ", "))
+}
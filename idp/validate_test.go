@@ -0,0 +1,109 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// setConfig changes the setting for the rest of the test
+func setConfig(t *testing.T, key string, value interface{}) {
+	previous := viper.Get(key)
+	t.Cleanup(func() { viper.Set(key, previous) })
+	viper.Set(key, value)
+}
+
+// setConfigFile points the configuration at a file in a temporary directory, so tests that write it don't change the
+// source tree, and returns its path
+func setConfigFile(t *testing.T) string {
+	previous := viper.ConfigFileUsed()
+	t.Cleanup(func() { viper.SetConfigFile(previous) })
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	viper.SetConfigFile(config)
+	return config
+}
+
+func TestIDP_Validate(t *testing.T) {
+	sp := newTestSP(t, "https://wiki.example.com", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	setConfig(t, "tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	setConfig(t, "tls-private-key", filepath.Join("testdata", "key.pem"))
+	setConfig(t, "sps", []ServiceProvider{sp.serviceProvider()})
+	assert.NoError(t, (&IDP{}).Validate())
+
+	unsupported := sp.serviceProvider()
+	unsupported.SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	corrupt := sp.serviceProvider()
+	corrupt.EntityID = "https://corrupt.example.com"
+	corrupt.Certificate = "not a certificate"
+	setConfig(t, "sps", []ServiceProvider{unsupported, corrupt})
+	setConfig(t, "assertion-lifetime", "5 minutes")
+	setConfig(t, "readiness-path", "ready")
+	setConfig(t, "digest-algorithm", "http://www.w3.org/2001/04/xmldsig-more#md5")
+	setConfig(t, "logout-request-lifetime", "5m")
+	err := (&IDP{}).Validate()
+	if assert.IsType(t, ConfigError{}, err) {
+		assert.Len(t, err.(ConfigError), 6, "every problem should be reported: %s", err)
+	}
+	for _, problem := range []string{"assertion-lifetime", "readiness-path", "digest-algorithm", "logout-request-lifetime",
+		"signaturealgorithm of https://wiki.example.com", "https://corrupt.example.com"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+
+	setConfig(t, "tls-private-key", filepath.Join("testdata", "missing.pem"))
+	err = (&IDP{}).Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tls-private-key")
+	}
+}
+
+func TestIDP_ValidateSettings(t *testing.T) {
+	setConfig(t, "tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	setConfig(t, "tls-private-key", filepath.Join("testdata", "key.pem"))
+	// Left to the configuration file
+	setConfig(t, "readiness-path", nil)
+	setConfig(t, "sps", nil)
+	i := &IDP{ServiceProviders: NewConfigSPStore()}
+	// Read the way the configuration is reloaded, keeping the settings and defaults of the current one
+	next := *viper.GetViper()
+	next.SetConfigType("yaml")
+	config := "readiness-path: ready\nsps:\n- entityid: https://corrupt.example.com\n  certificate: not a certificate\n"
+	if err := next.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	err := i.ValidateSettings(&next)
+	if assert.Error(t, err, "the configuration being validated should be checked rather than the current one") {
+		assert.Contains(t, err.Error(), "readiness-path")
+		assert.Contains(t, err.Error(), "https://corrupt.example.com")
+	}
+	assert.NoError(t, i.Validate())
+}
+
+func TestIDP_Validate_loginCancel(t *testing.T) {
+	setConfig(t, "tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	setConfig(t, "tls-private-key", filepath.Join("testdata", "key.pem"))
+	setConfig(t, "login-cancel-enabled", true)
+	setConfig(t, "assets-path", t.TempDir())
+	err := (&IDP{}).Validate()
+	if assert.Error(t, err, "the cancel button can't be shown without a login page") {
+		assert.Contains(t, err.Error(), "login-cancel-enabled")
+	}
+	assert.NoError(t, (&IDP{UIHandler: http.NotFoundHandler()}).Validate(), "a custom UI handler serves its own login page")
+}
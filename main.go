@@ -64,6 +64,9 @@ func initConfig() {
 	} else {
 		log.Info("failed to load config file:", err)
 	}
+	if err := cmd.ReadConfigData(viper.GetString("config-data")); err != nil {
+		log.Fatalln("failed to load CONFIG_DATA:", err)
+	}
 }
 
 func main() {
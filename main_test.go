@@ -37,6 +37,25 @@ func Test_initConfig(t *testing.T) {
 	assert.Equal(t, "b", viper.Get("my-config-value"), "second value is wrong")
 }
 
+func Test_initConfig_environment(t *testing.T) {
+	previous := viper.Get("sps")
+	defer viper.Set("sps", previous)
+	t.Setenv("CONFIG_DATA", `{
+		"sps": [{"entityid": "https://wiki.example.org", "assertionconsumerservices": [{"location": "https://wiki.example.org/acs", "isdefault": true}]}],
+		"ldap": {"addr": "ldaps://ldap.example.org", "search_base": "ou=people,dc=example,dc=org"}
+	}`)
+	initConfig()
+	var sps []idp.ServiceProvider
+	if assert.NoError(t, viper.UnmarshalKey("sps", &sps)) && assert.Len(t, sps, 1) {
+		assert.Equal(t, "https://wiki.example.org", sps[0].EntityID)
+		if assert.Len(t, sps[0].AssertionConsumerServices, 1) {
+			assert.Equal(t, "https://wiki.example.org/acs", sps[0].AssertionConsumerServices[0].Location)
+		}
+	}
+	assert.Equal(t, "ldaps://ldap.example.org", viper.GetString("ldap.addr"))
+	assert.Equal(t, "ou=people,dc=example,dc=org", viper.GetString("ldap.search_base"))
+}
+
 func Test_server(t *testing.T) {
 	initConfig()
 	indentityProvider := &idp.IDP{}
@@ -48,6 +67,7 @@ func Test_server(t *testing.T) {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer indentityProvider.Close()
 
 	server := &http.Server{
 		Handler: handlers.CombinedLoggingHandler(os.Stdout, handler),
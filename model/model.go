@@ -22,9 +22,11 @@
 package model
 
 import (
+	"strings"
+
 	"github.com/chriskery/sso-idp/saml"
+	"github.com/chriskery/sso-idp/settings"
 	"github.com/golang/protobuf/ptypes"
-	"github.com/spf13/viper"
 )
 
 func (u *User) AppendAttributes(atts []*Attribute) {
@@ -40,36 +42,78 @@ func (u *User) AttributeStatement() *saml.AttributeStatement {
 		return nil
 	}
 	stmt := &saml.AttributeStatement{}
+	// Multiple sources may provide values for the same attribute. Each attribute must only
+	// appear once with all of its values.
+	index := make(map[string]int, len(u.Attributes))
+	seen := make(map[string]map[string]bool, len(u.Attributes))
+	types := attributeSettings("attribute-types")
+	scopes := attributeSettings("attribute-scopes")
 	for _, val := range u.Attributes {
-		attVals := make([]saml.AttributeValue, len(val.Value))
-		for i := range val.Value {
-			attVals[i] = saml.AttributeValue{Value: val.Value[i]}
+		xsiType := val.Type
+		if xsiType == "" {
+			xsiType = types[strings.ToLower(val.Name)]
+		}
+		scope := val.Scope
+		if scope == "" {
+			scope = scopes[strings.ToLower(val.Name)]
 		}
-		att := saml.Attribute{
-			FriendlyName:   val.Name,
-			Name:           val.Name,
-			NameFormat:     viper.GetString("saml-attribute-name-format"),
-			AttributeValue: attVals,
+		j, ok := index[val.Name]
+		if !ok {
+			j = len(stmt.Attribute)
+			index[val.Name] = j
+			seen[val.Name] = make(map[string]bool, len(val.Value))
+			stmt.Attribute = append(stmt.Attribute, saml.Attribute{
+				FriendlyName: val.Name,
+				Name:         val.Name,
+				NameFormat:   settings.GetString("saml-attribute-name-format"),
+			})
+		}
+		for _, value := range val.Value {
+			attVal := saml.NewAttributeValue(value, xsiType)
+			if scope != "" {
+				attVal = saml.NewScopedAttributeValue(value, xsiType, scope)
+			}
+			if seen[val.Name][attVal.Value] {
+				continue
+			}
+			seen[val.Name][attVal.Value] = true
+			stmt.Attribute[j].AttributeValue = append(stmt.Attribute[j].AttributeValue, attVal)
 		}
-		stmt.Attribute = append(stmt.Attribute, att)
 	}
 	return stmt
 }
 
+// attributeSettings reads a map of attribute names to values. Viper lower cases keys read from
+// configuration files, so the names are lower cased here as well.
+func attributeSettings(key string) map[string]string {
+	configured := settings.GetStringMapString(key)
+	lowered := make(map[string]string, len(configured))
+	for name, value := range configured {
+		lowered[strings.ToLower(name)] = value
+	}
+	return lowered
+}
+
 // NewAuthnRequest creates a protobuf object from XML-derived struct
 func NewAuthnRequest(src *saml.AuthnRequest, relayState string) (*AuthnRequest, error) {
 	t, err := ptypes.TimestampProto(src.IssueInstant)
 	if err != nil {
 		return nil, err
 	}
+	// Only used to find the assertion consumer service, which is resolved before the request is saved
+	var index uint32
+	if src.AssertionConsumerServiceIndex != nil {
+		index = *src.AssertionConsumerServiceIndex
+	}
 	return &AuthnRequest{
 		AssertionConsumerServiceURL:   src.AssertionConsumerServiceURL,
-		AssertionConsumerServiceIndex: src.AssertionConsumerServiceIndex,
+		AssertionConsumerServiceIndex: index,
 		Destination:                   src.Destination,
 		ID:                            src.ID,
 		ProtocolBinding:               src.ProtocolBinding,
 		RelayState:                    relayState,
 		IssueInstant:                  t,
 		Issuer:                        src.Issuer,
+		ForceAuthn:                    src.ForceAuthn,
 	}, nil
 }
@@ -33,9 +33,20 @@ type AuthnRequest struct {
 	ProtocolBinding               string               `protobuf:"bytes,7,opt,name=ProtocolBinding,proto3" json:"ProtocolBinding,omitempty"`
 	AssertionConsumerServiceIndex uint32               `protobuf:"varint,8,opt,name=AssertionConsumerServiceIndex,proto3" json:"AssertionConsumerServiceIndex,omitempty"`
 	RelayState                    string               `protobuf:"bytes,9,opt,name=RelayState,proto3" json:"RelayState,omitempty"`
-	XXX_NoUnkeyedLiteral          struct{}             `json:"-"`
-	XXX_unrecognized              []byte               `json:"-"`
-	XXX_sizecache                 int32                `json:"-"`
+	// Set for IdP-initiated SSO where there is no request to respond to
+	Unsolicited bool `protobuf:"varint,10,opt,name=Unsolicited,proto3" json:"Unsolicited,omitempty"`
+	// OpenID Connect nonce to echo in the ID token
+	Nonce string `protobuf:"bytes,11,opt,name=Nonce,proto3" json:"Nonce,omitempty"`
+	// Assigned when the user logs in so the audit record can be
+	// correlated with the assertion and session
+	AssertionID string `protobuf:"bytes,12,opt,name=AssertionID,proto3" json:"AssertionID,omitempty"`
+	SessionID   string `protobuf:"bytes,13,opt,name=SessionID,proto3" json:"SessionID,omitempty"`
+	// Set when the service provider requires the user to log in again
+	// even if they have a session
+	ForceAuthn           bool     `protobuf:"varint,14,opt,name=ForceAuthn,proto3" json:"ForceAuthn,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *AuthnRequest) Reset()         { *m = AuthnRequest{} }
@@ -126,18 +137,56 @@ func (m *AuthnRequest) GetRelayState() string {
 	return ""
 }
 
+func (m *AuthnRequest) GetUnsolicited() bool {
+	if m != nil {
+		return m.Unsolicited
+	}
+	return false
+}
+
+func (m *AuthnRequest) GetNonce() string {
+	if m != nil {
+		return m.Nonce
+	}
+	return ""
+}
+
+func (m *AuthnRequest) GetAssertionID() string {
+	if m != nil {
+		return m.AssertionID
+	}
+	return ""
+}
+
+func (m *AuthnRequest) GetSessionID() string {
+	if m != nil {
+		return m.SessionID
+	}
+	return ""
+}
+
+func (m *AuthnRequest) GetForceAuthn() bool {
+	if m != nil {
+		return m.ForceAuthn
+	}
+	return false
+}
+
 // Allows storage of user information to avoid
 // repeated logins, basis of SSO
 type User struct {
-	Name                 string       `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
-	Format               string       `protobuf:"bytes,2,opt,name=Format,proto3" json:"Format,omitempty"`
-	Context              string       `protobuf:"bytes,3,opt,name=Context,proto3" json:"Context,omitempty"`
-	IP                   string       `protobuf:"bytes,4,opt,name=IP,proto3" json:"IP,omitempty"`
-	Attributes           []*Attribute `protobuf:"bytes,5,rep,name=Attributes,proto3" json:"Attributes,omitempty"`
-	X509Certificate      []byte       `protobuf:"bytes,6,opt,name=X509Certificate,proto3" json:"X509Certificate,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
-	XXX_unrecognized     []byte       `json:"-"`
-	XXX_sizecache        int32        `json:"-"`
+	Name            string       `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
+	Format          string       `protobuf:"bytes,2,opt,name=Format,proto3" json:"Format,omitempty"`
+	Context         string       `protobuf:"bytes,3,opt,name=Context,proto3" json:"Context,omitempty"`
+	IP              string       `protobuf:"bytes,4,opt,name=IP,proto3" json:"IP,omitempty"`
+	Attributes      []*Attribute `protobuf:"bytes,5,rep,name=Attributes,proto3" json:"Attributes,omitempty"`
+	X509Certificate []byte       `protobuf:"bytes,6,opt,name=X509Certificate,proto3" json:"X509Certificate,omitempty"`
+	// Upstream authorities involved in authenticating the user,
+	// such as the IdP a login was proxied to
+	AuthenticatingAuthorities []string `protobuf:"bytes,7,rep,name=AuthenticatingAuthorities,proto3" json:"AuthenticatingAuthorities,omitempty"`
+	XXX_NoUnkeyedLiteral      struct{} `json:"-"`
+	XXX_unrecognized          []byte   `json:"-"`
+	XXX_sizecache             int32    `json:"-"`
 }
 
 func (m *User) Reset()         { *m = User{} }
@@ -207,10 +256,138 @@ func (m *User) GetX509Certificate() []byte {
 	return nil
 }
 
+func (m *User) GetAuthenticatingAuthorities() []string {
+	if m != nil {
+		return m.AuthenticatingAuthorities
+	}
+	return nil
+}
+
+// A user's login to the IdP, identified by
+// the session cookie
+type Session struct {
+	ID      string               `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	User    *User                `protobuf:"bytes,2,opt,name=User,proto3" json:"User,omitempty"`
+	Created *timestamp.Timestamp `protobuf:"bytes,3,opt,name=Created,proto3" json:"Created,omitempty"`
+	// Entity IDs of the service providers the
+	// session has been used to log in to
+	ServiceProviders []string `protobuf:"bytes,4,rep,name=ServiceProviders,proto3" json:"ServiceProviders,omitempty"`
+	// When the user last logged in, which is when the session was
+	// created unless they logged in again to keep using it
+	Authenticated        *timestamp.Timestamp `protobuf:"bytes,5,opt,name=Authenticated,proto3" json:"Authenticated,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
+	XXX_unrecognized     []byte               `json:"-"`
+	XXX_sizecache        int32                `json:"-"`
+}
+
+func (m *Session) Reset()         { *m = Session{} }
+func (m *Session) String() string { return proto.CompactTextString(m) }
+func (*Session) ProtoMessage()    {}
+func (*Session) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4c16552f9fdb66d8, []int{2}
+}
+
+func (m *Session) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Session.Unmarshal(m, b)
+}
+func (m *Session) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Session.Marshal(b, m, deterministic)
+}
+func (m *Session) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Session.Merge(m, src)
+}
+func (m *Session) XXX_Size() int {
+	return xxx_messageInfo_Session.Size(m)
+}
+func (m *Session) XXX_DiscardUnknown() {
+	xxx_messageInfo_Session.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Session proto.InternalMessageInfo
+
+func (m *Session) GetID() string {
+	if m != nil {
+		return m.ID
+	}
+	return ""
+}
+
+func (m *Session) GetUser() *User {
+	if m != nil {
+		return m.User
+	}
+	return nil
+}
+
+func (m *Session) GetCreated() *timestamp.Timestamp {
+	if m != nil {
+		return m.Created
+	}
+	return nil
+}
+
+func (m *Session) GetServiceProviders() []string {
+	if m != nil {
+		return m.ServiceProviders
+	}
+	return nil
+}
+
+func (m *Session) GetAuthenticated() *timestamp.Timestamp {
+	if m != nil {
+		return m.Authenticated
+	}
+	return nil
+}
+
+// Index of a user's sessions
+type SessionIDs struct {
+	IDs                  []string `protobuf:"bytes,1,rep,name=IDs,proto3" json:"IDs,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SessionIDs) Reset()         { *m = SessionIDs{} }
+func (m *SessionIDs) String() string { return proto.CompactTextString(m) }
+func (*SessionIDs) ProtoMessage()    {}
+func (*SessionIDs) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4c16552f9fdb66d8, []int{3}
+}
+
+func (m *SessionIDs) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SessionIDs.Unmarshal(m, b)
+}
+func (m *SessionIDs) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SessionIDs.Marshal(b, m, deterministic)
+}
+func (m *SessionIDs) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SessionIDs.Merge(m, src)
+}
+func (m *SessionIDs) XXX_Size() int {
+	return xxx_messageInfo_SessionIDs.Size(m)
+}
+func (m *SessionIDs) XXX_DiscardUnknown() {
+	xxx_messageInfo_SessionIDs.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SessionIDs proto.InternalMessageInfo
+
+func (m *SessionIDs) GetIDs() []string {
+	if m != nil {
+		return m.IDs
+	}
+	return nil
+}
+
 // User attributes
 type Attribute struct {
-	Name                 string   `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
-	Value                []string `protobuf:"bytes,2,rep,name=Value,proto3" json:"Value,omitempty"`
+	Name  string   `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
+	Value []string `protobuf:"bytes,2,rep,name=Value,proto3" json:"Value,omitempty"`
+	// Optional xsi:type of the values such as xs:string
+	Type string `protobuf:"bytes,3,opt,name=Type,proto3" json:"Type,omitempty"`
+	// Optional scope, such as a domain, for eduPerson scoped attributes
+	Scope                string   `protobuf:"bytes,4,opt,name=Scope,proto3" json:"Scope,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -220,7 +397,7 @@ func (m *Attribute) Reset()         { *m = Attribute{} }
 func (m *Attribute) String() string { return proto.CompactTextString(m) }
 func (*Attribute) ProtoMessage()    {}
 func (*Attribute) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4c16552f9fdb66d8, []int{2}
+	return fileDescriptor_4c16552f9fdb66d8, []int{4}
 }
 
 func (m *Attribute) XXX_Unmarshal(b []byte) error {
@@ -255,6 +432,20 @@ func (m *Attribute) GetValue() []string {
 	return nil
 }
 
+func (m *Attribute) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *Attribute) GetScope() string {
+	if m != nil {
+		return m.Scope
+	}
+	return ""
+}
+
 // Allows storage of data required for artifact
 // response until service provider retrieves it
 type ArtifactResponse struct {
@@ -269,7 +460,7 @@ func (m *ArtifactResponse) Reset()         { *m = ArtifactResponse{} }
 func (m *ArtifactResponse) String() string { return proto.CompactTextString(m) }
 func (*ArtifactResponse) ProtoMessage()    {}
 func (*ArtifactResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4c16552f9fdb66d8, []int{3}
+	return fileDescriptor_4c16552f9fdb66d8, []int{5}
 }
 
 func (m *ArtifactResponse) XXX_Unmarshal(b []byte) error {
@@ -307,6 +498,8 @@ func (m *ArtifactResponse) GetRequest() *AuthnRequest {
 func init() {
 	proto.RegisterType((*AuthnRequest)(nil), "model.AuthnRequest")
 	proto.RegisterType((*User)(nil), "model.User")
+	proto.RegisterType((*Session)(nil), "model.Session")
+	proto.RegisterType((*SessionIDs)(nil), "model.SessionIDs")
 	proto.RegisterType((*Attribute)(nil), "model.Attribute")
 	proto.RegisterType((*ArtifactResponse)(nil), "model.ArtifactResponse")
 }
@@ -314,33 +507,44 @@ func init() {
 func init() { proto.RegisterFile("model.proto", fileDescriptor_4c16552f9fdb66d8) }
 
 var fileDescriptor_4c16552f9fdb66d8 = []byte{
-	// 438 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x52, 0x4d, 0x6f, 0xd3, 0x40,
-	0x10, 0x95, 0x9d, 0x2f, 0x3c, 0x0e, 0x50, 0x2d, 0x08, 0xad, 0x8a, 0xa0, 0x56, 0x4e, 0xbe, 0xe0,
-	0x56, 0x41, 0x3d, 0x70, 0x41, 0x84, 0x44, 0x48, 0x96, 0x10, 0x8a, 0xb6, 0xb4, 0xe2, 0xba, 0x49,
-	0xa6, 0xc1, 0x92, 0xbd, 0x1b, 0x76, 0xc7, 0xa8, 0xdc, 0xf9, 0x51, 0xfc, 0x3c, 0xb4, 0x6b, 0xbb,
-	0x32, 0x15, 0xed, 0xcd, 0xef, 0xf9, 0xcd, 0xbc, 0xd9, 0x37, 0x03, 0x71, 0xa5, 0x77, 0x58, 0x66,
-	0x07, 0xa3, 0x49, 0xb3, 0x91, 0x07, 0xc7, 0x27, 0x7b, 0xad, 0xf7, 0x25, 0x9e, 0x7a, 0x72, 0x53,
-	0x5f, 0x9f, 0x52, 0x51, 0xa1, 0x25, 0x59, 0x1d, 0x1a, 0xdd, 0xec, 0xf7, 0x00, 0xa6, 0x8b, 0x9a,
-	0xbe, 0x2b, 0x81, 0x3f, 0x6a, 0xb4, 0xc4, 0x9e, 0x40, 0x98, 0xaf, 0x78, 0x90, 0x04, 0x69, 0x24,
-	0xc2, 0x7c, 0xc5, 0x38, 0x4c, 0xae, 0xd0, 0xd8, 0x42, 0x2b, 0x1e, 0x7a, 0xb2, 0x83, 0xec, 0x3d,
-	0x4c, 0x73, 0x6b, 0x6b, 0xcc, 0x95, 0x25, 0xa9, 0x88, 0x0f, 0x92, 0x20, 0x8d, 0xe7, 0xc7, 0x59,
-	0x63, 0x99, 0x75, 0x96, 0xd9, 0xd7, 0xce, 0x52, 0xfc, 0xa3, 0x67, 0x2f, 0x60, 0xec, 0xb1, 0xe1,
-	0x43, 0xdf, 0xb8, 0x45, 0x2c, 0x81, 0x78, 0x85, 0x96, 0x0a, 0x25, 0xc9, 0xb9, 0x8e, 0xfc, 0xcf,
-	0x3e, 0xc5, 0x3e, 0xc0, 0xcb, 0x85, 0xb5, 0x68, 0x1c, 0x58, 0x6a, 0x65, 0xeb, 0x0a, 0xcd, 0x05,
-	0x9a, 0x9f, 0xc5, 0x16, 0x2f, 0xc5, 0x67, 0x3e, 0xf6, 0x15, 0x0f, 0x49, 0x58, 0x0a, 0x4f, 0xd7,
-	0x6e, 0xbe, 0xad, 0x2e, 0x3f, 0x16, 0x6a, 0x57, 0xa8, 0x3d, 0x9f, 0xf8, 0xaa, 0xbb, 0x34, 0x5b,
-	0xc1, 0xab, 0xfb, 0x1a, 0xe5, 0x6a, 0x87, 0x37, 0xfc, 0x51, 0x12, 0xa4, 0x8f, 0xc5, 0xc3, 0x22,
-	0xf6, 0x1a, 0x40, 0x60, 0x29, 0x7f, 0x5d, 0x90, 0x24, 0xe4, 0x91, 0xb7, 0xea, 0x31, 0xb3, 0x3f,
-	0x01, 0x0c, 0x2f, 0x2d, 0x1a, 0xc6, 0x60, 0xf8, 0x45, 0x56, 0xd8, 0x2e, 0xc0, 0x7f, 0xbb, 0xa0,
-	0x3e, 0x69, 0x53, 0x49, 0x6a, 0x37, 0xd0, 0x22, 0xb7, 0x9a, 0xa5, 0x56, 0x84, 0x37, 0x4d, 0xf6,
-	0x91, 0xe8, 0xa0, 0x5f, 0xe2, 0xba, 0x8d, 0x35, 0xcc, 0xd7, 0xec, 0x0c, 0x60, 0x41, 0x64, 0x8a,
-	0x4d, 0x4d, 0x68, 0xf9, 0x28, 0x19, 0xa4, 0xf1, 0xfc, 0x28, 0x6b, 0xee, 0xe5, 0xf6, 0x87, 0xe8,
-	0x69, 0x5c, 0x40, 0xdf, 0xce, 0xcf, 0xde, 0x2d, 0xdd, 0x9b, 0xae, 0x8b, 0xad, 0x9b, 0xda, 0xc5,
-	0x3a, 0x15, 0x77, 0xe9, 0xd9, 0x39, 0x44, 0xb7, 0x75, 0xff, 0x1d, 0xff, 0x39, 0x8c, 0xae, 0x64,
-	0x59, 0x23, 0x0f, 0x93, 0x41, 0x1a, 0x89, 0x06, 0xcc, 0x36, 0x70, 0xb4, 0x70, 0x4d, 0xe4, 0x96,
-	0x04, 0xda, 0x83, 0x56, 0x16, 0xd9, 0x49, 0x13, 0x82, 0xaf, 0x8e, 0xe7, 0x71, 0x3b, 0xa0, 0xa3,
-	0x44, 0x93, 0xce, 0x1b, 0x98, 0xb4, 0x77, 0xea, 0xa3, 0x88, 0xe7, 0xcf, 0xba, 0x47, 0xf4, 0x4e,
-	0x58, 0x74, 0x9a, 0xcd, 0xd8, 0xdf, 0xe0, 0xdb, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff, 0x6d, 0x90,
-	0x64, 0xb4, 0x1a, 0x03, 0x00, 0x00,
+	// 617 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x54, 0x5f, 0x4f, 0xdb, 0x3e,
+	0x14, 0x55, 0xfa, 0x87, 0xd2, 0x9b, 0xc2, 0xaf, 0xf2, 0x0f, 0x4d, 0x1e, 0xdb, 0x20, 0xea, 0x53,
+	0x34, 0x69, 0x05, 0xb1, 0xed, 0x61, 0xd2, 0x34, 0xd1, 0xb5, 0x42, 0x8a, 0x34, 0xa1, 0xca, 0x05,
+	0xb4, 0xb7, 0x29, 0x4d, 0x2f, 0x9d, 0xa5, 0xd6, 0xee, 0x6c, 0x07, 0xc1, 0x77, 0xd9, 0x67, 0xdb,
+	0xc7, 0xd8, 0xf3, 0x64, 0xc7, 0xe9, 0x02, 0x0c, 0x78, 0xcb, 0x39, 0x3e, 0x37, 0xf7, 0xfa, 0xdc,
+	0x93, 0x40, 0xb8, 0x94, 0x33, 0x5c, 0xf4, 0x57, 0x4a, 0x1a, 0x49, 0x9a, 0x0e, 0xec, 0xee, 0xcf,
+	0xa5, 0x9c, 0x2f, 0xf0, 0xc0, 0x91, 0xd3, 0xfc, 0xf2, 0xc0, 0xf0, 0x25, 0x6a, 0x93, 0x2e, 0x57,
+	0x85, 0xae, 0xf7, 0xb3, 0x01, 0x9d, 0x41, 0x6e, 0xbe, 0x0b, 0x86, 0x3f, 0x72, 0xd4, 0x86, 0x6c,
+	0x43, 0x2d, 0x19, 0xd1, 0x20, 0x0a, 0xe2, 0x36, 0xab, 0x25, 0x23, 0x42, 0xa1, 0x75, 0x81, 0x4a,
+	0x73, 0x29, 0x68, 0xcd, 0x91, 0x25, 0x24, 0x9f, 0xa0, 0x93, 0x68, 0x9d, 0x63, 0x22, 0xb4, 0x49,
+	0x85, 0xa1, 0xf5, 0x28, 0x88, 0xc3, 0xa3, 0xdd, 0x7e, 0xd1, 0xb2, 0x5f, 0xb6, 0xec, 0x9f, 0x95,
+	0x2d, 0xd9, 0x2d, 0x3d, 0x79, 0x06, 0x1b, 0x0e, 0x2b, 0xda, 0x70, 0x2f, 0xf6, 0x88, 0x44, 0x10,
+	0x8e, 0x50, 0x1b, 0x2e, 0x52, 0x63, 0xbb, 0x36, 0xdd, 0x61, 0x95, 0x22, 0xc7, 0xf0, 0x62, 0xa0,
+	0x35, 0x2a, 0x0b, 0x86, 0x52, 0xe8, 0x7c, 0x89, 0x6a, 0x82, 0xea, 0x8a, 0x67, 0x78, 0xce, 0xbe,
+	0xd0, 0x0d, 0x57, 0xf1, 0x98, 0x84, 0xc4, 0xf0, 0xdf, 0xd8, 0xce, 0x97, 0xc9, 0xc5, 0x67, 0x2e,
+	0x66, 0x5c, 0xcc, 0x69, 0xcb, 0x55, 0xdd, 0xa5, 0xc9, 0x08, 0x5e, 0x3d, 0xf4, 0xa2, 0x44, 0xcc,
+	0xf0, 0x9a, 0x6e, 0x46, 0x41, 0xbc, 0xc5, 0x1e, 0x17, 0x91, 0x3d, 0x00, 0x86, 0x8b, 0xf4, 0x66,
+	0x62, 0x52, 0x83, 0xb4, 0xed, 0x5a, 0x55, 0x18, 0x7b, 0xe7, 0x73, 0xa1, 0xe5, 0x82, 0x67, 0xdc,
+	0xe0, 0x8c, 0x42, 0x14, 0xc4, 0x9b, 0xac, 0x4a, 0x91, 0x1d, 0x68, 0x9e, 0x4a, 0x91, 0x21, 0x0d,
+	0x5d, 0x71, 0x01, 0x6c, 0xdd, 0xba, 0x71, 0x32, 0xa2, 0x9d, 0xc2, 0xab, 0x0a, 0x45, 0x5e, 0x42,
+	0x7b, 0x82, 0x5a, 0x17, 0xe7, 0x5b, 0xee, 0xfc, 0x2f, 0x61, 0xe7, 0x3a, 0x91, 0x2a, 0x43, 0x17,
+	0x01, 0xba, 0xed, 0xda, 0x56, 0x98, 0xde, 0xef, 0x00, 0x1a, 0xe7, 0x1a, 0x15, 0x21, 0xd0, 0x38,
+	0x4d, 0x97, 0xe8, 0x83, 0xe1, 0x9e, 0xed, 0x02, 0x4f, 0xa4, 0x5a, 0xa6, 0xc6, 0x27, 0xc3, 0x23,
+	0x1b, 0x99, 0xa1, 0x14, 0x06, 0xaf, 0x8b, 0x4c, 0xb4, 0x59, 0x09, 0x5d, 0xb8, 0xc6, 0x7e, 0xdd,
+	0xb5, 0x64, 0x4c, 0x0e, 0x01, 0x06, 0xc6, 0x28, 0x3e, 0xcd, 0x0d, 0x6a, 0xda, 0x8c, 0xea, 0x71,
+	0x78, 0xd4, 0xed, 0x17, 0x39, 0x5e, 0x1f, 0xb0, 0x8a, 0xc6, 0x2e, 0xee, 0xeb, 0xfb, 0xc3, 0x0f,
+	0x43, 0x7b, 0xbf, 0x4b, 0x9e, 0x59, 0x37, 0xed, 0xba, 0x3b, 0xec, 0x2e, 0x4d, 0x3e, 0xc2, 0x73,
+	0x7b, 0x07, 0x14, 0xc6, 0x62, 0x2e, 0xe6, 0x16, 0x49, 0xc5, 0x0d, 0x47, 0x4d, 0x5b, 0x51, 0x3d,
+	0x6e, 0xb3, 0x87, 0x05, 0xbd, 0x5f, 0x01, 0xb4, 0xbc, 0x4d, 0xf7, 0x3e, 0x89, 0xfd, 0xc2, 0x13,
+	0x77, 0xeb, 0xf0, 0x28, 0xf4, 0xf3, 0x5a, 0x8a, 0x15, 0x66, 0xbd, 0x83, 0xd6, 0x50, 0x61, 0x6a,
+	0x37, 0xf9, 0xf4, 0x47, 0x51, 0x4a, 0xc9, 0x6b, 0xe8, 0xfa, 0xcc, 0x8c, 0x95, 0xbc, 0xe2, 0x33,
+	0x54, 0x9a, 0x36, 0xdc, 0x9c, 0xf7, 0x78, 0x72, 0x0c, 0x5b, 0x95, 0xd9, 0x71, 0x46, 0x9b, 0x4f,
+	0xf6, 0xb9, 0x5d, 0xd0, 0xdb, 0x03, 0x58, 0xc7, 0x40, 0x93, 0x2e, 0xd4, 0x93, 0x91, 0xa6, 0x81,
+	0x6b, 0x67, 0x1f, 0x7b, 0xdf, 0xa0, 0xbd, 0xb6, 0xfd, 0x9f, 0xdb, 0xdf, 0x81, 0xe6, 0x45, 0xba,
+	0xc8, 0x91, 0xd6, 0x5c, 0x51, 0x01, 0xac, 0xf2, 0xec, 0x66, 0x85, 0x7e, 0xf1, 0xee, 0xd9, 0x2a,
+	0x27, 0x99, 0x5c, 0xa1, 0x5f, 0x7c, 0x01, 0x7a, 0x53, 0xe8, 0x0e, 0xec, 0xb6, 0xd2, 0xcc, 0x30,
+	0xd4, 0x2b, 0x29, 0x34, 0xae, 0x9d, 0x0d, 0x1e, 0x72, 0xf6, 0x0d, 0xb4, 0xfc, 0x8f, 0xca, 0xbb,
+	0xff, 0x7f, 0x99, 0x96, 0xca, 0x3f, 0x8c, 0x95, 0x9a, 0xe9, 0x86, 0xf3, 0xe1, 0xed, 0x9f, 0x01,
+	0x00, 0x61, 0x04, 0xe8, 0x71, 0x1b, 0x05, 0x00, 0x00,
 }
@@ -18,9 +18,11 @@ import (
 	"encoding/xml"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/chriskery/sso-idp/saml"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -50,3 +52,71 @@ func TestUser_AttributeStatement(t *testing.T) {
 	statement := user.AttributeStatement()
 	assert.Equal(t, 3, len(statement.Attribute), "expected 3 attributes")
 }
+
+func TestUser_AttributeStatement_multiValued(t *testing.T) {
+	user := &User{Name: "joe"}
+	// group membership from the LDAP validator and again from an attribute source
+	user.AppendAttributes([]*Attribute{
+		{Name: "memberUid", Value: []string{"admins", "developers", "users"}},
+		{Name: "mail", Value: []string{"joe@example.com"}},
+	})
+	user.AppendAttributes([]*Attribute{
+		{Name: "memberUid", Value: []string{"users", "operators"}},
+	})
+	statement := user.AttributeStatement()
+	if !assert.Equal(t, 2, len(statement.Attribute), "each attribute should only appear once") {
+		return
+	}
+	assert.Equal(t, "memberUid", statement.Attribute[0].Name)
+	values := []string{}
+	for _, value := range statement.Attribute[0].AttributeValue {
+		values = append(values, value.Value)
+	}
+	assert.Equal(t, []string{"admins", "developers", "users", "operators"}, values)
+	data, err := xml.Marshal(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, strings.Count(string(data), "<Attribute "))
+	assert.Equal(t, 5, strings.Count(string(data), "<AttributeValue "))
+}
+
+func TestUser_AttributeStatement_types(t *testing.T) {
+	viper.Set("attribute-types", map[string]string{"age": "xs:integer"})
+	defer viper.Set("attribute-types", map[string]string{})
+	user := &User{Name: "joe"}
+	user.AppendAttributes([]*Attribute{
+		{Name: "age", Value: []string{"9"}},
+		{Name: "student", Value: []string{"true"}, Type: "xs:boolean"},
+		{Name: "sn", Value: []string{"Mama"}},
+	})
+	statement := user.AttributeStatement()
+	assert.True(t, statement.Typed())
+	data, err := xml.Marshal(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), `xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="xs:integer">9<`)
+	assert.Contains(t, string(data), `xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="xs:boolean">true<`)
+	assert.Contains(t, string(data), `<AttributeValue xmlns="urn:oasis:names:tc:SAML:2.0:assertion">Mama<`, "untyped values shouldn't change")
+}
+
+func TestUser_AttributeStatement_scopes(t *testing.T) {
+	viper.Set("attribute-scopes", map[string]string{"eduPersonPrincipalName": "example.edu"})
+	defer viper.Set("attribute-scopes", map[string]string{})
+	user := &User{Name: "joe"}
+	user.AppendAttributes([]*Attribute{
+		{Name: "eduPersonPrincipalName", Value: []string{"joe", "joe@example.edu"}},
+		{Name: "eduPersonScopedAffiliation", Value: []string{"staff"}, Scope: "example.org"},
+	})
+	statement := user.AttributeStatement()
+	principal := statement.Attribute[0].AttributeValue
+	assert.Equal(t, 1, len(principal), "already scoped value shouldn't be repeated")
+	assert.Equal(t, "joe@example.edu", principal[0].Value)
+	assert.Equal(t, "example.edu", principal[0].Scope)
+	data, err := xml.Marshal(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), `Scope="example.org">staff@example.org<`)
+}
@@ -17,6 +17,7 @@ package saml
 import (
 	"encoding/xml"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/amdonov/xmlsig"
@@ -30,7 +31,7 @@ type Subject struct {
 
 type Issuer struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
-	Format  string   `xml:",attr"`
+	Format  string   `xml:",attr,omitempty"`
 	Value   string   `xml:",chardata"`
 }
 
@@ -48,21 +49,68 @@ type SubjectLocality struct {
 }
 
 type AuthnContext struct {
-	XMLName              xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContext"`
-	AuthnContextClassRef string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+	XMLName                 xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContext"`
+	AuthnContextClassRef    string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+	AuthenticatingAuthority []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthenticatingAuthority,omitempty"`
 }
 
 type AuthnStatement struct {
-	XMLName         xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
-	AuthnInstant    time.Time `xml:",attr"`
-	SessionIndex    string    `xml:",attr"`
-	SubjectLocality *SubjectLocality
-	AuthnContext    *AuthnContext
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
+	AuthnInstant time.Time `xml:",attr"`
+	SessionIndex string    `xml:",attr"`
+	// When the IdP session ends, so SPs can limit their own sessions to match
+	SessionNotOnOrAfter *time.Time `xml:",attr,omitempty"`
+	SubjectLocality     *SubjectLocality
+	AuthnContext        *AuthnContext
 }
 
+const (
+	// XMLSchemaNamespace is declared with the xs prefix for typed attribute values
+	XMLSchemaNamespace = "http://www.w3.org/2001/XMLSchema"
+	// XMLSchemaInstanceNamespace is declared with the xsi prefix for typed attribute values
+	XMLSchemaInstanceNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
 type AttributeValue struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
-	Value   string   `xml:",chardata"`
+	XSI     string   `xml:"xmlns:xsi,attr,omitempty"`
+	Type    string   `xml:"xsi:type,attr,omitempty"`
+	// Scope of eduPerson scoped attribute values
+	Scope string `xml:",attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// NewAttributeValue creates an attribute value with an optional xsi:type
+func NewAttributeValue(value, xsiType string) AttributeValue {
+	if xsiType == "" {
+		return AttributeValue{Value: value}
+	}
+	return AttributeValue{XSI: XMLSchemaInstanceNamespace, Type: xsiType, Value: value}
+}
+
+// NewScopedAttributeValue creates a value formatted as value@scope with the Scope attribute
+func NewScopedAttributeValue(value, xsiType, scope string) AttributeValue {
+	if !strings.HasSuffix(value, "@"+scope) {
+		value = value + "@" + scope
+	}
+	v := NewAttributeValue(value, xsiType)
+	v.Scope = scope
+	return v
+}
+
+// Typed reports whether any of the values have an xsi:type
+func (stmt *AttributeStatement) Typed() bool {
+	if stmt == nil {
+		return false
+	}
+	for _, att := range stmt.Attribute {
+		for _, value := range att.AttributeValue {
+			if value.Type != "" {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 type Attribute struct {
@@ -94,8 +142,8 @@ type SubjectConfirmation struct {
 
 type SubjectConfirmationData struct {
 	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
-	Address      net.IP    `xml:",attr"`
-	InResponseTo string    `xml:",attr"`
+	Address      net.IP    `xml:",attr,omitempty"`
+	InResponseTo string    `xml:",attr,omitempty"`
 	NotOnOrAfter time.Time `xml:",attr"`
 	Recipient    string    `xml:",attr"`
 }
@@ -106,7 +154,10 @@ type AudienceRestriction struct {
 }
 
 type Assertion struct {
-	XMLName            xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	// Declares the xs prefix used by xsi:type values, so the assertion can be processed apart from the Response.
+	// Exclusive canonicalization drops namespaces only referenced from attribute values, so it's set after signing.
+	XS                 string    `xml:"xmlns:xs,attr,omitempty"`
 	ID                 string    `xml:",attr"`
 	Version            string    `xml:",attr"`
 	IssueInstant       time.Time `xml:",attr"`
@@ -20,10 +20,13 @@ import (
 	"github.com/google/uuid"
 )
 
+// EntityFormat identifies SAML entities, such as the Issuer of messages
+const EntityFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:entity"
+
 func NewID() string {
 	return fmt.Sprintf("_%s", uuid.New())
 }
 
 func NewIssuer(issuer string) *Issuer {
-	return &Issuer{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity", Value: issuer}
+	return &Issuer{Format: EntityFormat, Value: issuer}
 }
@@ -21,10 +21,33 @@ import (
 )
 
 type EntityDescriptor struct {
-	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
-	ID        string   `xml:",attr"`
-	EntityID  string   `xml:"entityID,attr"`
-	Signature *xmlsig.Signature
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	ID         string   `xml:",attr"`
+	EntityID   string   `xml:"entityID,attr"`
+	Signature  *xmlsig.Signature
+	Extensions *Extensions
+}
+
+// Extensions of an entity or role descriptor. Only the algorithm support declarations of the SAML V2.0
+// Metadata Profile for Algorithm Support are read and written.
+type Extensions struct {
+	XMLName        xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
+	DigestMethods  []AlgorithmMethod `xml:"urn:oasis:names:tc:SAML:metadata:algsupport DigestMethod"`
+	SigningMethods []AlgorithmMethod `xml:"urn:oasis:names:tc:SAML:metadata:algsupport SigningMethod"`
+}
+
+// AlgorithmMethod declares support for an algorithm, listed in order of preference
+type AlgorithmMethod struct {
+	Algorithm string `xml:",attr"`
+}
+
+// Algorithms returns the algorithm URIs of the methods
+func Algorithms(methods []AlgorithmMethod) []string {
+	algorithms := make([]string, 0, len(methods))
+	for _, method := range methods {
+		algorithms = append(algorithms, method.Algorithm)
+	}
+	return algorithms
 }
 
 type SPEntityDescriptor struct {
@@ -87,9 +110,10 @@ type ArtifactResolutionService struct {
 
 type SPSSODescriptor struct {
 	XMLName                    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
-	AuthnRequestsSigned        bool     `xml:",attr"`
-	WantAssertionsSigned       bool     `xml:",attr"`
-	ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
+	Extensions                 *Extensions
+	AuthnRequestsSigned        bool   `xml:",attr"`
+	WantAssertionsSigned       bool   `xml:",attr"`
+	ProtocolSupportEnumeration string `xml:"protocolSupportEnumeration,attr"`
 	AssertionConsumerService   []AssertionConsumerService
 	SingleLogoutService        []SingleLogoutService
 	KeyDescriptor              KeyDescriptor
@@ -105,5 +129,45 @@ type AssertionConsumerService struct {
 type KeyDescriptor struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
 	Use     string   `xml:"use,attr,omitempty"`
-	KeyInfo xmlsig.KeyInfo
+	KeyInfo KeyInfo
+}
+
+// KeyInfo holds either a certificate or, for some service providers, a bare public key
+type KeyInfo struct {
+	XMLName  xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+	X509Data *xmlsig.X509Data
+	KeyValue *KeyValue
+}
+
+type KeyValue struct {
+	XMLName     xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyValue"`
+	RSAKeyValue *RSAKeyValue
+	DSAKeyValue *DSAKeyValue
+	ECKeyValue  *ECKeyValue
+}
+
+// RSAKeyValue values are base64 encoded big-endian integers
+type RSAKeyValue struct {
+	XMLName  xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# RSAKeyValue"`
+	Modulus  string   `xml:"http://www.w3.org/2000/09/xmldsig# Modulus"`
+	Exponent string   `xml:"http://www.w3.org/2000/09/xmldsig# Exponent"`
+}
+
+// DSAKeyValue values are base64 encoded big-endian integers
+type DSAKeyValue struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# DSAKeyValue"`
+	P       string   `xml:"http://www.w3.org/2000/09/xmldsig# P"`
+	Q       string   `xml:"http://www.w3.org/2000/09/xmldsig# Q"`
+	G       string   `xml:"http://www.w3.org/2000/09/xmldsig# G"`
+	Y       string   `xml:"http://www.w3.org/2000/09/xmldsig# Y"`
+}
+
+// ECKeyValue is defined by XML Signature 1.1. Only named curves are supported.
+type ECKeyValue struct {
+	XMLName    xml.Name `xml:"http://www.w3.org/2009/xmldsig11# ECKeyValue"`
+	NamedCurve struct {
+		URI string `xml:",attr"`
+	} `xml:"http://www.w3.org/2009/xmldsig11# NamedCurve"`
+	// base64 encoded uncompressed curve point
+	PublicKey string `xml:"http://www.w3.org/2009/xmldsig11# PublicKey"`
 }
@@ -23,22 +23,32 @@ import (
 
 type AuthnRequest struct {
 	RequestAbstractType
-	XMLName                       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
-	AssertionConsumerServiceURL   string   `xml:",attr"`
-	ProtocolBinding               string   `xml:",attr"`
-	AssertionConsumerServiceIndex uint32   `xml:",attr"`
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	Signature                   *xmlsig.Signature
+	AssertionConsumerServiceURL string `xml:",attr,omitempty"`
+	ProtocolBinding             string `xml:",attr"`
+	// nil when the request doesn't specify an index, which is different from index 0
+	AssertionConsumerServiceIndex *uint32 `xml:",attr,omitempty"`
+	// Requires the user to log in again rather than reuse their session
+	ForceAuthn bool `xml:",attr,omitempty"`
 }
 
 type LogoutRequest struct {
 	RequestAbstractType
-	XMLName                xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
-	NotOnOrAfter           *time.Time `xml:",attr"`
+	XMLName                xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	Signature              *xmlsig.Signature
+	NotOnOrAfter           *time.Time `xml:",attr,omitempty"`
 	NameID                 *NameID
 	SingleLogoutServiceUrl string `xml:",attr"`
 	LogoutResponse         string `xml:",attr"`
 	ProtocolBinding        string `xml:",attr"`
 }
 
+type LogoutResponse struct {
+	StatusResponseType
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutResponse"`
+}
+
 type ArtifactResolveEnvelope struct {
 	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
 	Body    ArtifactResolveBody
@@ -69,7 +79,7 @@ type ArtifactResponseBody struct {
 type ArtifactResponse struct {
 	StatusResponseType
 	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol ArtifactResponse"`
-	Response Response
+	Response *Response
 }
 
 type ECPResponseEnvelope struct {
@@ -116,6 +126,8 @@ type Status struct {
 type StatusCode struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
 	Value   string   `xml:",attr"`
+	// Second-level code that refines the top-level status, such as RequestDenied
+	StatusCode *StatusCode
 }
 
 type RequestAbstractType struct {
@@ -131,8 +143,10 @@ type StatusResponseType struct {
 	Version      string    `xml:",attr"`
 	IssueInstant time.Time `xml:",attr"`
 	Issuer       *Issuer
+	// Only set when the message itself is signed, such as a LogoutResponse sent using the POST binding
+	Signature    *xmlsig.Signature
 	Destination  string `xml:",attr,omitempty"`
-	InResponseTo string `xml:",attr"`
+	InResponseTo string `xml:",attr,omitempty"`
 	Status       *Status
 }
 
@@ -146,8 +160,39 @@ type SOAPFaultBody struct {
 	Fault   SOAPFault
 }
 
+// SOAPFault is a SOAP 1.1 fault. Codes such as SOAP-ENV:Client use the prefix declared when it's marshaled.
 type SOAPFault struct {
 	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Fault"`
-	Code    string   `xml:",faultcode"`
-	String  string   `xml:",faultstring"`
+	Code    string   `xml:"faultcode"`
+	String  string   `xml:"faultstring"`
+}
+
+const soapEnvelopeNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+
+// MarshalXML writes the fault with the SOAP-ENV prefix. The faultcode and faultstring elements must be
+// unqualified, which isn't possible when the envelope namespace is the default.
+func (e SOAPFaultEnvelope) MarshalXML(encoder *xml.Encoder, _ xml.StartElement) error {
+	envelope := xml.StartElement{
+		Name: xml.Name{Local: "SOAP-ENV:Envelope"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns:SOAP-ENV"}, Value: soapEnvelopeNamespace}},
+	}
+	body := xml.StartElement{Name: xml.Name{Local: "SOAP-ENV:Body"}}
+	fault := xml.StartElement{Name: xml.Name{Local: "SOAP-ENV:Fault"}}
+	for _, token := range []xml.Token{envelope, body, fault} {
+		if err := encoder.EncodeToken(token); err != nil {
+			return err
+		}
+	}
+	if err := encoder.EncodeElement(e.Body.Fault.Code, xml.StartElement{Name: xml.Name{Local: "faultcode"}}); err != nil {
+		return err
+	}
+	if err := encoder.EncodeElement(e.Body.Fault.String, xml.StartElement{Name: xml.Name{Local: "faultstring"}}); err != nil {
+		return err
+	}
+	for _, start := range []xml.StartElement{fault, body, envelope} {
+		if err := encoder.EncodeToken(start.End()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -21,6 +21,8 @@ type AttributeQuery struct {
 	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
 	Subject   Subject
 	Signature *xmlsig.Signature
+	// Attributes to return, optionally with the values to return. All of them are returned when it's empty.
+	Attribute []Attribute
 }
 
 type AttributeRespEnv struct {
@@ -0,0 +1,86 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package settings holds the configuration the IDP is running with. Viper isn't safe for concurrent use, so a
+// reloaded configuration is read into its own viper instance, which isn't changed afterwards, and published in one
+// step. Requests read whichever configuration is published when they read it, without waiting for a reload.
+package settings
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var current atomic.Pointer[viper.Viper]
+
+// Current returns the published configuration, or viper's global one until a configuration is published
+func Current() *viper.Viper {
+	if v := current.Load(); v != nil {
+		return v
+	}
+	return viper.GetViper()
+}
+
+// Publish replaces the configuration returned by Current. The viper instance mustn't be changed afterwards, since
+// it's read without locking. Publishing nil goes back to viper's global configuration.
+func Publish(v *viper.Viper) {
+	current.Store(v)
+}
+
+// Get returns the value of the key in the current configuration
+func Get(key string) interface{} {
+	return Current().Get(key)
+}
+
+// GetString returns the value of the key in the current configuration as a string
+func GetString(key string) string {
+	return Current().GetString(key)
+}
+
+// GetBool returns the value of the key in the current configuration as a bool
+func GetBool(key string) bool {
+	return Current().GetBool(key)
+}
+
+// GetInt returns the value of the key in the current configuration as an int
+func GetInt(key string) int {
+	return Current().GetInt(key)
+}
+
+// GetDuration returns the value of the key in the current configuration as a duration
+func GetDuration(key string) time.Duration {
+	return Current().GetDuration(key)
+}
+
+// GetStringSlice returns the value of the key in the current configuration as a slice of strings
+func GetStringSlice(key string) []string {
+	return Current().GetStringSlice(key)
+}
+
+// GetStringMapString returns the value of the key in the current configuration as a map of strings
+func GetStringMapString(key string) map[string]string {
+	return Current().GetStringMapString(key)
+}
+
+// UnmarshalKey decodes the value of the key in the current configuration into rawVal
+func UnmarshalKey(key string, rawVal interface{}) error {
+	return Current().UnmarshalKey(key, rawVal)
+}
+
+// ConfigFileUsed returns the configuration file the current configuration was read from
+func ConfigFileUsed() string {
+	return Current().ConfigFileUsed()
+}
@@ -0,0 +1,47 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package settings
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish(t *testing.T) {
+	viper.Set("cookie-name", "started")
+	defer viper.Set("cookie-name", nil)
+	assert.Equal(t, "started", GetString("cookie-name"), "viper's global configuration is used until one is published")
+
+	next := viper.New()
+	next.Set("cookie-name", "reloaded")
+	var wg sync.WaitGroup
+	for j := 0; j < 10; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Contains(t, []string{"started", "reloaded"}, GetString("cookie-name"))
+		}()
+	}
+	Publish(next)
+	wg.Wait()
+	assert.Equal(t, "reloaded", GetString("cookie-name"))
+	assert.Equal(t, "started", viper.GetString("cookie-name"), "the global configuration should be left alone")
+
+	Publish(nil)
+	assert.Equal(t, "started", GetString("cookie-name"))
+}
@@ -0,0 +1,48 @@
+// Copyright © 2019 David Morgan <dmorgan81@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+
+package sign
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// PKCS11Key finds the private key on the token. The key never leaves the token; signing operations are
+// performed by the token. Combine it with the matching certificate and NewSigner to sign SAML messages.
+func PKCS11Key(config PKCS11Config) (crypto.Signer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       config.Module,
+		SlotNumber: &config.Slot,
+		Pin:        config.Pin,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open PKCS#11 slot %d: %v", config.Slot, err)
+	}
+	key, err := ctx.FindKeyPair(nil, []byte(config.KeyLabel))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no PKCS#11 key labeled %s found", config.KeyLabel)
+	}
+	return key, nil
+}
@@ -0,0 +1,30 @@
+// Copyright © 2019 David Morgan <dmorgan81@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !cgo
+
+package sign
+
+import (
+	"crypto"
+	"errors"
+)
+
+// PKCS11Key is unavailable because PKCS#11 modules are loaded with cgo
+func PKCS11Key(config PKCS11Config) (crypto.Signer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("PKCS#11 support requires building with cgo enabled")
+}
@@ -15,13 +15,52 @@
 package sign
 
 import (
+	"crypto/tls"
+	"errors"
+
 	"github.com/amdonov/xmlsig"
 )
 
+// Signer creates the XML digital signatures on SAML messages and signs HTTP-Redirect binding
+// query strings. Implementations can keep the private key outside of the process, for
+// example in a hardware security module.
 type Signer interface {
-	xmlsig.Signer
+	// Sign returns the base64 encoded signature of the data
+	Sign([]byte) (string, error)
+	// CreateSignature returns an enveloped signature for a struct that marshals to a single XML element
+	CreateSignature(interface{}) (*xmlsig.Signature, error)
+	// Algorithm returns the URI of the signature algorithm
+	Algorithm() string
+}
+
+// CertificateSigner is implemented by Signers that can provide the certificate they sign with along with its
+// private key, which needs to be a crypto.Signer rather than the key itself when it's held elsewhere. The IDP signs
+// tokens with the key.
+type CertificateSigner interface {
+	Signer
+	Certificate() tls.Certificate
 }
 
+// Validator validates XML digital signatures and returns the signed elements
 type Validator interface {
 	Validate(xml string) ([]string, error)
 }
+
+// PKCS11Config identifies a private key held by a PKCS#11 token such as a hardware security module
+type PKCS11Config struct {
+	// Path to the PKCS#11 library provided by the HSM vendor
+	Module   string
+	Slot     int
+	Pin      string
+	KeyLabel string
+}
+
+func (c PKCS11Config) validate() error {
+	if c.Module == "" {
+		return errors.New("a PKCS#11 module is required")
+	}
+	if c.KeyLabel == "" {
+		return errors.New("a PKCS#11 key label is required")
+	}
+	return nil
+}
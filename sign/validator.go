@@ -15,17 +15,38 @@
 package sign
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/beevik/etree"
 	"github.com/ma314smith/signedxml"
 )
 
+const (
+	signatureNamespace = "http://www.w3.org/2000/09/xmldsig#"
+	assertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	protocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	soapNamespace      = "http://schemas.xmlsoap.org/soap/envelope/"
+)
+
 type signedxmlValidator struct {
 }
 
+// NewValidator returns a Validator for enveloped signatures. To prevent signature wrapping, documents must
+// have a single signature with a single reference to the element enclosing it. The referenced ID must be
+// unique and the signed element must be the message, so it's the element callers process.
 func NewValidator() Validator {
 	return &signedxmlValidator{}
 }
 
 func (v *signedxmlValidator) Validate(xml string) ([]string, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(xml); err != nil {
+		return nil, err
+	}
+	if err := checkStructure(doc); err != nil {
+		return nil, err
+	}
 	validator, err := signedxml.NewValidator(xml)
 	if err != nil {
 		return nil, err
@@ -33,3 +54,95 @@ func (v *signedxmlValidator) Validate(xml string) ([]string, error) {
 
 	return validator.ValidateReferences()
 }
+
+// checkStructure rejects documents that could be used to wrap a signed element
+func checkStructure(doc *etree.Document) error {
+	signatures := findAll(doc.Root(), signatureNamespace, "Signature")
+	if len(signatures) != 1 {
+		return fmt.Errorf("document must contain exactly one signature, found %d", len(signatures))
+	}
+	signature := signatures[0]
+	references := signature.FindElements("./SignedInfo/Reference")
+	if len(references) != 1 {
+		return fmt.Errorf("signature must contain exactly one reference, found %d", len(references))
+	}
+	uri := references[0].SelectAttrValue("URI", "")
+	if len(uri) < 2 || uri[0] != '#' {
+		return fmt.Errorf("signature reference must identify an element by ID: %q", uri)
+	}
+	signed := findByID(doc.Root(), uri[1:])
+	if len(signed) != 1 {
+		return fmt.Errorf("signed ID %s must be unique, found %d elements", uri[1:], len(signed))
+	}
+	// An enveloped signature is a child of the element it signs. Otherwise the signed element may
+	// have been moved away from where it's processed.
+	if signature.Parent() != signed[0] {
+		return errors.New("signature is not enveloped in the element it references")
+	}
+	if !contains(processed(doc.Root()), signed[0]) {
+		return fmt.Errorf("signed element %s is not the message", signed[0].Tag)
+	}
+	if assertions := findAll(doc.Root(), assertionNamespace, "Assertion"); len(assertions) > 1 {
+		return fmt.Errorf("document must contain at most one assertion, found %d", len(assertions))
+	}
+	// The signature is checked with every certificate in the document, so they must be part of its KeyInfo
+	if len(doc.FindElements(".//X509Certificate")) != len(signature.FindElements("./KeyInfo//X509Certificate")) {
+		return errors.New("certificates found outside the signature's KeyInfo")
+	}
+	return nil
+}
+
+// processed returns the elements that are handled as the message: the root or the content of a SOAP Body,
+// the Response of an ArtifactResponse, and the assertion of a Response
+func processed(root *etree.Element) []*etree.Element {
+	message := root
+	if root.Tag == "Envelope" && root.NamespaceURI() == soapNamespace {
+		body := root.FindElements("./Body")
+		if len(body) != 1 || len(body[0].ChildElements()) != 1 {
+			return nil
+		}
+		message = body[0].ChildElements()[0]
+	}
+	elements := []*etree.Element{message}
+	// Artifact resolution delivers the Response inside the ArtifactResponse
+	if message.Tag == "ArtifactResponse" && message.NamespaceURI() == protocolNamespace {
+		if responses := message.FindElements("./Response"); len(responses) == 1 {
+			message = responses[0]
+			elements = append(elements, message)
+		}
+	}
+	if message.Tag == "Response" && message.NamespaceURI() == protocolNamespace {
+		elements = append(elements, message.FindElements("./Assertion")...)
+	}
+	return elements
+}
+
+func contains(elements []*etree.Element, element *etree.Element) bool {
+	for _, e := range elements {
+		if e == element {
+			return true
+		}
+	}
+	return false
+}
+
+func findAll(root *etree.Element, namespace, tag string) []*etree.Element {
+	var found []*etree.Element
+	for _, e := range append([]*etree.Element{root}, root.FindElements(".//"+tag)...) {
+		if e.Tag == tag && e.NamespaceURI() == namespace {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// findByID returns the elements the signedxml library could resolve the ID to
+func findByID(root *etree.Element, id string) []*etree.Element {
+	var found []*etree.Element
+	for _, e := range append([]*etree.Element{root}, root.FindElements(".//*")...) {
+		if e.SelectAttrValue("ID", "") == id || e.SelectAttrValue("AssertionID", "") == id {
+			found = append(found, e)
+		}
+	}
+	return found
+}
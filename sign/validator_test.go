@@ -0,0 +1,141 @@
+// Copyright © 2019 David Morgan <dmorgan81@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/xmlsig"
+	"github.com/stretchr/testify/assert"
+)
+
+type testRequest struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	ID        string   `xml:",attr"`
+	Issuer    string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature *xmlsig.Signature
+}
+
+type testAssertion struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID        string   `xml:",attr"`
+	Issuer    string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature *xmlsig.Signature
+	Subject   string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+}
+
+func newTestSigner(t *testing.T) Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func signed(t *testing.T, signer Signer, v interface{}) string {
+	signature, err := signer.CreateSignature(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch m := v.(type) {
+	case *testRequest:
+		m.Signature = signature
+	case *testAssertion:
+		m.Signature = signature
+	}
+	data, err := xml.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestValidator_Validate(t *testing.T) {
+	signer := newTestSigner(t)
+	request := signed(t, signer, &testRequest{ID: "_signed", Issuer: "https://sp.example.com"})
+	assertion := signed(t, signer, &testAssertion{ID: "_assertion", Issuer: "https://idp.example.com", Subject: "joe"})
+	unsigned := func(id, issuer string) string {
+		data, _ := xml.Marshal(&testRequest{ID: id, Issuer: issuer})
+		return string(data)
+	}
+	// Removes the closing tag so elements can be inserted into the signed message
+	open := strings.TrimSuffix(unsigned("_forged", "https://evil.example.com"), "</LogoutRequest>")
+	const response = `<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="_response">`
+	const envelope = `<Envelope xmlns="http://schemas.xmlsoap.org/soap/envelope/"><Body>`
+	tests := []struct {
+		name    string
+		xml     string
+		wantErr bool
+	}{
+		{"request", request, false},
+		{"request in SOAP envelope", envelope + request + `</Body></Envelope>`, false},
+		{"assertion in response", response + assertion + `</Response>`, false},
+		{"assertion in artifact response", envelope + `<ArtifactResponse xmlns="urn:oasis:names:tc:SAML:2.0:protocol">` +
+			response + assertion + `</Response></ArtifactResponse></Body></Envelope>`, false},
+		{"signed request wrapped in forged request", open + `<Extensions>` + request + `</Extensions></LogoutRequest>`, true},
+		{"signed request after forged request in SOAP envelope",
+			envelope + unsigned("_forged", "https://evil.example.com") + request + `</Body></Envelope>`, true},
+		{"forged request with the signed ID",
+			strings.Replace(open, "_forged", "_signed", 1) + `<Extensions>` + request + `</Extensions></LogoutRequest>`, true},
+		{"issuer changed after signing",
+			strings.Replace(request, `<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">https://sp.example.com</Issuer>`,
+				`<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">https://evil.example.com</Issuer>`, 1), true},
+		{"forged assertion before signed assertion",
+			response + `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_forged"><Subject>admin</Subject></Assertion>` +
+				assertion + `</Response>`, true},
+		{"signed assertion in forged assertion's advice",
+			response + `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_forged"><Subject>admin</Subject><Advice>` +
+				assertion + `</Advice></Assertion></Response>`, true},
+		{"certificate outside the signature",
+			strings.Replace(request, "</LogoutRequest>",
+				`<X509Certificate xmlns="http://www.w3.org/2000/09/xmldsig#">MIIB</X509Certificate></LogoutRequest>`, 1), true},
+		{"unsigned", unsigned("_unsigned", "https://sp.example.com"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			referenced, err := NewValidator().Validate(tt.xml)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) && assert.Len(t, referenced, 1) {
+				assert.NotContains(t, referenced[0], "_forged")
+			}
+		})
+	}
+}
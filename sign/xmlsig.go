@@ -0,0 +1,61 @@
+// Copyright © 2019 David Morgan <dmorgan81@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/amdonov/xmlsig"
+)
+
+// DigestAlgorithms lists the digest algorithms supported by the default Signer, strongest first
+var DigestAlgorithms = []string{
+	"http://www.w3.org/2001/04/xmlenc#sha256",
+	"http://www.w3.org/2000/09/xmldsig#sha1",
+}
+
+// SignatureAlgorithms returns the signature algorithms the default Signer supports for the certificate's
+// key, strongest first
+func SignatureAlgorithms(cert *x509.Certificate) []string {
+	switch cert.PublicKeyAlgorithm {
+	case x509.RSA:
+		return []string{
+			"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			"http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+		}
+	case x509.DSA:
+		return []string{
+			"http://www.w3.org/2009/xmldsig11#dsa-sha256",
+			"http://www.w3.org/2000/09/xmldsig#dsa-sha1",
+		}
+	}
+	return nil
+}
+
+// Options selects the algorithms used by the default Signer
+type Options struct {
+	SignatureAlgorithm string
+	DigestAlgorithm    string
+}
+
+// NewSigner returns the default Signer, which is backed by github.com/amdonov/xmlsig. The certificate's
+// private key can be any crypto.Signer, so keys held by other providers are supported.
+func NewSigner(cert tls.Certificate, options Options) (Signer, error) {
+	return xmlsig.NewSignerWithOptions(cert, xmlsig.SignerOptions{
+		SignatureAlgorithm: options.SignatureAlgorithm,
+		DigestAlgorithm:    options.DigestAlgorithm,
+	})
+}
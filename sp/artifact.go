@@ -67,15 +67,17 @@ func (sp *serviceProvider) ArtifactFunc(callback ArtifactCallback) http.HandlerF
 func (sp *serviceProvider) validateAssertion(assertion *saml.Assertion) error {
 	now := time.Now().UTC()
 
+	// the margin allows for clocks that are out of step, so the times are compared to the second
 	notOnOrAfter := assertion.Conditions.NotOnOrAfter
 	// check if the "now" time is after the specified time, subtracting the margin from the time
-	if !notOnOrAfter.IsZero() && now.Add(sp.timestampMargin*-1).After(notOnOrAfter) {
+	if !notOnOrAfter.IsZero() &&
+		now.Add(sp.timestampMargin*-1).Truncate(time.Second).After(notOnOrAfter.Truncate(time.Second)) {
 		return fmt.Errorf("at %s got response that cannot be processed because it expired at %s", now, notOnOrAfter)
 	}
 
 	notBefore := assertion.Conditions.NotBefore
 	// check if the "now" time is before the specified time, adding the margin to the time
-	if !notBefore.IsZero() && now.Add(sp.timestampMargin).Before(notBefore) {
+	if !notBefore.IsZero() && now.Add(sp.timestampMargin).Truncate(time.Second).Before(notBefore.Truncate(time.Second)) {
 		return fmt.Errorf("at %s got response that cannot be processed before %s", now, notBefore)
 	}
 
@@ -125,7 +127,15 @@ func (sp *serviceProvider) resolveArtifact(artifact string) (*saml.Assertion, er
 	if err := decoder.Decode(response); err != nil {
 		return nil, err
 	}
-	assertion := response.Body.ArtifactResponse.Response.Assertion
+	artifactResponse := response.Body.ArtifactResponse
+	if artifactResponse.Response == nil {
+		status := ""
+		if artifactResponse.Status != nil {
+			status = artifactResponse.Status.StatusCode.Value
+		}
+		return nil, fmt.Errorf("artifact response did not contain a response, status %s", status)
+	}
+	assertion := artifactResponse.Response.Assertion
 	if assertion == nil {
 		// TODO check the rest of the response for an error
 		// Write it out for now until we know what we're looking
@@ -133,7 +143,7 @@ func (sp *serviceProvider) resolveArtifact(artifact string) (*saml.Assertion, er
 		encoder.Encode(response)
 		return nil, errors.New("check logs assertion was nil")
 	}
-	assertion.RawXML = response.Body.ArtifactResponse.Response.RawAssertion
+	assertion.RawXML = artifactResponse.Response.RawAssertion
 	return assertion, nil
 }
 
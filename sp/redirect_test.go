@@ -18,7 +18,7 @@ import (
 	"path/filepath"
 	"testing"
 
-	"github.com/chriskery/sso-idp"
+	"github.com/chriskery/sso-idp/idp"
 	"github.com/spf13/viper"
 )
 
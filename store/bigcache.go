@@ -15,11 +15,15 @@
 package store
 
 import (
+	"sync"
+
 	"github.com/allegro/bigcache"
 )
 
 type bigcacheStore struct {
 	cache *bigcache.BigCache
+	// serializes takes
+	lock sync.Mutex
 }
 
 func (b *bigcacheStore) Set(key string, entry []byte) error {
@@ -28,10 +32,13 @@ func (b *bigcacheStore) Set(key string, entry []byte) error {
 
 func (b *bigcacheStore) Get(key string) ([]byte, error) {
 	entry, err := b.cache.Get(key)
+	if err == bigcache.ErrEntryNotFound {
+		return nil, ErrNotFound
+	}
 	if len(entry) == 7 {
 		// this might be a deleted key
 		if "DELETED" == string(entry) {
-			return nil, bigcache.ErrEntryNotFound
+			return nil, ErrNotFound
 		}
 	}
 	return entry, err
@@ -40,3 +47,16 @@ func (b *bigcacheStore) Get(key string) ([]byte, error) {
 func (b *bigcacheStore) Delete(key string) error {
 	return b.Set(key, []byte("DELETED"))
 }
+
+func (b *bigcacheStore) Take(key string) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.Delete(key); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
@@ -15,22 +15,69 @@
 package store
 
 import (
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/allegro/bigcache"
 )
 
+// ErrNotFound is returned by the caches for keys that were never set, have expired, or were evicted. Other
+// errors mean the cache couldn't be read.
+var ErrNotFound = errors.New("entry not found")
+
 type Cache interface {
 	Set(key string, entry []byte) error
 	Get(key string) ([]byte, error)
 	Delete(key string) error
 }
 
+// Evicter is implemented by caches with an entry limit. Evictions returns how many unexpired entries have been
+// evicted to stay within the limit, which logins and sessions fail for when it keeps growing.
+type Evicter interface {
+	Evictions() uint64
+}
+
+// Taker is implemented by caches that can read and remove an entry in one step, so that only one caller gets it
+type Taker interface {
+	Take(key string) ([]byte, error)
+}
+
+var takeLock sync.Mutex
+
+// Take reads and removes an entry that must only be used once. Caches that don't implement Taker have the read and
+// removal serialized within this process. The entry isn't returned unless it was removed.
+func Take(cache Cache, key string) ([]byte, error) {
+	if taker, ok := cache.(Taker); ok {
+		return taker.Take(key)
+	}
+	takeLock.Lock()
+	defer takeLock.Unlock()
+	entry, err := cache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = cache.Delete(key); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
 // Default to a big cache implementation
 func New(duration time.Duration) (Cache, error) {
 	cache, err := bigcache.NewBigCache(bigcache.DefaultConfig(duration))
 	if err != nil {
 		return nil, err
 	}
-	return &bigcacheStore{cache}, nil
+	return &bigcacheStore{cache: cache}, nil
+}
+
+// NewWithLimit returns an in-memory cache holding at most maxEntries, evicting the least recently used
+// entries when it's full. Evictions are logged with the name of the cache and counted by the Evicter it implements.
+// The limit is ignored when it isn't positive.
+func NewWithLimit(name string, duration time.Duration, maxEntries int) (Cache, error) {
+	if maxEntries <= 0 {
+		return New(duration)
+	}
+	return newLRU(name, duration, maxEntries), nil
 }
@@ -0,0 +1,150 @@
+// Copyright © 2017 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NewLRU returns an in-memory cache holding at most maxEntries. When it's full, the least recently used
+// entry is evicted to make room.
+func NewLRU(duration time.Duration, maxEntries int) Cache {
+	return newLRU("cache", duration, maxEntries)
+}
+
+func newLRU(name string, duration time.Duration, maxEntries int) *lruStore {
+	return &lruStore{
+		name:       name,
+		duration:   duration,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+type lruStore struct {
+	// identifies the cache in log messages
+	name       string
+	duration   time.Duration
+	maxEntries int
+	lock       sync.Mutex
+	entries    map[string]*list.Element
+	// most recently used at the front
+	order     *list.List
+	evictions uint64
+}
+
+func (l *lruStore) Set(key string, entry []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	expires := time.Now().Add(l.duration)
+	if element, ok := l.entries[key]; ok {
+		element.Value = &lruEntry{key, entry, expires}
+		l.order.MoveToFront(element)
+		return nil
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry{key, entry, expires})
+	for l.order.Len() > l.maxEntries {
+		l.evict()
+	}
+	return nil
+}
+
+// evict removes the least recently used entry. Entries that already expired aren't counted.
+func (l *lruStore) evict() {
+	oldest := l.order.Back()
+	l.remove(oldest)
+	if time.Now().After(oldest.Value.(*lruEntry).expires) {
+		return
+	}
+	l.evictions++
+	switch {
+	case l.evictions == 1:
+		log.Warnf("%s reached its limit of %d entries, evicting the least recently used", l.name, l.maxEntries)
+	case isPowerOfTen(l.evictions):
+		// Logged less and less often so a cache that's too small stays visible without flooding the log
+		log.Warnf("%s has evicted %d entries to stay within its limit of %d", l.name, l.evictions, l.maxEntries)
+	default:
+		log.Debugf("evicted least recently used %s entry, %d evictions", l.name, l.evictions)
+	}
+}
+
+func isPowerOfTen(n uint64) bool {
+	for n >= 10 && n%10 == 0 {
+		n /= 10
+	}
+	return n == 1
+}
+
+func (l *lruStore) remove(element *list.Element) {
+	l.order.Remove(element)
+	delete(l.entries, element.Value.(*lruEntry).key)
+}
+
+func (l *lruStore) Get(key string) ([]byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	element, ok := l.entries[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		l.remove(element)
+		return nil, ErrNotFound
+	}
+	l.order.MoveToFront(element)
+	return entry.value, nil
+}
+
+func (l *lruStore) Delete(key string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if element, ok := l.entries[key]; ok {
+		l.remove(element)
+	}
+	return nil
+}
+
+func (l *lruStore) Take(key string) ([]byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	element, ok := l.entries[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	l.remove(element)
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		return nil, ErrNotFound
+	}
+	return entry.value, nil
+}
+
+func (l *lruStore) Evictions() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.evictions
+}
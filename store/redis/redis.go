@@ -15,6 +15,7 @@
 package redis
 
 import (
+	"github.com/chriskery/sso-idp/settings"
 	"github.com/chriskery/sso-idp/store"
 	"time"
 
@@ -24,8 +25,8 @@ import (
 
 func New(duration time.Duration) (store.Cache, error) {
 	redisdb := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("redis.address"),
-		Password: viper.GetString("redis.password"),
+		Addr:     settings.GetString("redis.address"),
+		Password: settings.GetString("redis.password"),
 	})
 	return &cache{redisdb, duration}, nil
 }
@@ -40,6 +41,9 @@ func (c *cache) Set(key string, entry []byte) error {
 }
 func (c *cache) Get(key string) ([]byte, error) {
 	res, err := c.client.Get(key).Result()
+	if err == redis.Nil {
+		return nil, store.ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +53,30 @@ func (c *cache) Delete(key string) error {
 	return c.client.Del(key).Err()
 }
 
+// Take reads and deletes the key in a transaction, so only one of the IDPs sharing the cache gets the entry
+func (c *cache) Take(key string) ([]byte, error) {
+	var get *redis.StringCmd
+	_, err := c.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(key)
+		pipe.Del(key)
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := get.Result()
+	if err == redis.Nil {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(res), nil
+}
+
 func init() {
 	viper.SetDefault("redis.address", "127.0.0.1:6379")
 	viper.SetDefault("redis.password", "")
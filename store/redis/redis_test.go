@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/alicebob/miniredis"
+	"github.com/chriskery/sso-idp/store"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -48,4 +49,11 @@ func TestNew(t *testing.T) {
 	if err == nil {
 		t.Fatal("should not have returned value")
 	}
+	cache.Set("test", value)
+	res, err = store.Take(cache, "test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, res)
+	}
+	_, err = store.Take(cache, "test")
+	assert.Equal(t, store.ErrNotFound, err, "entry should only be taken once")
 }
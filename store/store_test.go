@@ -14,6 +14,8 @@
 package store
 
 import (
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -37,7 +39,107 @@ func TestDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 	_, err = cache.Get("test")
-	if err == nil {
+	if err != ErrNotFound {
 		t.Fatal("should not have returned value")
 	}
+	if _, err = cache.Get("missing"); err != ErrNotFound {
+		t.Fatal("missing keys should return ErrNotFound")
+	}
+}
+
+func TestNewLRU(t *testing.T) {
+	cache := NewLRU(time.Minute, 2)
+	cache.Set("a", []byte("a"))
+	cache.Set("b", []byte("b"))
+	// Using a makes b the least recently used
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("c", []byte("c"))
+	if _, err := cache.Get("b"); err != ErrNotFound {
+		t.Fatal("least recently used entry should have been evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if data, err := cache.Get(key); err != nil || string(data) != key {
+			t.Fatalf("%s should have been kept", key)
+		}
+	}
+	if evictions := cache.(Evicter).Evictions(); evictions != 1 {
+		t.Fatalf("expected 1 eviction, got %d", evictions)
+	}
+}
+
+func TestNewLRU_expiration(t *testing.T) {
+	cache := NewLRU(-time.Second, 1)
+	cache.Set("a", []byte("a"))
+	if _, err := cache.Get("a"); err != ErrNotFound {
+		t.Fatal("expired entry should not be returned")
+	}
+	cache.Set("b", []byte("b"))
+	cache.Set("c", []byte("c"))
+	if evictions := cache.(Evicter).Evictions(); evictions != 0 {
+		t.Fatalf("expired entries should not count as evictions, got %d", evictions)
+	}
+}
+
+func TestNewWithLimit(t *testing.T) {
+	cache, err := NewWithLimit("temp cache", time.Minute, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evicter, ok := cache.(Evicter)
+	if !ok {
+		t.Fatal("a limited cache should count its evictions")
+	}
+	cache.Set("a", []byte("a"))
+	cache.Set("b", []byte("b"))
+	if evictions := evicter.Evictions(); evictions != 1 {
+		t.Fatalf("expected 1 eviction, got %d", evictions)
+	}
+	if cache, err = NewWithLimit("user cache", time.Minute, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = cache.(Evicter); ok {
+		t.Fatal("an unlimited cache doesn't evict entries")
+	}
+}
+
+func Test_isPowerOfTen(t *testing.T) {
+	for n, expected := range map[uint64]bool{1: true, 10: true, 1000: true, 0: false, 2: false, 20: false, 110: false} {
+		if isPowerOfTen(n) != expected {
+			t.Errorf("isPowerOfTen(%d) should be %t", n, expected)
+		}
+	}
+}
+
+func TestTake(t *testing.T) {
+	bigcache, err := New(5 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, cache := range map[string]Cache{"bigcache": bigcache, "lru": NewLRU(time.Minute, 10)} {
+		cache.Set("test", []byte("content"))
+		// Only one of the concurrent takes gets the entry
+		var taken int32
+		var wg sync.WaitGroup
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, err := Take(cache, "test")
+				if err == nil && string(data) == "content" {
+					atomic.AddInt32(&taken, 1)
+				} else if err != ErrNotFound {
+					t.Errorf("%s: unexpected error %v", name, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if taken != 1 {
+			t.Fatalf("%s: entry was taken %d times", name, taken)
+		}
+		if _, err = cache.Get("test"); err != ErrNotFound {
+			t.Fatalf("%s: taken entry should be removed", name)
+		}
+	}
 }
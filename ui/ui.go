@@ -1,44 +1,306 @@
 package ui
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/chriskery/sso-idp/settings"
 	log "github.com/sirupsen/logrus"
+	"html"
+	"io"
+	"io/fs"
+	"io/ioutil"
 	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
-func UI() http.Handler {
-	assetsPath := viper.GetString("assets-path")
+// embeddedStatic holds the built-in UI, compiled in so the assets always match the source tree
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+// relative asset references in the login page that don't already carry a query
+var assetReference = regexp.MustCompile(`((?:href|src)=")([^":?#]+)(")`)
+
+func init() {
+	viper.SetDefault("static-path", "/idp/static")
+	viper.SetDefault("login-page-path", "/idp/static/login.html")
+	viper.SetDefault("password-change-page-path", "/idp/static/change-password.html")
+	viper.SetDefault("ui-cache-duration", "8760h")
+	viper.SetDefault("login-page-cache-duration", "10m")
+	viper.SetDefault("ui-cache-busting", false)
+}
+
+// openAssets returns the UI assets, read from the assets-path of the configuration when it's set
+func openAssets(config *viper.Viper) http.FileSystem {
+	if assetsPath := config.GetString("assets-path"); assetsPath != "" {
+		return http.Dir(assetsPath)
+	}
+	static, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(static)
+}
 
-	var filesystem http.FileSystem
-	if assetsPath != "" {
+// Validate checks the assets have what the UI settings of the configuration rely on, such as the cancel button
+// login-cancel-enabled shows
+func Validate(config *viper.Viper) error {
+	if !config.GetBool("login-cancel-enabled") {
+		return nil
+	}
+	login, err := readAsset(openAssets(config), "login.html")
+	if err != nil {
+		return fmt.Errorf("login-cancel-enabled is set but the login page can't be read: %v", err)
+	}
+	if !cancelButton.Match(login) {
+		return errors.New("login-cancel-enabled is set but the login page has no hidden cancelButton element")
+	}
+	return nil
+}
+
+func UI() http.Handler {
+	if assetsPath := settings.GetString("assets-path"); assetsPath != "" {
 		log.Infof("using ui assets path:%s", assetsPath)
-		filesystem = http.Dir(assetsPath)
 	} else {
 		log.Info("using the built-in ui assets")
-		filesystem = assetFS()
 	}
+	assets := openAssets(settings.Current())
+
+	// base-path is the sub-path the IDP is mounted at behind a reverse proxy
+	basePath := strings.TrimSuffix(settings.GetString("base-path"), "/")
+	staticPath := basePath + strings.TrimSuffix(settings.GetString("static-path"), "/")
+	h := http.FileServer(assets)
+	ui := &idpUI{
+		assets:             assets,
+		h:                  h,
+		prefixHandler:      http.StripPrefix(staticPath, h),
+		basePath:           basePath,
+		loginPage:          basePath + settings.GetString("login-page-path"),
+		changePasswordPage: basePath + settings.GetString("password-change-page-path"),
+		cacheControl:       cacheControl(settings.GetDuration("ui-cache-duration")),
+		loginCacheControl:  cacheControl(settings.GetDuration("login-page-cache-duration")),
+	}
+	if settings.GetBool("login-cancel-enabled") {
+		if err := ui.showCancel(assets); err != nil {
+			log.Warnf("unable to show the cancel button: %s", err)
+		}
+	}
+	if settings.GetBool("ui-cache-busting") {
+		if err := ui.bustCaches(assets); err != nil {
+			// Fall back to serving the page as is
+			log.Warnf("unable to version ui assets: %s", err)
+		}
+	}
+	return ui
+}
 
-	h := http.FileServer(filesystem)
-	return &idpUI{h, http.StripPrefix("/idp/static", h)}
+func cacheControl(d time.Duration) string {
+	if d <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", int(d.Seconds()))
 }
 
 type idpUI struct {
-	h             http.Handler
+	assets http.FileSystem
+	h      http.Handler
+	// serves assets below the static-path
 	prefixHandler http.Handler
+	basePath      string
+	loginPage     string
+	// form for changing an expired password, served like the login page
+	changePasswordPage string
+	cacheControl       string
+	loginCacheControl  string
+	// login page rendered in memory, with versioned asset references when ui-cache-busting is set and the cancel
+	// button shown when login-cancel-enabled is set, nil when it's served as is
+	login    []byte
+	modified time.Time
+}
+
+// bustCaches versions the login page's references to other assets with a hash of their content, so long cache
+// durations don't leave browsers with stale assets after an upgrade
+func (s *idpUI) bustCaches(assets http.FileSystem) error {
+	hash := sha256.New()
+	if err := hashAssets(assets, "/", hash); err != nil {
+		return err
+	}
+	login, err := s.readLogin(assets)
+	if err != nil {
+		return err
+	}
+	version := hex.EncodeToString(hash.Sum(nil))[:12]
+	s.login = assetReference.ReplaceAll(login, []byte("${1}${2}?v="+version+"${3}"))
+	s.modified = time.Now()
+	return nil
+}
+
+// hashAssets adds the names and content of the assets below dir to hash
+func hashAssets(assets http.FileSystem, dir string, hash io.Writer) error {
+	f, err := assets.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	files, err := f.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for _, file := range files {
+		name := path.Join(dir, file.Name())
+		if file.IsDir() {
+			err = hashAssets(assets, name, hash)
+		} else {
+			err = hashAsset(assets, name, hash)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashAsset(assets http.FileSystem, name string, hash io.Writer) error {
+	f, err := assets.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	io.WriteString(hash, name)
+	_, err = io.Copy(hash, f)
+	return err
+}
+
+// readAsset returns the content of the named asset
+func readAsset(assets http.FileSystem, name string) ([]byte, error) {
+	f, err := assets.Open("/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// cancelButton is the login page's button for cancelling the login, hidden unless login-cancel-enabled is set
+var cancelButton = regexp.MustCompile(`(<[^>]*\bid="cancelButton"[^>]*?)\s+style="display: none"`)
+
+// showCancel unhides the cancel button so users can tell the service provider they gave up on the login
+func (s *idpUI) showCancel(assets http.FileSystem) error {
+	login, err := s.readLogin(assets)
+	if err != nil {
+		return err
+	}
+	if !cancelButton.Match(login) {
+		return errors.New("login page has no hidden cancelButton element")
+	}
+	s.login = cancelButton.ReplaceAll(login, []byte("${1}"))
+	s.modified = time.Now()
+	return nil
+}
+
+// readLogin returns the login page as rendered so far
+func (s *idpUI) readLogin(assets http.FileSystem) ([]byte, error) {
+	if s.login != nil {
+		return s.login, nil
+	}
+	return readAsset(assets, "login.html")
 }
 
 func (s *idpUI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if "/favicon.ico" == req.URL.Path {
-		s.h.ServeHTTP(w, req)
+	if s.basePath+"/favicon.ico" == req.URL.Path {
+		http.StripPrefix(s.basePath, s.h).ServeHTTP(w, req)
 		return
 	}
-	if "/ui/login.html" == req.URL.Path {
-		// 5 minute cache for the login HTML page
-		w.Header().Add("Cache-Control", "public, max-age=600")
-	} else {
-		// Encourage caching of UI
-		w.Header().Add("Cache-Control", "public, max-age=31536000")
+	if s.loginPage == req.URL.Path {
+		if loginError, ok := req.Context().Value(loginErrorKey{}).(loginError); ok {
+			s.serveLoginError(w, "login.html", loginError)
+			return
+		}
+		// Short cache for the login HTML page
+		w.Header().Add("Cache-Control", s.loginCacheControl)
+		if s.login != nil {
+			http.ServeContent(w, req, "login.html", s.modified, bytes.NewReader(s.login))
+			return
+		}
+		// The login page may be configured outside of the static assets
+		login := req.Clone(req.Context())
+		login.URL.Path = "/login.html"
+		s.h.ServeHTTP(w, login)
+		return
 	}
+	if s.changePasswordPage == req.URL.Path {
+		if loginError, ok := req.Context().Value(loginErrorKey{}).(loginError); ok {
+			s.serveLoginError(w, "change-password.html", loginError)
+			return
+		}
+		w.Header().Add("Cache-Control", s.loginCacheControl)
+		change := req.Clone(req.Context())
+		change.URL.Path = "/change-password.html"
+		s.h.ServeHTTP(w, change)
+		return
+	}
+	// Encourage caching of UI
+	w.Header().Add("Cache-Control", s.cacheControl)
 	s.prefixHandler.ServeHTTP(w, req)
 }
+
+type loginErrorKey struct{}
+
+type loginError struct {
+	message string
+	expired bool
+}
+
+// WithLoginError returns a context for a request for the login or password change page that shows the error, such
+// as an invalid password. An expired login also hides the form since the request it was for can no longer be answered.
+func WithLoginError(ctx context.Context, message string, expired bool) context.Context {
+	return context.WithValue(ctx, loginErrorKey{}, loginError{message, expired})
+}
+
+// errorElement is where the login and password change pages show errors
+var errorElement = regexp.MustCompile(`<[^>]*\bid="errorMsg"[^>]*>`)
+
+// serveLoginError renders the error into the errorMsg element of the page. Since it's only for this login attempt
+// the page isn't cached.
+func (s *idpUI) serveLoginError(w http.ResponseWriter, name string, loginError loginError) {
+	var page []byte
+	if name == "login.html" {
+		page = s.login
+	}
+	if page == nil {
+		var err error
+		if page, err = readAsset(s.assets, name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	location := errorElement.FindIndex(page)
+	if location == nil {
+		log.Warnf("%s has no errorMsg element to show the error: %s", name, loginError.message)
+	} else {
+		element := page[location[0]:location[1]]
+		if loginError.expired {
+			element = append([]byte(string(element[:len(element)-1])+` data-expired="true"`), '>')
+		}
+		rendered := make([]byte, 0, len(page)+len(loginError.message)+len(element))
+		rendered = append(rendered, page[:location[0]]...)
+		rendered = append(rendered, element...)
+		rendered = append(rendered, html.EscapeString(loginError.message)...)
+		page = append(rendered, page[location[1]:]...)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
@@ -1,9 +1,13 @@
 package ui
 
 import (
+	"io"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,8 +23,9 @@ func Test_idpUI_ServeHTTP(t *testing.T) {
 		want int
 	}{
 		{"favicon", "/favicon.ico", 200},
-		{"login form", "/ui/login.html", 200},
-		{"missing", "/ui/random.html", 404},
+		{"login form", "/idp/static/login.html", 200},
+		{"password change form", "/idp/static/change-password.html", 200},
+		{"missing", "/idp/static/random.html", 404},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -33,3 +38,167 @@ func Test_idpUI_ServeHTTP(t *testing.T) {
 		})
 	}
 }
+
+func Test_idpUI_ServeHTTP_embedded(t *testing.T) {
+	ts := httptest.NewServer(UI())
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/idp/static/login.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := os.ReadFile(filepath.Join("static", "login.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(source), string(body), "should serve the embedded login form")
+}
+
+func Test_idpUI_ServeHTTP_loginPagePath(t *testing.T) {
+	viper.Set("login-page-path", "/login")
+	defer viper.Set("login-page-path", "/idp/static/login.html")
+	ts := httptest.NewServer(UI())
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "public, max-age=600", resp.Header.Get("Cache-Control"), "login page should have a short cache lifetime")
+}
+
+func Test_idpUI_ServeHTTP_staticPath(t *testing.T) {
+	viper.Set("static-path", "/assets/")
+	viper.Set("login-page-path", "/assets/login.html")
+	defer viper.Set("static-path", "/idp/static")
+	defer viper.Set("login-page-path", "/idp/static/login.html")
+	ts := httptest.NewServer(UI())
+	defer ts.Close()
+	tests := []struct {
+		name         string
+		page         string
+		want         int
+		cacheControl string
+	}{
+		{"login form", "/assets/login.html", 200, "public, max-age=600"},
+		{"stylesheet", "/assets/css/main.css", 200, "public, max-age=31536000"},
+		{"old prefix", "/idp/static/login.html", 404, "public, max-age=31536000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ts.Client().Get(ts.URL + tt.page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want, resp.StatusCode)
+			assert.Equal(t, tt.cacheControl, resp.Header.Get("Cache-Control"))
+		})
+	}
+}
+
+func Test_idpUI_ServeHTTP_cacheControl(t *testing.T) {
+	viper.Set("ui-cache-duration", "1h")
+	viper.Set("login-page-cache-duration", "0s")
+	viper.Set("ui-cache-busting", true)
+	defer viper.Set("ui-cache-duration", "8760h")
+	defer viper.Set("login-page-cache-duration", "10m")
+	defer viper.Set("ui-cache-busting", false)
+	ts := httptest.NewServer(UI())
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/idp/static/css/main.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, "public, max-age=3600", resp.Header.Get("Cache-Control"))
+
+	resp, err = ts.Client().Get(ts.URL + "/idp/static/login.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Regexp(t, `href="css/main.css\?v=[0-9a-f]{12}"`, string(body), "local assets should be versioned")
+	assert.Contains(t, string(body), `src="https://apps.bdimg.com/libs/jquery/2.1.4/jquery.min.js"`,
+		"external assets should be left alone")
+}
+
+func Test_idpUI_ServeHTTP_loginError(t *testing.T) {
+	h := UI()
+	req := httptest.NewRequest("GET", "/idp/static/login.html?requestId=1234", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req.WithContext(WithLoginError(req.Context(), "invalid <login>", false)))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"), "the error is only for this login attempt")
+	assert.Contains(t, w.Body.String(), `id="errorMsg">invalid &lt;login&gt;`, "the error should be escaped")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req.WithContext(WithLoginError(req.Context(), "expired", true)))
+	assert.Contains(t, w.Body.String(), `id="errorMsg" data-expired="true">expired`)
+
+	req = httptest.NewRequest("GET", "/idp/static/change-password.html?requestId=1234", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req.WithContext(WithLoginError(req.Context(), "your password has expired", false)))
+	assert.Contains(t, w.Body.String(), `id="errorMsg">your password has expired`)
+	assert.Contains(t, w.Body.String(), `name="new-password"`, "should render the password change form")
+}
+
+func Test_idpUI_ServeHTTP_loginError_embedded(t *testing.T) {
+	// The built-in pages, not just a copy served from assets-path, need the element errors are rendered into
+	viper.Set("assets-path", "")
+	h := UI()
+	for _, page := range []string{"login.html", "change-password.html"} {
+		t.Run(page, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/idp/static/"+page+"?requestId=1234", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req.WithContext(WithLoginError(req.Context(), "invalid login or password", false)))
+			assert.Equal(t, 200, w.Code)
+			assert.Contains(t, w.Body.String(), `id="errorMsg">invalid login or password`)
+		})
+	}
+}
+
+func Test_idpUI_ServeHTTP_loginCancel(t *testing.T) {
+	get := func() string {
+		w := httptest.NewRecorder()
+		UI().ServeHTTP(w, httptest.NewRequest("GET", "/idp/static/login.html", nil))
+		return w.Body.String()
+	}
+	assert.Contains(t, get(), `id="cancelButton" style="display: none"`, "cancelling is disabled by default")
+	viper.Set("login-cancel-enabled", true)
+	defer viper.Set("login-cancel-enabled", false)
+	viper.Set("ui-cache-busting", true)
+	defer viper.Set("ui-cache-busting", false)
+	body := get()
+	assert.Contains(t, body, `id="cancelButton">`)
+	assert.Regexp(t, `href="css/main.css\?v=[0-9a-f]{12}"`, body, "should still be versioned")
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(viper.GetViper()), "the cancel button is only needed when login-cancel-enabled is set")
+	viper.Set("login-cancel-enabled", true)
+	defer viper.Set("login-cancel-enabled", false)
+	assert.NoError(t, Validate(viper.GetViper()), "the built-in login page should have the cancel button")
+
+	custom := t.TempDir()
+	if err := os.WriteFile(filepath.Join(custom, "login.html"), []byte(`<form id="loginForm"></form>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("assets-path", custom)
+	defer viper.Set("assets-path", "")
+	err := Validate(viper.GetViper())
+	if assert.Error(t, err, "a login page without the cancel button should be rejected") {
+		assert.Contains(t, err.Error(), "cancelButton")
+	}
+}